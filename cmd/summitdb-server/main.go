@@ -4,8 +4,12 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/tidwall/finn"
 	"github.com/tidwall/redcon"
@@ -23,15 +27,33 @@ func main() {
 	var loglevel string
 	var join string
 	var dir string
+	var notify string
+	var forward bool
+	var learner bool
+	var forceNewCluster bool
+	var groups int
+	var rangeMaxKeys int
+	var shardsToken string
+	var groupCommit time.Duration
+	var groupCommitBytes int
 	var high, medium, low bool
 
 	flag.IntVar(&port, "p", 7481, "Bind port")
 	flag.StringVar(&host, "h", "localhost", "Bind host")
 	flag.StringVar(&durability, "durability", "high", "Log durability [low,medium,high]")
-	flag.StringVar(&consistency, "consistency", "high", "Raft consistency [low,medium,high]")
+	flag.StringVar(&consistency, "consistency", "high", "Raft consistency [low,medium,high,readindex]")
 	flag.StringVar(&loglevel, "loglevel", "notice", "Log level [quiet,warning,notice,verbose,debug]")
 	flag.StringVar(&dir, "dir", "data", "Data directory")
 	flag.StringVar(&join, "join", "", "Join a cluster by providing an address")
+	flag.StringVar(&notify, "notify-keyspace-events", "", "Keyspace notifications published by this node (e.g. KEA)")
+	flag.BoolVar(&forward, "forward", false, "Followers forward commands to the leader instead of replying with TRY")
+	flag.BoolVar(&learner, "learner", false, "Join the cluster as a non-voting learner")
+	flag.BoolVar(&forceNewCluster, "force-new-cluster", false, "Start as a single node cluster from the existing data, dropping all other peers")
+	flag.IntVar(&groups, "groups", 1, "Number of raft groups that the keyspace is sharded across, bound to consecutive ports. Disables pipelined writes and group commit")
+	flag.StringVar(&shardsToken, "shards-token", "", "Secret shared by the servers of a sharded cluster for sending each other internal commands")
+	flag.IntVar(&rangeMaxKeys, "range-max-keys", machine.DefaultRangeMaxKeys, "Number of keys in a range before it's split")
+	flag.DurationVar(&groupCommit, "group-commit", 0, "Window in which the leader merges writes from connections into one log entry, zero is off (e.g. 2ms). Not used with --groups")
+	flag.IntVar(&groupCommitBytes, "group-commit-bytes", machine.DefaultGroupCommitBytes, "Size of the merged writes that ends a group commit window early")
 	flag.BoolVar(&high, "high", false, "Set durability and consistency to high")
 	flag.BoolVar(&medium, "medium", false, "Set durability and consistency to medium")
 	flag.BoolVar(&low, "low", false, "Set durability and consistency to low")
@@ -42,6 +64,8 @@ func main() {
 
 	var opts finn.Options
 	opts.Backend = finn.FastLog
+	opts.Learner = learner
+	opts.ForceNewCluster = forceNewCluster
 
 	switch strings.ToLower(durability) {
 	default:
@@ -65,6 +89,8 @@ func main() {
 		opts.Consistency = finn.Medium
 	case "high":
 		opts.Consistency = finn.High
+	case "readindex":
+		opts.Consistency = finn.ReadIndex
 	}
 	if low {
 		opts.Consistency, opts.Durability = finn.Low, finn.Low
@@ -91,42 +117,120 @@ func main() {
 		opts.LogLevel = finn.Debug
 	}
 
-	addr := fmt.Sprintf("%s:%d", host, port)
+	if groups < 1 {
+		log.Warningf("invalid groups '%v'", groups)
+		os.Exit(1)
+	}
+	if groups > 1 && shardsToken == "" {
+		log.Warningf("--shards-token is required with --groups")
+		os.Exit(1)
+	}
+	if groups > 1 && groupCommit > 0 {
+		log.Warningf("--group-commit is not used with --groups")
+	}
 
 	// set the log level
 	log.SetLevel(int(opts.LogLevel))
 
 	log.Printf("SummitDB %s", version)
 
-	// create the new machine
-	m, err := machine.New(log.Sub('M'), addr)
-	if err != nil {
+	// the database is kept in memory. remove the temporary files that were
+	// left behind by earlier versions after a crash.
+	if err := machine.RemoveTempDirs(); err != nil {
 		log.Warningf("%v", err)
-		os.Exit(1)
 	}
 
-	// setup the connection events
-	opts.ConnAccept = func(conn redcon.Conn) bool {
-		return m.ConnAccept(conn)
-	}
-	opts.ConnClosed = func(conn redcon.Conn, err error) {
-		m.ConnClosed(conn, err)
+	var sh *machine.Shards
+	if groups > 1 {
+		sh = machine.NewShards(groups)
+		sh.SetRangeMaxKeys(rangeMaxKeys)
+		sh.SetToken(shardsToken)
 	}
+	var nodes []*finn.Node
+	var machines []*machine.Machine
+	defer func() {
+		if sh != nil {
+			sh.Close()
+		}
+		for i := range nodes {
+			nodes[i].Close()
+			machines[i].Close()
+		}
+	}()
+	for group := 0; group < groups; group++ {
+		// each group is bound to its own port and has its own data
+		// directory. the first group uses the data directory itself.
+		addr := fmt.Sprintf("%s:%d", host, port+group)
+		gdir, gjoin := dir, join
+		if group > 0 {
+			gdir = filepath.Join(dir, "groups", strconv.Itoa(group))
+			if join != "" {
+				jhost, jport, err := net.SplitHostPort(join)
+				if err != nil {
+					log.Warningf("invalid join '%v'", join)
+					os.Exit(1)
+				}
+				n, err := strconv.Atoi(jport)
+				if err != nil {
+					log.Warningf("invalid join '%v'", join)
+					os.Exit(1)
+				}
+				gjoin = net.JoinHostPort(jhost, strconv.Itoa(n+group))
+			}
+		}
 
-	// open the raft machine
-	n, err := finn.Open(dir, addr, join, m, &opts)
-	if err != nil {
-		if opts.LogOutput == ioutil.Discard {
+		// create the new machine
+		m, err := machine.New(log.Sub('M'), addr)
+		if err != nil {
+			log.Warningf("%v", err)
+			os.Exit(1)
+		}
+		if err := m.SetNotifyKeyspaceEvents(notify); err != nil {
 			log.Warningf("%v", err)
 			os.Exit(1)
 		}
-		m.Close()
-		return
+		if err := m.SetGroupCommit(groupCommit, groupCommitBytes); err != nil {
+			log.Warningf("%v", err)
+			os.Exit(1)
+		}
+		if sh != nil {
+			if err := sh.SetGroup(group, m); err != nil {
+				log.Warningf("%v", err)
+				os.Exit(1)
+			}
+		}
+
+		// setup the connection events
+		gopts := opts
+		gopts.ConnAccept = func(conn redcon.Conn) bool {
+			return m.ConnAccept(conn)
+		}
+		gopts.ConnClosed = func(conn redcon.Conn, err error) {
+			m.ConnClosed(conn, err)
+		}
+
+		// open the raft machine
+		n, err := finn.Open(gdir, addr, gjoin, m, &gopts)
+		if err != nil {
+			if opts.LogOutput == ioutil.Discard {
+				log.Warningf("%v", err)
+				os.Exit(1)
+			}
+			m.Close()
+			return
+		}
+		nodes = append(nodes, n)
+		machines = append(machines, m)
+		if forward {
+			m.SetForwarding(n.Leader)
+		}
+		if sh != nil {
+			sh.SetLeader(group, n.Leader)
+		}
+	}
+	if sh != nil {
+		sh.Start()
 	}
-	defer func() {
-		n.Close()
-		m.Close()
-	}()
 	// run forever
 	select {}
 }
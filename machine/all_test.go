@@ -42,9 +42,25 @@ func TestAll(t *testing.T) {
 	runSubTest(t, "strings", mc, subTestStrings)
 	runSubTest(t, "keys", mc, subTestKeys)
 	runSubTest(t, "json", mc, subTestJSON)
+	runSubTest(t, "hashes", mc, subTestHashes)
+	runSubTest(t, "lists", mc, subTestLists)
+	runSubTest(t, "sortedsets", mc, subTestSortedSets)
+	runSubTest(t, "sets", mc, subTestSets)
+	runSubTest(t, "streams", mc, subTestStreams)
+	runSubTest(t, "pubsub", mc, subTestPubSub)
+	runSubTest(t, "changes", mc, subTestChanges)
+	runSubTest(t, "versions", mc, subTestVersions)
+	runSubTest(t, "locks", mc, subTestLocks)
+	runSubTest(t, "elections", mc, subTestElections)
+	runSubTest(t, "idempotent", mc, subTestIdempotent)
+	runSubTest(t, "forward", mc, subTestForward)
+	runSubTest(t, "consistency", mc, subTestConsistency)
 	runSubTest(t, "indexes", mc, subTestIndexes)
 	runSubTest(t, "transactions", mc, subTestTransactions)
+	runSubTest(t, "groupcommit", mc, subTestGroupCommit)
 	runSubTest(t, "scripts", mc, subTestScripts)
+	runSubTest(t, "shards", mc, subTestShards)
+	runSubTest(t, "txns", mc, subTestTxns)
 	runSubTest(t, "raft", mc, subTestRaft)
 }
 
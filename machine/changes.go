@@ -0,0 +1,482 @@
+package machine
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/raft"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// Each applied write that modifies keys is a change at the index of its
+// entry in the Raft log, so it's the same on every node and a client may
+// resume a change feed on any node. The changes that a client has missed
+// are read from the log of the node, by applying the log to a scratch
+// machine from a snapshot that was taken before them. A client that asks
+// for changes which have been compacted away is sent a snapshot of the
+// keyspace instead.
+
+// changesKey holds the index of the latest change.
+const changesKey = sdbMetaPrefix + "changes"
+
+// errFeedClosed is returned when the client of a change feed is gone.
+var errFeedClosed = errors.New("change feed closed")
+
+// logIndexer is implemented by an applier that knows the index of the log
+// entry that is being applied.
+type logIndexer interface {
+	Index() uint64
+}
+
+// change is a single modified key. The value is the new value of the key in
+// the DUMP format, or nil when the key was deleted.
+type change struct {
+	index uint64
+	op    string
+	key   string
+	value *string
+}
+
+func (c change) reply() []byte {
+	var value interface{}
+	if c.value != nil {
+		value = *c.value
+	}
+	return pubsubReply(int(c.index), c.op, c.key, value)
+}
+
+// changeFeed is a client that is receiving changes.
+type changeFeed struct {
+	s       *subscriber
+	pattern string
+	since   uint64   // the index that the client asked for
+	last    uint64   // the index of the last change in the backlog
+	ready   bool     // false while the backlog is being sent
+	held    []change // changes that arrive while the backlog is being sent
+}
+
+// matches returns true when the change should be sent to the client.
+// Changes without a key, such as FLUSHDB, are always sent.
+func (f *changeFeed) matches(c change) bool {
+	return c.key == "" || f.pattern == "" || match.Match(c.key, f.pattern)
+}
+
+// sendWait sends a change to the client, waiting for room in the backlog.
+func (f *changeFeed) sendWait(c change) bool {
+	if !f.matches(c) {
+		return true
+	}
+	select {
+	case f.s.out <- c.reply():
+		return true
+	case <-f.s.done:
+		return false
+	}
+}
+
+type changeLog struct {
+	mu       sync.Mutex
+	index    uint64     // index of the latest committed change
+	applying uint64     // index of the log entry that is being applied
+	pending  []change   // changes from the current transaction
+	tx       *buntdb.Tx // the current transaction
+	feeds    map[*changeFeed]bool
+	sink     func(changes []change) // receives the changes, or nil
+}
+
+func newChangeLog() *changeLog {
+	return &changeLog{
+		feeds: make(map[*changeFeed]bool),
+	}
+}
+
+// setApplying sets the index of the log entry that is being applied.
+func (cl *changeLog) setApplying(index uint64) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.applying = index
+}
+
+// begin starts recording the changes of a write transaction.
+func (cl *changeLog) begin(tx *buntdb.Tx) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.tx = tx
+}
+
+// changed returns true when the key has been changed by the transaction.
+func (cl *changeLog) changed(tx *buntdb.Tx, key string) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if tx != cl.tx {
+		return false
+	}
+	for _, c := range cl.pending {
+		if c.key == key || c.key == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// record adds a change to the current transaction.
+func (cl *changeLog) record(op, key string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.pending = append(cl.pending, change{op: op, key: key})
+}
+
+func txChangeIndex(tx *buntdb.Tx) (uint64, error) {
+	val, err := tx.Get(changesKey)
+	if err != nil {
+		if err == buntdb.ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseUint(val, 10, 64)
+}
+
+// stamp assigns the index of the log entry to the changes of the current
+// transaction, updates the versions of the changed keys, and reads their
+// new values. It must be called at the end of the transaction.
+func (cl *changeLog) stamp(tx *buntdb.Tx) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if len(cl.pending) == 0 {
+		return nil
+	}
+	index := cl.applying
+	if _, _, err := tx.Set(changesKey, strconv.FormatUint(index, 10), nil); err != nil {
+		return err
+	}
+	// the values are only needed when they may be sent to a client.
+	values := cl.sink != nil || len(cl.feeds) > 0
+	var deleted bool
+	for i := range cl.pending {
+		c := &cl.pending[i]
+		c.index = index
+		if c.key == "" {
+			if err := txPurgeVersions(tx); err != nil {
+				return err
+			}
+			deleted = true
+			continue
+		}
+		var val string
+		var err error
+		if values {
+			val, err = dumpValue(tx, c.key)
+		} else {
+			_, err = tx.Get(c.key)
+		}
+		if err != nil {
+			if err != buntdb.ErrNotFound {
+				return err
+			}
+			if _, err := tx.Delete(versionKeyPrefix + c.key); err != nil && err != buntdb.ErrNotFound {
+				return err
+			}
+			deleted = true
+			continue
+		}
+		if err := txSetVersion(tx, versionKeyPrefix+c.key, index); err != nil {
+			return err
+		}
+		if values {
+			c.value = &val
+		}
+	}
+	if deleted {
+		return txSetVersion(tx, versionDeletedKey, index)
+	}
+	return nil
+}
+
+// flush commits the changes from the current transaction and sends them to
+// the clients. When commit is false the changes are discarded.
+func (cl *changeLog) flush(commit bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	pending := cl.pending
+	cl.pending = nil
+	cl.tx = nil
+	if !commit || len(pending) == 0 || pending[0].index == 0 {
+		return
+	}
+	cl.index = pending[0].index
+	if cl.sink != nil {
+		cl.sink(pending)
+	}
+	for f := range cl.feeds {
+		if !f.ready {
+			f.held = append(f.held, pending...)
+			continue
+		}
+		for _, c := range pending {
+			if c.index > f.since && f.matches(c) {
+				f.s.send(c.reply())
+			}
+		}
+	}
+}
+
+// reset is called when the database has been replaced by a snapshot.
+// Clients are disconnected so that they may resume from the new state.
+func (cl *changeLog) reset(index uint64) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.index = index
+	cl.pending = nil
+	for f := range cl.feeds {
+		f.s.close()
+		delete(cl.feeds, f)
+	}
+}
+
+func (m *Machine) doChanges(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// CHANGES SINCE index [MATCH pattern]
+	if len(cmd.Args) != 3 && len(cmd.Args) != 5 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if qcmdlower(cmd.Args[1]) != "since" {
+		return nil, errSyntaxError
+	}
+	since, err := strconv.ParseUint(string(cmd.Args[2]), 10, 64)
+	if err != nil {
+		return nil, errNotAnInt
+	}
+	var pattern string
+	if len(cmd.Args) == 5 {
+		if qcmdlower(cmd.Args[3]) != "match" {
+			return nil, errSyntaxError
+		}
+		pattern = string(cmd.Args[4])
+	}
+	f := &changeFeed{
+		s:       newSubscriber(conn.Detach()),
+		pattern: pattern,
+		since:   since,
+		last:    since,
+	}
+	m.cl.mu.Lock()
+	m.cl.feeds[f] = true
+	if m.cl.index > f.last {
+		f.last = m.cl.index
+	}
+	m.cl.mu.Unlock()
+	go f.s.writeLoop()
+	go m.sendChanges(a, f)
+	go func() {
+		defer func() {
+			m.cl.mu.Lock()
+			delete(m.cl.feeds, f)
+			m.cl.mu.Unlock()
+		}()
+		for {
+			cmd, err := f.s.conn.ReadCommand()
+			if err != nil {
+				f.s.close()
+				return
+			}
+			switch qcmdlower(cmd.Args[0]) {
+			default:
+				f.s.send(pubsubError("ERR only PING / QUIT allowed in this context"))
+			case "ping":
+				f.s.send([]byte("+PONG\r\n"))
+			case "quit":
+				f.s.send([]byte("+OK\r\n"))
+				f.s.send(nil)
+				return
+			}
+		}
+	}()
+	return nil, nil
+}
+
+// sendChanges sends the changes that the client has missed, and then marks
+// the client as ready for new changes. When the missed changes have been
+// compacted away the client is sent a 'snapshot' change, followed by a
+// 'restore' change for every key.
+func (m *Machine) sendChanges(a finn.Applier, f *changeFeed) {
+	err := m.replayChanges(a, f)
+	if err == finn.ErrCompacted {
+		err = m.sendSnapshot(f)
+	}
+	if err != nil {
+		if err != errFeedClosed {
+			f.s.send(pubsubError("ERR " + err.Error()))
+			f.s.send(nil)
+		}
+		return
+	}
+	m.cl.mu.Lock()
+	defer m.cl.mu.Unlock()
+	for _, c := range f.held {
+		if c.index > f.last && f.matches(c) {
+			f.s.send(c.reply())
+		}
+	}
+	f.held = nil
+	f.ready = true
+}
+
+// replayChanges sends the changes that follow the index of the client up to
+// the last change of the backlog. They're read from the log, which is
+// applied to a scratch machine that is restored from a snapshot that was
+// taken before the index.
+func (m *Machine) replayChanges(a finn.Applier, f *changeFeed) error {
+	if f.since >= f.last {
+		return nil
+	}
+	la, ok := a.(finn.LogApplier)
+	if !ok {
+		return finn.ErrCompacted
+	}
+	before := f.since
+	for {
+		sindex, rc, err := la.OpenSnapshot(before)
+		if err != nil {
+			return err
+		}
+		scratch, err := m.newReplayMachine(rc)
+		if err != nil {
+			return err
+		}
+		// the snapshot is written while the log is being applied, so it may
+		// have changes that follow its index.
+		start := sindex
+		if scratch.cl.index > start {
+			start = scratch.cl.index
+		}
+		if start > f.since {
+			scratch.Close()
+			if sindex == 0 {
+				return finn.ErrCompacted
+			}
+			before = sindex - 1
+			continue
+		}
+		defer scratch.Close()
+		var closed bool
+		scratch.cl.sink = func(changes []change) {
+			for _, c := range changes {
+				if !closed && c.index > f.since && c.index <= f.last {
+					closed = !f.sendWait(c)
+				}
+			}
+		}
+		ra := &replayApplier{log: m.log}
+		return la.ReadLog(start+1, f.last, func(index uint64, cmd redcon.Command) error {
+			// the commands that failed when the log was applied fail
+			// again.
+			ra.index = index
+			scratch.Command(ra, nil, cmd)
+			if closed {
+				return errFeedClosed
+			}
+			return nil
+		})
+	}
+}
+
+// newReplayMachine returns a scratch machine for applying the log, which is
+// restored from the snapshot when it's not nil.
+func (m *Machine) newReplayMachine(rc io.ReadCloser) (*Machine, error) {
+	var rd io.Reader = strings.NewReader("")
+	if rc != nil {
+		defer rc.Close()
+		rd = rc
+	}
+	scratch, err := newScratchMachine(m.log)
+	if err != nil {
+		return nil, err
+	}
+	if m.sh != nil {
+		// the routes of the scratch machine are its own.
+		scratch.sh, scratch.group = NewShards(len(m.sh.groups)), m.group
+	}
+	if err := scratch.Restore(rd); err != nil {
+		scratch.Close()
+		return nil, err
+	}
+	return scratch, nil
+}
+
+// sendSnapshot sends a 'snapshot' change, followed by a 'restore' change
+// for every key.
+func (m *Machine) sendSnapshot(f *changeFeed) error {
+	// read the entire keyspace before sending, the database must not be
+	// locked while waiting on the client.
+	var backlog []change
+	err := m.db.View(func(tx *buntdb.Tx) error {
+		index, err := txChangeIndex(tx)
+		if err != nil {
+			return err
+		}
+		f.last = index
+		backlog = append(backlog, change{index: index, op: "snapshot"})
+		var keys []string
+		if err := tx.Ascend("", func(key, _ string) bool {
+			if !isMercMetaKey(key) && (f.pattern == "" || match.Match(key, f.pattern)) {
+				keys = append(keys, key)
+			}
+			return true
+		}); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			val, err := dumpValue(tx, key)
+			if err != nil {
+				return err
+			}
+			backlog = append(backlog, change{index, "restore", key, &val})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, c := range backlog {
+		if !f.sendWait(c) {
+			return errFeedClosed
+		}
+	}
+	return nil
+}
+
+// replayApplier applies the commands of the log to a scratch machine.
+// Nothing may be proposed, such as the removal of expired keys.
+type replayApplier struct {
+	log   finn.Logger
+	index uint64 // the index of the log entry that is being applied
+}
+
+func (a *replayApplier) Apply(
+	conn redcon.Conn, cmd redcon.Command,
+	mutate func() (interface{}, error),
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	if conn != nil {
+		return nil, raft.ErrNotLeader
+	}
+	if mutate != nil {
+		// as a follower, there's no client to respond to.
+		return mutate()
+	}
+	return respond(nil)
+}
+
+func (a *replayApplier) Index() uint64 {
+	return a.index
+}
+
+func (a *replayApplier) Log() finn.Logger {
+	return a.log
+}
@@ -0,0 +1,226 @@
+package machine
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/tidwall/finn"
+)
+
+func subTestChanges(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "CHANGES", changes_CHANGES_test)
+	runStep(t, mc, "resume", changes_resume_test)
+	runStep(t, mc, "compacted", changes_compacted_test)
+}
+
+// changesExpect reads the next change and checks it. A '*' value matches
+// any value.
+func changesExpect(conn redis.Conn, index int64, op, key, value string) error {
+	vals, err := redis.Values(conn.Receive())
+	if err != nil {
+		return err
+	}
+	normalize(vals)
+	if len(vals) != 4 {
+		return fmt.Errorf("expected 4 values, got %d", len(vals))
+	}
+	resp := fmt.Sprintf("%v %v %v %v", vals[0], vals[1], vals[2], vals[3])
+	if value == "*" {
+		resp = fmt.Sprintf("%v %v %v *", vals[0], vals[1], vals[2])
+	}
+	expect := fmt.Sprintf("%v %v %v %v", index, op, key, value)
+	if resp != expect {
+		return fmt.Errorf("expected '%v', got '%v'", expect, resp)
+	}
+	return nil
+}
+
+func changes_CHANGES_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"CHANGES"}, {"ERR wrong number of arguments for 'CHANGES' command"},
+		{"CHANGES", "FROM", 0}, {"ERR syntax error"},
+		{"CHANGES", "SINCE", "a"}, {"ERR value is not an integer or out of range"},
+		{"CHANGES", "SINCE", 0, "PATTERN", "*"}, {"ERR syntax error"},
+	})
+}
+
+// changesIndex returns the index of the last entry that the server applied.
+func changesIndex(s *mockServer) (int64, error) {
+	stats, err := redis.StringMap(s.Do("RAFTSTATS"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(stats["applied_index"], 10, 64)
+}
+
+// changesDial opens a change feed on the server.
+func changesDial(s *mockServer, since int64) (redis.Conn, error) {
+	conn, err := redis.Dial("tcp", fmt.Sprintf(":%d", s.port),
+		redis.DialReadTimeout(time.Second*5))
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Send("CHANGES", "SINCE", since, "MATCH", "cdc:*"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func changes_resume_test(mc *mockCluster) error {
+	// the current server is the leader, which has applied each write by
+	// the time that it responds. the change index is the index of the
+	// write in the log.
+	leader := mc.cs
+	index, err := changesIndex(leader)
+	if err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "cdc:1", "one"}, {"OK"},
+		{"HSET", "cdc:2", "field", "value"}, {1},
+		{"SET", "other", "value"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	// the missed changes are read from the log.
+	conn, err := changesDial(leader, index)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := changesExpect(conn, index+1, "set", "cdc:1", "one"); err != nil {
+		return err
+	}
+	if err := changesExpect(conn, index+2, "hset", "cdc:2", "*"); err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "cdc:1", "two"}, {"OK"},
+		{"SET", "other", "value"}, {"OK"},
+		{"MSET", "cdc:3", "three", "cdc:4", "four"}, {"OK"},
+		{"DEL", "cdc:1"}, {1},
+		{"FLUSHDB"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	changes := [][]interface{}{
+		{index + 4, "set", "cdc:1", "two"},
+		{index + 6, "set", "cdc:3", "three"},
+		{index + 6, "set", "cdc:4", "four"},
+		{index + 7, "del", "cdc:1", "<nil>"},
+		{index + 8, "flushdb", "", "<nil>"},
+	}
+	for _, c := range changes {
+		if err := changesExpect(conn, c[0].(int64), c[1].(string), c[2].(string), c[3].(string)); err != nil {
+			return err
+		}
+	}
+	if err := pubsubExpect(conn, "PONG", "PING"); err != nil {
+		return err
+	}
+	if err := pubsubExpect(conn, "ERR only PING / QUIT allowed in this context", "GET", "cdc:1"); err != nil {
+		return err
+	}
+	if err := pubsubExpect(conn, "OK", "QUIT"); err != nil {
+		return err
+	}
+
+	// resume from the middle on a follower, which has the same log.
+	s, err := mc.Follower()
+	if err != nil {
+		return err
+	}
+	conn, err = changesDial(s, index+6)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, c := range changes[3:] {
+		if err := changesExpect(conn, c[0].(int64), c[1].(string), c[2].(string), c[3].(string)); err != nil {
+			return err
+		}
+	}
+	// finding the follower may have written to the leader.
+	if index, err = changesIndex(leader); err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "cdc:5", "five"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	return changesExpect(conn, index+1, "set", "cdc:5", "five")
+}
+
+func changes_compacted_test(mc *mockCluster) error {
+	// a server that keeps a single entry of the log after a snapshot.
+	rand.Seed(time.Now().UnixNano())
+	var opts finn.Options
+	opts.Consistency = finn.High
+	opts.TrailingLogs = 1
+	s, err := mockOpenServerPort(rand.Int()%20000+20000, nil, opts)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	set := func(key, value string) error {
+		resp, err := s.Do("SET", key, value)
+		return checkExpect("OK", resp, err)
+	}
+	if err := set("cdc:1", "one"); err != nil {
+		return err
+	}
+	if err := set("cdc:2", "two"); err != nil {
+		return err
+	}
+	if resp, err := s.Do("RAFTSNAPSHOT"); checkExpect("OK", resp, err) != nil {
+		return fmt.Errorf("expected 'OK', got '%v', '%v'", resp, err)
+	}
+	stats, err := redis.StringMap(s.Do("RAFTSTATS"))
+	if err != nil {
+		return err
+	}
+	snapshot, err := strconv.ParseInt(stats["last_snapshot_index"], 10, 64)
+	if err != nil {
+		return err
+	}
+	if err := set("cdc:3", "three"); err != nil {
+		return err
+	}
+	index, err := changesIndex(s)
+	if err != nil {
+		return err
+	}
+	// the changes before the snapshot are gone from the log.
+	conn, err := changesDial(s, 0)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, c := range [][]interface{}{
+		{index, "snapshot", "", "<nil>"},
+		{index, "restore", "cdc:1", "one"},
+		{index, "restore", "cdc:2", "two"},
+		{index, "restore", "cdc:3", "three"},
+	} {
+		if err := changesExpect(conn, c[0].(int64), c[1].(string), c[2].(string), c[3].(string)); err != nil {
+			return err
+		}
+	}
+	// the changes after the snapshot are read from the log.
+	conn, err = changesDial(s, snapshot)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return changesExpect(conn, index, "set", "cdc:3", "three")
+}
@@ -0,0 +1,108 @@
+package machine
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/redcon"
+)
+
+// Writes that depend on the current time, such as expirations and XADD with
+// an auto ID, must apply the same on every node, and again when the log is
+// replayed. The leader stamps its clock onto each write before it's
+// proposed, and the stamp travels along with the write through the Raft log.
+// While the write is applied, the stamp is the cluster time.
+
+// clockArgPrefix marks a trailing command argument that holds a stamp.
+const clockArgPrefix = sdbMetaPrefix + "clock:"
+
+// clockKey holds the latest stamp that has been applied.
+const clockKey = sdbMetaPrefix + "clock"
+
+// stampCommand appends the leader's clock to a command which is about to be
+// proposed. Commands that are applied from the log, or inside of a
+// transaction, are returned as-is.
+func stampCommand(conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) redcon.Command {
+	if conn == nil || tx != nil {
+		return cmd
+	}
+	args := make([][]byte, len(cmd.Args), len(cmd.Args)+1)
+	copy(args, cmd.Args)
+	args = append(args, []byte(clockArgPrefix+strconv.FormatInt(localClock(), 10)))
+	return buildCommand(args)
+}
+
+// unstampCommand removes the stamp from a command. Returns the stamp in
+// milliseconds, or zero when the command has no stamp.
+func unstampCommand(cmd redcon.Command) (redcon.Command, int64) {
+	if len(cmd.Args) == 0 {
+		return cmd, 0
+	}
+	last := string(cmd.Args[len(cmd.Args)-1])
+	if !strings.HasPrefix(last, clockArgPrefix) {
+		return cmd, 0
+	}
+	ms, _ := strconv.ParseInt(last[len(clockArgPrefix):], 10, 64)
+	return buildCommand(cmd.Args[:len(cmd.Args)-1]), ms
+}
+
+// localClock returns the local time in milliseconds.
+func localClock() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// txClock returns the cluster time in milliseconds. The stamp is recorded
+// so that the commands which run in the same transaction will use it too.
+// The clock never goes backwards, even when a new leader's clock is behind.
+func txClock(tx *buntdb.Tx, stamp int64) (int64, error) {
+	var clock int64
+	val, err := tx.Get(clockKey)
+	if err != nil && err != buntdb.ErrNotFound {
+		return 0, err
+	}
+	if err == nil {
+		clock, _ = strconv.ParseInt(val, 10, 64)
+	}
+	if stamp > clock {
+		clock = stamp
+		_, _, err := tx.Set(clockKey, strconv.FormatInt(clock, 10), nil)
+		if err != nil && err != buntdb.ErrTxNotWritable {
+			return 0, err
+		}
+	}
+	return clock, nil
+}
+
+// txNow returns the time in milliseconds for a command. Writes use the
+// cluster time. Reads aren't replicated, and use the local time.
+func txNow(tx *buntdb.Tx) (int64, error) {
+	val, err := tx.Get(clockKey)
+	if err != nil {
+		if err != buntdb.ErrNotFound {
+			return 0, err
+		}
+		// nothing has been stamped, such as a log from an older version.
+		return localClock(), nil
+	}
+	// rewriting the clock tells a write from a read.
+	if _, _, err := tx.Set(clockKey, val, nil); err != nil {
+		if err != buntdb.ErrTxNotWritable {
+			return 0, err
+		}
+		return localClock(), nil
+	}
+	return strconv.ParseInt(val, 10, 64)
+}
+
+// expireOptions returns the options for a key that expires at the time in
+// milliseconds. buntdb expects a duration from the local time, which will be
+// negative when the key has already expired, such as when the log is
+// replayed.
+func expireOptions(at int64) *buntdb.SetOptions {
+	return &buntdb.SetOptions{
+		Expires: true,
+		TTL:     time.Unix(0, at*int64(time.Millisecond)).Sub(time.Now()),
+	}
+}
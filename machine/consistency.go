@@ -0,0 +1,108 @@
+package machine
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// Reads are processed at the consistency level of the node, which is set
+// with the --consistency flag. A connection can use CONSISTENCY to read at
+// a different level, or to accept reads that are stale by no more than a
+// number of milliseconds. Writes always go through the raft log.
+
+var errInvalidConsistency = errors.New("ERR invalid consistency level")
+
+// consistency is the read consistency of a connection.
+type consistency struct {
+	level finn.Level
+	stale time.Duration // the max staleness of a read, or zero
+}
+
+func (c *consistency) String() string {
+	if c == nil {
+		return "default"
+	}
+	if c.stale > 0 {
+		return "stale " + strconv.FormatInt(int64(c.stale/time.Millisecond), 10)
+	}
+	return c.level.String()
+}
+
+// parseConsistency parses the arguments of a CONSISTENCY command. Returns
+// nil for the default level of the node.
+func parseConsistency(args [][]byte) (*consistency, error) {
+	name := strings.ToLower(string(args[0]))
+	if name == "stale" {
+		if len(args) != 2 {
+			return nil, errSyntaxError
+		}
+		ms, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil || ms <= 0 {
+			return nil, errInvalidConsistency
+		}
+		return &consistency{level: finn.Low, stale: time.Duration(ms) * time.Millisecond}, nil
+	}
+	if len(args) != 1 {
+		return nil, errSyntaxError
+	}
+	if name == "default" {
+		return nil, nil
+	}
+	for _, level := range []finn.Level{finn.Low, finn.Medium, finn.High, finn.ReadIndex} {
+		if name == level.String() {
+			return &consistency{level: level}, nil
+		}
+	}
+	return nil, errInvalidConsistency
+}
+
+func (m *Machine) doConsistency(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// CONSISTENCY [level]
+	// CONSISTENCY STALE ms
+	if len(cmd.Args) > 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if conn == nil {
+		return nil, errors.New("missing connection")
+	}
+	ctx := conn.Context().(*connContext)
+	if len(cmd.Args) == 1 {
+		conn.WriteBulkString(ctx.consistency.String())
+		return nil, nil
+	}
+	c, err := parseConsistency(cmd.Args[1:])
+	if err != nil {
+		return nil, err
+	}
+	ctx.consistency = c
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+// applyRead applies a readonly command at the consistency of the connection.
+func applyRead(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
+	respond func(interface{}) (interface{}, error),
+) (interface{}, error) {
+	var c *consistency
+	if conn != nil {
+		if ctx, ok := conn.Context().(*connContext); ok {
+			c = ctx.consistency
+		}
+	}
+	la, ok := a.(finn.LevelApplier)
+	if c == nil || !ok {
+		return a.Apply(conn, cmd, nil, respond)
+	}
+	if c.stale > 0 && la.Staleness() >= c.stale {
+		// too far behind, the read must go to the leader.
+		return nil, raft.ErrNotLeader
+	}
+	return la.ApplyLevel(c.level, conn, cmd, nil, respond)
+}
@@ -0,0 +1,66 @@
+package machine
+
+import (
+	"fmt"
+	"testing"
+)
+
+func subTestConsistency(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "CONSISTENCY", consistency_CONSISTENCY_test)
+	runStep(t, mc, "follower", consistency_follower_test)
+}
+
+func consistency_CONSISTENCY_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"CONSISTENCY"}, {"default"},
+		{"CONSISTENCY", "low"}, {"OK"},
+		{"CONSISTENCY"}, {"low"},
+		{"CONSISTENCY", "READINDEX"}, {"OK"},
+		{"CONSISTENCY"}, {"readindex"},
+		{"CONSISTENCY", "stale", 500}, {"OK"},
+		{"CONSISTENCY"}, {"stale 500"},
+		{"CONSISTENCY", "default"}, {"OK"},
+		{"CONSISTENCY"}, {"default"},
+		{"CONSISTENCY", "lowest"}, {"ERR invalid consistency level"},
+		{"CONSISTENCY", "stale", 0}, {"ERR invalid consistency level"},
+		{"CONSISTENCY", "stale"}, {"ERR syntax error"},
+		{"CONSISTENCY", "low", 1}, {"ERR syntax error"},
+		{"CONSISTENCY", "stale", 1, 2}, {"ERR wrong number of arguments for 'CONSISTENCY' command"},
+	})
+}
+
+func consistency_follower_test(mc *mockCluster) error {
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "mykey", "1"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	s, err := mc.Follower()
+	if err != nil {
+		return err
+	}
+	// the settings belong to this connection only.
+	defer func() {
+		s.conn.Close()
+		s.conn = nil
+	}()
+	resps, err := s.DoPipeline([][]interface{}{
+		{"GET", "mykey"},
+		{"CONSISTENCY", "readindex"},
+		{"GET", "mykey"},
+		{"CONSISTENCY", "stale", 10000},
+		{"GET", "mykey"},
+		{"CONSISTENCY", "medium"},
+		{"GET", "mykey"},
+		{"SET", "mykey", "2"},
+	})
+	if err != nil {
+		return err
+	}
+	resp := fmt.Sprintf("%v", normalize(resps))
+	expect := fmt.Sprintf("[TRY %[1]s OK 1 OK 1 OK TRY %[1]s TRY %[1]s]", s.n.Leader())
+	if resp != expect {
+		return fmt.Errorf("expected '%v', got '%v'", expect, resp)
+	}
+	return nil
+}
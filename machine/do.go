@@ -2,6 +2,7 @@ package machine
 
 import (
 	"errors"
+	"time"
 
 	"github.com/tidwall/buntdb"
 	"github.com/tidwall/finn"
@@ -46,20 +47,38 @@ func (m *Machine) writeDoApply(
 			return nil, nil
 		}
 	}
-	return a.Apply(conn, cmd, func() (v interface{}, err error) {
+	v, err := a.Apply(conn, stampCommand(conn, cmd, tx), func() (v interface{}, err error) {
 		if tx != nil {
 			v, err = wrdo(tx)
 		} else {
 			err = m.db.Update(func(tx *buntdb.Tx) error {
+				if _, err := txClock(tx, m.stamp); err != nil {
+					return err
+				}
+				m.cl.begin(tx)
 				var err error
 				v, err = wrdo(tx)
-				return err
+				if err != nil {
+					return err
+				}
+				return m.cl.stamp(tx)
 			})
+			// deliver messages, notifications, and changes from the
+			// transaction, wake up the clients blocked on its keys, and
+			// lock or unlock the keys of sharded transactions.
+			m.ps.flush(err == nil)
+			m.cl.flush(err == nil)
+			m.flushSignals(err == nil)
+			m.flushIntents(err == nil)
 		}
 		return v, err
 	}, func(v interface{}) (interface{}, error) {
 		return nil, rddo(v)
 	})
+	if m.forwarding(conn, tx, err) {
+		return nil, m.forward(conn, cmd)
+	}
+	return v, err
 }
 
 func (m *Machine) readDoApply(
@@ -77,7 +96,7 @@ func (m *Machine) readDoApply(
 			return nil, nil
 		}
 	}
-	return a.Apply(conn, cmd, nil, func(v interface{}) (interface{}, error) {
+	v, err := applyRead(a, conn, cmd, func(v interface{}) (interface{}, error) {
 		if tx != nil {
 			return nil, rddo(tx)
 		}
@@ -85,16 +104,26 @@ func (m *Machine) readDoApply(
 			return rddo(tx)
 		})
 	})
+	if m.forwarding(conn, tx, err) {
+		return nil, m.forward(conn, cmd)
+	}
+	return v, err
 }
 
 // flushAllButMeta removes all data from the database except meta keys.
 func flushAllButMeta(tx *buntdb.Tx) ([]string, int, error) {
 	// backup the meta keys
 	var metas []string
+	var members int
 	if err := tx.AscendGreaterOrEqual("", sdbMetaPrefix, func(key, val string) bool {
 		if !isMercMetaKey(key) {
 			return false
 		}
+		if isMemberKey(key) {
+			// collection members are deleted with their collection
+			members++
+			return true
+		}
 		metas = append(metas, key, val)
 		return true
 	}); err != nil {
@@ -114,5 +143,100 @@ func flushAllButMeta(tx *buntdb.Tx) ([]string, int, error) {
 			return nil, 0, err
 		}
 	}
-	return metas, n - (len(metas) / 2), nil
+	return metas, n - (len(metas) / 2) - members, nil
+}
+
+// canBlock returns true when a command may block the client connection. A
+// command that is applied from the log, or is inside of a transaction, must
+// never block.
+func canBlock(conn redcon.Conn, tx *buntdb.Tx) bool {
+	if conn == nil || tx != nil {
+		return false
+	}
+	ctx, ok := conn.Context().(*connContext)
+	return ok && ctx.multi == nil
+}
+
+// blockOn calls try until it returns true or until the timeout expires. The
+// try function is called again each time that one of the keys is signaled.
+// A zero timeout waits forever.
+func (m *Machine) blockOn(keys []string, timeout time.Duration, try func() (bool, error)) (bool, error) {
+	ch := m.blockKeys(keys)
+	defer m.unblockKeys(keys, ch)
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+	for {
+		ok, err := try()
+		if err != nil || ok {
+			return ok, err
+		}
+		select {
+		case <-ch:
+		case <-deadline:
+			return false, nil
+		}
+	}
+}
+
+// blockKeys returns a channel that is signaled when new data is written to
+// any of the keys.
+func (m *Machine) blockKeys(keys []string) chan struct{} {
+	ch := make(chan struct{}, 1)
+	m.bmu.Lock()
+	defer m.bmu.Unlock()
+	for _, key := range keys {
+		chs := m.blocked[key]
+		if chs == nil {
+			chs = make(map[chan struct{}]bool)
+			m.blocked[key] = chs
+		}
+		chs[ch] = true
+	}
+	return ch
+}
+
+func (m *Machine) unblockKeys(keys []string, ch chan struct{}) {
+	m.bmu.Lock()
+	defer m.bmu.Unlock()
+	for _, key := range keys {
+		if chs := m.blocked[key]; chs != nil {
+			delete(chs, ch)
+			if len(chs) == 0 {
+				delete(m.blocked, key)
+			}
+		}
+	}
+}
+
+// signalKey wakes up all clients that are blocked on the key, once the
+// transaction that wrote to the key commits.
+func (m *Machine) signalKey(key string) {
+	m.bmu.Lock()
+	defer m.bmu.Unlock()
+	if m.signaled == nil {
+		m.signaled = make(map[string]bool)
+	}
+	m.signaled[key] = true
+}
+
+// flushSignals wakes up the clients that are blocked on the signaled keys
+// when commit is true, otherwise the signals are discarded.
+func (m *Machine) flushSignals(commit bool) {
+	m.bmu.Lock()
+	defer m.bmu.Unlock()
+	if commit {
+		for key := range m.signaled {
+			for ch := range m.blocked[key] {
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+	m.signaled = nil
 }
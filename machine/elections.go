@@ -0,0 +1,262 @@
+package machine
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// An election has at most one leader, which holds a lease just like a lock.
+// A candidate that calls ELECT while it's the leader keeps the leadership
+// and renews its lease. Each new leader starts a new term, and is issued a
+// fencing token that has the same name as the election. The term counts the
+// leaders of the election, while the token may also be incremented by FENCE.
+
+// electionKeyPrefix is the prefix for the leader of an election.
+const electionKeyPrefix = sdbMetaPrefix + "election:"
+
+// termKeyPrefix is the prefix for the latest term of an election.
+const termKeyPrefix = sdbMetaPrefix + "term:"
+
+type election struct {
+	term uint64
+	lock // the leader
+}
+
+func (e election) String() string {
+	return strconv.FormatUint(e.term, 10) + " " + e.lock.String()
+}
+
+func parseElection(val string) (election, bool) {
+	parts := strings.SplitN(val, " ", 2)
+	if len(parts) != 2 {
+		return election{}, false
+	}
+	term, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return election{}, false
+	}
+	l, ok := parseLock(parts[1])
+	if !ok {
+		return election{}, false
+	}
+	return election{term: term, lock: l}, true
+}
+
+// txGetElection returns the election with the name. Returns false when the
+// election has no leader as of the clock.
+func txGetElection(tx *buntdb.Tx, name string, clock int64) (election, bool, error) {
+	val, found, err := txGetLeased(tx, electionKeyPrefix+name)
+	if err != nil || !found {
+		return election{}, false, err
+	}
+	e, ok := parseElection(val)
+	if !ok || e.expires <= clock {
+		return election{}, false, nil
+	}
+	return e, true, nil
+}
+
+// txNextTerm increments the term of an election and returns the new term.
+func txNextTerm(tx *buntdb.Tx, name string) (uint64, error) {
+	key := termKeyPrefix + name
+	var term uint64
+	val, err := tx.Get(key)
+	if err != nil {
+		if err != buntdb.ErrNotFound {
+			return 0, err
+		}
+	} else {
+		term, err = strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	}
+	term++
+	if _, _, err := tx.Set(key, strconv.FormatUint(term, 10), nil); err != nil {
+		return 0, err
+	}
+	return term, nil
+}
+
+// writeLeader writes an election as the reply to LEADEROF and OBSERVE.
+func writeLeader(conn redcon.Conn, e election, now int64) {
+	conn.WriteArray(4)
+	conn.WriteBulkString(e.owner)
+	conn.WriteInt64(int64(e.term))
+	conn.WriteBulkString(strconv.FormatUint(e.token, 10))
+	conn.WriteInt64(e.expires - now)
+}
+
+func (m *Machine) doElect(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// ELECT election candidate milliseconds
+	if len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	name, candidate := string(cmd.Args[1]), string(cmd.Args[2])
+	ttl, err := parseLockTTL(cmd.Args[3])
+	if err != nil {
+		return nil, err
+	}
+	key := electionKeyPrefix + name
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		now, err := txNow(tx)
+		if err != nil {
+			return nil, err
+		}
+		e, led, err := txGetElection(tx, name, now)
+		if err != nil {
+			return nil, err
+		}
+		if led && e.owner != candidate {
+			return nil, nil
+		}
+		if !led {
+			e.term, err = txNextTerm(tx, name)
+			if err != nil {
+				return nil, err
+			}
+			token, err := txFence(tx, name, 1)
+			if err != nil {
+				return nil, err
+			}
+			e.token, _ = strconv.ParseUint(token, 10, 64)
+			e.owner = candidate
+		}
+		e.expires = now + ttl
+		if _, _, err := tx.Set(key, e.String(), expireOptions(e.expires)); err != nil {
+			return nil, err
+		}
+		if !led {
+			m.signalKey(key)
+		}
+		return strconv.FormatUint(e.token, 10), nil
+	}, func(v interface{}) error {
+		if v == nil {
+			conn.WriteNull()
+		} else {
+			conn.WriteBulkString(v.(string))
+		}
+		return nil
+	})
+}
+
+func (m *Machine) doResign(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// RESIGN election leader token
+	if len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	name, leader := string(cmd.Args[1]), string(cmd.Args[2])
+	token, err := parseLockToken(cmd.Args[3])
+	if err != nil {
+		return nil, err
+	}
+	key := electionKeyPrefix + name
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		now, err := txNow(tx)
+		if err != nil {
+			return nil, err
+		}
+		e, led, err := txGetElection(tx, name, now)
+		if err != nil {
+			return nil, err
+		}
+		if !led || e.owner != leader || e.token != token {
+			return 0, nil
+		}
+		if _, err := tx.Delete(key); err != nil {
+			return nil, err
+		}
+		m.signalKey(key)
+		return 1, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+func (m *Machine) doLeaderOf(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// LEADEROF election
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	name := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		now, err := txNow(tx)
+		if err != nil {
+			return err
+		}
+		e, led, err := txGetElection(tx, name, now)
+		if err != nil {
+			return err
+		}
+		if !led {
+			conn.WriteNull()
+			return nil
+		}
+		writeLeader(conn, e, now)
+		return nil
+	})
+}
+
+func (m *Machine) doObserve(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// OBSERVE election term timeout
+	if len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	name := string(cmd.Args[1])
+	term, err := strconv.ParseUint(string(cmd.Args[2]), 10, 64)
+	if err != nil {
+		return nil, errNotAnInt
+	}
+	timeout, err := strconv.ParseFloat(string(cmd.Args[3]), 64)
+	if err != nil || timeout < 0 {
+		return nil, errors.New("ERR timeout is not a float or out of range")
+	}
+	// The observed term is zero while there's no leader. A change is
+	// written like LEADEROF, except that no leader is an empty array.
+	var changed bool
+	rddo := func(tx *buntdb.Tx) error {
+		now, err := txNow(tx)
+		if err != nil {
+			return err
+		}
+		e, led, err := txGetElection(tx, name, now)
+		if err != nil {
+			return err
+		}
+		if (led && e.term == term) || (!led && term == 0) {
+			return nil
+		}
+		changed = true
+		if !led {
+			conn.WriteArray(0)
+			return nil
+		}
+		writeLeader(conn, e, now)
+		return nil
+	}
+	if !canBlock(conn, tx) {
+		return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+			if err := rddo(tx); err != nil || changed {
+				return err
+			}
+			conn.WriteNull()
+			return nil
+		})
+	}
+	key := electionKeyPrefix + name
+	_, err = m.blockOn([]string{key}, time.Duration(timeout*float64(time.Second)), func() (bool, error) {
+		_, err := m.readDoApply(a, conn, cmd, tx, rddo)
+		return changed, err
+	})
+	if err == nil && !changed {
+		conn.WriteNull()
+	}
+	return nil, err
+}
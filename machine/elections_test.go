@@ -0,0 +1,92 @@
+package machine
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func subTestElections(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "ELECT", elections_ELECT_test)
+	runStep(t, mc, "RESIGN", elections_RESIGN_test)
+	runStep(t, mc, "expires", elections_expires_test)
+	runStep(t, mc, "OBSERVE", elections_OBSERVE_test)
+}
+
+func elections_ELECT_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"LEADEROF", "elect1"}, {nil},
+		{"FENCE", "elect1", 10}, {"10"},
+		{"ELECT", "elect1", "alice", 10000}, {"11"},
+		{"ELECT", "elect1", "bob", 10000}, {nil},
+		{"ELECT", "elect1", "alice", 10000}, {"11"},
+		{"LEADEROF", "elect1"}, {func(v interface{}) (resp, expect interface{}) {
+			vals := v.([]string)
+			return fmt.Sprint(vals[:3]), "[alice 1 11]"
+		}},
+		{"KEYS", "*"}, {"[]"},
+		{"ELECT", "elect1", "alice"}, {"ERR wrong number of arguments for 'ELECT' command"},
+		{"ELECT", "elect1", "alice", 0}, {"ERR invalid expire time in lock command"},
+	})
+}
+
+func elections_RESIGN_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"ELECT", "elect2", "alice", 10000}, {"1"},
+		{"RESIGN", "elect2", "bob", 1}, {0},
+		{"RESIGN", "elect2", "alice", 2}, {0},
+		{"RESIGN", "elect2", "alice", 1}, {1},
+		{"LEADEROF", "elect2"}, {nil},
+		{"ELECT", "elect2", "bob", 10000}, {"2"},
+		{"LEADEROF", "elect2"}, {func(v interface{}) (resp, expect interface{}) {
+			vals := v.([]string)
+			return fmt.Sprint(vals[:3]), "[bob 2 2]"
+		}},
+	})
+}
+
+func elections_expires_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"ELECT", "elect3", "alice", 100}, {"1"},
+		{time.Second / 4}, {}, // sleep
+		{"LEADEROF", "elect3"}, {nil},
+		{"RESIGN", "elect3", "alice", 1}, {0},
+		{"ELECT", "elect3", "bob", 10000}, {"2"},
+	})
+}
+
+func elections_OBSERVE_test(mc *mockCluster) error {
+	if err := mc.DoBatch([][]interface{}{
+		{"OBSERVE", "elect4", 0, 0.1}, {nil},
+		{"ELECT", "elect4", "alice", 10000}, {"1"},
+		{"OBSERVE", "elect4", 0, 0.1}, {func(v interface{}) (resp, expect interface{}) {
+			vals := v.([]string)
+			return fmt.Sprint(vals[:3]), "[alice 1 1]"
+		}},
+		{"OBSERVE", "elect4", 1, 0.1}, {nil},
+		{"OBSERVE", "elect4", 1, "a"}, {"ERR timeout is not a float or out of range"},
+	}); err != nil {
+		return err
+	}
+	// change the leader from a different connection while the current one
+	// is blocked.
+	port := mc.cs.port
+	errc := make(chan error, 1)
+	go func() {
+		time.Sleep(time.Second / 4)
+		conn, err := redis.Dial("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		_, err = conn.Do("RESIGN", "elect4", "alice", 1)
+		errc <- err
+	}()
+	if err := mc.DoExpect("[]", "OBSERVE", "elect4", 1, 5); err != nil {
+		return err
+	}
+	return <-errc
+}
@@ -0,0 +1,118 @@
+package machine
+
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// Keys are expired through the Raft log, like any other write. Every node is
+// told by buntdb which of its keys have expired, but only the leader is able
+// to propose their removal. The proposal carries the leader's clock, and a
+// key is only removed when it has expired as of that time. A key that was
+// written again after the proposal was made is left alone.
+
+// expiredCommand is the internal command that removes expired keys. It's
+// not available to clients.
+const expiredCommand = "sdbexpired"
+
+// expiredConn is the connection that proposes expired keys. It stands in for
+// a client because the applier only proposes commands that have one.
+type expiredConn struct {
+	passiveConn
+}
+
+// onExpired is called by buntdb with keys that have expired on this node.
+func (m *Machine) onExpired(keys []string) {
+	a, _ := m.applier.Load().(finn.Applier)
+	if a == nil {
+		// nothing has been received from the Raft node yet.
+		return
+	}
+	m.log.Debugf("expire: %v", keys)
+	args := make([][]byte, 0, len(keys)+1)
+	args = append(args, []byte(expiredCommand))
+	for _, key := range keys {
+		args = append(args, []byte(key))
+	}
+	_, err := m.doExpired(a, &expiredConn{}, buildCommand(args), nil)
+	if err != nil {
+		if err == raft.ErrNotLeader {
+			// the leader will remove the keys.
+			return
+		}
+		m.log.Warningf("expire: %v", err)
+	}
+}
+
+// expireKey removes a key that has expired as of the clock. Returns false
+// when the key does not exist or has not expired.
+func expireKey(tx *buntdb.Tx, key string, clock int64) (bool, error) {
+	ttl, err := tx.TTL(key)
+	if err == nil {
+		if ttl < 0 {
+			return false, nil
+		}
+		at := time.Now().Add(ttl).UnixNano() / int64(time.Millisecond)
+		if at > clock {
+			return false, nil
+		}
+	} else if err != buntdb.ErrNotFound {
+		return false, err
+	}
+	// buntdb hides expired keys, but they're still seen when iterating.
+	var exists bool
+	if err := tx.AscendGreaterOrEqual("", key, func(k, _ string) bool {
+		exists = k == key
+		return false
+	}); err != nil {
+		return false, err
+	}
+	if _, err := deleteKey(tx, key); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func (m *Machine) doExpired(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SDBEXPIRED key [key ...]
+	if conn != nil {
+		if _, ok := conn.(*expiredConn); !ok {
+			return nil, finn.ErrUnknownCommand
+		}
+	}
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		clock, err := txNow(tx)
+		if err != nil {
+			return nil, err
+		}
+		var n int
+		for i := 1; i < len(cmd.Args); i++ {
+			key := string(cmd.Args[i])
+			ok, err := expireKey(tx, key, clock)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				// meta keys, such as locks, aren't visible to clients.
+				if !isMercMetaKey(key) {
+					m.notify(notifyExpired, "expired", key)
+				} else {
+					// wake up the observers of an election.
+					m.signalKey(key)
+				}
+				n++
+			}
+		}
+		return n, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
@@ -0,0 +1,281 @@
+package machine
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/hashicorp/raft"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/redcon"
+)
+
+// A follower normally replies to a command that must run on the leader with
+// a "TRY addr" error, and leaves it to the client to connect to the leader.
+// When forwarding is enabled, the follower sends the command to the leader
+// over a pooled connection instead, and relays the reply to the client.
+
+const (
+	forwardConnectTimeout = time.Second * 5  // connecting to the leader
+	forwardTimeout        = time.Second * 15 // reading or writing a reply
+	forwardMaxActive      = 64               // connections to each server
+)
+
+// errForwarded is returned once the reply from the leader has been written
+// to the client. No other reply must be written.
+var errForwarded = errors.New("forwarded")
+
+// forwarder sends commands to the leader.
+type forwarder struct {
+	leader func() string               // returns the address of the leader
+	setup  func(conn redis.Conn) error // prepares a new connection, or nil
+	opts   []redis.DialOption          // options for dialing a server
+
+	mu     sync.Mutex
+	pools  map[string]*redis.Pool // connections for commands
+	bpools map[string]*redis.Pool // connections for blocking commands
+}
+
+func newForwarder(leader func() string, opts []redis.DialOption) *forwarder {
+	return &forwarder{
+		leader: leader,
+		opts:   opts,
+		pools:  make(map[string]*redis.Pool),
+		bpools: make(map[string]*redis.Pool),
+	}
+}
+
+// SetForwarding enables forwarding of commands from a follower to the
+// leader. The leader function returns the address of the current leader.
+// The options are used for dialing the leader, such as DialPassword or a
+// DialNetDial that uses TLS. A nil function turns forwarding off.
+func (m *Machine) SetForwarding(leader func() string, opts ...redis.DialOption) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if leader == nil {
+		m.fw = nil
+	} else {
+		m.fw = newForwarder(leader, opts)
+	}
+}
+
+func (m *Machine) forwarder() *forwarder {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.fw
+}
+
+// forwarding returns true when a command that failed with the error should
+// be forwarded to the leader. Only commands from clients are forwarded.
+func (m *Machine) forwarding(conn redcon.Conn, tx *buntdb.Tx, err error) bool {
+	if err != raft.ErrNotLeader || conn == nil || tx != nil {
+		return false
+	}
+	if _, ok := conn.Context().(*connContext); !ok {
+		return false
+	}
+	return m.forwarder() != nil
+}
+
+// pool returns the connections to a server. The connections for blocking
+// commands have no read timeout, and a command doesn't wait for one when
+// all of them are in use.
+func (f *forwarder) pool(addr string, block bool) *redis.Pool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pools := f.pools
+	if block {
+		pools = f.bpools
+	}
+	pool := pools[addr]
+	if pool == nil {
+		opts := []redis.DialOption{
+			redis.DialConnectTimeout(forwardConnectTimeout),
+			redis.DialWriteTimeout(forwardTimeout),
+		}
+		if !block {
+			opts = append(opts, redis.DialReadTimeout(forwardTimeout))
+		}
+		opts = append(opts, f.opts...)
+		pool = &redis.Pool{
+			MaxIdle:     16,
+			MaxActive:   forwardMaxActive,
+			Wait:        !block,
+			IdleTimeout: time.Minute,
+			Dial: func() (redis.Conn, error) {
+				conn, err := redis.Dial("tcp", addr, opts...)
+				if err != nil {
+					return nil, err
+				}
+				if f.setup != nil {
+					if err := f.setup(conn); err != nil {
+						conn.Close()
+						return nil, err
+					}
+				}
+				return conn, nil
+			},
+		}
+		pools[addr] = pool
+	}
+	return pool
+}
+
+// conn returns a connection to a server. When no connection can be made,
+// the error is ErrNotLeader, so that the client is told to try the leader
+// itself.
+func (f *forwarder) conn(addr string, block bool) (redis.Conn, error) {
+	conn := f.pool(addr, block).Get()
+	if conn.Err() != nil {
+		conn.Close()
+		return nil, raft.ErrNotLeader
+	}
+	return conn, nil
+}
+
+// blocking returns true for a command that may block on the server.
+func blocking(cmd redcon.Command) bool {
+	switch qcmdlower(cmd.Args[0]) {
+	case "blpop", "brpop":
+		return true
+	case "xread", "xreadgroup":
+		for _, arg := range cmd.Args[1:] {
+			if qcmdlower(arg) == "block" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forward sends a command to the leader and writes the reply to the client.
+func (m *Machine) forward(conn redcon.Conn, cmd redcon.Command) error {
+	f := m.forwarder()
+	leader := f.leader()
+	if leader == "" || leader == m.addr {
+		return raft.ErrNotLeader
+	}
+	return f.forward(conn, cmd, leader)
+}
+
+// forward sends a command to a server and writes the reply to the client.
+// Pipelined GETs and SETs are sent as a single MGET or MSET, and the reply
+// is written as one reply per command. Other pipelined commands are sent
+// as a pipeline.
+func (f *forwarder) forward(conn redcon.Conn, cmd redcon.Command, addr string) error {
+	name := qcmdlower(cmd.Args[0])
+	if name == "plwpipe" {
+		return f.forwardPipeline(conn, cmd.Args[1:], addr)
+	}
+	args := make([]interface{}, 0, len(cmd.Args)-1)
+	for _, arg := range cmd.Args[1:] {
+		args = append(args, arg)
+	}
+	switch name {
+	case "plget":
+		name = "mget"
+	case "plset":
+		name = "mset"
+	}
+	rconn, err := f.conn(addr, blocking(cmd))
+	if err != nil {
+		return err
+	}
+	defer rconn.Close()
+	reply, err := rconn.Do(name, args...)
+	if err != nil {
+		if _, ok := err.(redis.Error); !ok {
+			return err
+		}
+		reply = err
+	}
+	switch qcmdlower(cmd.Args[0]) {
+	default:
+		writeForwarded(conn, reply)
+	case "plget":
+		if vals, ok := reply.([]interface{}); ok {
+			for _, val := range vals {
+				writeForwarded(conn, val)
+			}
+		} else {
+			writeForwarded(conn, reply)
+		}
+	case "plset":
+		for i := 1; i < len(cmd.Args); i += 2 {
+			writeForwarded(conn, reply)
+		}
+	}
+	return errForwarded
+}
+
+// forwardPipeline sends the commands of a PLWPIPE to a server as a pipeline
+// and writes each reply to the client. Once the commands are sent, there is
+// a reply for each command, and a command without a reply from the server
+// gets an error.
+func (f *forwarder) forwardPipeline(conn redcon.Conn, raws [][]byte, addr string) error {
+	cmds := make([]redcon.Command, 0, len(raws))
+	for _, raw := range raws {
+		cmd, err := parseCommand(raw)
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds, cmd)
+	}
+	rconn, err := f.conn(addr, false)
+	if err != nil {
+		return err
+	}
+	defer rconn.Close()
+	for _, cmd := range cmds {
+		args := make([]interface{}, 0, len(cmd.Args)-1)
+		for _, arg := range cmd.Args[1:] {
+			args = append(args, arg)
+		}
+		if err = rconn.Send(string(cmd.Args[0]), args...); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = rconn.Flush()
+	}
+	var n int
+	for ; err == nil && n < len(cmds); n++ {
+		reply, rerr := rconn.Receive()
+		if rerr != nil {
+			if _, ok := rerr.(redis.Error); !ok {
+				err = rerr
+				break
+			}
+			reply = rerr
+		}
+		writeForwarded(conn, reply)
+	}
+	for ; n < len(cmds); n++ {
+		conn.WriteError("ERR forwarding to the leader failed: " + err.Error())
+	}
+	return errForwarded
+}
+
+// writeForwarded writes a reply from the leader to the client.
+func writeForwarded(conn redcon.Conn, reply interface{}) {
+	switch v := reply.(type) {
+	default:
+		conn.WriteError("ERR invalid response")
+	case string:
+		conn.WriteString(v)
+	case int64:
+		conn.WriteInt64(v)
+	case []byte:
+		conn.WriteBulk(v)
+	case redis.Error:
+		conn.WriteError(v.Error())
+	case nil:
+		conn.WriteNull()
+	case []interface{}:
+		conn.WriteArray(len(v))
+		for _, v := range v {
+			writeForwarded(conn, v)
+		}
+	}
+}
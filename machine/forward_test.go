@@ -0,0 +1,195 @@
+package machine
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func subTestForward(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "commands", forward_commands_test)
+	runStep(t, mc, "pipeline", forward_pipeline_test)
+	runStep(t, mc, "MULTI", forward_MULTI_test)
+	runStep(t, mc, "blocking", forward_blocking_test)
+	runStep(t, mc, "unreachable", forward_unreachable_test)
+	runStep(t, mc, "broken", forward_broken_test)
+}
+
+// forwardFollower runs a step on a follower that forwards to the leader.
+func forwardFollower(mc *mockCluster, step func(s *mockServer) error) error {
+	s, err := mc.Follower()
+	if err != nil {
+		return err
+	}
+	s.m.SetForwarding(s.n.Leader)
+	defer s.m.SetForwarding(nil)
+	return step(s)
+}
+
+func forwardExpect(resps []interface{}, expect string) error {
+	resp := fmt.Sprintf("%v", normalize(resps))
+	if resp != expect {
+		return fmt.Errorf("expected '%v', got '%v'", expect, resp)
+	}
+	return nil
+}
+
+func forward_commands_test(mc *mockCluster) error {
+	return forwardFollower(mc, func(s *mockServer) error {
+		resps, err := s.DoPipeline([][]interface{}{{"SET", "mykey", "1"}})
+		if err != nil {
+			return err
+		}
+		if err := forwardExpect(resps, "[OK]"); err != nil {
+			return err
+		}
+		var cmds [][]interface{}
+		cmds = append(cmds, []interface{}{"INCR", "mykey"})
+		cmds = append(cmds, []interface{}{"GET", "mykey"})
+		cmds = append(cmds, []interface{}{"HSET", "mykey", "a", "1"})
+		cmds = append(cmds, []interface{}{"LPUSH", "mylist", "a", "b"})
+		cmds = append(cmds, []interface{}{"LRANGE", "mylist", 0, -1})
+		cmds = append(cmds, []interface{}{"GET", "nokey"})
+		resps, err = s.DoPipeline(cmds)
+		if err != nil {
+			return err
+		}
+		return forwardExpect(resps, "[2 2 WRONGTYPE Operation against a key holding the wrong kind of value 2 [b a] <nil>]")
+	})
+}
+
+func forward_pipeline_test(mc *mockCluster) error {
+	return forwardFollower(mc, func(s *mockServer) error {
+		var cmds [][]interface{}
+		for i := 0; i < 3; i++ {
+			cmds = append(cmds, []interface{}{"SET", fmt.Sprintf("key%d", i), fmt.Sprintf("val%d", i)})
+		}
+		resps, err := s.DoPipeline(cmds)
+		if err != nil {
+			return err
+		}
+		if err := forwardExpect(resps, "[OK OK OK]"); err != nil {
+			return err
+		}
+		cmds = nil
+		for i := 0; i < 4; i++ {
+			cmds = append(cmds, []interface{}{"GET", fmt.Sprintf("key%d", i)})
+		}
+		resps, err = s.DoPipeline(cmds)
+		if err != nil {
+			return err
+		}
+		return forwardExpect(resps, "[val0 val1 val2 <nil>]")
+	})
+}
+
+func forward_MULTI_test(mc *mockCluster) error {
+	return forwardFollower(mc, func(s *mockServer) error {
+		resps, err := s.DoPipeline([][]interface{}{
+			{"SET", "mykey", "1"},
+			{"MULTI"},
+			{"INCR", "mykey"},
+			{"GET", "mykey"},
+			{"EXEC"},
+		})
+		if err != nil {
+			return err
+		}
+		if err := forwardExpect(resps, "[OK OK QUEUED QUEUED [2 2]]"); err != nil {
+			return err
+		}
+		resps, err = s.DoPipeline([][]interface{}{
+			{"WATCH", "mykey"},
+			{"INCR", "mykey"},
+			{"MULTI"},
+			{"INCR", "mykey"},
+			{"EXEC"},
+		})
+		if err != nil {
+			return err
+		}
+		return forwardExpect(resps, "[OK 3 OK QUEUED <nil>]")
+	})
+}
+
+func forward_blocking_test(mc *mockCluster) error {
+	return forwardFollower(mc, func(s *mockServer) error {
+		leader := mc.cs
+		go func() {
+			time.Sleep(time.Millisecond * 200)
+			leader.Do("RPUSH", "mylist", "a")
+		}()
+		resps, err := s.DoPipeline([][]interface{}{{"BLPOP", "mylist", 5}})
+		if err != nil {
+			return err
+		}
+		return forwardExpect(resps, "[[mylist a]]")
+	})
+}
+
+func forward_unreachable_test(mc *mockCluster) error {
+	s, err := mc.Follower()
+	if err != nil {
+		return err
+	}
+	// the client is told to try the leader itself.
+	s.m.SetForwarding(func() string { return ":1" })
+	defer s.m.SetForwarding(nil)
+	resps, err := s.DoPipeline([][]interface{}{{"SET", "mykey", "1"}})
+	if err != nil {
+		return err
+	}
+	return forwardExpect(resps, fmt.Sprintf("[TRY %s]", s.n.Leader()))
+}
+
+func forward_broken_test(mc *mockCluster) error {
+	s, err := mc.Follower()
+	if err != nil {
+		return err
+	}
+	// a leader that replies to the first command of a pipeline and then
+	// closes the connection.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 4096)
+			conn.Read(buf)
+			conn.Write([]byte("+OK\r\n"))
+			conn.Close()
+		}
+	}()
+	s.m.SetForwarding(func() string { return ln.Addr().String() })
+	defer s.m.SetForwarding(nil)
+	resps, err := s.DoPipeline([][]interface{}{
+		{"SET", "key1", "val1"},
+		{"INCR", "key2"},
+		{"DEL", "key3"},
+	})
+	if err != nil {
+		return err
+	}
+	// every command has a reply, and the next command gets its own.
+	if fmt.Sprintf("%v", resps[0]) != "OK" {
+		return fmt.Errorf("expected 'OK', got '%v'", resps[0])
+	}
+	for _, resp := range resps[1:] {
+		if !strings.HasPrefix(fmt.Sprintf("%v", resp), "ERR forwarding to the leader failed") {
+			return fmt.Errorf("expected a forwarding error, got '%v'", resp)
+		}
+	}
+	resps, err = s.DoPipeline([][]interface{}{{"PING"}})
+	if err != nil {
+		return err
+	}
+	return forwardExpect(resps, "[PONG]")
+}
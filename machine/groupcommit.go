@@ -0,0 +1,210 @@
+package machine
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// Group commit merges the writes of many client connections into a single
+// PLGROUP entry in the raft log, which is then stored and fsynced once. The
+// first write to arrive waits for the window, or until the writes that
+// joined it reach the byte budget, and then applies the group. The replies
+// of each write are returned to the connection that sent it.
+
+// DefaultGroupCommitBytes is the number of bytes of commands that are
+// merged before a group is applied without waiting for the window.
+const DefaultGroupCommitBytes = 1024 * 1024
+
+// groupCommitter merges writes from connections into groups.
+type groupCommitter struct {
+	window   time.Duration // how long the first write waits for others
+	maxBytes int           // the size of the commands that fill a group
+
+	mu      sync.Mutex
+	pending *commitGroup // the group that writes join, or nil
+}
+
+// commitGroup is the writes that are applied as a single command.
+type commitGroup struct {
+	members [][]byte        // the raw command of each write
+	size    int             // the size of the members
+	full    chan struct{}   // closed when the group is full
+	done    chan struct{}   // closed once the group is applied
+	resps   [][]interface{} // the replies of each member
+	err     error           // the error from applying the group
+}
+
+// SetGroupCommit enables group commit on the leader. Writes that arrive
+// within the window are merged, up to maxBytes of commands. Zero for
+// maxBytes is DefaultGroupCommitBytes. A zero window turns it off. Group
+// commit isn't used when the keyspace is sharded.
+func (m *Machine) SetGroupCommit(window time.Duration, maxBytes int) error {
+	if window < 0 {
+		return errors.New("group commit window must be >= 0")
+	}
+	if maxBytes < 0 {
+		return errors.New("group commit bytes must be >= 0")
+	}
+	if maxBytes == 0 {
+		maxBytes = DefaultGroupCommitBytes
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if window == 0 {
+		m.gc = nil
+	} else {
+		m.gc = &groupCommitter{window: window, maxBytes: maxBytes}
+	}
+	return nil
+}
+
+func (m *Machine) groupCommitter() *groupCommitter {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.gc
+}
+
+// groupable returns true when a command from a client can join a group. A
+// command is a single write, or a PLWPIPE from a pipeline.
+func (m *Machine) groupable(pn int, cmd redcon.Command) bool {
+	if pn > 0 {
+		return qcmdlower(cmd.Args[0]) == "plwpipe"
+	}
+	return m.pipelineWrites([]redcon.Command{cmd})
+}
+
+// groupCommit adds the command to a group and writes its replies to the
+// client once the group is applied. Only the leader groups writes, a
+// follower forwards or redirects them without waiting for the window.
+func (m *Machine) groupCommit(gc *groupCommitter, a finn.Applier, conn redcon.Conn, cmd redcon.Command) error {
+	gc.mu.Lock()
+	g := gc.pending
+	lead := g == nil
+	if lead {
+		g = &commitGroup{full: make(chan struct{}), done: make(chan struct{})}
+		gc.pending = g
+	}
+	i := len(g.members)
+	g.members = append(g.members, cmd.Raw)
+	g.size += len(cmd.Raw)
+	if g.size >= gc.maxBytes {
+		// no more writes may join.
+		gc.pending = nil
+		close(g.full)
+	}
+	gc.mu.Unlock()
+
+	if lead {
+		timer := time.NewTimer(gc.window)
+		select {
+		case <-timer.C:
+		case <-g.full:
+			timer.Stop()
+		}
+		gc.mu.Lock()
+		if gc.pending == g {
+			gc.pending = nil
+		}
+		gc.mu.Unlock()
+		g.resps, g.err = m.applyGroup(a, g.members)
+		close(g.done)
+	} else {
+		<-g.done
+	}
+	if g.err != nil {
+		if m.forwarding(conn, nil, g.err) {
+			// this is a follower.
+			return m.forward(conn, cmd)
+		}
+		return g.err
+	}
+	writePassiveResps(conn, g.resps[i])
+	return nil
+}
+
+// applyGroup applies the members of a group as a single PLGROUP command,
+// and returns the replies of each member.
+func (m *Machine) applyGroup(a finn.Applier, members [][]byte) ([][]interface{}, error) {
+	args := make([][]byte, 0, len(members)+1)
+	args = append(args, []byte("plgroup"))
+	args = append(args, members...)
+	cmd := buildCommand(args)
+	groups, err := parseGroup(cmd)
+	if err != nil {
+		return nil, err
+	}
+	var resps [][]interface{}
+	// the command doesn't belong to the connection of any member.
+	_, err = m.writeDoApply(a, &passiveConn{}, cmd, nil, func(tx *buntdb.Tx) (interface{}, error) {
+		return m.runGroup(tx, groups), nil
+	}, func(v interface{}) error {
+		resps = v.([][]interface{})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resps, nil
+}
+
+// doPlgroup applies a group of writes from the log.
+func (m *Machine) doPlgroup(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// PLGROUP cmd [cmd ...]
+	if conn != nil {
+		// only the leader creates a group.
+		return nil, finn.ErrUnknownCommand
+	}
+	groups, err := parseGroup(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		return m.runGroup(tx, groups), nil
+	}, func(v interface{}) error {
+		return nil
+	})
+}
+
+// parseGroup returns the commands of each member of a PLGROUP command. A
+// member that is a PLWPIPE has the commands of the pipeline.
+func parseGroup(cmd redcon.Command) ([][]redcon.Command, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	groups := make([][]redcon.Command, 0, len(cmd.Args)-1)
+	for _, raw := range cmd.Args[1:] {
+		mcmd, err := parseCommand(raw)
+		if err != nil {
+			return nil, err
+		}
+		if qcmdlower(mcmd.Args[0]) != "plwpipe" {
+			groups = append(groups, []redcon.Command{mcmd})
+			continue
+		}
+		cmds := make([]redcon.Command, 0, len(mcmd.Args)-1)
+		for _, raw := range mcmd.Args[1:] {
+			pcmd, err := parseCommand(raw)
+			if err != nil {
+				return nil, err
+			}
+			cmds = append(cmds, pcmd)
+		}
+		groups = append(groups, cmds)
+	}
+	return groups, nil
+}
+
+// runGroup runs the commands of each member, and returns the replies of
+// each member. An error only fails the command that returned it.
+func (m *Machine) runGroup(tx *buntdb.Tx, groups [][]redcon.Command) [][]interface{} {
+	resps := make([][]interface{}, len(groups))
+	for i, cmds := range groups {
+		resps[i] = m.runCommands(tx, cmds)
+	}
+	return resps
+}
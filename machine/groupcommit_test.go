@@ -0,0 +1,195 @@
+package machine
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func subTestGroupCommit(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "concurrent", groupCommit_concurrent_test)
+	runStep(t, mc, "pipeline", groupCommit_pipeline_test)
+	runStep(t, mc, "follower", groupCommit_follower_test)
+}
+
+// groupCommit runs a step with group commit enabled on every server.
+func groupCommit(mc *mockCluster, step func() error) error {
+	for _, s := range mc.ss {
+		if err := s.m.SetGroupCommit(time.Millisecond*100, 0); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		for _, s := range mc.ss {
+			s.m.SetGroupCommit(0, 0)
+		}
+	}()
+	return step()
+}
+
+// groupCommitLeader returns the leader and the index of its last log entry.
+func groupCommitLeader(mc *mockCluster) (*mockServer, int, error) {
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "mykey", "0"}, {"OK"},
+	}); err != nil {
+		return nil, 0, err
+	}
+	stats, err := redis.StringMap(mc.cs.Do("RAFTSTATS"))
+	if err != nil {
+		return nil, 0, err
+	}
+	index, err := strconv.Atoi(stats["last_log_index"])
+	if err != nil {
+		return nil, 0, err
+	}
+	return mc.cs, index, nil
+}
+
+func groupCommit_concurrent_test(mc *mockCluster) error {
+	s, index, err := groupCommitLeader(mc)
+	if err != nil {
+		return err
+	}
+	const n = 20
+	return groupCommit(mc, func() error {
+		// open the connections first, so that the writes arrive together.
+		conns := make([]redis.Conn, n)
+		for i := range conns {
+			conn, err := redis.Dial("tcp", fmt.Sprintf(":%d", s.port))
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			conns[i] = conn
+		}
+		var wg sync.WaitGroup
+		vals := make([]int, n)
+		errs := make([]error, n)
+		for i := range conns {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				vals[i], errs[i] = redis.Int(conns[i].Do("INCR", "mykey"))
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+		// each connection has its own reply.
+		sort.Ints(vals)
+		for i, val := range vals {
+			if val != i+1 {
+				return fmt.Errorf("expected '%d', got '%d'", i+1, val)
+			}
+		}
+		stats, err := redis.StringMap(s.Do("RAFTSTATS"))
+		if err != nil {
+			return err
+		}
+		last, err := strconv.Atoi(stats["last_log_index"])
+		if err != nil {
+			return err
+		}
+		if last-index >= n {
+			return fmt.Errorf("expected less than %d log entries, got %d", n, last-index)
+		}
+		return nil
+	})
+}
+
+func groupCommit_pipeline_test(mc *mockCluster) error {
+	s, _, err := groupCommitLeader(mc)
+	if err != nil {
+		return err
+	}
+	return groupCommit(mc, func() error {
+		conn, err := redis.Dial("tcp", fmt.Sprintf(":%d", s.port))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		var wg sync.WaitGroup
+		var single interface{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			single, _ = conn.Do("SET", "other", "1")
+		}()
+		resps, err := s.DoPipeline([][]interface{}{
+			{"INCR", "mykey"},
+			{"HSET", "mykey", "a", "1"},
+			{"INCR", "mykey"},
+		})
+		if err != nil {
+			return err
+		}
+		wg.Wait()
+		if single != "OK" {
+			return fmt.Errorf("expected 'OK', got '%v'", single)
+		}
+		return forwardExpect(resps, "[1 WRONGTYPE Operation against a key holding the wrong kind of value 2]")
+	})
+}
+
+func groupCommit_follower_test(mc *mockCluster) error {
+	return groupCommit(mc, func() error {
+		s, err := mc.Follower()
+		if err != nil {
+			return err
+		}
+		resps, err := s.DoPipeline([][]interface{}{
+			{"SET", "mykey", "1"},
+			{"INCR", "mykey"},
+		})
+		if err != nil {
+			return err
+		}
+		leader := s.n.Leader()
+		if err := forwardExpect(resps, fmt.Sprintf("[TRY %[1]s TRY %[1]s]", leader)); err != nil {
+			return err
+		}
+		// a follower doesn't hold writes for the window.
+		if err := s.m.SetGroupCommit(time.Second*10, 0); err != nil {
+			return err
+		}
+		start := time.Now()
+		resps, err = s.DoPipeline([][]interface{}{{"SET", "mykey", "1"}})
+		if err != nil {
+			return err
+		}
+		if err := forwardExpect(resps, fmt.Sprintf("[TRY %s]", leader)); err != nil {
+			return err
+		}
+		if time.Since(start) > time.Second*5 {
+			return fmt.Errorf("expected the follower to reply before the window, took %v", time.Since(start))
+		}
+		if err := s.m.SetGroupCommit(time.Millisecond*100, 0); err != nil {
+			return err
+		}
+		return forwardFollower(mc, func(s *mockServer) error {
+			resps, err := s.DoPipeline([][]interface{}{{"SET", "mykey", "1"}})
+			if err != nil {
+				return err
+			}
+			if err := forwardExpect(resps, "[OK]"); err != nil {
+				return err
+			}
+			resps, err = s.DoPipeline([][]interface{}{
+				{"INCR", "mykey"},
+				{"INCR", "mykey"},
+			})
+			if err != nil {
+				return err
+			}
+			return forwardExpect(resps, "[2 3]")
+		})
+	})
+}
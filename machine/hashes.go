@@ -0,0 +1,349 @@
+package machine
+
+import (
+	"errors"
+	"math"
+	"strconv"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+var errHashNotAnInt = errors.New("ERR hash value is not an integer")
+var errHashNotAFloat = errors.New("ERR hash value is not a float")
+
+func (m *Machine) doHset(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// HSET key field value [field value ...]
+	if len(cmd.Args) < 4 || (len(cmd.Args)-2)%2 == 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := txGetHeaderForUpdate(tx, key, "hash")
+		if err != nil {
+			return nil, err
+		}
+		prefix := memberKeyPrefix("hash", key)
+		var n int
+		for i := 2; i < len(cmd.Args); i += 2 {
+			_, replaced, err := tx.Set(prefix+string(cmd.Args[i]), string(cmd.Args[i+1]), nil)
+			if err != nil {
+				return nil, err
+			}
+			if !replaced {
+				n++
+			}
+		}
+		if n > 0 {
+			h.count += n
+			if err := txSetHeader(tx, key, h); err != nil {
+				return nil, err
+			}
+		}
+		m.notify(notifyHash, "hset", key)
+		return n, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+func (m *Machine) doHget(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// HGET key field
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "hash")
+		if err != nil {
+			return err
+		}
+		if h.count == 0 {
+			conn.WriteNull()
+			return nil
+		}
+		val, err := tx.Get(memberKeyPrefix("hash", key) + string(cmd.Args[2]))
+		if err != nil {
+			if err == buntdb.ErrNotFound {
+				conn.WriteNull()
+				return nil
+			}
+			return err
+		}
+		conn.WriteBulkString(val)
+		return nil
+	})
+}
+
+func (m *Machine) doHmget(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// HMGET key field [field ...]
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "hash")
+		if err != nil {
+			return err
+		}
+		prefix := memberKeyPrefix("hash", key)
+		vals := make([]*string, 0, len(cmd.Args)-2)
+		for i := 2; i < len(cmd.Args); i++ {
+			if h.count == 0 {
+				vals = append(vals, nil)
+				continue
+			}
+			val, err := tx.Get(prefix + string(cmd.Args[i]))
+			if err != nil {
+				if err == buntdb.ErrNotFound {
+					vals = append(vals, nil)
+					continue
+				}
+				return err
+			}
+			vals = append(vals, &val)
+		}
+		conn.WriteArray(len(vals))
+		for _, val := range vals {
+			if val == nil {
+				conn.WriteNull()
+			} else {
+				conn.WriteBulkString(*val)
+			}
+		}
+		return nil
+	})
+}
+
+func (m *Machine) doHgetall(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// HGETALL key
+	// HKEYS key
+	// HVALS key
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	var fields, vals bool
+	switch qcmdlower(cmd.Args[0]) {
+	default:
+		return nil, finn.ErrUnknownCommand
+	case "hgetall":
+		fields, vals = true, true
+	case "hkeys":
+		fields = true
+	case "hvals":
+		vals = true
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "hash")
+		if err != nil {
+			return err
+		}
+		var results []string
+		if h.count > 0 {
+			if err := scanMembers(tx, "hash", key, func(field, val string) bool {
+				if fields {
+					results = append(results, field)
+				}
+				if vals {
+					results = append(results, val)
+				}
+				return true
+			}); err != nil {
+				return err
+			}
+		}
+		conn.WriteArray(len(results))
+		for _, result := range results {
+			conn.WriteBulkString(result)
+		}
+		return nil
+	})
+}
+
+func (m *Machine) doHdel(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// HDEL key field [field ...]
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := txGetHeader(tx, key, "hash")
+		if err != nil {
+			return nil, err
+		}
+		if h.count == 0 {
+			return 0, nil
+		}
+		prefix := memberKeyPrefix("hash", key)
+		var n int
+		for i := 2; i < len(cmd.Args); i++ {
+			if _, err := tx.Delete(prefix + string(cmd.Args[i])); err != nil {
+				if err == buntdb.ErrNotFound {
+					continue
+				}
+				return nil, err
+			}
+			n++
+		}
+		if n > 0 {
+			h.count -= n
+			if err := txSetHeader(tx, key, h); err != nil {
+				return nil, err
+			}
+			m.notify(notifyHash, "hdel", key)
+			if h.count == 0 {
+				m.notify(notifyGeneric, "del", key)
+			}
+		}
+		return n, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+func (m *Machine) doHexists(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// HEXISTS key field
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "hash")
+		if err != nil {
+			return err
+		}
+		if h.count == 0 {
+			conn.WriteInt(0)
+			return nil
+		}
+		_, err = tx.Get(memberKeyPrefix("hash", key) + string(cmd.Args[2]))
+		if err != nil {
+			if err == buntdb.ErrNotFound {
+				conn.WriteInt(0)
+				return nil
+			}
+			return err
+		}
+		conn.WriteInt(1)
+		return nil
+	})
+}
+
+func (m *Machine) doHlen(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// HLEN key
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "hash")
+		if err != nil {
+			return err
+		}
+		conn.WriteInt(h.count)
+		return nil
+	})
+}
+
+func (m *Machine) doHincrby(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// HINCRBY key field increment
+	if len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	amt, err := strconv.ParseInt(string(cmd.Args[3]), 10, 64)
+	if err != nil {
+		return nil, errNotAnInt
+	}
+	key := string(cmd.Args[1])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := txGetHeaderForUpdate(tx, key, "hash")
+		if err != nil {
+			return nil, err
+		}
+		mkey := memberKeyPrefix("hash", key) + string(cmd.Args[2])
+		val, err := tx.Get(mkey)
+		if err != nil && err != buntdb.ErrNotFound {
+			return nil, err
+		}
+		var n int64
+		if err == nil {
+			n, err = strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return nil, errHashNotAnInt
+			}
+		}
+		if (amt < 0 && n < math.MinInt64-amt) || (amt > 0 && n > math.MaxInt64-amt) {
+			return nil, errors.New("ERR increment or decrement would overflow")
+		}
+		n += amt
+		_, replaced, err := tx.Set(mkey, strconv.FormatInt(n, 10), nil)
+		if err != nil {
+			return nil, err
+		}
+		if !replaced {
+			h.count++
+			if err := txSetHeader(tx, key, h); err != nil {
+				return nil, err
+			}
+		}
+		m.notify(notifyHash, "hincrby", key)
+		return n, nil
+	}, func(v interface{}) error {
+		conn.WriteInt64(v.(int64))
+		return nil
+	})
+}
+
+func (m *Machine) doHincrbyfloat(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// HINCRBYFLOAT key field increment
+	if len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	amt, err := strconv.ParseFloat(string(cmd.Args[3]), 64)
+	if err != nil {
+		return nil, errNotAFloat
+	}
+	key := string(cmd.Args[1])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := txGetHeaderForUpdate(tx, key, "hash")
+		if err != nil {
+			return nil, err
+		}
+		mkey := memberKeyPrefix("hash", key) + string(cmd.Args[2])
+		val, err := tx.Get(mkey)
+		if err != nil && err != buntdb.ErrNotFound {
+			return nil, err
+		}
+		var n float64
+		if err == nil {
+			n, err = strconv.ParseFloat(val, 64)
+			if err != nil {
+				return nil, errHashNotAFloat
+			}
+		}
+		n += amt
+		if math.IsNaN(n) || math.IsInf(n, +1) || math.IsInf(n, -1) {
+			return nil, errors.New("ERR increment would produce NaN or Infinity")
+		}
+		val = strconv.FormatFloat(n, 'f', -1, 64)
+		_, replaced, err := tx.Set(mkey, val, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !replaced {
+			h.count++
+			if err := txSetHeader(tx, key, h); err != nil {
+				return nil, err
+			}
+		}
+		m.notify(notifyHash, "hincrbyfloat", key)
+		return val, nil
+	}, func(v interface{}) error {
+		conn.WriteBulkString(v.(string))
+		return nil
+	})
+}
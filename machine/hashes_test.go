@@ -0,0 +1,138 @@
+package machine
+
+import (
+	"testing"
+	"time"
+)
+
+func subTestHashes(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "HSET", hashes_HSET_test)
+	runStep(t, mc, "HMGET", hashes_HMGET_test)
+	runStep(t, mc, "HGETALL", hashes_HGETALL_test)
+	runStep(t, mc, "HDEL", hashes_HDEL_test)
+	runStep(t, mc, "HINCRBY", hashes_HINCRBY_test)
+	runStep(t, mc, "HINCRBYFLOAT", hashes_HINCRBYFLOAT_test)
+	runStep(t, mc, "TYPE", hashes_TYPE_test)
+	runStep(t, mc, "keys", hashes_KEYS_test)
+	runStep(t, mc, "EXPIRE", hashes_EXPIRE_test)
+	runStep(t, mc, "MULTI", hashes_MULTI_test)
+}
+
+func hashes_HSET_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"HSET", "myhash", "field1", "Hello"}, {1},
+		{"HSET", "myhash", "field1", "World", "field2", "!"}, {1},
+		{"HGET", "myhash", "field1"}, {"World"},
+		{"HGET", "myhash", "field3"}, {nil},
+		{"HGET", "nohash", "field1"}, {nil},
+		{"HEXISTS", "myhash", "field2"}, {1},
+		{"HEXISTS", "myhash", "field3"}, {0},
+		{"HLEN", "myhash"}, {2},
+		{"HLEN", "nohash"}, {0},
+		{"HSET", "myhash", "field1"}, {"ERR wrong number of arguments for 'HSET' command"},
+	})
+}
+func hashes_HMGET_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"HSET", "myhash", "field1", "Hello", "field2", "World"}, {2},
+		{"HMGET", "myhash", "field1", "field2", "nofield"}, {"[Hello World nil]"},
+		{"HMGET", "nohash", "field1"}, {"[nil]"},
+	})
+}
+func hashes_HGETALL_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"HSET", "myhash", "b", "2", "a", "1", "c", "3"}, {3},
+		{"HGETALL", "myhash"}, {"[a 1 b 2 c 3]"},
+		{"HKEYS", "myhash"}, {"[a b c]"},
+		{"HVALS", "myhash"}, {"[1 2 3]"},
+		{"HGETALL", "nohash"}, {"[]"},
+	})
+}
+func hashes_HDEL_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"HSET", "myhash", "field1", "foo", "field2", "bar"}, {2},
+		{"HDEL", "myhash", "field1", "field3"}, {1},
+		{"HLEN", "myhash"}, {1},
+		{"HDEL", "myhash", "field2"}, {1},
+		{"EXISTS", "myhash"}, {0},
+		{"HDEL", "myhash", "field2"}, {0},
+	})
+}
+func hashes_HINCRBY_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"HSET", "myhash", "field", 5}, {1},
+		{"HINCRBY", "myhash", "field", 1}, {6},
+		{"HINCRBY", "myhash", "field", -1}, {5},
+		{"HINCRBY", "myhash", "field", -10}, {-5},
+		{"HINCRBY", "myhash", "other", 3}, {3},
+		{"HLEN", "myhash"}, {2},
+		{"HSET", "myhash", "str", "hello"}, {1},
+		{"HINCRBY", "myhash", "str", 1}, {"ERR hash value is not an integer"},
+	})
+}
+func hashes_HINCRBYFLOAT_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"HSET", "mykey", "field", 10.50}, {1},
+		{"HINCRBYFLOAT", "mykey", "field", 0.1}, {exfloat(10.6, 2)},
+		{"HINCRBYFLOAT", "mykey", "field", -5}, {exfloat(5.6, 2)},
+		{"HSET", "mykey", "field", "5.0e3"}, {0},
+		{"HINCRBYFLOAT", "mykey", "field", "2.0e2"}, {exfloat(5200, 2)},
+	})
+}
+func hashes_TYPE_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"HSET", "myhash", "field", "value"}, {1},
+		{"SET", "mystr", "value"}, {"OK"},
+		{"TYPE", "myhash"}, {"hash"},
+		{"TYPE", "mystr"}, {"string"},
+		{"GET", "myhash"}, {"WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"APPEND", "myhash", "value"}, {"WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"HGET", "mystr", "field"}, {"WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"MGET", "myhash", "mystr"}, {"[nil value]"},
+		{"SET", "myhash", "value"}, {"OK"},
+		{"TYPE", "myhash"}, {"string"},
+		{"HSET", "myhash", "field", "value"}, {"WRONGTYPE Operation against a key holding the wrong kind of value"},
+	})
+}
+func hashes_KEYS_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"HSET", "myhash", "field1", "1", "field2", "2"}, {2},
+		{"KEYS", "*"}, {"[myhash]"},
+		{"DBSIZE"}, {1},
+		{"RENAME", "myhash", "newhash"}, {"OK"},
+		{"HGETALL", "newhash"}, {"[field1 1 field2 2]"},
+		{"HGETALL", "myhash"}, {"[]"},
+		{"DEL", "newhash"}, {1},
+		{"HGETALL", "newhash"}, {"[]"},
+		{"HSET", "myhash", "field1", "1", "field2", "2"}, {2},
+		{"EXPIRE", "myhash", 2}, {1},
+		{"HSET", "myhash", "field3", "3"}, {1},
+		{"TTL", "myhash"}, {1},
+		{"PDEL", "my*"}, {1},
+		{"HLEN", "myhash"}, {0},
+	})
+}
+func hashes_EXPIRE_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"HSET", "myhash", "field1", "1", "field2", "2"}, {2},
+		{"PEXPIRE", "myhash", 100}, {1},
+		{time.Second / 4}, {}, // sleep
+		{"HLEN", "myhash"}, {0},
+		{"HSET", "myhash", "field3", "3"}, {1},
+		{"HGETALL", "myhash"}, {"[field3 3]"},
+		{"DUMP", "myhash"}, {func(v interface{}) (resp, expect interface{}) {
+			return mc.DoExpect("OK", "RESTORE", "newhash", 0, v), nil
+		}},
+		{"HGETALL", "newhash"}, {"[field3 3]"},
+	})
+}
+func hashes_MULTI_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"MULTI"}, {"OK"},
+		{"HSET", "myhash", "field1", "1"}, {"QUEUED"},
+		{"HINCRBY", "myhash", "field1", "5"}, {"QUEUED"},
+		{"HGET", "myhash", "nofield"}, {"QUEUED"},
+		{"EXEC"}, {"[1 6 nil]"},
+		{"EVAL", `sdb.call("hset", KEYS[0], "field2", ARGV[0]); return sdb.call("hgetall", KEYS[0])`, 1, "myhash", "2"}, {"[field1 6 field2 2]"},
+	})
+}
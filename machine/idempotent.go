@@ -0,0 +1,96 @@
+package machine
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// A write that is wrapped by IDEMPOTENT is applied at most once for each
+// token. The reply of the write is stored along with the token, and a retry
+// with the same token gets the stored reply without the write being applied
+// again. Tokens are kept for a number of seconds, measured with the cluster
+// time so that every node forgets a token at the same point in the log.
+
+// idempotentKeyPrefix is the prefix for the reply of a token.
+const idempotentKeyPrefix = sdbMetaPrefix + "idempotent:"
+
+var errInvalidIdempotentTTL = errors.New("ERR invalid expire time in idempotent command")
+
+// txGetIdempotent returns the stored reply for a token. Returns false when
+// the token isn't known as of the clock.
+func txGetIdempotent(tx *buntdb.Tx, token string, clock int64) ([]byte, bool, error) {
+	val, found, err := txGetLeased(tx, idempotentKeyPrefix+token)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	parts := strings.SplitN(val, " ", 2)
+	if len(parts) != 2 {
+		return nil, false, nil
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || expires <= clock {
+		return nil, false, nil
+	}
+	return []byte(parts[1]), true, nil
+}
+
+func txSetIdempotent(tx *buntdb.Tx, token string, reply []byte, expires int64) error {
+	val := strconv.FormatInt(expires, 10) + " " + string(reply)
+	_, _, err := tx.Set(idempotentKeyPrefix+token, val, expireOptions(expires))
+	return err
+}
+
+func (m *Machine) doIdempotent(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// IDEMPOTENT token seconds command [arg ...]
+	if len(cmd.Args) < 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	token := string(cmd.Args[1])
+	ttl, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+	if err != nil || ttl <= 0 {
+		return nil, errInvalidIdempotentTTL
+	}
+	inner := buildCommand(cmd.Args[3:])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		now, err := txNow(tx)
+		if err != nil {
+			return nil, err
+		}
+		reply, ok, err := txGetIdempotent(tx, token, now)
+		if err != nil || ok {
+			return reply, err
+		}
+		pconn := &passiveConn{}
+		pa := &passiveApplier{log: m.log}
+		switch qcmdlower(inner.Args[0]) {
+		case "plwmulti", "plrmulti":
+			_, err = m.doPlmulti(pa, pconn, inner, tx)
+		default:
+			_, err = m.doScriptableCommand(pa, pconn, inner, tx)
+		}
+		if err != nil {
+			// the write failed, so a retry is free to try again.
+			if err == finn.ErrUnknownCommand {
+				err = errors.New("ERR unknown command '" + string(inner.Args[0]) + "'")
+			} else if err == finn.ErrWrongNumberOfArguments {
+				err = errors.New("ERR wrong number of arguments for '" + string(inner.Args[0]) + "' command")
+			}
+			return nil, err
+		}
+		w := redcon.NewWriter(nil)
+		writePassiveResps(w, pconn.resps)
+		reply = w.Buffer()
+		if err := txSetIdempotent(tx, token, reply, now+ttl*1000); err != nil {
+			return nil, err
+		}
+		return reply, nil
+	}, func(v interface{}) error {
+		conn.WriteRaw(v.([]byte))
+		return nil
+	})
+}
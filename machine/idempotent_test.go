@@ -0,0 +1,60 @@
+package machine
+
+import (
+	"testing"
+	"time"
+)
+
+func subTestIdempotent(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "IDEMPOTENT", idempotent_IDEMPOTENT_test)
+	runStep(t, mc, "PLWMULTI", idempotent_PLWMULTI_test)
+	runStep(t, mc, "expires", idempotent_expires_test)
+}
+
+func idempotent_IDEMPOTENT_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"IDEMPOTENT", "tok1", 60, "INCRBY", "mykey", 5}, {5},
+		{"IDEMPOTENT", "tok1", 60, "INCRBY", "mykey", 5}, {5},
+		{"IDEMPOTENT", "tok2", 60, "INCRBY", "mykey", 5}, {10},
+		{"IDEMPOTENT", "tok3", 60, "APPEND", "mystr", "a"}, {1},
+		{"IDEMPOTENT", "tok3", 60, "APPEND", "mystr", "a"}, {1},
+		{"IDEMPOTENT", "tok4", 60, "GET", "mystr"}, {"a"},
+		{"IDEMPOTENT", "tok5", 60, "FENCE", "myfence"}, {"1"},
+		{"IDEMPOTENT", "tok5", 60, "FENCE", "myfence"}, {"1"},
+		{"FENCEGET", "myfence"}, {"1"},
+		{"GET", "mykey"}, {"10"},
+		{"KEYS", "*"}, {"[mykey mystr]"},
+
+		// failed writes are not recorded.
+		{"IDEMPOTENT", "tok6", 60, "INCRBY", "mystr", 1}, {"ERR value is not an integer or out of range"},
+		{"IDEMPOTENT", "tok6", 60, "INCRBY", "mykey", 1}, {11},
+
+		{"IDEMPOTENT", "tok7", 60}, {"ERR wrong number of arguments for 'IDEMPOTENT' command"},
+		{"IDEMPOTENT", "tok7", 0, "INCR", "mykey"}, {"ERR invalid expire time in idempotent command"},
+		{"IDEMPOTENT", "tok7", 60, "MULTI"}, {"ERR unknown command 'MULTI'"},
+		{"IDEMPOTENT", "tok7", 60, "INCR"}, {"ERR wrong number of arguments for 'INCR' command"},
+	})
+}
+
+func idempotent_PLWMULTI_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"IDEMPOTENT", "tok8", 60, "PLWMULTI",
+			"*3\r\n$6\r\nINCRBY\r\n$5\r\nmykey\r\n$1\r\n2\r\n",
+			"*2\r\n$3\r\nGET\r\n$5\r\nmykey\r\n",
+		}, {"[2 2]"},
+		{"IDEMPOTENT", "tok8", 60, "PLWMULTI",
+			"*3\r\n$6\r\nINCRBY\r\n$5\r\nmykey\r\n$1\r\n2\r\n",
+			"*2\r\n$3\r\nGET\r\n$5\r\nmykey\r\n",
+		}, {"[2 2]"},
+		{"GET", "mykey"}, {"2"},
+	})
+}
+
+func idempotent_expires_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"IDEMPOTENT", "tok9", 1, "INCR", "mykey"}, {1},
+		{"IDEMPOTENT", "tok9", 1, "INCR", "mykey"}, {1},
+		{time.Second + time.Second/4}, {}, // sleep
+		{"IDEMPOTENT", "tok9", 1, "INCR", "mykey"}, {2},
+	})
+}
@@ -160,7 +160,7 @@ func (m *Machine) iterateIndex(rargs *iterArgs, conn redcon.Conn, tx *buntdb.Tx)
 	var pastrange bool
 	var pivoteq bool // flag indicating that pivot compares should exclude equal-to
 	iterfn := func(key, val string) bool {
-		if isMercMetaKey(key) {
+		if isMercMetaKey(key) || !m.servesKey(key) {
 			return true
 		}
 		if rargs.limiton && len(results) >= rargs.limit*2 {
@@ -367,7 +367,7 @@ func (m *Machine) iterateKeys(rargs *iterArgs, conn redcon.Conn, tx *buntdb.Tx)
 	err = func() error {
 		if rargs.desc {
 			descIter := func(key, val string) bool {
-				if isMercMetaKey(key) {
+				if isMercMetaKey(key) || !m.servesKey(key) {
 					return true
 				}
 				if rargs.limiton && len(results) == rargs.limit {
@@ -396,7 +396,7 @@ func (m *Machine) iterateKeys(rargs *iterArgs, conn redcon.Conn, tx *buntdb.Tx)
 			return tx.DescendLessOrEqual("", max, descIter)
 		}
 		return tx.AscendGreaterOrEqual("", min, func(key, val string) bool {
-			if isMercMetaKey(key) {
+			if isMercMetaKey(key) || !m.servesKey(key) {
 				return true
 			}
 			if rargs.limiton && len(results) == rargs.limit {
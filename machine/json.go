@@ -17,7 +17,7 @@ func (m *Machine) doJget(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		return nil, finn.ErrWrongNumberOfArguments
 	}
 	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
-		val, err := tx.Get(string(cmd.Args[1]))
+		val, err := txGetString(tx, string(cmd.Args[1]))
 		if err != nil {
 			if err == buntdb.ErrNotFound {
 				conn.WriteNull()
@@ -35,14 +35,29 @@ func (m *Machine) doJget(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 	})
 }
 func (m *Machine) doJset(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
-	// JSET key path value [RAW]
+	// JSET key path value [RAW|STR]
+	// JSETCAS key path value version [RAW|STR]
+	cas := qcmdlower(cmd.Args[0]) == "jsetcas"
+	args := cmd.Args
+	var version uint64
+	if cas {
+		if len(args) < 5 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		var err error
+		version, err = parseVersion(args[4])
+		if err != nil {
+			return nil, err
+		}
+		args = append(args[:4:4], args[5:]...)
+	}
 	var raw, str bool
-	switch len(cmd.Args) {
+	switch len(args) {
 	default:
 		return nil, finn.ErrWrongNumberOfArguments
 	case 4:
 	case 5:
-		switch qcmdlower(cmd.Args[4]) {
+		switch qcmdlower(args[4]) {
 		default:
 			return nil, errSyntaxError
 		case "raw":
@@ -69,7 +84,13 @@ func (m *Machine) doJset(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		}
 	}
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
-		json, err := tx.Get(key)
+		if cas {
+			ok, err := m.checkVersion(tx, key, version)
+			if err != nil || !ok {
+				return nil, err
+			}
+		}
+		json, err := txGetString(tx, key)
 		if err != nil && err != buntdb.ErrNotFound {
 			return nil, err
 		}
@@ -83,13 +104,24 @@ func (m *Machine) doJset(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		if err != nil {
 			return nil, fmt.Errorf("ERR %v", err)
 		}
-		_, _, err = tx.Set(key, json, nil)
+		err = txSetString(tx, key, json, nil)
 		if err != nil {
 			return nil, err
 		}
-		return nil, nil
+		m.notify(notifyJSON, "jset", key)
+		if cas {
+			return m.nextVersion()
+		}
+		return "OK", nil
 	}, func(v interface{}) error {
-		conn.WriteString("OK")
+		switch v := v.(type) {
+		case nil:
+			conn.WriteNull()
+		case uint64:
+			conn.WriteInt64(int64(v))
+		default:
+			conn.WriteString("OK")
+		}
 		return nil
 	})
 }
@@ -101,7 +133,7 @@ func (m *Machine) doJdel(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 	key := string(cmd.Args[1])
 	path := string(cmd.Args[2])
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
-		json, err := tx.Get(key)
+		json, err := txGetString(tx, key)
 		if err != nil {
 			if err == buntdb.ErrNotFound {
 				return 0, nil
@@ -113,10 +145,11 @@ func (m *Machine) doJdel(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 			return nil, fmt.Errorf("ERR %v", err)
 		}
 		if res != json {
-			_, _, err = tx.Set(key, res, nil)
+			err = txSetString(tx, key, res, nil)
 			if err != nil {
 				return nil, err
 			}
+			m.notify(notifyJSON, "jdel", key)
 			return 1, nil
 		}
 		return 0, nil
@@ -17,7 +17,7 @@ func (m *Machine) doType(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		return nil, finn.ErrWrongNumberOfArguments
 	}
 	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
-		_, err := tx.Get(string(cmd.Args[1]))
+		val, err := tx.Get(string(cmd.Args[1]))
 		if err != nil {
 			if err == buntdb.ErrNotFound {
 				conn.WriteString("none")
@@ -25,7 +25,7 @@ func (m *Machine) doType(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 			}
 			return err
 		}
-		conn.WriteString("string")
+		conn.WriteString(valueType(val))
 		return nil
 	})
 }
@@ -40,7 +40,11 @@ func (m *Machine) doPdel(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
 		if pattern == "*" {
 			_, n, err := flushAllButMeta(tx)
-			return n, err
+			if err != nil {
+				return nil, err
+			}
+			m.notify(notifyGeneric, "flushdb", "")
+			return n, nil
 		}
 		var n int
 		var keys []string
@@ -73,14 +77,14 @@ func (m *Machine) doPdel(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 			if isMercMetaKey(key) {
 				continue
 			}
-			_, err := tx.Delete(key)
+			ok, err := deleteKey(tx, key)
 			if err != nil {
-				if err == buntdb.ErrNotFound {
-					continue
-				}
 				return nil, err
 			}
-			n++
+			if ok {
+				m.notify(notifyGeneric, "del", key)
+				n++
+			}
 		}
 		return n, nil
 	}, func(v interface{}) error {
@@ -89,7 +93,22 @@ func (m *Machine) doPdel(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 	})
 }
 func (m *Machine) doDump(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
-	return m.doGet(a, conn, cmd, tx)
+	// DUMP key
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		val, err := dumpValue(tx, string(cmd.Args[1]))
+		if err != nil {
+			if err == buntdb.ErrNotFound {
+				conn.WriteNull()
+				return nil
+			}
+			return err
+		}
+		conn.WriteBulkString(val)
+		return nil
+	})
 }
 
 func (m *Machine) doRestore(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
@@ -104,7 +123,6 @@ func (m *Machine) doRestore(a finn.Applier, conn redcon.Conn, cmd redcon.Command
 	if n < 0 {
 		return nil, errors.New("ERR Invalid TTL value, must be >= 0")
 	}
-	ttl := time.Millisecond * time.Duration(n)
 	var replace bool
 	if len(cmd.Args) == 5 {
 		if qcmdlower(cmd.Args[4]) != "replace" {
@@ -127,15 +145,17 @@ func (m *Machine) doRestore(a finn.Applier, conn redcon.Conn, cmd redcon.Command
 			}
 		}
 		var opts *buntdb.SetOptions
-		if ttl > 0 {
-			opts = &buntdb.SetOptions{}
-			opts.Expires = true
-			opts.TTL = ttl
+		if n > 0 {
+			now, err := txNow(tx)
+			if err != nil {
+				return nil, err
+			}
+			opts = expireOptions(now + n)
 		}
-		_, _, err := tx.Set(key, string(cmd.Args[3]), opts)
-		if err != nil {
+		if err := restoreValue(tx, key, string(cmd.Args[3]), opts); err != nil {
 			return nil, err
 		}
+		m.notify(notifyGeneric, "restore", key)
 		return nil, nil
 	}, func(v interface{}) error {
 		conn.WriteString("OK")
@@ -189,10 +209,17 @@ func (m *Machine) doRename(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 			}
 			return nil, err
 		}
-		_, _, err = tx.Set(newkey, val, nil)
+		err = txSetString(tx, newkey, val, nil)
 		if err != nil {
 			return nil, err
 		}
+		if h, ok := parseTypeHeader(val); ok {
+			if err := moveMembers(tx, h.kind, key, newkey); err != nil {
+				return nil, err
+			}
+		}
+		m.notify(notifyGeneric, "rename_from", key)
+		m.notify(notifyGeneric, "rename_to", newkey)
 		if nx {
 			return 1, nil
 		}
@@ -234,6 +261,7 @@ func (m *Machine) doPersist(a finn.Applier, conn redcon.Conn, cmd redcon.Command
 		if err != nil {
 			return nil, err
 		}
+		m.notify(notifyGeneric, "persist", key)
 		return 1, nil
 	}, func(v interface{}) error {
 		conn.WriteInt(v.(int))
@@ -283,22 +311,22 @@ func (m *Machine) doExpire(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 		return nil, finn.ErrWrongNumberOfArguments
 	}
 
-	var ttl time.Duration
 	n, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
 	if err != nil {
 		return nil, errNotAnInt
 	}
+	var at, rel int64 // expire at, or relative to the current time
 	switch qcmdlower(cmd.Args[0]) {
 	default:
 		return nil, finn.ErrUnknownCommand
 	case "expire":
-		ttl = time.Second * time.Duration(n)
+		rel = n * 1000
 	case "pexpire":
-		ttl = time.Millisecond * time.Duration(n)
+		rel = n
 	case "expireat":
-		ttl = time.Unix(0, int64(time.Second*time.Duration(n))).Sub(time.Now())
+		at = n * 1000
 	case "pexpireat":
-		ttl = time.Unix(0, int64(time.Millisecond*time.Duration(n))).Sub(time.Now())
+		at = n
 	}
 	key := string(cmd.Args[1])
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
@@ -309,13 +337,22 @@ func (m *Machine) doExpire(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 			}
 			return nil, err
 		}
-		if ttl <= 0 {
-			ttl = 0
+		now, err := txNow(tx)
+		if err != nil {
+			return nil, err
+		}
+		at := at
+		if at == 0 {
+			at = now + rel
 		}
-		_, _, err = tx.Set(key, val, &buntdb.SetOptions{Expires: true, TTL: ttl})
+		if at < now {
+			at = now
+		}
+		_, _, err = tx.Set(key, val, expireOptions(at))
 		if err != nil {
 			return nil, err
 		}
+		m.notify(notifyGeneric, "expire", key)
 		return 1, nil
 	}, func(v interface{}) error {
 		conn.WriteInt(v.(int))
@@ -331,14 +368,14 @@ func (m *Machine) doDel(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
 		var n int
 		for i := 1; i < len(cmd.Args); i++ {
-			_, err := tx.Delete(string(cmd.Args[i]))
+			ok, err := deleteKey(tx, string(cmd.Args[i]))
 			if err != nil {
-				if err == buntdb.ErrNotFound {
-					continue
-				}
 				return nil, err
 			}
-			n++
+			if ok {
+				m.notify(notifyGeneric, "del", string(cmd.Args[i]))
+				n++
+			}
 		}
 		return n, nil
 	}, func(v interface{}) error {
@@ -371,6 +408,7 @@ func (m *Machine) doFlushdb(a finn.Applier, conn redcon.Conn, cmd redcon.Command
 				}
 			}
 		}
+		m.notify(notifyGeneric, "flushdb", "")
 		return nil, nil
 	}, func(v interface{}) error {
 		conn.WriteString("OK")
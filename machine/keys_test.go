@@ -20,6 +20,7 @@ func subTestKeys(t *testing.T, mc *mockCluster) {
 	runStep(t, mc, "EXPIREAT", keys_EXPIREAT_test)
 	runStep(t, mc, "PEXPIRE", keys_PEXPIRE_test)
 	runStep(t, mc, "PEXPIREAT", keys_PEXPIREAT_test)
+	runStep(t, mc, "expired", keys_expired_test)
 	runStep(t, mc, "TTL", keys_TTL_test)
 	runStep(t, mc, "PTTL", keys_PTTL_test)
 	runStep(t, mc, "RENAME", keys_RENAME_test)
@@ -76,6 +77,58 @@ func keys_PERSIST_test(mc *mockCluster) error {
 		{"PERSIST", "mykey"}, {0},
 	})
 }
+func keys_expired_test(mc *mockCluster) error {
+	// expired keys are removed through the log, which is seen by the
+	// followers as an 'expired' notification.
+	config := func(flags string) error {
+		for _, s := range mc.ss {
+			if _, err := s.Do("CONFIG", "SET", "notify-keyspace-events", flags); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := config("Ex"); err != nil {
+		return err
+	}
+	defer config("")
+	conn, err := pubsubDialFollower(mc)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := pubsubExpect(conn, "[subscribe __keyevent@0__:expired 1]",
+		"SUBSCRIBE", "__keyevent@0__:expired"); err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "mykey", "value", "PX", 100}, {"OK"},
+		{"HSET", "myhash", "a", "1", "b", "2"}, {2},
+		{"PEXPIRE", "myhash", 100}, {1},
+		{"SDBEXPIRED", "mykey"}, {"ERR unknown command 'SDBEXPIRED'"},
+	}); err != nil {
+		return err
+	}
+	// the keys may be expired in either order.
+	expired := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		vals, err := redis.Strings(conn.Receive())
+		if err != nil {
+			return err
+		}
+		if len(vals) != 3 || vals[0] != "message" {
+			return fmt.Errorf("expected a message, got '%v'", vals)
+		}
+		expired[vals[2]] = true
+	}
+	if !expired["mykey"] || !expired["myhash"] {
+		return fmt.Errorf("expected 'mykey' and 'myhash', got '%v'", expired)
+	}
+	return mc.DoBatch([][]interface{}{
+		{"HSET", "myhash", "c", "3"}, {1},
+		{"HLEN", "myhash"}, {1},
+	})
+}
 func keys_TTL_test(mc *mockCluster) error {
 	return mc.DoBatch([][]interface{}{
 		{"SET", "mykey", "value"}, {"OK"},
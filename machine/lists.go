@@ -0,0 +1,487 @@
+package machine
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+var errNoSuchKey = errors.New("ERR no such key")
+var errIndexOutOfRange = errors.New("ERR index out of range")
+
+// listMember returns the member suffix for a list sequence. The sequence is
+// encoded so that the members are stored in list order.
+func listMember(seq int64) string {
+	s := strconv.FormatUint(uint64(seq)^(1<<63), 16)
+	return "0000000000000000"[len(s):] + s
+}
+
+// listRange converts start and stop offsets, which may be negative, into
+// a range within a list of n elements. Returns false for an empty range.
+func listRange(start, stop, n int) (int, int, bool) {
+	if start < 0 {
+		start = n + start
+		if start < 0 {
+			start = 0
+		}
+	}
+	if stop < 0 {
+		stop = n + stop
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop || start >= n {
+		return 0, 0, false
+	}
+	return start, stop, true
+}
+
+// listPush adds values to the head or tail of a list.
+func listPush(tx *buntdb.Tx, key string, vals []string, left bool) (typeHeader, error) {
+	h, err := txGetHeaderForUpdate(tx, key, "list")
+	if err != nil {
+		return h, err
+	}
+	prefix := memberKeyPrefix("list", key)
+	for _, val := range vals {
+		var seq int64
+		if left {
+			h.head--
+			seq = h.head
+		} else {
+			seq = h.tail
+			h.tail++
+		}
+		if _, _, err := tx.Set(prefix+listMember(seq), val, nil); err != nil {
+			return h, err
+		}
+		h.count++
+	}
+	return h, txSetHeader(tx, key, h)
+}
+
+// listPop removes and returns the first or last element of a list, along
+// with the number of elements that remain.
+func listPop(tx *buntdb.Tx, key string, left bool) (string, int, bool, error) {
+	h, err := txGetHeader(tx, key, "list")
+	if err != nil || h.count == 0 {
+		return "", 0, false, err
+	}
+	var seq int64
+	if left {
+		seq = h.head
+		h.head++
+	} else {
+		h.tail--
+		seq = h.tail
+	}
+	val, err := tx.Delete(memberKeyPrefix("list", key) + listMember(seq))
+	if err != nil {
+		return "", 0, false, err
+	}
+	h.count--
+	if err := txSetHeader(tx, key, h); err != nil {
+		return "", 0, false, err
+	}
+	return val, h.count, true, nil
+}
+
+// notifyPop queues the keyspace notifications for a pop from a list.
+func (m *Machine) notifyPop(key string, left bool, remain int) {
+	if left {
+		m.notify(notifyList, "lpop", key)
+	} else {
+		m.notify(notifyList, "rpop", key)
+	}
+	if remain == 0 {
+		m.notify(notifyGeneric, "del", key)
+	}
+}
+
+func (m *Machine) doPush(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// LPUSH key element [element ...]
+	// RPUSH key element [element ...]
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	left := qcmdlower(cmd.Args[0]) == "lpush"
+	key := string(cmd.Args[1])
+	vals := make([]string, 0, len(cmd.Args)-2)
+	for i := 2; i < len(cmd.Args); i++ {
+		vals = append(vals, string(cmd.Args[i]))
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := listPush(tx, key, vals, left)
+		if err != nil {
+			return nil, err
+		}
+		if left {
+			m.notify(notifyList, "lpush", key)
+		} else {
+			m.notify(notifyList, "rpush", key)
+		}
+		m.signalKey(key)
+		return h.count, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+func (m *Machine) doPop(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// LPOP key
+	// RPOP key
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	left := qcmdlower(cmd.Args[0]) == "lpop"
+	key := string(cmd.Args[1])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		val, remain, ok, err := listPop(tx, key, left)
+		if err != nil || !ok {
+			return nil, err
+		}
+		m.notifyPop(key, left, remain)
+		return val, nil
+	}, func(v interface{}) error {
+		if v == nil {
+			conn.WriteNull()
+		} else {
+			conn.WriteBulkString(v.(string))
+		}
+		return nil
+	})
+}
+
+func (m *Machine) doBpop(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// BLPOP key [key ...] timeout
+	// BRPOP key [key ...] timeout
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	timeout, err := strconv.ParseFloat(string(cmd.Args[len(cmd.Args)-1]), 64)
+	if err != nil || timeout < 0 {
+		return nil, errors.New("ERR timeout is not a float or out of range")
+	}
+	left := qcmdlower(cmd.Args[0]) == "blpop"
+	var keys []string
+	for i := 1; i < len(cmd.Args)-1; i++ {
+		keys = append(keys, string(cmd.Args[i]))
+	}
+	wrdo := func(tx *buntdb.Tx) (interface{}, error) {
+		for _, key := range keys {
+			val, remain, ok, err := listPop(tx, key, left)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				m.notifyPop(key, left, remain)
+				return []string{key, val}, nil
+			}
+		}
+		return nil, nil
+	}
+	rddo := func(v interface{}) error {
+		if v == nil {
+			conn.WriteNull()
+			return nil
+		}
+		conn.WriteArray(2)
+		conn.WriteBulkString(v.([]string)[0])
+		conn.WriteBulkString(v.([]string)[1])
+		return nil
+	}
+	if !canBlock(conn, tx) {
+		return m.writeDoApply(a, conn, cmd, tx, wrdo, rddo)
+	}
+	// Each attempt to pop goes through the raft log, but only once a read
+	// finds an element to pop. A follower always sends the attempt on, so
+	// that the client is redirected to the leader.
+	leader := isLeader(a)
+	popped, err := m.blockOn(keys, time.Duration(timeout*float64(time.Second)), func() (bool, error) {
+		if leader && m.listsEmpty(keys) {
+			return false, nil
+		}
+		var popped bool
+		_, err := m.writeDoApply(a, conn, cmd, tx, wrdo, func(v interface{}) error {
+			if v == nil {
+				return nil
+			}
+			popped = true
+			return rddo(v)
+		})
+		return popped, err
+	})
+	if err == nil && !popped {
+		conn.WriteNull()
+	}
+	return nil, err
+}
+
+// listsEmpty returns true when none of the keys is a list with elements. A
+// key of another type isn't empty, so that popping it returns the error.
+func (m *Machine) listsEmpty(keys []string) bool {
+	empty := true
+	m.db.View(func(tx *buntdb.Tx) error {
+		for _, key := range keys {
+			h, err := txGetHeader(tx, key, "list")
+			if err != nil || h.count > 0 {
+				empty = false
+				return nil
+			}
+		}
+		return nil
+	})
+	return empty
+}
+
+func (m *Machine) doLrange(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// LRANGE key start stop
+	if len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	start, stop, err := parseStartEnd(cmd, 2, 3)
+	if err != nil {
+		return nil, err
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "list")
+		if err != nil {
+			return err
+		}
+		start, stop, ok := listRange(start, stop, h.count)
+		if !ok {
+			conn.WriteArray(0)
+			return nil
+		}
+		prefix := memberKeyPrefix("list", key)
+		vals := make([]string, 0, stop-start+1)
+		for i := start; i <= stop; i++ {
+			val, err := tx.Get(prefix + listMember(h.head+int64(i)))
+			if err != nil {
+				return err
+			}
+			vals = append(vals, val)
+		}
+		conn.WriteArray(len(vals))
+		for _, val := range vals {
+			conn.WriteBulkString(val)
+		}
+		return nil
+	})
+}
+
+func (m *Machine) doLlen(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// LLEN key
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "list")
+		if err != nil {
+			return err
+		}
+		conn.WriteInt(h.count)
+		return nil
+	})
+}
+
+func (m *Machine) doLindex(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// LINDEX key index
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	n, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+	if err != nil {
+		return nil, errNotAnInt
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "list")
+		if err != nil {
+			return err
+		}
+		index := int(n)
+		if index < 0 {
+			index = h.count + index
+		}
+		if index < 0 || index >= h.count {
+			conn.WriteNull()
+			return nil
+		}
+		val, err := tx.Get(memberKeyPrefix("list", key) + listMember(h.head+int64(index)))
+		if err != nil {
+			return err
+		}
+		conn.WriteBulkString(val)
+		return nil
+	})
+}
+
+func (m *Machine) doLset(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// LSET key index element
+	if len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	n, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+	if err != nil {
+		return nil, errNotAnInt
+	}
+	key := string(cmd.Args[1])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := txGetHeader(tx, key, "list")
+		if err != nil {
+			return nil, err
+		}
+		if h.count == 0 {
+			return nil, errNoSuchKey
+		}
+		index := int(n)
+		if index < 0 {
+			index = h.count + index
+		}
+		if index < 0 || index >= h.count {
+			return nil, errIndexOutOfRange
+		}
+		mkey := memberKeyPrefix("list", key) + listMember(h.head+int64(index))
+		if _, _, err := tx.Set(mkey, string(cmd.Args[3]), nil); err != nil {
+			return nil, err
+		}
+		m.notify(notifyList, "lset", key)
+		return nil, nil
+	}, func(v interface{}) error {
+		conn.WriteString("OK")
+		return nil
+	})
+}
+
+func (m *Machine) doLrem(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// LREM key count element
+	if len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	n, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+	if err != nil {
+		return nil, errNotAnInt
+	}
+	key := string(cmd.Args[1])
+	elem := string(cmd.Args[3])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := txGetHeader(tx, key, "list")
+		if err != nil {
+			return nil, err
+		}
+		if h.count == 0 {
+			return 0, nil
+		}
+		prefix := memberKeyPrefix("list", key)
+		vals := make([]string, 0, h.count)
+		for seq := h.head; seq < h.tail; seq++ {
+			val, err := tx.Delete(prefix + listMember(seq))
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, val)
+		}
+		// remove the matching elements from the head, or from the tail
+		// when count is negative.
+		limit := int(n)
+		if limit < 0 {
+			limit = -limit
+		}
+		var removed int
+		keep := make([]bool, len(vals))
+		for i := 0; i < len(vals); i++ {
+			j := i
+			if n < 0 {
+				j = len(vals) - 1 - i
+			}
+			if vals[j] == elem && (limit == 0 || removed < limit) {
+				removed++
+				continue
+			}
+			keep[j] = true
+		}
+		// write back the remaining elements
+		seq := h.head
+		for i, val := range vals {
+			if !keep[i] {
+				continue
+			}
+			if _, _, err := tx.Set(prefix+listMember(seq), val, nil); err != nil {
+				return nil, err
+			}
+			seq++
+		}
+		h.tail = seq
+		h.count -= removed
+		if err := txSetHeader(tx, key, h); err != nil {
+			return nil, err
+		}
+		if removed > 0 {
+			m.notify(notifyList, "lrem", key)
+			if h.count == 0 {
+				m.notify(notifyGeneric, "del", key)
+			}
+		}
+		return removed, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+func (m *Machine) doLtrim(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// LTRIM key start stop
+	if len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	start, stop, err := parseStartEnd(cmd, 2, 3)
+	if err != nil {
+		return nil, err
+	}
+	key := string(cmd.Args[1])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := txGetHeader(tx, key, "list")
+		if err != nil {
+			return nil, err
+		}
+		if h.count == 0 {
+			return nil, nil
+		}
+		start, stop, ok := listRange(start, stop, h.count)
+		if !ok {
+			start, stop = h.count, h.count-1
+		}
+		prefix := memberKeyPrefix("list", key)
+		for i := 0; i < h.count; i++ {
+			if i >= start && i <= stop {
+				continue
+			}
+			if _, err := tx.Delete(prefix + listMember(h.head+int64(i))); err != nil {
+				return nil, err
+			}
+		}
+		h.tail = h.head + int64(stop) + 1
+		h.head += int64(start)
+		h.count = stop - start + 1
+		if err := txSetHeader(tx, key, h); err != nil {
+			return nil, err
+		}
+		m.notify(notifyList, "ltrim", key)
+		if h.count == 0 {
+			m.notify(notifyGeneric, "del", key)
+		}
+		return nil, nil
+	}, func(v interface{}) error {
+		conn.WriteString("OK")
+		return nil
+	})
+}
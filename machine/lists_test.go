@@ -0,0 +1,193 @@
+package machine
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func subTestLists(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "LPUSH", lists_LPUSH_test)
+	runStep(t, mc, "RPUSH", lists_RPUSH_test)
+	runStep(t, mc, "LPOP", lists_LPOP_test)
+	runStep(t, mc, "LRANGE", lists_LRANGE_test)
+	runStep(t, mc, "LINDEX", lists_LINDEX_test)
+	runStep(t, mc, "LSET", lists_LSET_test)
+	runStep(t, mc, "LREM", lists_LREM_test)
+	runStep(t, mc, "LTRIM", lists_LTRIM_test)
+	runStep(t, mc, "TYPE", lists_TYPE_test)
+	runStep(t, mc, "keys", lists_KEYS_test)
+	runStep(t, mc, "BLPOP", lists_BLPOP_test)
+}
+
+func lists_LPUSH_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"LPUSH", "mylist", "world"}, {1},
+		{"LPUSH", "mylist", "hello"}, {2},
+		{"LRANGE", "mylist", 0, -1}, {"[hello world]"},
+		{"LPUSH", "mylist", "a", "b", "c"}, {5},
+		{"LRANGE", "mylist", 0, -1}, {"[c b a hello world]"},
+		{"LLEN", "mylist"}, {5},
+		{"LLEN", "nolist"}, {0},
+		{"LPUSH", "mylist"}, {"ERR wrong number of arguments for 'LPUSH' command"},
+	})
+}
+func lists_RPUSH_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"RPUSH", "mylist", "hello"}, {1},
+		{"RPUSH", "mylist", "world"}, {2},
+		{"LPUSH", "mylist", "first"}, {3},
+		{"RPUSH", "mylist", "a", "b"}, {5},
+		{"LRANGE", "mylist", 0, -1}, {"[first hello world a b]"},
+	})
+}
+func lists_LPOP_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"RPUSH", "mylist", "one", "two", "three"}, {3},
+		{"LPOP", "mylist"}, {"one"},
+		{"RPOP", "mylist"}, {"three"},
+		{"LRANGE", "mylist", 0, -1}, {"[two]"},
+		{"LPOP", "mylist"}, {"two"},
+		{"LPOP", "mylist"}, {nil},
+		{"EXISTS", "mylist"}, {0},
+		{"RPOP", "nolist"}, {nil},
+	})
+}
+func lists_LRANGE_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"RPUSH", "mylist", "one", "two", "three"}, {3},
+		{"LRANGE", "mylist", 0, 0}, {"[one]"},
+		{"LRANGE", "mylist", -3, 2}, {"[one two three]"},
+		{"LRANGE", "mylist", -100, 100}, {"[one two three]"},
+		{"LRANGE", "mylist", 5, 10}, {"[]"},
+		{"LRANGE", "mylist", 2, 1}, {"[]"},
+		{"LRANGE", "nolist", 0, -1}, {"[]"},
+		{"LRANGE", "mylist", "a", 1}, {"ERR value is not an integer or out of range"},
+	})
+}
+func lists_LINDEX_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"LPUSH", "mylist", "World"}, {1},
+		{"LPUSH", "mylist", "Hello"}, {2},
+		{"LINDEX", "mylist", 0}, {"Hello"},
+		{"LINDEX", "mylist", -1}, {"World"},
+		{"LINDEX", "mylist", 3}, {nil},
+		{"LINDEX", "nolist", 0}, {nil},
+	})
+}
+func lists_LSET_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"RPUSH", "mylist", "one", "two", "three"}, {3},
+		{"LSET", "mylist", 0, "four"}, {"OK"},
+		{"LSET", "mylist", -2, "five"}, {"OK"},
+		{"LRANGE", "mylist", 0, -1}, {"[four five three]"},
+		{"LSET", "mylist", 3, "six"}, {"ERR index out of range"},
+		{"LSET", "nolist", 0, "six"}, {"ERR no such key"},
+	})
+}
+func lists_LREM_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"RPUSH", "mylist", "hello", "hello", "foo", "hello"}, {4},
+		{"LREM", "mylist", -2, "hello"}, {2},
+		{"LRANGE", "mylist", 0, -1}, {"[hello foo]"},
+		{"RPUSH", "mylist", "bar"}, {3},
+		{"LRANGE", "mylist", 0, -1}, {"[hello foo bar]"},
+		{"LREM", "mylist", 0, "foo"}, {1},
+		{"LREM", "mylist", 0, "foo"}, {0},
+		{"LRANGE", "mylist", 0, -1}, {"[hello bar]"},
+		{"LREM", "mylist", 0, "hello"}, {1},
+		{"LREM", "mylist", 0, "bar"}, {1},
+		{"EXISTS", "mylist"}, {0},
+	})
+}
+func lists_LTRIM_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"RPUSH", "mylist", "one", "two", "three"}, {3},
+		{"LTRIM", "mylist", 1, -1}, {"OK"},
+		{"LRANGE", "mylist", 0, -1}, {"[two three]"},
+		{"LPUSH", "mylist", "zero"}, {3},
+		{"RPUSH", "mylist", "four"}, {4},
+		{"LRANGE", "mylist", 0, -1}, {"[zero two three four]"},
+		{"LTRIM", "mylist", 5, 10}, {"OK"},
+		{"EXISTS", "mylist"}, {0},
+	})
+}
+func lists_TYPE_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"RPUSH", "mylist", "one"}, {1},
+		{"HSET", "myhash", "field", "value"}, {1},
+		{"TYPE", "mylist"}, {"list"},
+		{"GET", "mylist"}, {"WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"HGET", "mylist", "field"}, {"WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"LPUSH", "myhash", "one"}, {"WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"LRANGE", "myhash", 0, -1}, {"WRONGTYPE Operation against a key holding the wrong kind of value"},
+	})
+}
+func lists_KEYS_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"RPUSH", "mylist", "one", "two"}, {2},
+		{"KEYS", "*"}, {"[mylist]"},
+		{"DBSIZE"}, {1},
+		{"RENAME", "mylist", "newlist"}, {"OK"},
+		{"LRANGE", "newlist", 0, -1}, {"[one two]"},
+		{"DUMP", "newlist"}, {func(v interface{}) (resp, expect interface{}) {
+			return mc.DoExpect("OK", "RESTORE", "mylist", 0, v), nil
+		}},
+		{"LRANGE", "mylist", 0, -1}, {"[one two]"},
+		{"DEL", "newlist", "mylist"}, {2},
+		{"LRANGE", "mylist", 0, -1}, {"[]"},
+		{"MULTI"}, {"OK"},
+		{"RPUSH", "mylist", "one"}, {"QUEUED"},
+		{"LPOP", "mylist"}, {"QUEUED"},
+		{"EXEC"}, {"[1 one]"},
+	})
+}
+func lists_BLPOP_test(mc *mockCluster) error {
+	err := mc.DoBatch([][]interface{}{
+		{"RPUSH", "list1", "a", "b"}, {2},
+		{"BLPOP", "list2", "list1", 0}, {"[list1 a]"},
+		{"BRPOP", "list1", 0}, {"[list1 b]"},
+		{"BLPOP", "list1", 0.1}, {nil},
+		{"BLPOP", "list1", "a"}, {"ERR timeout is not a float or out of range"},
+		{"SET", "str", "a"}, {"OK"},
+		{"BLPOP", "str", 0}, {"WRONGTYPE Operation against a key holding the wrong kind of value"},
+	})
+	if err != nil {
+		return err
+	}
+	// waiting on empty lists doesn't write to the log.
+	before, err := redis.StringMap(mc.cs.Do("RAFTSTATS"))
+	if err != nil {
+		return err
+	}
+	if err := mc.DoExpect(nil, "BLPOP", "list1", "list2", 0.5); err != nil {
+		return err
+	}
+	after, err := redis.StringMap(mc.cs.Do("RAFTSTATS"))
+	if err != nil {
+		return err
+	}
+	if before["last_log_index"] != after["last_log_index"] {
+		return fmt.Errorf("expected last_log_index '%v', got '%v'", before["last_log_index"], after["last_log_index"])
+	}
+	// push from a different connection while the current one is blocked.
+	port := mc.cs.port
+	errc := make(chan error, 1)
+	go func() {
+		time.Sleep(time.Second / 4)
+		conn, err := redis.Dial("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		_, err = conn.Do("RPUSH", "list2", "c")
+		errc <- err
+	}()
+	if err := mc.DoExpect("[list2 c]", "BLPOP", "list1", "list2", 5); err != nil {
+		return err
+	}
+	return <-errc
+}
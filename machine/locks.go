@@ -0,0 +1,236 @@
+package machine
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// A lock is held by an owner until it's unlocked or its lease runs out.
+// Acquiring a lock increments the fencing token that has the same name as
+// the lock, in the same write, so the token can be handed to other services
+// to reject requests from an owner that lost the lock. Leases are measured
+// with the cluster time, which makes a lock expire at the same point in the
+// log on every node. A lock that has expired is removed through the Raft log
+// like any other key.
+
+// lockKeyPrefix is the prefix for a lock.
+const lockKeyPrefix = sdbMetaPrefix + "lock:"
+
+var errInvalidLockTTL = errors.New("ERR invalid expire time in lock command")
+
+type lock struct {
+	token   uint64
+	expires int64 // cluster time in milliseconds
+	owner   string
+}
+
+func (l lock) String() string {
+	return strconv.FormatUint(l.token, 10) + " " +
+		strconv.FormatInt(l.expires, 10) + " " + l.owner
+}
+
+func parseLock(val string) (lock, bool) {
+	parts := strings.SplitN(val, " ", 3)
+	if len(parts) != 3 {
+		return lock{}, false
+	}
+	token, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return lock{}, false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return lock{}, false
+	}
+	return lock{token: token, expires: expires, owner: parts[2]}, true
+}
+
+// txGetLeased returns the value of a key that has a lease. buntdb hides a key
+// that has expired by the local time, which may not agree with the cluster
+// time. Iterating sees every key.
+func txGetLeased(tx *buntdb.Tx, key string) (string, bool, error) {
+	var val string
+	var found bool
+	if err := tx.AscendGreaterOrEqual("", key, func(k, v string) bool {
+		val, found = v, k == key
+		return false
+	}); err != nil {
+		return "", false, err
+	}
+	return val, found, nil
+}
+
+// txGetLock returns the lock with the name. Returns false when the lock isn't
+// held as of the clock.
+func txGetLock(tx *buntdb.Tx, name string, clock int64) (lock, bool, error) {
+	val, found, err := txGetLeased(tx, lockKeyPrefix+name)
+	if err != nil || !found {
+		return lock{}, false, err
+	}
+	l, ok := parseLock(val)
+	if !ok || l.expires <= clock {
+		return lock{}, false, nil
+	}
+	return l, true, nil
+}
+
+func txSetLock(tx *buntdb.Tx, name string, l lock) error {
+	_, _, err := tx.Set(lockKeyPrefix+name, l.String(), expireOptions(l.expires))
+	return err
+}
+
+func parseLockTTL(arg []byte) (int64, error) {
+	ttl, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil || ttl <= 0 {
+		return 0, errInvalidLockTTL
+	}
+	return ttl, nil
+}
+
+func parseLockToken(arg []byte) (uint64, error) {
+	token, err := strconv.ParseUint(string(arg), 10, 64)
+	if err != nil {
+		return 0, errNotAnInt
+	}
+	return token, nil
+}
+
+func (m *Machine) doLock(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// LOCK name owner milliseconds
+	if len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	name, owner := string(cmd.Args[1]), string(cmd.Args[2])
+	ttl, err := parseLockTTL(cmd.Args[3])
+	if err != nil {
+		return nil, err
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		now, err := txNow(tx)
+		if err != nil {
+			return nil, err
+		}
+		_, held, err := txGetLock(tx, name, now)
+		if err != nil || held {
+			return nil, err
+		}
+		token, err := txFence(tx, name, 1)
+		if err != nil {
+			return nil, err
+		}
+		l := lock{expires: now + ttl, owner: owner}
+		l.token, _ = strconv.ParseUint(token, 10, 64)
+		if err := txSetLock(tx, name, l); err != nil {
+			return nil, err
+		}
+		return token, nil
+	}, func(v interface{}) error {
+		if v == nil {
+			conn.WriteNull()
+		} else {
+			conn.WriteBulkString(v.(string))
+		}
+		return nil
+	})
+}
+
+func (m *Machine) doUnlock(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// UNLOCK name owner token
+	if len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	name, owner := string(cmd.Args[1]), string(cmd.Args[2])
+	token, err := parseLockToken(cmd.Args[3])
+	if err != nil {
+		return nil, err
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		now, err := txNow(tx)
+		if err != nil {
+			return nil, err
+		}
+		l, held, err := txGetLock(tx, name, now)
+		if err != nil {
+			return nil, err
+		}
+		if !held || l.owner != owner || l.token != token {
+			return 0, nil
+		}
+		if _, err := tx.Delete(lockKeyPrefix + name); err != nil {
+			return nil, err
+		}
+		return 1, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+func (m *Machine) doLockRefresh(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// LOCKREFRESH name owner token milliseconds
+	if len(cmd.Args) != 5 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	name, owner := string(cmd.Args[1]), string(cmd.Args[2])
+	token, err := parseLockToken(cmd.Args[3])
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := parseLockTTL(cmd.Args[4])
+	if err != nil {
+		return nil, err
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		now, err := txNow(tx)
+		if err != nil {
+			return nil, err
+		}
+		l, held, err := txGetLock(tx, name, now)
+		if err != nil {
+			return nil, err
+		}
+		if !held || l.owner != owner || l.token != token {
+			return 0, nil
+		}
+		l.expires = now + ttl
+		if err := txSetLock(tx, name, l); err != nil {
+			return nil, err
+		}
+		return 1, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+func (m *Machine) doLockInfo(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// LOCKINFO name
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	name := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		now, err := txNow(tx)
+		if err != nil {
+			return err
+		}
+		l, held, err := txGetLock(tx, name, now)
+		if err != nil {
+			return err
+		}
+		if !held {
+			conn.WriteNull()
+			return nil
+		}
+		conn.WriteArray(3)
+		conn.WriteBulkString(l.owner)
+		conn.WriteBulkString(strconv.FormatUint(l.token, 10))
+		conn.WriteInt64(l.expires - now)
+		return nil
+	})
+}
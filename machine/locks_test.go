@@ -0,0 +1,73 @@
+package machine
+
+import (
+	"testing"
+	"time"
+)
+
+func subTestLocks(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "LOCK", locks_LOCK_test)
+	runStep(t, mc, "UNLOCK", locks_UNLOCK_test)
+	runStep(t, mc, "LOCKREFRESH", locks_LOCKREFRESH_test)
+	runStep(t, mc, "expires", locks_expires_test)
+}
+
+func locks_LOCK_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"LOCK", "lock1", "alice", 10000}, {"1"},
+		{"LOCK", "lock1", "bob", 10000}, {nil},
+		{"LOCK", "lock1", "alice", 10000}, {nil},
+		{"FENCEGET", "lock1"}, {"1"},
+		{"LOCKINFO", "lock1"}, {func(v interface{}) (resp, expect interface{}) {
+			vals := v.([]string)
+			return vals[0] == "alice" && vals[1] == "1" && vals[2] > "0", true
+		}},
+		{"LOCKINFO", "lock2"}, {nil},
+		{"KEYS", "*"}, {"[]"},
+		{"LOCK", "lock1", "alice"}, {"ERR wrong number of arguments for 'LOCK' command"},
+		{"LOCK", "lock1", "alice", 0}, {"ERR invalid expire time in lock command"},
+		{"LOCK", "lock1", "alice", "a"}, {"ERR invalid expire time in lock command"},
+	})
+}
+
+func locks_UNLOCK_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"FENCE", "lock2", 5}, {"5"},
+		{"LOCK", "lock2", "alice", 10000}, {"6"},
+		{"UNLOCK", "lock2", "bob", 6}, {0},
+		{"UNLOCK", "lock2", "alice", 5}, {0},
+		{"UNLOCK", "lock2", "alice", "a"}, {"ERR value is not an integer or out of range"},
+		{"UNLOCK", "lock2", "alice", 6}, {1},
+		{"UNLOCK", "lock2", "alice", 6}, {0},
+		{"LOCKINFO", "lock2"}, {nil},
+		{"LOCK", "lock2", "bob", 10000}, {"7"},
+	})
+}
+
+func locks_LOCKREFRESH_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"LOCK", "lock3", "alice", 200}, {"1"},
+		{"LOCKREFRESH", "lock3", "bob", 1, 10000}, {0},
+		{"LOCKREFRESH", "lock3", "alice", 2, 10000}, {0},
+		{"LOCKREFRESH", "lock3", "alice", 1, 0}, {"ERR invalid expire time in lock command"},
+		{"LOCKREFRESH", "lock3", "alice", 1, 10000}, {1},
+		{time.Second / 2}, {}, // sleep
+		{"LOCK", "lock3", "bob", 10000}, {nil},
+		{"LOCKINFO", "lock3"}, {func(v interface{}) (resp, expect interface{}) {
+			vals := v.([]string)
+			return vals[0] == "alice" && vals[1] == "1", true
+		}},
+	})
+}
+
+func locks_expires_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"LOCK", "lock4", "alice", 100}, {"1"},
+		{time.Second / 4}, {}, // sleep
+		{"LOCKINFO", "lock4"}, {nil},
+		{"LOCKREFRESH", "lock4", "alice", 1, 10000}, {0},
+		{"UNLOCK", "lock4", "alice", 1}, {0},
+		{"LOCK", "lock4", "bob", 100}, {"2"},
+		{"DBSIZE"}, {0},
+	})
+}
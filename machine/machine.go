@@ -1,15 +1,14 @@
 package machine
 
 import (
-	"bufio"
 	"errors"
 	"io"
 	"io/ioutil"
-	"net"
 	"os"
-	"path"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/tidwall/buntdb"
 	"github.com/tidwall/finn"
@@ -21,17 +20,47 @@ type Machine struct {
 	sm   *scriptMachine
 	addr string
 
-	mu   sync.RWMutex
-	db   *buntdb.DB
-	file string
+	mu sync.RWMutex
+	db *buntdb.DB
+
+	bmu      sync.Mutex                        // guards blocked and signaled
+	blocked  map[string]map[chan struct{}]bool // clients blocked on keys
+	signaled map[string]bool                   // keys written by the transaction
+
+	ps *pubsub
+	cl *changeLog
+
+	applier atomic.Value // the finn.Applier, for proposing expired keys
+
+	fw *forwarder      // forwards commands to the leader, guarded by mu
+	gc *groupCommitter // merges writes from connections, guarded by mu
+
+	sh       *Shards // the groups of a sharded keyspace, or nil
+	group    int     // the group of this machine
+	rmu      sync.RWMutex
+	owned    []keyRange        // the ranges served by the group, guarded by rmu
+	leaving  []keyRange        // the ranges being moved away, guarded by rmu
+	intents  map[string]string // keys locked by transactions, guarded by rmu
+	pintents []intentChange    // changes to intents waiting on a commit, guarded by rmu
+
+	// stamp is the clock stamp of the log entry that is being applied. The
+	// log is applied from a single goroutine.
+	stamp int64
 }
 
 func New(log finn.Logger, addr string) (*Machine, error) {
 	m := &Machine{log: log, addr: addr}
+	m.blocked = make(map[string]map[chan struct{}]bool)
+	m.ps = newPubsub()
+	m.cl = newChangeLog()
 	err := m.reopenBlankDB(nil, func(keys []string) { m.onExpired(keys) })
 	if err != nil {
 		return nil, err
 	}
+	if err := m.db.Update(dbSetZsetIndex); err != nil {
+		m.Close()
+		return nil, err
+	}
 	m.sm, err = newScriptMachine(m)
 	if err != nil {
 		m.Close()
@@ -44,65 +73,12 @@ func (m *Machine) Close() error {
 	return m.db.Close()
 }
 
-func (m *Machine) onExpired(keys []string) {
-	// Connect to ourself using a standard redcon connection.
-	// This is important in order to emulate a full round trip
-	// through the Raft pipeline.
-	// This operation only works on the leader. Followers will
-	// simply receive a TRY response, which we will ignore.
-	// This should not be a bottleneck because there cannot be
-	// more than one connection at a time and never more that
-	// one connection every one second.
-	// Failures are ignored, but logged.
-	err := func() error {
-		m.log.Debugf("expire: %v", keys)
-		conn, err := net.Dial("tcp", m.addr)
-		if err != nil {
-			return err
-		}
-		defer conn.Close()
-		wr := redcon.NewWriter(conn)
-		wr.WriteArray(len(keys) + 1)
-		wr.WriteBulkString("del")
-		for i := 0; i < len(keys); i++ {
-			wr.WriteBulkString(keys[i])
-		}
-		err = wr.Flush()
-		if err != nil {
-			return err
-		}
-		rd := bufio.NewReader(conn)
-		c, err := rd.ReadByte()
-		if err != nil {
-			return err
-		}
-		if c == '-' {
-			line, err := rd.ReadString('\n')
-			if err != nil {
-				return err
-			}
-			m.log.Debugf("expired: failed: %v", strings.TrimSpace(line))
-			return nil
-		}
-		if c == ':' {
-			line, err := rd.ReadString('\n')
-			if err != nil {
-				return err
-			}
-			m.log.Debugf("expired: success: %v", strings.TrimSpace(line))
-			return nil
-		}
-		m.log.Warningf("expired: success: %v", "invalid response")
-		return nil
-	}()
-	if err != nil {
-		m.log.Warningf("expired: error: %v", err)
-		println(err.Error())
-	}
-}
-
 type connContext struct {
 	multi *multiContext
+	watch map[string]uint64 // versions of the watched keys
+
+	consistency *consistency // the read consistency, nil for the default
+	internal    bool         // a server of the cluster, see SDBAUTH
 }
 
 func (m *Machine) ConnAccept(conn redcon.Conn) bool {
@@ -113,47 +89,107 @@ func (m *Machine) ConnAccept(conn redcon.Conn) bool {
 func (m *Machine) ConnClosed(conn redcon.Conn, err error) {
 
 }
+
+// reopenBlankDB replaces the database with a new one that is kept in
+// memory, and is loaded from the reader when it's not nil.
 func (m *Machine) reopenBlankDB(rd io.Reader, onExpired func(keys []string)) error {
-	dir, err := ioutil.TempDir("", "summitdb")
+	db, err := buntdb.Open(":memory:")
 	if err != nil {
 		return err
 	}
-	file := path.Join(dir, "data.db")
 	if rd != nil {
-		f, err := os.Create(file)
-		if err != nil {
+		if err := db.Load(rd); err != nil {
+			db.Close()
 			return err
 		}
-		defer f.Close()
-		if _, err := io.Copy(f, rd); err != nil {
-			os.RemoveAll(file)
-			return err
-		}
-		f.Close()
-	}
-	db, err := buntdb.Open(file)
-	if err != nil {
-		return err
 	}
 	var cfg buntdb.Config
 	if err := db.ReadConfig(&cfg); err != nil {
+		db.Close()
 		return err
 	}
 	cfg.OnExpired = func(keys []string) { onExpired(keys) }
 	if err := db.SetConfig(cfg); err != nil {
+		db.Close()
 		return err
 	}
-	if m.file != "" {
-		os.RemoveAll(m.file)
-	}
 	if m.db != nil {
 		m.db.Close()
 	}
-	m.file = file
 	m.db = db
 	return nil
 }
 
+// RemoveTempDirs removes the temporary directories that the database was
+// kept in by earlier versions. These are left behind after a crash. Only
+// directories that hold nothing but a database file, and whose database is
+// not open in any running process, are removed. Nothing is removed when the
+// open files of the running processes can't be listed.
+func RemoveTempDirs() error {
+	dirs, err := filepath.Glob(filepath.Join(os.TempDir(), "summitdb*"))
+	if err != nil {
+		return err
+	}
+	if len(dirs) == 0 {
+		return nil
+	}
+	open, err := openFiles()
+	if err != nil {
+		return nil
+	}
+	for _, dir := range dirs {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			// not a directory, it belongs to another user, or it's
+			// already gone.
+			continue
+		}
+		stale := len(fis) > 0
+		for _, fi := range fis {
+			switch fi.Name() {
+			case "data.db", "data.db.tmp":
+			default:
+				stale = false
+			}
+		}
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = real
+		}
+		for _, fi := range fis {
+			if open[filepath.Join(dir, fi.Name())] {
+				stale = false
+			}
+		}
+		if stale {
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// openFiles returns the paths of the files that are open in the running
+// processes, as listed in /proc. The processes that can't be read belong to
+// other users, who can't open a temporary directory of ours.
+func openFiles() (map[string]bool, error) {
+	fds, err := filepath.Glob("/proc/[0-9]*/fd/*")
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) == 0 {
+		// no procfs, or not even our own process is listed.
+		return nil, errors.New("open files are not available")
+	}
+	open := make(map[string]bool)
+	for _, fd := range fds {
+		if path, err := os.Readlink(fd); err == nil {
+			open[path] = true
+		}
+	}
+	return open, nil
+}
+
 func scriptNotAllowedCommand(cmd string) bool {
 	switch strings.ToLower(cmd) {
 	case "multi", "exec", "discard", "eval", "evalro", "evalsha", "evalsharo", "script":
@@ -162,11 +198,37 @@ func scriptNotAllowedCommand(cmd string) bool {
 	return false
 }
 
-func respPipeline(conn redcon.Conn, pn int, err error) (interface{}, error) {
-	if err != nil {
+// errorTranslator is implemented by an applier that changes the message of
+// an error before it's written to the client, such as "TRY addr" for a
+// follower.
+type errorTranslator interface {
+	TranslateError(err error, cmd string) string
+}
+
+// leaderApplier is implemented by an applier that knows whether its node is
+// the leader.
+type leaderApplier interface {
+	IsLeader() bool
+}
+
+// isLeader returns true when the node of the applier is the leader, or when
+// that isn't known.
+func isLeader(a finn.Applier) bool {
+	if la, ok := a.(leaderApplier); ok {
+		return la.IsLeader()
+	}
+	return true
+}
+
+func respPipeline(a finn.Applier, conn redcon.Conn, cmd redcon.Command, pn int, err error) (interface{}, error) {
+	if err != nil && err != errForwarded {
 		if conn != nil {
+			msg := err.Error()
+			if et, ok := a.(errorTranslator); ok {
+				msg = et.TranslateError(err, string(cmd.Args[0]))
+			}
 			for i := 0; i < pn-1; i++ {
-				conn.WriteError(err.Error())
+				conn.WriteError(msg)
 			}
 		}
 	}
@@ -175,6 +237,44 @@ func respPipeline(conn redcon.Conn, pn int, err error) (interface{}, error) {
 
 // Command processes a command through the Raft pipeline.
 func (m *Machine) Command(a finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	v, err := m.command(a, conn, cmd)
+	if err == errForwarded {
+		// the leader's reply has been written.
+		return nil, nil
+	}
+	return v, err
+}
+
+func (m *Machine) command(a finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if m.applier.Load() == nil {
+		m.applier.Store(a)
+	}
+	if conn == nil {
+		// the command is being applied from the log.
+		cmd, m.stamp = unstampCommand(cmd)
+		if li, ok := a.(logIndexer); ok {
+			m.cl.setApplying(li.Index())
+		}
+	}
+	if m.sh != nil {
+		if conn == nil {
+			if err := m.checkRanges(cmd); err != nil {
+				return nil, err
+			}
+		} else if qcmdlower(cmd.Args[0]) == "sdbgroup" {
+			// SDBGROUP command [arg ...]
+			// runs the command on this group only.
+			if len(cmd.Args) < 2 {
+				return nil, finn.ErrWrongNumberOfArguments
+			}
+			cmd = buildCommand(cmd.Args[1:])
+		} else if routed, v, err := m.route(conn, cmd); routed {
+			return v, err
+		}
+	}
+	if internalCommand(cmd.Args[0]) && !m.internal(conn) {
+		return nil, finn.ErrUnknownCommand
+	}
 	if conn != nil {
 		ctx, ok := conn.Context().(*connContext)
 		if ok && ctx.multi != nil {
@@ -188,6 +288,8 @@ func (m *Machine) Command(a finn.Applier, conn redcon.Conn, cmd redcon.Command)
 				return v, err
 			case "multi":
 				return nil, errors.New("ERR MULTI calls can not be nested")
+			case "watch":
+				return nil, errors.New("ERR WATCH inside MULTI is not allowed")
 			case "exec":
 				return m.doExec(a, conn, cmd, nil)
 			case "discard":
@@ -198,10 +300,19 @@ func (m *Machine) Command(a finn.Applier, conn redcon.Conn, cmd redcon.Command)
 
 	var pn int
 	var err error
-	// try to pipeline the command first.
-	pn, cmd, err = pipelineCommand(conn, cmd)
-	if err != nil {
-		return nil, err
+	// try to pipeline the command first. the commands of a pipeline may
+	// be served by different groups when the keyspace is sharded.
+	if m.sh == nil {
+		pn, cmd, err = m.pipelineCommand(conn, cmd)
+		if err != nil {
+			return nil, err
+		}
+		// writes from clients may be merged with the writes of other
+		// connections.
+		if gc := m.groupCommitter(); gc != nil && conn != nil && isLeader(a) && m.groupable(pn, cmd) {
+			err := m.groupCommit(gc, a, conn, cmd)
+			return respPipeline(a, conn, cmd, pn, err)
+		}
 	}
 	switch qcmdlower(cmd.Args[0]) {
 	default:
@@ -209,21 +320,113 @@ func (m *Machine) Command(a finn.Applier, conn redcon.Conn, cmd redcon.Command)
 	case "plget":
 		// PLGET key [key ...]
 		_, err := m.doMget(a, conn, cmd, nil)
-		return respPipeline(conn, pn, err)
+		return respPipeline(a, conn, cmd, pn, err)
 	case "plset":
 		// PLSET key value [key value ...]
 		_, err := m.doMset(a, conn, cmd, nil)
-		return respPipeline(conn, pn, err)
+		return respPipeline(a, conn, cmd, pn, err)
+	case "plwpipe":
+		// PLWPIPE cmd [cmd ...]
+		// the replies are the result of applying the command.
+		v, err := m.doPlmulti(a, conn, cmd, nil)
+		if err != nil {
+			return respPipeline(a, conn, cmd, pn, err)
+		}
+		return v, nil
+	case "plgroup":
+		// PLGROUP cmd [cmd ...]
+		return m.doPlgroup(a, conn, cmd, nil)
 	case "plwmulti", "plrmulti":
 		// PLWMULTI cmd [cmd ...]
 		// PLRMULTI cmd [cmd ...]
 		return m.doPlmulti(a, conn, cmd, nil)
+	case "idempotent":
+		// IDEMPOTENT token seconds command [arg ...]
+		return m.doIdempotent(a, conn, cmd, nil)
 	case "massinsert":
 		// MASSINSERT count
 		return m.doMassInsert(a, conn, cmd, nil)
 	case "multi":
 		// MULTI
 		return m.doMulti(a, conn, cmd, nil)
+	case "watch":
+		// WATCH key [key ...]
+		return m.doWatch(a, conn, cmd, nil)
+	case "unwatch":
+		// UNWATCH
+		return m.doUnwatch(a, conn, cmd, nil)
+	case "subscribe", "psubscribe":
+		// SUBSCRIBE channel [channel ...]
+		// PSUBSCRIBE pattern [pattern ...]
+		return m.doSubscribe(a, conn, cmd, nil)
+	case "unsubscribe", "punsubscribe":
+		// UNSUBSCRIBE [channel ...]
+		// PUNSUBSCRIBE [pattern ...]
+		return m.doUnsubscribe(a, conn, cmd, nil)
+	case "changes":
+		// CHANGES SINCE index [MATCH pattern]
+		return m.doChanges(a, conn, cmd, nil)
+	case expiredCommand:
+		// SDBEXPIRED key [key ...]
+		return m.doExpired(a, conn, cmd, nil)
+	case "consistency":
+		// CONSISTENCY [level]
+		// CONSISTENCY STALE ms
+		return m.doConsistency(a, conn, cmd, nil)
+	case "config":
+		// CONFIG GET parameter
+		// CONFIG SET parameter value
+		return m.doConfig(a, conn, cmd, nil)
+	case "ranges":
+		// RANGES
+		return m.doRanges(a, conn, cmd, nil)
+	case "rangesplit":
+		// RANGESPLIT key [group]
+		return m.doRangeSplit(a, conn, cmd, nil)
+	case "sdbauth":
+		// SDBAUTH token
+		return m.doAuth(a, conn, cmd, nil)
+	case "sdbrangestats":
+		// SDBRANGESTATS start end
+		return m.doRangeStats(a, conn, cmd, nil)
+	case "sdbrangeleave":
+		// SDBRANGELEAVE start end
+		return m.doRangeLeave(a, conn, cmd, nil)
+	case "sdbrangedump":
+		// SDBRANGEDUMP start end count
+		return m.doRangeDump(a, conn, cmd, nil)
+	case "sdbrangeload":
+		// SDBRANGELOAD key pttl serialized-value [key pttl serialized-value ...]
+		return m.doRangeLoad(a, conn, cmd, nil)
+	case "sdbrangeown":
+		// SDBRANGEOWN start end
+		return m.doRangeOwn(a, conn, cmd, nil)
+	case "sdbrangedrop":
+		// SDBRANGEDROP start end
+		return m.doRangeDrop(a, conn, cmd, nil)
+	case "sdbroutemove", "sdbroutedone":
+		// SDBROUTEMOVE start end from to
+		// SDBROUTEDONE start end from to
+		return m.doRouteMove(a, conn, cmd, nil)
+	case "sdbrouteset":
+		// SDBROUTESET start end group
+		return m.doRouteSet(a, conn, cmd, nil)
+	case "sdbtxbegin":
+		// SDBTXBEGIN id group [group ...]
+		return m.doTxnBegin(a, conn, cmd, nil)
+	case "sdbtxprepare":
+		// SDBTXPREPARE id command [command ...]
+		return m.doTxnPrepare(a, conn, cmd, nil)
+	case "sdbtxdecide":
+		// SDBTXDECIDE id COMMIT|ABORT
+		return m.doTxnDecide(a, conn, cmd, nil)
+	case "sdbtxcommit", "sdbtxabort":
+		// SDBTXCOMMIT id
+		// SDBTXABORT id
+		return m.doTxnResolve(a, conn, cmd, nil)
+	case "sdbtxend":
+		// SDBTXEND id
+		return m.doTxnEnd(a, conn, cmd, nil)
 	case "exec":
 		return nil, errors.New("ERR EXEC without MULTI")
 	case "discard":
@@ -384,6 +587,39 @@ func (m *Machine) doScriptableCommand(a finn.Applier, conn redcon.Conn, cmd redc
 	case "fenceget":
 		// FENCEGET token
 		return m.doFenceGet(a, conn, cmd, tx)
+	case "lock":
+		// LOCK name owner milliseconds
+		return m.doLock(a, conn, cmd, tx)
+	case "unlock":
+		// UNLOCK name owner token
+		return m.doUnlock(a, conn, cmd, tx)
+	case "lockrefresh":
+		// LOCKREFRESH name owner token milliseconds
+		return m.doLockRefresh(a, conn, cmd, tx)
+	case "lockinfo":
+		// LOCKINFO name
+		return m.doLockInfo(a, conn, cmd, tx)
+	case "elect":
+		// ELECT election candidate milliseconds
+		return m.doElect(a, conn, cmd, tx)
+	case "resign":
+		// RESIGN election leader token
+		return m.doResign(a, conn, cmd, tx)
+	case "leaderof":
+		// LEADEROF election
+		return m.doLeaderOf(a, conn, cmd, tx)
+	case "observe":
+		// OBSERVE election term timeout
+		return m.doObserve(a, conn, cmd, tx)
+	case "getv":
+		// GETV key
+		return m.doGetv(a, conn, cmd, tx)
+	case "setcas":
+		// SETCAS key value version
+		return m.doSetcas(a, conn, cmd, tx)
+	case "delcas":
+		// DELCAS key version
+		return m.doDelcas(a, conn, cmd, tx)
 	case "backup":
 		// BACKUP [STATUS]
 		return m.doBackup(a, conn, cmd, tx)
@@ -391,11 +627,177 @@ func (m *Machine) doScriptableCommand(a finn.Applier, conn redcon.Conn, cmd redc
 	case "jget":
 		// JGET key path
 		return m.doJget(a, conn, cmd, tx)
-	case "jset":
+	case "jset", "jsetcas":
 		// JSET key path value [RAW|STR]
+		// JSETCAS key path value version [RAW|STR]
 		return m.doJset(a, conn, cmd, tx)
 	case "jdel":
 		// JDEL key path
 		return m.doJdel(a, conn, cmd, tx)
+
+	case "hset":
+		// HSET key field value [field value ...]
+		return m.doHset(a, conn, cmd, tx)
+	case "hget":
+		// HGET key field
+		return m.doHget(a, conn, cmd, tx)
+	case "hmget":
+		// HMGET key field [field ...]
+		return m.doHmget(a, conn, cmd, tx)
+	case "hgetall", "hkeys", "hvals":
+		// HGETALL key
+		// HKEYS key
+		// HVALS key
+		return m.doHgetall(a, conn, cmd, tx)
+	case "hdel":
+		// HDEL key field [field ...]
+		return m.doHdel(a, conn, cmd, tx)
+	case "hexists":
+		// HEXISTS key field
+		return m.doHexists(a, conn, cmd, tx)
+	case "hlen":
+		// HLEN key
+		return m.doHlen(a, conn, cmd, tx)
+	case "hincrby":
+		// HINCRBY key field increment
+		return m.doHincrby(a, conn, cmd, tx)
+	case "hincrbyfloat":
+		// HINCRBYFLOAT key field increment
+		return m.doHincrbyfloat(a, conn, cmd, tx)
+
+	case "lpush", "rpush":
+		// LPUSH key element [element ...]
+		// RPUSH key element [element ...]
+		return m.doPush(a, conn, cmd, tx)
+	case "lpop", "rpop":
+		// LPOP key
+		// RPOP key
+		return m.doPop(a, conn, cmd, tx)
+	case "blpop", "brpop":
+		// BLPOP key [key ...] timeout
+		// BRPOP key [key ...] timeout
+		return m.doBpop(a, conn, cmd, tx)
+	case "lrange":
+		// LRANGE key start stop
+		return m.doLrange(a, conn, cmd, tx)
+	case "llen":
+		// LLEN key
+		return m.doLlen(a, conn, cmd, tx)
+	case "lindex":
+		// LINDEX key index
+		return m.doLindex(a, conn, cmd, tx)
+	case "lset":
+		// LSET key index element
+		return m.doLset(a, conn, cmd, tx)
+	case "lrem":
+		// LREM key count element
+		return m.doLrem(a, conn, cmd, tx)
+	case "ltrim":
+		// LTRIM key start stop
+		return m.doLtrim(a, conn, cmd, tx)
+
+	case "zadd":
+		// ZADD key [NX|XX] [CH] [INCR] score member [score member ...]
+		return m.doZadd(a, conn, cmd, tx)
+	case "zincrby":
+		// ZINCRBY key increment member
+		return m.doZincrby(a, conn, cmd, tx)
+	case "zrem":
+		// ZREM key member [member ...]
+		return m.doZrem(a, conn, cmd, tx)
+	case "zscore":
+		// ZSCORE key member
+		return m.doZscore(a, conn, cmd, tx)
+	case "zcard":
+		// ZCARD key
+		return m.doZcard(a, conn, cmd, tx)
+	case "zrank", "zrevrank":
+		// ZRANK key member
+		// ZREVRANK key member
+		return m.doZrank(a, conn, cmd, tx)
+	case "zrange":
+		// ZRANGE key start stop [WITHSCORES]
+		return m.doZrange(a, conn, cmd, tx)
+	case "zrangebyscore", "zcount":
+		// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+		// ZCOUNT key min max
+		return m.doZrangebyscore(a, conn, cmd, tx)
+	case "zrangebylex":
+		// ZRANGEBYLEX key min max [LIMIT offset count]
+		return m.doZrangebylex(a, conn, cmd, tx)
+
+	case "sadd":
+		// SADD key member [member ...]
+		return m.doSadd(a, conn, cmd, tx)
+	case "srem":
+		// SREM key member [member ...]
+		return m.doSrem(a, conn, cmd, tx)
+	case "sismember":
+		// SISMEMBER key member
+		return m.doSismember(a, conn, cmd, tx)
+	case "smembers":
+		// SMEMBERS key
+		return m.doSmembers(a, conn, cmd, tx)
+	case "scard":
+		// SCARD key
+		return m.doScard(a, conn, cmd, tx)
+	case "spop":
+		// SPOP key [count]
+		return m.doSpop(a, conn, cmd, tx)
+	case "srandmember":
+		// SRANDMEMBER key [count]
+		return m.doSrandmember(a, conn, cmd, tx)
+	case "sinter", "sunion", "sdiff":
+		// SINTER key [key ...]
+		// SUNION key [key ...]
+		// SDIFF key [key ...]
+		return m.doSetOp(a, conn, cmd, tx)
+	case "sinterstore", "sunionstore", "sdiffstore":
+		// SINTERSTORE destination key [key ...]
+		// SUNIONSTORE destination key [key ...]
+		// SDIFFSTORE destination key [key ...]
+		return m.doSetOpStore(a, conn, cmd, tx)
+
+	case "xadd":
+		// XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold] id field value [field value ...]
+		return m.doXadd(a, conn, cmd, tx)
+	case "xrange", "xrevrange":
+		// XRANGE key start end [COUNT count]
+		// XREVRANGE key end start [COUNT count]
+		return m.doXrange(a, conn, cmd, tx)
+	case "xlen":
+		// XLEN key
+		return m.doXlen(a, conn, cmd, tx)
+	case "xtrim":
+		// XTRIM key MAXLEN|MINID [=|~] threshold
+		return m.doXtrim(a, conn, cmd, tx)
+	case "xdel":
+		// XDEL key id [id ...]
+		return m.doXdel(a, conn, cmd, tx)
+	case "xgroup":
+		// XGROUP CREATE key group id|$ [MKSTREAM]
+		// XGROUP SETID key group id|$
+		// XGROUP DESTROY key group
+		// XGROUP DELCONSUMER key group consumer
+		return m.doXgroup(a, conn, cmd, tx)
+	case "xread":
+		// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+		return m.doXread(a, conn, cmd, tx)
+	case "xreadgroup":
+		// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+		return m.doXreadgroup(a, conn, cmd, tx)
+	case "xack":
+		// XACK key group id [id ...]
+		return m.doXack(a, conn, cmd, tx)
+	case "xpending":
+		// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+		return m.doXpending(a, conn, cmd, tx)
+	case "xclaim":
+		// XCLAIM key group consumer min-idle-time id [id ...] [JUSTID]
+		return m.doXclaim(a, conn, cmd, tx)
+
+	case "publish":
+		// PUBLISH channel message
+		return m.doPublish(a, conn, cmd, tx)
 	}
 }
@@ -127,18 +127,59 @@ func (s *mockServer) waitForStartup() error {
 }
 
 func mockOpenServer(join *mockServer) (*mockServer, error) {
+	return mockOpenServerLevel(join, finn.High)
+}
+
+func mockOpenServerLevel(join *mockServer, consistency finn.Level) (*mockServer, error) {
+	return mockOpenServerWith(join, consistency, false)
+}
+
+// mockOpenLearner opens a server that joins as a non-voting learner.
+func mockOpenLearner(join *mockServer) (*mockServer, error) {
+	return mockOpenServerWith(join, finn.Low, true)
+}
+
+func mockOpenServerWith(join *mockServer, consistency finn.Level, learner bool) (*mockServer, error) {
 	rand.Seed(time.Now().UnixNano())
 	port := rand.Int()%20000 + 20000
+	var opts finn.Options
+	opts.Consistency = consistency
+	opts.Learner = learner
+	return mockOpenServerPort(port, join, opts)
+}
+
+// mockForceNewCluster reopens the data of a closed server as a new single
+// node cluster.
+func mockForceNewCluster(s *mockServer) (*mockServer, error) {
+	var opts finn.Options
+	opts.Consistency = finn.High
+	opts.ForceNewCluster = true
+	return mockOpenServerPort(s.port, nil, opts)
+}
+
+func mockOpenServerPort(port int, join *mockServer, opts finn.Options) (*mockServer, error) {
+	s, err := mockStartServer(port, join, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.waitForStartup(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// mockStartServer opens a server without waiting for it to start. The setup
+// function is called with the machine before the raft node is opened.
+func mockStartServer(port int, join *mockServer, opts finn.Options, setup func(m *Machine) error) (*mockServer, error) {
 	dir := fmt.Sprintf("data-mock-%d", port)
 	fmt.Printf("Starting test server at port %d\n", port)
 	logOutput := ioutil.Discard
 	if os.Getenv("PRINTLOG") == "1" {
 		logOutput = os.Stderr
 	}
-	var opts finn.Options
 	opts.Backend = finn.FastLog
 	opts.Durability = finn.High
-	opts.Consistency = finn.High
 	opts.LogLevel = finn.Debug
 	opts.LogOutput = logOutput
 	addr := fmt.Sprintf(":%d", port)
@@ -152,6 +193,12 @@ func mockOpenServer(join *mockServer) (*mockServer, error) {
 	opts.ConnClosed = func(conn redcon.Conn, err error) {
 		m.ConnClosed(conn, err)
 	}
+	if setup != nil {
+		if err := setup(m); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
 	var joinAddr string
 	if join != nil {
 		joinAddr = fmt.Sprintf(":%d", join.port)
@@ -162,12 +209,134 @@ func mockOpenServer(join *mockServer) (*mockServer, error) {
 		m.Close()
 		return nil, err
 	}
-	s := &mockServer{port: port, n: n, m: m, join: joinAddr}
-	if err := s.waitForStartup(); err != nil {
-		s.Close()
+	return &mockServer{port: port, n: n, m: m, join: joinAddr}, nil
+}
+
+// mockShards is a server that hosts every group of a sharded keyspace.
+type mockShards struct {
+	sh *Shards
+	ss []*mockServer // the server of each group
+}
+
+func mockOpenShards(groups int) (*mockShards, error) {
+	rand.Seed(time.Now().UnixNano())
+	port := rand.Int()%20000 + 20000
+	fmt.Printf("Starting sharded server of %d groups\n", groups)
+	sh := NewShards(groups)
+	sh.SetToken("secret")
+	sh.SetRangeMaxKeys(0)
+	sh.interval = time.Millisecond * 100
+	sh.txnTimeout = time.Second * 2
+	ms := &mockShards{sh: sh}
+	for group := 0; group < groups; group++ {
+		var opts finn.Options
+		opts.Consistency = finn.High
+		s, err := mockStartServer(port+group, nil, opts, func(m *Machine) error {
+			return sh.SetGroup(group, m)
+		})
+		if err != nil {
+			ms.Close()
+			return nil, err
+		}
+		ms.ss = append(ms.ss, s)
+		sh.SetLeader(group, s.n.Leader)
+	}
+	if err := ms.waitForLeaders(); err != nil {
+		ms.Close()
 		return nil, err
 	}
-	return s, nil
+	sh.Start()
+	return ms, nil
+}
+
+// waitForLeaders waits for every group to elect itself.
+func (ms *mockShards) waitForLeaders() error {
+	start := time.Now()
+	for _, s := range ms.ss {
+		for s.n.Leader() != fmt.Sprintf(":%d", s.port) {
+			if time.Now().Sub(start) > time.Second*5 {
+				return errTimeout
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+	}
+	return nil
+}
+
+// restart closes the server of a group and opens it again from its data, as
+// if it had crashed.
+func (ms *mockShards) restart(group int) error {
+	s := ms.ss[group]
+	s.Close()
+	var opts finn.Options
+	opts.Consistency = finn.High
+	ns, err := mockStartServer(s.port, nil, opts, func(m *Machine) error {
+		return ms.sh.SetGroup(group, m)
+	})
+	if err != nil {
+		return err
+	}
+	ms.ss[group] = ns
+	ms.sh.SetLeader(group, ns.n.Leader)
+	return ms.waitForLeaders()
+}
+
+// internal sends an internal command to the server of a group, as if it
+// was sent by another server.
+func (ms *mockShards) internal(group int, commandName string, args ...interface{}) (interface{}, error) {
+	s := ms.ss[group]
+	if _, err := redis.String(s.Do("SDBAUTH", "secret")); err != nil {
+		return nil, err
+	}
+	return s.Do(commandName, args...)
+}
+
+// Do sends a command to the first group and follows MOVED replies. A
+// TRYAGAIN reply is retried.
+func (ms *mockShards) Do(commandName string, args ...interface{}) (interface{}, error) {
+	s := ms.ss[0]
+	start := time.Now()
+	for {
+		resp, err := s.Do(commandName, args...)
+		if rerr, ok := resp.(error); ok && err == nil {
+			err = rerr
+		}
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "MOVED ") {
+				parts := strings.Split(err.Error(), " ")
+				group, err := strconv.Atoi(parts[1])
+				if err != nil {
+					return nil, err
+				}
+				s = ms.ss[group]
+				continue
+			}
+			if strings.HasPrefix(err.Error(), "TRYAGAIN ") && time.Now().Sub(start) < time.Second*5 {
+				time.Sleep(time.Millisecond * 50)
+				continue
+			}
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+func (ms *mockShards) DoBatch(commands [][]interface{}) error {
+	for i := 0; i < len(commands); i += 2 {
+		cmds := commands[i]
+		resp, err := ms.Do(cmds[0].(string), cmds[1:]...)
+		if err := checkExpect(commands[i+1][0], resp, err); err != nil {
+			return fmt.Errorf("%v: %v", cmds, err)
+		}
+	}
+	return nil
+}
+
+func (ms *mockShards) Close() {
+	ms.sh.Close()
+	for _, s := range ms.ss {
+		s.Close()
+	}
 }
 
 type mockCluster struct {
@@ -214,6 +383,20 @@ func (mc *mockCluster) ServerForPort(port int) *mockServer {
 	return nil
 }
 
+// Follower returns a server that isn't the leader.
+func (mc *mockCluster) Follower() (*mockServer, error) {
+	for _, s := range mc.ss {
+		resp, err := s.Do("SET", "please", "allow")
+		if err != nil {
+			return nil, err
+		}
+		if rerr, ok := resp.(error); ok && strings.HasPrefix(rerr.Error(), "TRY ") {
+			return s, nil
+		}
+	}
+	return nil, errors.New("no follower")
+}
+
 func (mc *mockCluster) Do(commandName string, args ...interface{}) (interface{}, error) {
 	s := mc.cs
 	if s == nil {
@@ -268,6 +451,11 @@ func normalize(v interface{}) interface{} {
 }
 func (mc *mockCluster) DoExpect(expect interface{}, commandName string, args ...interface{}) error {
 	resp, err := mc.Do(commandName, args...)
+	return checkExpect(expect, resp, err)
+}
+
+// checkExpect compares the response of a command to the expected response.
+func checkExpect(expect interface{}, resp interface{}, err error) error {
 	if err != nil {
 		if exs, ok := expect.(string); ok {
 			if err.Error() == exs {
@@ -2,6 +2,7 @@ package machine
 
 import (
 	"errors"
+	"strconv"
 
 	"github.com/tidwall/buntdb"
 	"github.com/tidwall/finn"
@@ -38,6 +39,8 @@ func (m *Machine) doExec(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 	defer func() {
 		ctx.multi = nil
 	}()
+	watch := ctx.watch
+	ctx.watch = nil
 	if ctx.multi.errs {
 		return nil, errors.New("EXECABORT Transaction discarded because of previous errors.")
 	}
@@ -51,9 +54,24 @@ func (m *Machine) doExec(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 	} else {
 		args = append(args, []byte("plrmulti"))
 	}
+	if len(watch) > 0 {
+		// the versions of the watched keys are checked when the
+		// transaction is applied.
+		wargs := [][]byte{[]byte("watch")}
+		for key, version := range watch {
+			wargs = append(wargs, []byte(key), []byte(strconv.FormatUint(version, 10)))
+		}
+		args = append(args, buildCommand(wargs).Raw)
+	}
 	for _, cmd := range ctx.multi.cmds {
 		args = append(args, cmd.Raw)
 	}
+	if m.sh != nil {
+		// the commands may be served by other groups.
+		if routed, err := m.execGroups(conn, ctx.multi.writable, watch, ctx.multi.cmds); routed {
+			return nil, err
+		}
+	}
 	ctx.multi = nil
 	ncmd := buildCommand(args)
 	return m.doPlmulti(a, conn, ncmd, tx)
@@ -68,59 +86,131 @@ func (m *Machine) doDiscard(a finn.Applier, conn redcon.Conn, cmd redcon.Command
 	}
 	ctx := conn.Context().(*connContext)
 	ctx.multi = nil
+	ctx.watch = nil
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+func (m *Machine) doWatch(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// WATCH key [key ...]
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if conn == nil {
+		return nil, errors.New("missing connection")
+	}
+	ctx := conn.Context().(*connContext)
+	watch := func(tx *buntdb.Tx) error {
+		if ctx.watch == nil {
+			ctx.watch = make(map[string]uint64)
+		}
+		for i := 1; i < len(cmd.Args); i++ {
+			key := string(cmd.Args[i])
+			if _, ok := ctx.watch[key]; ok {
+				continue
+			}
+			version, err := txKeyVersion(tx, key)
+			if err != nil {
+				return err
+			}
+			ctx.watch[key] = version
+		}
+		conn.WriteString("OK")
+		return nil
+	}
+	if m.forwarder() != nil {
+		// The versions are kept by this connection, so they're read here
+		// rather than on the leader. A follower that is behind has older
+		// versions than the leader, which can only cause EXEC to abort.
+		return nil, m.db.View(watch)
+	}
+	return m.readDoApply(a, conn, cmd, tx, watch)
+}
+
+func (m *Machine) doUnwatch(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// UNWATCH
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if conn == nil {
+		return nil, errors.New("missing connection")
+	}
+	ctx := conn.Context().(*connContext)
+	ctx.watch = nil
 	conn.WriteString("OK")
 	return nil, nil
 }
 
+// parseWatch reads the keys and versions from a WATCH command that was
+// added to a PLWMULTI by EXEC.
+func parseWatch(cmd redcon.Command) (map[string]uint64, error) {
+	if (len(cmd.Args)-1)%2 == 1 {
+		return nil, errSyntaxError
+	}
+	watch := make(map[string]uint64)
+	for i := 1; i < len(cmd.Args); i += 2 {
+		version, err := strconv.ParseUint(string(cmd.Args[i+1]), 10, 64)
+		if err != nil {
+			return nil, errNotAnInt
+		}
+		watch[string(cmd.Args[i])] = version
+	}
+	return watch, nil
+}
+
 func (m *Machine) doPlmulti(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
 	if len(cmd.Args) < 2 {
 		return nil, finn.ErrWrongNumberOfArguments
 	}
 
-	writable := qcmdlower(cmd.Args[0]) == "plwmulti"
+	// PLWPIPE is a pipeline, which has a reply for each command rather
+	// than an array.
+	pipe := qcmdlower(cmd.Args[0]) == "plwpipe"
+	writable := pipe || qcmdlower(cmd.Args[0]) == "plwmulti"
 
 	// read the commands
 	var cmds []redcon.Command
+	var watch map[string]uint64
 	for i := 1; i < len(cmd.Args); i++ {
 		cmd, err := parseCommand(cmd.Args[i])
 		if err != nil {
 			return nil, err
 		}
+		if i == 1 && !pipe && qcmdlower(cmd.Args[0]) == "watch" {
+			watch, err = parseWatch(cmd)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
 		cmds = append(cmds, cmd)
 	}
 
 	dowr := func(tx *buntdb.Tx) (interface{}, error) {
-		var resps []interface{}
-		for _, cmd := range cmds {
-			pconn := &passiveConn{}
-			_, err := m.doTransactableCommand(&passiveApplier{log: m.log}, pconn, cmd, tx)
+		for key, version := range watch {
+			current, err := txKeyVersion(tx, key)
 			if err != nil {
-				resps = append(resps, err)
-			} else {
-				resps = append(resps, pconn.resps...)
+				return nil, err
+			}
+			if current != version {
+				// a watched key has changed. abort.
+				return nil, nil
 			}
 		}
-		return resps, nil
+		return m.runCommands(tx, cmds), nil
 	}
 
 	dord := func(v interface{}) error {
-		conn.WriteArray(len(cmds))
-		for _, resp := range v.([]interface{}) {
-			switch v := resp.(type) {
-			default:
-				conn.WriteError("ERR invalid response")
-			case string:
-				conn.WriteString(v)
-			case int64:
-				conn.WriteInt64(v)
-			case []byte:
-				conn.WriteBulk(v)
-			case error:
-				conn.WriteError(v.Error())
-			case []int:
-				conn.WriteArray(v[0])
-			}
+		if pipe {
+			writePassiveResps(conn, v.([]interface{}))
+			return nil
+		}
+		if v == nil {
+			conn.WriteNull()
+			return nil
 		}
+		conn.WriteArray(len(cmds))
+		writePassiveResps(conn, v.([]interface{}))
 		return nil
 	}
 
@@ -140,3 +230,51 @@ func (m *Machine) doPlmulti(a finn.Applier, conn redcon.Conn, cmd redcon.Command
 		return dord(v)
 	})
 }
+
+// runCommands runs the commands of a transaction, and returns the replies
+// that they wrote.
+func (m *Machine) runCommands(tx *buntdb.Tx, cmds []redcon.Command) []interface{} {
+	var resps []interface{}
+	for _, cmd := range cmds {
+		pconn := &passiveConn{}
+		_, err := m.doTransactableCommand(&passiveApplier{log: m.log}, pconn, cmd, tx)
+		if err != nil {
+			resps = append(resps, err)
+		} else {
+			resps = append(resps, pconn.resps...)
+		}
+	}
+	return resps
+}
+
+// respWriter writes replies, such as to a redcon.Conn or a redcon.Writer.
+type respWriter interface {
+	WriteString(str string)
+	WriteInt64(num int64)
+	WriteBulk(bulk []byte)
+	WriteError(msg string)
+	WriteNull()
+	WriteArray(count int)
+}
+
+// writePassiveResps writes the replies that were collected by a passiveConn.
+func writePassiveResps(w respWriter, resps []interface{}) {
+	for _, resp := range resps {
+		switch v := resp.(type) {
+		default:
+			w.WriteError("ERR invalid response")
+		case string:
+			w.WriteString(v)
+		case int64:
+			w.WriteInt64(v)
+		case []byte:
+			w.WriteBulk(v)
+		case error:
+			w.WriteError(v.Error())
+		case nil:
+			w.WriteNull()
+		case []int:
+			w.WriteArray(v[0])
+		}
+	}
+}
@@ -0,0 +1,497 @@
+package machine
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// Messages are delivered only to the subscribers that are connected to the
+// local node. PUBLISH and keyspace notifications are generated while the
+// Raft log is applied, which happens on every node, so a client may
+// subscribe to any node in the cluster, including followers.
+
+// Keyspace notification channel prefixes.
+const (
+	keyspaceChannelPrefix = "__keyspace@0__:"
+	keyeventChannelPrefix = "__keyevent@0__:"
+)
+
+// Keyspace notification flags. The flag characters are the same as the
+// 'notify-keyspace-events' setting in Redis, plus 'j' for JSON commands.
+const (
+	notifyKeyspace = 1 << iota // K
+	notifyKeyevent             // E
+	notifyGeneric              // g
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZset                 // z
+	notifyExpired              // x
+	notifyStream               // t
+	notifyJSON                 // j
+
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet |
+		notifyHash | notifyZset | notifyExpired | notifyStream | notifyJSON
+)
+
+// notifyFlagChars maps each flag character to its bit position.
+const notifyFlagChars = "KEg$lshzxtj"
+
+var errInvalidNotifyFlags = errors.New("ERR Invalid event class character. Use 'Ag$lshzxetjKE'.")
+
+func parseNotifyFlags(s string) (int, error) {
+	var flags int
+	for i := 0; i < len(s); i++ {
+		if s[i] == 'A' {
+			flags |= notifyAll
+			continue
+		}
+		idx := strings.IndexByte(notifyFlagChars, s[i])
+		if idx == -1 {
+			return 0, errInvalidNotifyFlags
+		}
+		flags |= 1 << uint(idx)
+	}
+	return flags, nil
+}
+
+func formatNotifyFlags(flags int) string {
+	var s string
+	if flags&notifyAll == notifyAll {
+		s = "A"
+		flags &^= notifyAll
+	}
+	// classes first, then K and E.
+	for i := 2; i < len(notifyFlagChars); i++ {
+		if flags&(1<<uint(i)) != 0 {
+			s += notifyFlagChars[i : i+1]
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if flags&(1<<uint(i)) != 0 {
+			s += notifyFlagChars[i : i+1]
+		}
+	}
+	return s
+}
+
+type pubsubMessage struct {
+	channel string
+	message string
+}
+
+// pubsub tracks the subscriptions of local clients.
+type pubsub struct {
+	mu       sync.Mutex
+	events   int                             // notify-keyspace-events
+	channels map[string]map[*subscriber]bool // channel -> subscribers
+	patterns map[string]map[*subscriber]bool // pattern -> subscribers
+	pending  []pubsubMessage                 // waiting on a commit
+}
+
+func newPubsub() *pubsub {
+	return &pubsub{
+		channels: make(map[string]map[*subscriber]bool),
+		patterns: make(map[string]map[*subscriber]bool),
+	}
+}
+
+// subscriber is a detached client connection which is in pub/sub mode, or
+// is receiving changes. All writes to the client are sent through the out
+// channel, and are written by a single goroutine.
+type subscriber struct {
+	conn     redcon.DetachedConn
+	out      chan []byte
+	done     chan struct{}
+	once     sync.Once
+	channels map[string]bool // guarded by pubsub.mu
+	patterns map[string]bool // guarded by pubsub.mu
+}
+
+// subscriberBacklog is the maximum number of messages that may be waiting
+// to be written to a subscriber. A subscriber that falls further behind is
+// disconnected, which prevents a slow client from stalling the log.
+const subscriberBacklog = 1024
+
+func newSubscriber(conn redcon.DetachedConn) *subscriber {
+	return &subscriber{
+		conn:     conn,
+		out:      make(chan []byte, subscriberBacklog),
+		done:     make(chan struct{}),
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+	}
+}
+
+func (s *subscriber) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+// send queues a message for the client. A nil message closes the client
+// after all prior messages have been written.
+func (s *subscriber) send(msg []byte) {
+	select {
+	case s.out <- msg:
+	case <-s.done:
+	default:
+		s.close()
+	}
+}
+
+func (s *subscriber) writeLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case msg := <-s.out:
+			for msg != nil {
+				s.conn.WriteRaw(msg)
+				if len(s.out) == 0 {
+					break
+				}
+				msg = <-s.out
+			}
+			if err := s.conn.Flush(); err != nil || msg == nil {
+				s.close()
+				return
+			}
+		}
+	}
+}
+
+// subscribe adds a channel or pattern to the subscriber and returns the
+// subscriber's total number of subscriptions.
+func (ps *pubsub) subscribe(s *subscriber, pattern bool, name string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	subs, names := ps.channels, s.channels
+	if pattern {
+		subs, names = ps.patterns, s.patterns
+	}
+	if !names[name] {
+		names[name] = true
+		if subs[name] == nil {
+			subs[name] = make(map[*subscriber]bool)
+		}
+		subs[name][s] = true
+	}
+	return len(s.channels) + len(s.patterns)
+}
+
+// unsubscribe removes a channel or pattern from the subscriber and returns
+// the subscriber's remaining number of subscriptions.
+func (ps *pubsub) unsubscribe(s *subscriber, pattern bool, name string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	subs, names := ps.channels, s.channels
+	if pattern {
+		subs, names = ps.patterns, s.patterns
+	}
+	if names[name] {
+		delete(names, name)
+		delete(subs[name], s)
+		if len(subs[name]) == 0 {
+			delete(subs, name)
+		}
+	}
+	return len(s.channels) + len(s.patterns)
+}
+
+// subscriptions returns the sorted channels or patterns of the subscriber.
+func (ps *pubsub) subscriptions(s *subscriber, pattern bool) []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	names := s.channels
+	if pattern {
+		names = s.patterns
+	}
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// count returns the subscriber's total number of subscriptions.
+func (ps *pubsub) count(s *subscriber) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(s.channels) + len(s.patterns)
+}
+
+// remove drops all of the subscriptions for the subscriber.
+func (ps *pubsub) remove(s *subscriber) {
+	for _, name := range ps.subscriptions(s, false) {
+		ps.unsubscribe(s, false, name)
+	}
+	for _, name := range ps.subscriptions(s, true) {
+		ps.unsubscribe(s, true, name)
+	}
+}
+
+// publish queues a message which will be delivered when the current
+// transaction commits. Returns the number of local receivers.
+func (ps *pubsub) publish(channel, message string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.pending = append(ps.pending, pubsubMessage{channel, message})
+	n := len(ps.channels[channel])
+	for pattern, subs := range ps.patterns {
+		if match.Match(channel, pattern) {
+			n += len(subs)
+		}
+	}
+	return n
+}
+
+// notify queues a keyspace notification for the key, but only when the
+// class of the event has been enabled.
+func (ps *pubsub) notify(class int, event, key string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.events&class == 0 || key == "" {
+		// events without a key, such as flushdb, are not published.
+		return
+	}
+	if ps.events&notifyKeyspace != 0 {
+		ps.pending = append(ps.pending,
+			pubsubMessage{keyspaceChannelPrefix + key, event})
+	}
+	if ps.events&notifyKeyevent != 0 {
+		ps.pending = append(ps.pending,
+			pubsubMessage{keyeventChannelPrefix + event, key})
+	}
+}
+
+// flush delivers the pending messages when commit is true, otherwise the
+// messages are discarded.
+func (ps *pubsub) flush(commit bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if commit {
+		for _, msg := range ps.pending {
+			ps.deliver(msg)
+		}
+	}
+	ps.pending = nil
+}
+
+func (ps *pubsub) deliver(msg pubsubMessage) {
+	if subs := ps.channels[msg.channel]; len(subs) > 0 {
+		reply := pubsubReply("message", msg.channel, msg.message)
+		for s := range subs {
+			s.send(reply)
+		}
+	}
+	for pattern, subs := range ps.patterns {
+		if match.Match(msg.channel, pattern) {
+			reply := pubsubReply("pmessage", pattern, msg.channel, msg.message)
+			for s := range subs {
+				s.send(reply)
+			}
+		}
+	}
+}
+
+// pubsubReply encodes an array reply. Each part must be a string, an int,
+// or nil.
+func pubsubReply(parts ...interface{}) []byte {
+	b := []byte("*" + strconv.Itoa(len(parts)) + "\r\n")
+	for _, part := range parts {
+		switch part := part.(type) {
+		case nil:
+			b = append(b, "$-1\r\n"...)
+		case int:
+			b = append(b, ':')
+			b = strconv.AppendInt(b, int64(part), 10)
+			b = append(b, '\r', '\n')
+		case string:
+			b = append(b, '$')
+			b = strconv.AppendInt(b, int64(len(part)), 10)
+			b = append(b, '\r', '\n')
+			b = append(b, part...)
+			b = append(b, '\r', '\n')
+		}
+	}
+	return b
+}
+
+// notify queues a keyspace notification and records the change. It must be
+// called from the apply path of a write command.
+func (m *Machine) notify(class int, event, key string) {
+	m.ps.notify(class, event, key)
+	m.cl.record(event, key)
+}
+
+// SetNotifyKeyspaceEvents sets which keyspace notifications are published
+// by this node. The flags use the same format as 'notify-keyspace-events'.
+func (m *Machine) SetNotifyKeyspaceEvents(flags string) error {
+	events, err := parseNotifyFlags(flags)
+	if err != nil {
+		return err
+	}
+	m.ps.mu.Lock()
+	m.ps.events = events
+	m.ps.mu.Unlock()
+	return nil
+}
+
+func (m *Machine) doPublish(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// PUBLISH channel message
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		return m.ps.publish(string(cmd.Args[1]), string(cmd.Args[2])), nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+func (m *Machine) doSubscribe(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SUBSCRIBE channel [channel ...]
+	// PSUBSCRIBE pattern [pattern ...]
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	s := newSubscriber(conn.Detach())
+	go s.writeLoop()
+	go func() {
+		defer m.ps.remove(s)
+		for {
+			if m.doSubscriberCommand(s, cmd) {
+				// quit after the pending messages are written.
+				s.send(nil)
+				return
+			}
+			var err error
+			cmd, err = s.conn.ReadCommand()
+			if err != nil {
+				s.close()
+				return
+			}
+		}
+	}()
+	return nil, nil
+}
+
+func (m *Machine) doUnsubscribe(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// UNSUBSCRIBE [channel ...]
+	// PUNSUBSCRIBE [pattern ...]
+	// The connection is not subscribed to anything.
+	kind := qcmdlower(cmd.Args[0])
+	if len(cmd.Args) == 1 {
+		conn.WriteRaw(pubsubReply(kind, nil, 0))
+	}
+	for i := 1; i < len(cmd.Args); i++ {
+		conn.WriteRaw(pubsubReply(kind, string(cmd.Args[i]), 0))
+	}
+	return nil, nil
+}
+
+// doSubscriberCommand executes a command from a client that is in pub/sub
+// mode. Returns true when the client has quit.
+func (m *Machine) doSubscriberCommand(s *subscriber, cmd redcon.Command) bool {
+	if len(cmd.Args) == 0 {
+		return false
+	}
+	kind := qcmdlower(cmd.Args[0])
+	switch kind {
+	default:
+		s.send(pubsubError("ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context"))
+	case "subscribe", "psubscribe":
+		if len(cmd.Args) < 2 {
+			s.send(pubsubError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command"))
+			break
+		}
+		for i := 1; i < len(cmd.Args); i++ {
+			name := string(cmd.Args[i])
+			n := m.ps.subscribe(s, kind == "psubscribe", name)
+			s.send(pubsubReply(kind, name, n))
+		}
+	case "unsubscribe", "punsubscribe":
+		pattern := kind == "punsubscribe"
+		var names []string
+		for i := 1; i < len(cmd.Args); i++ {
+			names = append(names, string(cmd.Args[i]))
+		}
+		if len(names) == 0 {
+			names = m.ps.subscriptions(s, pattern)
+			if len(names) == 0 {
+				s.send(pubsubReply(kind, nil, m.ps.count(s)))
+			}
+		}
+		for _, name := range names {
+			n := m.ps.unsubscribe(s, pattern, name)
+			s.send(pubsubReply(kind, name, n))
+		}
+	case "ping":
+		var msg string
+		if len(cmd.Args) > 1 {
+			msg = string(cmd.Args[1])
+		}
+		s.send(pubsubReply("pong", msg))
+	case "quit":
+		s.send([]byte("+OK\r\n"))
+		return true
+	}
+	return false
+}
+
+func pubsubError(msg string) []byte {
+	return []byte("-" + msg + "\r\n")
+}
+
+func (m *Machine) doConfig(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// CONFIG GET parameter
+	// CONFIG SET parameter value
+	// Only 'notify-keyspace-events' is supported. The setting is local to
+	// the node and is not replicated.
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	switch qcmdlower(cmd.Args[1]) {
+	default:
+		return nil, errSyntaxError
+	case "get":
+		if len(cmd.Args) != 3 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		if !match.Match("notify-keyspace-events", qcmdlower(cmd.Args[2])) {
+			conn.WriteArray(0)
+			return nil, nil
+		}
+		m.ps.mu.Lock()
+		events := m.ps.events
+		m.ps.mu.Unlock()
+		conn.WriteArray(2)
+		conn.WriteBulkString("notify-keyspace-events")
+		conn.WriteBulkString(formatNotifyFlags(events))
+	case "set":
+		if len(cmd.Args) != 4 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		if qcmdlower(cmd.Args[2]) != "notify-keyspace-events" {
+			return nil, errors.New("ERR Unsupported CONFIG parameter: " + string(cmd.Args[2]))
+		}
+		if err := m.SetNotifyKeyspaceEvents(string(cmd.Args[3])); err != nil {
+			return nil, err
+		}
+		conn.WriteString("OK")
+	}
+	return nil, nil
+}
@@ -0,0 +1,195 @@
+package machine
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func subTestPubSub(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "PUBLISH", pubsub_PUBLISH_test)
+	runStep(t, mc, "CONFIG", pubsub_CONFIG_test)
+	runStep(t, mc, "SUBSCRIBE", pubsub_SUBSCRIBE_test)
+	runStep(t, mc, "notifications", pubsub_notifications_test)
+}
+
+// pubsubDialFollower connects to a server that is not the current server.
+// The current server is the leader after a write has been sent, such as the
+// FLUSHDB that starts each step.
+func pubsubDialFollower(mc *mockCluster) (redis.Conn, error) {
+	for _, s := range mc.ss {
+		if s != mc.cs {
+			return redis.Dial("tcp", fmt.Sprintf(":%d", s.port),
+				redis.DialReadTimeout(time.Second*5))
+		}
+	}
+	return nil, fmt.Errorf("no follower")
+}
+
+// pubsubExpect sends an optional command and then checks the next reply.
+func pubsubExpect(conn redis.Conn, expect string, args ...interface{}) error {
+	if len(args) > 0 {
+		if err := conn.Send(args[0].(string), args[1:]...); err != nil {
+			return err
+		}
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+	}
+	resp, err := conn.Receive()
+	if err != nil {
+		if _, ok := err.(redis.Error); !ok {
+			return err
+		}
+		resp = err.Error()
+	}
+	if fmt.Sprintf("%v", normalize(resp)) != expect {
+		return fmt.Errorf("expected '%v', got '%v'", expect, normalize(resp))
+	}
+	return nil
+}
+
+func pubsub_PUBLISH_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"PUBLISH", "news", "hello"}, {0},
+		{"PUBLISH", "news"}, {"ERR wrong number of arguments for 'PUBLISH' command"},
+		{"UNSUBSCRIBE"}, {"[unsubscribe nil 0]"},
+		{"PUNSUBSCRIBE", "n*"}, {"[punsubscribe n* 0]"},
+		{"MULTI"}, {"OK"},
+		{"PUBLISH", "news", "hello"}, {"QUEUED"},
+		{"EXEC"}, {"[0]"},
+	})
+}
+
+func pubsub_CONFIG_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"CONFIG", "GET", "notify-keyspace-events"}, {"[notify-keyspace-events ]"},
+		{"CONFIG", "SET", "notify-keyspace-events", "KEA"}, {"OK"},
+		{"CONFIG", "GET", "notify-*"}, {"[notify-keyspace-events AKE]"},
+		{"CONFIG", "SET", "notify-keyspace-events", "Kl$"}, {"OK"},
+		{"CONFIG", "GET", "notify-keyspace-events"}, {"[notify-keyspace-events $lK]"},
+		{"CONFIG", "SET", "notify-keyspace-events", "Kq"}, {"ERR Invalid event class character. Use 'Ag$lshzxetjKE'."},
+		{"CONFIG", "SET", "notify-keyspace-events", ""}, {"OK"},
+		{"CONFIG", "GET", "notify-keyspace-events"}, {"[notify-keyspace-events ]"},
+		{"CONFIG", "GET", "maxmemory"}, {"[]"},
+		{"CONFIG", "SET", "maxmemory", "1"}, {"ERR Unsupported CONFIG parameter: maxmemory"},
+		{"CONFIG", "RESET"}, {"ERR syntax error"},
+	})
+}
+
+func pubsub_SUBSCRIBE_test(mc *mockCluster) error {
+	conn, err := pubsubDialFollower(mc)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	steps := [][]interface{}{
+		{"[subscribe news 1]", "SUBSCRIBE", "news"},
+		{"[psubscribe n* 2]", "PSUBSCRIBE", "n*"},
+		{"[subscribe news 2]", "SUBSCRIBE", "news"},
+		{"ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context", "GET", "news"},
+		{"[pong ]", "PING"},
+	}
+	for _, step := range steps {
+		if err := pubsubExpect(conn, step[0].(string), step[1:]...); err != nil {
+			return err
+		}
+	}
+	// publish through the leader. the subscriber is on a follower.
+	if err := mc.DoBatch([][]interface{}{
+		{"PUBLISH", "news", "hello"}, {0},
+		{"PUBLISH", "nothing", "world"}, {0},
+		{"PUBLISH", "other", "ignored"}, {0},
+	}); err != nil {
+		return err
+	}
+	steps = [][]interface{}{
+		{"[message news hello]"},
+		{"[pmessage n* news hello]"},
+		{"[pmessage n* nothing world]"},
+		{"[unsubscribe news 1]", "UNSUBSCRIBE"},
+		{"[punsubscribe n* 0]", "PUNSUBSCRIBE"},
+		{"[unsubscribe <nil> 0]", "UNSUBSCRIBE"},
+		{"OK", "QUIT"},
+	}
+	for _, step := range steps {
+		if err := pubsubExpect(conn, step[0].(string), step[1:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pubsub_notifications_test(mc *mockCluster) error {
+	// notifications are configured on each node.
+	config := func(flags string) error {
+		for _, s := range mc.ss {
+			if _, err := s.Do("CONFIG", "SET", "notify-keyspace-events", flags); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := config("KEA"); err != nil {
+		return err
+	}
+	defer config("")
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "other", "value"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	conn, err := pubsubDialFollower(mc)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	steps := [][]interface{}{
+		{"[subscribe __keyspace@0__:mykey 1]", "SUBSCRIBE", "__keyspace@0__:mykey"},
+		{"[subscribe __keyevent@0__:del 2]", "SUBSCRIBE", "__keyevent@0__:del"},
+	}
+	for _, step := range steps {
+		if err := pubsubExpect(conn, step[0].(string), step[1:]...); err != nil {
+			return err
+		}
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "mykey", "hello"}, {"OK"},
+		{"EXPIRE", "mykey", 100}, {1},
+		{"DEL", "nokey"}, {0},
+		{"DEL", "mykey"}, {1},
+		{"RPUSH", "mykey", "a"}, {1},
+		{"LPOP", "mykey"}, {"a"},
+		{"JSET", "mykey", "name", "Tom"}, {"OK"},
+		{"EVAL", `sdb.call("set", "mykey", "2"); throw "oops"`, 0}, {"oops"},
+		{"MULTI"}, {"OK"},
+		{"SET", "mykey", "1"}, {"QUEUED"},
+		{"RENAME", "mykey", "newkey"}, {"QUEUED"},
+		{"DEL", "other"}, {"QUEUED"},
+		{"EXEC"}, {"[OK OK 1]"},
+	}); err != nil {
+		return err
+	}
+	steps = [][]interface{}{
+		{"[message __keyspace@0__:mykey set]"},
+		{"[message __keyspace@0__:mykey expire]"},
+		{"[message __keyspace@0__:mykey del]"},
+		{"[message __keyevent@0__:del mykey]"},
+		{"[message __keyspace@0__:mykey rpush]"},
+		{"[message __keyspace@0__:mykey lpop]"},
+		{"[message __keyspace@0__:mykey del]"},
+		{"[message __keyevent@0__:del mykey]"},
+		{"[message __keyspace@0__:mykey jset]"},
+		{"[message __keyspace@0__:mykey set]"},
+		{"[message __keyspace@0__:mykey rename_from]"},
+		{"[message __keyevent@0__:del other]"},
+	}
+	for _, step := range steps {
+		if err := pubsubExpect(conn, step[0].(string), step[1:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,35 +1,170 @@
 package machine
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
 )
 
 func subTestRaft(t *testing.T, mc *mockCluster) {
 	runStep(t, mc, "snapshot", raft_SNAPSHOT_test)
+	runStep(t, mc, "restore", raft_RESTORE_test)
+	runStep(t, mc, "backup", raft_BACKUP_test)
+	runStep(t, mc, "tempdirs", raft_TEMPDIRS_test)
+	runStep(t, mc, "readindex", raft_READINDEX_test)
+	runStep(t, mc, "transfer", raft_TRANSFERLEADER_test)
+	runStep(t, mc, "learner", raft_LEARNER_test)
+	runStep(t, mc, "removelearner", raft_REMOVELEARNER_test)
+	runStep(t, mc, "forcenewcluster", raft_FORCENEWCLUSTER_test)
 	runStep(t, mc, "join", raft_JOIN_test)
 	runStep(t, mc, "remove", raft_REMOVE_test)
 }
 
 func raft_SNAPSHOT_test(mc *mockCluster) error {
-	for i := 0; i < 1000; i++ {
+	if err := raftSetKeys(mc, 1000); err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"RAFTSNAPSHOT"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// raftSetKeys sets the keys from key:0 to key:n-1.
+func raftSetKeys(mc *mockCluster, n int) error {
+	for i := 0; i < n; i++ {
 		if err := mc.DoBatch([][]interface{}{
 			{"SET", fmt.Sprintf("key:%d", i), fmt.Sprintf("val:%d", i)}, {"OK"},
 		}); err != nil {
 			return err
 		}
 	}
-	if err := mc.DoBatch([][]interface{}{
-		{"RAFTSNAPSHOT"}, {"OK"},
-	}); err != nil {
+	return nil
+}
+
+func raft_RESTORE_test(mc *mockCluster) error {
+	if err := raftSetKeys(mc, 100); err != nil {
+		return err
+	}
+	// a snapshot of the database is restored into a new machine.
+	var buf bytes.Buffer
+	if err := mc.cs.m.Snapshot(&buf); err != nil {
+		return err
+	}
+	m, err := New(mc.cs.m.log, "")
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	if err := m.Restore(&buf); err != nil {
+		return err
+	}
+	return m.db.View(func(tx *buntdb.Tx) error {
+		for i := 0; i < 100; i++ {
+			val, err := txGetString(tx, fmt.Sprintf("key:%d", i))
+			if err != nil {
+				return err
+			}
+			if val != fmt.Sprintf("val:%d", i) {
+				return fmt.Errorf("expected 'val:%d', got '%v'", i, val)
+			}
+		}
+		return nil
+	})
+}
+
+func raft_BACKUP_test(mc *mockCluster) error {
+	if err := raftSetKeys(mc, 100); err != nil {
+		return err
+	}
+	// the connection is closed after the backup.
+	conn, err := redis.Dial("tcp", fmt.Sprintf(":%d", mc.cs.port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	data, err := redis.Bytes(conn.Do("BACKUP"))
+	if err != nil {
+		return err
+	}
+	db, err := buntdb.Open(":memory:")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Load(bytes.NewReader(data)); err != nil {
+		return err
+	}
+	return db.View(func(tx *buntdb.Tx) error {
+		val, err := txGetString(tx, "key:99")
+		if err != nil {
+			return err
+		}
+		if val != "val:99" {
+			return fmt.Errorf("expected 'val:99', got '%v'", val)
+		}
+		return nil
+	})
+}
+
+func raft_TEMPDIRS_test(mc *mockCluster) error {
+	// a directory with only a database is removed, and any other is kept,
+	// as is one whose database is open in another instance.
+	stale, err := ioutil.TempDir("", "summitdb")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stale)
+	if err := ioutil.WriteFile(filepath.Join(stale, "data.db"), nil, 0666); err != nil {
+		return err
+	}
+	other, err := ioutil.TempDir("", "summitdb")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(other)
+	if err := ioutil.WriteFile(filepath.Join(other, "other.txt"), nil, 0666); err != nil {
+		return err
+	}
+	live, err := ioutil.TempDir("", "summitdb")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(live)
+	f, err := os.Create(filepath.Join(live, "data.db"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := RemoveTempDirs(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		return fmt.Errorf("expected '%v' to be removed, got '%v'", stale, err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		return err
+	}
+	if _, err := os.Stat(live); err != nil {
 		return err
 	}
 	return nil
 }
+
 func raftWaitForNumPeers(mc *mockCluster, count int) error {
 	for {
 		var numPeers int
@@ -63,6 +198,316 @@ func raftWaitForNumPeers(mc *mockCluster, count int) error {
 	}
 }
 
+func raft_READINDEX_test(mc *mockCluster) error {
+	if err := raftWaitForNumPeers(mc, 2); err != nil {
+		return err
+	}
+	// the current server is the leader after a write.
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "mykey", 0}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	s, err := mockOpenServerLevel(mc.cs, finn.ReadIndex)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	for i := 1; i <= 100; i++ {
+		if err := mc.DoBatch([][]interface{}{
+			{"INCR", "mykey"}, {i},
+		}); err != nil {
+			return err
+		}
+		// the write must be visible on the follower right away.
+		resp, err := s.Do("GET", "mykey")
+		if err != nil {
+			return err
+		}
+		if resp := fmt.Sprintf("%s", resp); resp != strconv.Itoa(i) {
+			return fmt.Errorf("expected '%v', got '%v'", i, resp)
+		}
+	}
+	resp, err := s.Do("RAFTREADINDEX")
+	if err != nil {
+		return err
+	}
+	if rerr, ok := resp.(error); !ok || !strings.HasPrefix(rerr.Error(), "TRY ") {
+		return fmt.Errorf("expected 'TRY', got '%v'", resp)
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"RAFTREMOVEPEER", fmt.Sprintf(":%d", s.port)}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	mc.ResetConn()
+	return raftWaitForNumPeers(mc, 2)
+}
+
+func raft_TRANSFERLEADER_test(mc *mockCluster) error {
+	for i := 0; i < 2; i++ {
+		s, err := mc.Follower()
+		if err != nil {
+			return err
+		}
+		args := []interface{}{"RAFTTRANSFERLEADER"}
+		if i == 0 {
+			args = append(args, fmt.Sprintf(":%d", s.port))
+		}
+		if err := mc.DoBatch([][]interface{}{
+			args, {"OK"},
+		}); err != nil {
+			return err
+		}
+		leader := mc.cs.n.Leader()
+		if i == 0 && leader != fmt.Sprintf(":%d", s.port) {
+			return fmt.Errorf("expected '%v', got '%v'", s.port, leader)
+		}
+		if leader == fmt.Sprintf(":%d", mc.cs.port) {
+			return fmt.Errorf("expected a new leader, got '%v'", leader)
+		}
+		mc.ResetConn()
+		if err := mc.DoBatch([][]interface{}{
+			{"SET", "mykey", i}, {"OK"},
+			{"GET", "mykey"}, {fmt.Sprint(i)},
+		}); err != nil {
+			return err
+		}
+		mc.ResetConn()
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"RAFTTRANSFERLEADER", ":1"}, {"peer is unknown"},
+		{"RAFTTRANSFERLEADER", ":1", ":2"}, {"ERR wrong number of arguments for 'RAFTTRANSFERLEADER' command"},
+		{"RAFTTRANSFERCHECK", "token"}, {"not a leadership transfer of the leader"},
+	}); err != nil {
+		return err
+	}
+	// only the leader can start an election on a follower.
+	s, err := mc.Follower()
+	if err != nil {
+		return err
+	}
+	leader := s.n.Leader()
+	for _, step := range []struct {
+		args   []interface{}
+		expect string
+	}{
+		{[]interface{}{"RAFTTIMEOUTNOW"}, "ERR wrong number of arguments for 'RAFTTIMEOUTNOW' command"},
+		{[]interface{}{"RAFTTIMEOUTNOW", "token"}, "not a leadership transfer of the leader"},
+	} {
+		resp, err := s.Do(step.args[0].(string), step.args[1:]...)
+		if err := checkExpect(step.expect, resp, err); err != nil {
+			return fmt.Errorf("%v: %v", step.args, err)
+		}
+	}
+	time.Sleep(time.Millisecond * 500)
+	if s.n.Leader() != leader {
+		return fmt.Errorf("expected '%v', got '%v'", leader, s.n.Leader())
+	}
+	return nil
+}
+
+func raft_LEARNER_test(mc *mockCluster) error {
+	if err := raftWaitForNumPeers(mc, 2); err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "learnkey", "hello"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	s, err := mockOpenLearner(mc.cs)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	addr := fmt.Sprintf(":%d", s.port)
+	// the learner serves low consistency reads once it catches up.
+	start := time.Now()
+	for {
+		resp, err := s.Do("GET", "learnkey")
+		if err != nil {
+			return err
+		}
+		if fmt.Sprintf("%s", resp) == "hello" {
+			break
+		}
+		if time.Now().Sub(start) > time.Second*5 {
+			return fmt.Errorf("expected 'hello', got '%v'", resp)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	// the learner does not count toward quorum.
+	if err := raftWaitForNumPeers(mc, 2); err != nil {
+		return err
+	}
+	for {
+		resp, err := mc.Do("RAFTPEERS")
+		if err != nil {
+			return err
+		}
+		if strings.Contains(fmt.Sprintf("%s", resp), addr+" Follower Learner") {
+			break
+		}
+		if time.Now().Sub(start) > time.Second*10 {
+			return fmt.Errorf("expected learner role, got '%s'", resp)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"RAFTPROMOTE", ":1"}, {"peer is unknown"},
+		{"RAFTPROMOTE", addr}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	if err := raftWaitForNumPeers(mc, 3); err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"RAFTREMOVEPEER", addr}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	mc.ResetConn()
+	return raftWaitForNumPeers(mc, 2)
+}
+
+// raftWaitForStat waits until a stat from RAFTSTATS on the server has the
+// value.
+func raftWaitForStat(s *mockServer, name, value string) error {
+	start := time.Now()
+	for {
+		stats, err := redis.StringMap(s.Do("RAFTSTATS"))
+		if err != nil {
+			return err
+		}
+		if stats[name] == value {
+			return nil
+		}
+		if time.Now().Sub(start) > time.Second*10 {
+			return fmt.Errorf("expected %s '%v', got '%v'", name, value, stats[name])
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+func raft_REMOVELEARNER_test(mc *mockCluster) error {
+	// a separate cluster that keeps a single entry of the log after a
+	// snapshot.
+	rand.Seed(time.Now().UnixNano())
+	var opts finn.Options
+	opts.Consistency = finn.High
+	opts.TrailingLogs = 1
+	leader, err := mockOpenServerPort(rand.Int()%20000+20000, nil, opts)
+	if err != nil {
+		return err
+	}
+	defer leader.Close()
+	lopts := opts
+	lopts.Learner = true
+	l, err := mockOpenServerPort(rand.Int()%20000+20000, leader, lopts)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := raftWaitForStat(leader, "num_learners", "1"); err != nil {
+		return err
+	}
+	// the last learner is removed, and the removal is compacted away.
+	if resp, err := leader.Do("RAFTREMOVEPEER", fmt.Sprintf(":%d", l.port)); checkExpect("OK", resp, err) != nil {
+		return fmt.Errorf("expected 'OK', got '%v', '%v'", resp, err)
+	}
+	if err := raftWaitForStat(leader, "num_learners", "0"); err != nil {
+		return err
+	}
+	if resp, err := leader.Do("SET", "learnkey", "hello"); checkExpect("OK", resp, err) != nil {
+		return fmt.Errorf("expected 'OK', got '%v', '%v'", resp, err)
+	}
+	if resp, err := leader.Do("RAFTSNAPSHOT"); checkExpect("OK", resp, err) != nil {
+		return fmt.Errorf("expected 'OK', got '%v', '%v'", resp, err)
+	}
+	// a new follower is restored from the snapshot, and knows of no
+	// learners.
+	s, err := mockOpenServerPort(rand.Int()%20000+20000, leader, opts)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	start := time.Now()
+	for {
+		stats, err := redis.StringMap(s.Do("RAFTSTATS"))
+		if err != nil {
+			return err
+		}
+		if stats["last_snapshot_index"] != "0" {
+			if stats["num_learners"] != "0" {
+				return fmt.Errorf("expected num_learners '0', got '%v'", stats["num_learners"])
+			}
+			return nil
+		}
+		if time.Now().Sub(start) > time.Second*10 {
+			return errors.New("expected the follower to install a snapshot")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+func raft_FORCENEWCLUSTER_test(mc *mockCluster) error {
+	// a separate two node cluster, which loses a majority when a node
+	// goes down.
+	s1, err := mockOpenServer(nil)
+	if err != nil {
+		return err
+	}
+	s2, err := mockOpenServer(s1)
+	if err != nil {
+		s1.Close()
+		return err
+	}
+	err = func() error {
+		defer s1.Close()
+		defer s2.Close()
+		if resp, err := redis.String(s1.Do("SET", "mykey", "survived")); err != nil || resp != "OK" {
+			return fmt.Errorf("expected 'OK', got '%v', '%v'", resp, err)
+		}
+		// wait for the write to be applied on the follower.
+		start := time.Now()
+		for {
+			stats, err := redis.StringMap(s2.Do("RAFTSTATS"))
+			if err != nil {
+				return err
+			}
+			if stats["applied_index"] == stats["last_log_index"] {
+				return nil
+			}
+			if time.Now().Sub(start) > time.Second*5 {
+				return errTimeout
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	s3, err := mockForceNewCluster(s2)
+	if err != nil {
+		return err
+	}
+	defer s3.Close()
+	if resp, err := redis.String(s3.Do("GET", "mykey")); err != nil || resp != "survived" {
+		return fmt.Errorf("expected 'survived', got '%v', '%v'", resp, err)
+	}
+	s4, err := mockOpenServer(s3)
+	if err != nil {
+		return err
+	}
+	defer s4.Close()
+	if resp, err := redis.String(s3.Do("SET", "mykey", "joined")); err != nil || resp != "OK" {
+		return fmt.Errorf("expected 'OK', got '%v', '%v'", resp, err)
+	}
+	return nil
+}
+
 func raft_JOIN_test(mc *mockCluster) error {
 	if err := raftWaitForNumPeers(mc, 2); err != nil {
 		return err
@@ -0,0 +1,776 @@
+package machine
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// When the keyspace is sharded, each raft group keeps the key ranges that
+// it serves in its own log, and the meta group (group zero) also keeps the
+// routing table, which maps every range to a group. A range is moved to
+// another group in steps that are each applied through a raft log:
+//
+//  1. The meta group records the move, so it's resumed after a crash.
+//  2. The source group marks the range as leaving. Commands for keys in
+//     the range are rejected with TRYAGAIN from now on.
+//  3. The keys are copied in batches to the target group.
+//  4. The target group takes ownership of the range.
+//  5. The meta group points the range at the target group.
+//  6. The source group deletes the keys and gives up the range.
+//  7. The meta group clears the record of the move.
+//
+// Every step can be repeated, and a copy into a range that the target group
+// already owns is ignored, so a move that was interrupted at any point is
+// completed by running it again.
+
+const (
+	// rangeKeyPrefix is the prefix for the ranges that a group owns. The
+	// key is the start of a range and the value is the end.
+	rangeKeyPrefix = sdbMetaPrefix + "range:"
+	// leavingKeyPrefix is the prefix for the ranges that are being moved
+	// to another group.
+	leavingKeyPrefix = sdbMetaPrefix + "leaving:"
+	// rangesKey is set once the ranges of a group have been written.
+	// Until then group zero owns the entire keyspace.
+	rangesKey = sdbMetaPrefix + "ranges"
+	// routeKeyPrefix is the prefix for the routing table, which is only
+	// kept by the meta group. The value is the group and the end of the
+	// range, separated by a colon.
+	routeKeyPrefix = sdbMetaPrefix + "route:"
+	// routeMoveKey holds the range move that is in progress.
+	routeMoveKey = sdbMetaPrefix + "routemove"
+)
+
+var (
+	errRangeMoving = errors.New("TRYAGAIN key range is being moved to another group")
+	errCrossGroup  = errors.New("CROSSGROUP Keys in request belong to different groups")
+	errNotSharded  = errors.New("ERR the keyspace is not sharded")
+	errNotMeta     = errors.New("ERR not the meta group")
+)
+
+// keyRange is the range of keys from start up to, but not including, end.
+// An empty end is the end of the keyspace.
+type keyRange struct {
+	start, end string
+}
+
+func (r keyRange) contains(key string) bool {
+	return key >= r.start && (r.end == "" || key < r.end)
+}
+
+func (r keyRange) empty() bool {
+	return r.end != "" && r.end <= r.start
+}
+
+// endLess returns true when the end a comes before the end b.
+func endLess(a, b string) bool {
+	return a != "" && (b == "" || a < b)
+}
+
+func minEnd(a, b string) string {
+	if endLess(a, b) {
+		return a
+	}
+	return b
+}
+
+func maxString(a, b string) string {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func rangesContain(set []keyRange, key string) bool {
+	for _, r := range set {
+		if r.contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// addRange returns the union of the set and the range. Ranges that overlap
+// or touch are joined.
+func addRange(set []keyRange, r keyRange) []keyRange {
+	if r.empty() {
+		return set
+	}
+	all := append(append([]keyRange(nil), set...), r)
+	sort.Slice(all, func(i, j int) bool { return all[i].start < all[j].start })
+	var res []keyRange
+	for _, r := range all {
+		if n := len(res); n > 0 && (res[n-1].end == "" || res[n-1].end >= r.start) {
+			if endLess(res[n-1].end, r.end) {
+				res[n-1].end = r.end
+			}
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// subRange returns the set without the range.
+func subRange(set []keyRange, r keyRange) []keyRange {
+	var res []keyRange
+	for _, s := range set {
+		if left := (keyRange{s.start, minEnd(s.end, r.start)}); s.start < r.start && !left.empty() {
+			res = append(res, left)
+		}
+		if r.end != "" {
+			if right := (keyRange{maxString(s.start, r.end), s.end}); !right.empty() {
+				res = append(res, right)
+			}
+		}
+	}
+	return res
+}
+
+// intersectRange returns the parts of the set that are in the range.
+func intersectRange(set []keyRange, r keyRange) []keyRange {
+	var res []keyRange
+	for _, s := range set {
+		i := keyRange{maxString(s.start, r.start), minEnd(s.end, r.end)}
+		if !i.empty() {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// keyRoute is an entry in the routing table.
+type keyRoute struct {
+	keyRange
+	group int
+}
+
+// splitRoutes splits the route that contains the key, so that a route
+// starts at the key.
+func splitRoutes(routes []keyRoute, key string) []keyRoute {
+	for i, rt := range routes {
+		if rt.contains(key) {
+			if rt.start == key {
+				return routes
+			}
+			res := append([]keyRoute(nil), routes[:i]...)
+			res = append(res,
+				keyRoute{keyRange{rt.start, key}, rt.group},
+				keyRoute{keyRange{key, rt.end}, rt.group})
+			return append(res, routes[i+1:]...)
+		}
+	}
+	return routes
+}
+
+// setRoute points all keys in the range at the group.
+func setRoute(routes []keyRoute, r keyRange, group int) []keyRoute {
+	routes = splitRoutes(routes, r.start)
+	if r.end != "" {
+		routes = splitRoutes(routes, r.end)
+	}
+	for i, rt := range routes {
+		if rt.start >= r.start && !endLess(r.end, rt.end) {
+			routes[i].group = group
+		}
+	}
+	return routes
+}
+
+// routeGroup returns the group in the routing table for a key.
+func routeGroup(routes []keyRoute, key string) int {
+	i := sort.Search(len(routes), func(i int) bool {
+		return routes[i].start > key
+	})
+	if i == 0 {
+		return 0
+	}
+	return routes[i-1].group
+}
+
+func txReadRanges(tx *buntdb.Tx, prefix string) ([]keyRange, error) {
+	var set []keyRange
+	err := tx.AscendGreaterOrEqual("", prefix, func(key, val string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		set = append(set, keyRange{key[len(prefix):], val})
+		return true
+	})
+	return set, err
+}
+
+func txWriteRanges(tx *buntdb.Tx, prefix string, set []keyRange) error {
+	var keys []string
+	if err := tx.AscendGreaterOrEqual("", prefix, func(key, val string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := tx.Delete(key); err != nil {
+			return err
+		}
+	}
+	for _, r := range set {
+		if _, _, err := tx.Set(prefix+r.start, r.end, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// txReadRoutes returns the routing table. The table always covers the
+// entire keyspace.
+func txReadRoutes(tx *buntdb.Tx) ([]keyRoute, error) {
+	var routes []keyRoute
+	var perr error
+	err := tx.AscendGreaterOrEqual("", routeKeyPrefix, func(key, val string) bool {
+		if !strings.HasPrefix(key, routeKeyPrefix) {
+			return false
+		}
+		parts := strings.SplitN(val, ":", 2)
+		group, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			perr = errors.New("invalid route")
+			return false
+		}
+		routes = append(routes, keyRoute{keyRange{key[len(routeKeyPrefix):], parts[1]}, group})
+		return true
+	})
+	if err == nil {
+		err = perr
+	}
+	if len(routes) == 0 {
+		routes = []keyRoute{{keyRange{"", ""}, 0}}
+	}
+	return routes, err
+}
+
+func txWriteRoutes(tx *buntdb.Tx, routes []keyRoute) error {
+	var keys []string
+	if err := tx.AscendGreaterOrEqual("", routeKeyPrefix, func(key, val string) bool {
+		if !strings.HasPrefix(key, routeKeyPrefix) {
+			return false
+		}
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := tx.Delete(key); err != nil {
+			return err
+		}
+	}
+	for _, rt := range routes {
+		val := strconv.Itoa(rt.group) + ":" + rt.end
+		if _, _, err := tx.Set(routeKeyPrefix+rt.start, val, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rangeMove is a range that is being moved from one group to another.
+type rangeMove struct {
+	keyRange
+	from, to int
+}
+
+func (mv rangeMove) args() [][]byte {
+	return [][]byte{
+		[]byte(mv.start), []byte(mv.end),
+		[]byte(strconv.Itoa(mv.from)), []byte(strconv.Itoa(mv.to)),
+	}
+}
+
+func parseRangeMove(args [][]byte) (rangeMove, error) {
+	if len(args) != 4 {
+		return rangeMove{}, finn.ErrWrongNumberOfArguments
+	}
+	from, err1 := strconv.Atoi(string(args[2]))
+	to, err2 := strconv.Atoi(string(args[3]))
+	if err1 != nil || err2 != nil {
+		return rangeMove{}, errNotAnInt
+	}
+	return rangeMove{keyRange{string(args[0]), string(args[1])}, from, to}, nil
+}
+
+// txRangeMove returns the range move that is in progress, if any.
+func txRangeMove(tx *buntdb.Tx) (*rangeMove, error) {
+	val, err := tx.Get(routeMoveKey)
+	if err != nil {
+		if err == buntdb.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	cmd, err := parseCommand([]byte(val))
+	if err != nil {
+		return nil, err
+	}
+	mv, err := parseRangeMove(cmd.Args)
+	if err != nil {
+		return nil, err
+	}
+	return &mv, nil
+}
+
+// loadRanges reads the ranges of the group, the keys that are locked by
+// transactions, and the routing table for the meta group, from the
+// database.
+func (m *Machine) loadRanges(tx *buntdb.Tx) error {
+	owned, err := txReadRanges(tx, rangeKeyPrefix)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Get(rangesKey); err != nil {
+		if err != buntdb.ErrNotFound {
+			return err
+		}
+		owned = nil
+		if m.group == 0 {
+			owned = []keyRange{{"", ""}}
+		}
+	}
+	leaving, err := txReadRanges(tx, leavingKeyPrefix)
+	if err != nil {
+		return err
+	}
+	m.rmu.Lock()
+	m.owned, m.leaving = owned, leaving
+	m.rmu.Unlock()
+	if err := m.loadIntents(tx); err != nil {
+		return err
+	}
+	if m.group == 0 {
+		routes, err := txReadRoutes(tx)
+		if err != nil {
+			return err
+		}
+		m.sh.setRoutes(routes)
+	}
+	return nil
+}
+
+// setRanges writes the ranges of the group.
+func (m *Machine) setRanges(tx *buntdb.Tx, owned, leaving []keyRange) error {
+	if err := txWriteRanges(tx, rangeKeyPrefix, owned); err != nil {
+		return err
+	}
+	if err := txWriteRanges(tx, leavingKeyPrefix, leaving); err != nil {
+		return err
+	}
+	if _, _, err := tx.Set(rangesKey, "1", nil); err != nil {
+		return err
+	}
+	m.rmu.Lock()
+	m.owned, m.leaving = owned, leaving
+	m.rmu.Unlock()
+	return nil
+}
+
+func (m *Machine) ranges() (owned, leaving []keyRange) {
+	m.rmu.RLock()
+	defer m.rmu.RUnlock()
+	return m.owned, m.leaving
+}
+
+// ownsKey returns true when the key is in a range of the group.
+func (m *Machine) ownsKey(key string) bool {
+	m.rmu.RLock()
+	defer m.rmu.RUnlock()
+	return rangesContain(m.owned, key)
+}
+
+// servesKey returns true when the key is served by this machine. A group
+// may hold keys that it doesn't serve while a range is being copied to it.
+func (m *Machine) servesKey(key string) bool {
+	return m.sh == nil || m.ownsKey(key)
+}
+
+// keyGroup returns the group that serves the key.
+func (m *Machine) keyGroup(key string) (int, error) {
+	m.rmu.RLock()
+	owned := rangesContain(m.owned, key)
+	leaving := rangesContain(m.leaving, key)
+	m.rmu.RUnlock()
+	if owned {
+		if leaving {
+			return 0, errRangeMoving
+		}
+		return m.group, nil
+	}
+	group := m.sh.routeGroup(key)
+	if group == m.group {
+		// the routing table hasn't caught up with the move yet.
+		return 0, errRangeMoving
+	}
+	return group, nil
+}
+
+// checkRanges is called for every command that is applied from the log.
+// A command with a key that the group doesn't serve, that is being moved,
+// or that is locked by a transaction, is rejected without changing
+// anything.
+func (m *Machine) checkRanges(cmd redcon.Command) error {
+	route, keys := commandRoute(cmd.Args)
+	if route != routeKeys {
+		return nil
+	}
+	owned, leaving := m.ranges()
+	for _, key := range keys {
+		if !rangesContain(owned, string(key)) || rangesContain(leaving, string(key)) {
+			return errRangeMoving
+		}
+		if _, ok := m.lockedBy(string(key)); ok {
+			return errKeyLocked
+		}
+	}
+	return nil
+}
+
+func parseKeyRange(cmd redcon.Command) (keyRange, error) {
+	if len(cmd.Args) != 3 {
+		return keyRange{}, finn.ErrWrongNumberOfArguments
+	}
+	return keyRange{string(cmd.Args[1]), string(cmd.Args[2])}, nil
+}
+
+// ascendRange iterates over the keys in the range, skipping meta keys.
+func ascendRange(tx *buntdb.Tx, r keyRange, iter func(key, val string) bool) error {
+	return tx.AscendGreaterOrEqual("", r.start, func(key, val string) bool {
+		if r.end != "" && key >= r.end {
+			return false
+		}
+		if isMercMetaKey(key) {
+			return true
+		}
+		return iter(key, val)
+	})
+}
+
+func (m *Machine) doRangeStats(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SDBRANGESTATS start end
+	r, err := parseKeyRange(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		var count int
+		if err := ascendRange(tx, r, func(key, val string) bool {
+			count++
+			return true
+		}); err != nil {
+			return err
+		}
+		// the middle key is where the range would be split.
+		var middle string
+		var i int
+		if err := ascendRange(tx, r, func(key, val string) bool {
+			middle = key
+			i++
+			return i <= count/2
+		}); err != nil {
+			return err
+		}
+		conn.WriteArray(2)
+		conn.WriteInt(count)
+		conn.WriteBulkString(middle)
+		return nil
+	})
+}
+
+func (m *Machine) doRangeLeave(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SDBRANGELEAVE start end
+	r, err := parseKeyRange(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		if m.rangeLocked(r) {
+			// the keys of a prepared transaction would be copied before
+			// it commits.
+			return nil, errKeyLocked
+		}
+		owned, leaving := m.ranges()
+		for _, r := range intersectRange(owned, r) {
+			leaving = addRange(leaving, r)
+		}
+		return nil, m.setRanges(tx, owned, leaving)
+	}, func(v interface{}) error {
+		conn.WriteString("OK")
+		return nil
+	})
+}
+
+func (m *Machine) doRangeOwn(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SDBRANGEOWN start end
+	r, err := parseKeyRange(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		owned, leaving := m.ranges()
+		return nil, m.setRanges(tx, addRange(owned, r), leaving)
+	}, func(v interface{}) error {
+		conn.WriteString("OK")
+		return nil
+	})
+}
+
+func (m *Machine) doRangeDrop(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SDBRANGEDROP start end
+	r, err := parseKeyRange(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		// only the keys of a range that is leaving are dropped.
+		owned, leaving := m.ranges()
+		var keys []string
+		for _, r := range intersectRange(leaving, r) {
+			if err := ascendRange(tx, r, func(key, val string) bool {
+				keys = append(keys, key)
+				return true
+			}); err != nil {
+				return nil, err
+			}
+			owned, leaving = subRange(owned, r), subRange(leaving, r)
+		}
+		// the keys now belong to another group, so this isn't a change
+		// that is published or streamed.
+		for _, key := range keys {
+			if _, err := deleteKey(tx, key); err != nil {
+				return nil, err
+			}
+			if _, err := tx.Delete(versionKeyPrefix + key); err != nil && err != buntdb.ErrNotFound {
+				return nil, err
+			}
+		}
+		return nil, m.setRanges(tx, owned, leaving)
+	}, func(v interface{}) error {
+		conn.WriteString("OK")
+		return nil
+	})
+}
+
+func (m *Machine) doRangeDump(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SDBRANGEDUMP start end count
+	if len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	r := keyRange{string(cmd.Args[1]), string(cmd.Args[2])}
+	count, err := strconv.Atoi(string(cmd.Args[3]))
+	if err != nil || count < 1 {
+		return nil, errNotAnInt
+	}
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		var keys []string
+		if err := ascendRange(tx, r, func(key, val string) bool {
+			keys = append(keys, key)
+			return len(keys) < count
+		}); err != nil {
+			return err
+		}
+		// each key is sent with its time to live in milliseconds and its
+		// serialized value.
+		var vals []string
+		for _, key := range keys {
+			ttl, err := tx.TTL(key)
+			if err != nil {
+				return err
+			}
+			val, err := dumpValue(tx, key)
+			if err != nil {
+				return err
+			}
+			var pttl int64
+			if ttl >= 0 {
+				pttl = int64(ttl/time.Millisecond) + 1
+			}
+			vals = append(vals, key, strconv.FormatInt(pttl, 10), val)
+		}
+		conn.WriteArray(len(vals))
+		for _, val := range vals {
+			conn.WriteBulkString(val)
+		}
+		return nil
+	})
+}
+
+func (m *Machine) doRangeLoad(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SDBRANGELOAD key pttl serialized-value [key pttl serialized-value ...]
+	if len(cmd.Args) < 4 || (len(cmd.Args)-1)%3 != 0 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	pttls := make([]int64, 0, (len(cmd.Args)-1)/3)
+	for i := 1; i < len(cmd.Args); i += 3 {
+		if isMercMetaKeyBytes(cmd.Args[i]) {
+			return nil, errKeyNotAllowed
+		}
+		pttl, err := strconv.ParseInt(string(cmd.Args[i+1]), 10, 64)
+		if err != nil || pttl < 0 {
+			return nil, errNotAnInt
+		}
+		pttls = append(pttls, pttl)
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		var n int
+		for i := 1; i < len(cmd.Args); i += 3 {
+			key := string(cmd.Args[i])
+			if m.ownsKey(key) {
+				// the move has completed, and the key may have been
+				// written since.
+				continue
+			}
+			var opts *buntdb.SetOptions
+			if pttl := pttls[(i-1)/3]; pttl > 0 {
+				now, err := txNow(tx)
+				if err != nil {
+					return nil, err
+				}
+				opts = expireOptions(now + pttl)
+			}
+			if err := restoreValue(tx, key, string(cmd.Args[i+2]), opts); err != nil {
+				return nil, err
+			}
+			m.notify(notifyGeneric, "restore", key)
+			n++
+		}
+		return n, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+func (m *Machine) doRouteMove(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SDBROUTEMOVE start end from to
+	// SDBROUTEDONE start end from to
+	if m.group != 0 {
+		return nil, errNotMeta
+	}
+	mv, err := parseRangeMove(cmd.Args[1:])
+	if err != nil {
+		return nil, err
+	}
+	done := qcmdlower(cmd.Args[0]) == "sdbroutedone"
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		cur, err := txRangeMove(tx)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			if cur != nil && *cur == mv {
+				if _, err := tx.Delete(routeMoveKey); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		}
+		if cur != nil {
+			if *cur != mv {
+				return nil, errors.New("ERR another range is being moved")
+			}
+			return nil, nil
+		}
+		_, _, err = tx.Set(routeMoveKey, string(buildCommand(mv.args()).Raw), nil)
+		return nil, err
+	}, func(v interface{}) error {
+		conn.WriteString("OK")
+		return nil
+	})
+}
+
+func (m *Machine) doRouteSet(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SDBROUTESET start end group
+	if m.group != 0 {
+		return nil, errNotMeta
+	}
+	if len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	r := keyRange{string(cmd.Args[1]), string(cmd.Args[2])}
+	group, err := strconv.Atoi(string(cmd.Args[3]))
+	if err != nil || group < 0 || group >= len(m.sh.groups) {
+		return nil, errors.New("ERR invalid group")
+	}
+	if r.empty() {
+		return nil, errors.New("ERR invalid range")
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		routes, err := txReadRoutes(tx)
+		if err != nil {
+			return nil, err
+		}
+		routes = setRoute(routes, r, group)
+		if err := txWriteRoutes(tx, routes); err != nil {
+			return nil, err
+		}
+		m.sh.setRoutes(routes)
+		return nil, nil
+	}, func(v interface{}) error {
+		conn.WriteString("OK")
+		return nil
+	})
+}
+
+func (m *Machine) doRanges(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// RANGES
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if m.sh == nil {
+		return nil, errNotSharded
+	}
+	routes := m.sh.routesCopy()
+	conn.WriteArray(len(routes))
+	for _, rt := range routes {
+		conn.WriteArray(4)
+		conn.WriteBulkString(rt.start)
+		conn.WriteBulkString(rt.end)
+		conn.WriteInt(rt.group)
+		conn.WriteBulkString(m.sh.groupAddr(rt.group))
+	}
+	return nil, nil
+}
+
+func (m *Machine) doRangeSplit(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// RANGESPLIT key [group]
+	if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if m.sh == nil {
+		return nil, errNotSharded
+	}
+	if isMercMetaKeyBytes(cmd.Args[1]) {
+		return nil, errKeyNotAllowed
+	}
+	key := string(cmd.Args[1])
+	to := -1
+	if len(cmd.Args) == 3 {
+		var err error
+		to, err = strconv.Atoi(string(cmd.Args[2]))
+		if err != nil || to < 0 || to >= len(m.sh.groups) {
+			return nil, errors.New("ERR invalid group")
+		}
+	}
+	if err := m.sh.split(key, to); err != nil {
+		return nil, err
+	}
+	conn.WriteString("OK")
+	return nil, nil
+}
@@ -127,6 +127,49 @@ func newScriptMachine(m *Machine) (*scriptMachine, error) {
 		return nil, err
 	}
 
+	// replace Date with one that uses the time of the run context.
+	if err := sm.vm.Set("__now", func(call otto.FunctionCall) otto.Value {
+		now := localClock()
+		if v, err := call.Otto.Get("runid"); err == nil {
+			sm.mu.Lock()
+			if ctx := sm.runCtxs[v.String()]; ctx != nil {
+				now = ctx.now
+			}
+			sm.mu.Unlock()
+		}
+		v, _ := otto.ToValue(now)
+		return v
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := sm.vm.Run(`
+			Date = (function(NativeDate, now){
+				var Date = function(a, b, c, d, e, f, g){
+					if (!(this instanceof Date)) {
+						return new NativeDate(now()).toString();
+					}
+					switch (arguments.length){
+					case 0: return new NativeDate(now());
+					case 1: return new NativeDate(a);
+					case 2: return new NativeDate(a, b);
+					case 3: return new NativeDate(a, b, c);
+					case 4: return new NativeDate(a, b, c, d);
+					case 5: return new NativeDate(a, b, c, d, e);
+					case 6: return new NativeDate(a, b, c, d, e, f);
+					}
+					return new NativeDate(a, b, c, d, e, f, g);
+				}
+				Date.prototype = NativeDate.prototype;
+				Date.parse = NativeDate.parse;
+				Date.UTC = NativeDate.UTC;
+				Date.now = function(){ return now(); }
+				return Date;
+			}(Date, __now))
+			delete __now;
+		`); err != nil {
+		return nil, err
+	}
+
 	// redirect the console.log
 	log := m.log
 	console, err := sm.vm.Get("console")
@@ -191,11 +234,12 @@ func (sm *scriptMachine) getScript(sha string) *scriptVM {
 	return sm.cache[sha]
 }
 
-func (sm *scriptMachine) addRunContext(runid string, tx *buntdb.Tx) {
+func (sm *scriptMachine) addRunContext(runid string, tx *buntdb.Tx, now int64) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 	sm.runCtxs[runid] = &runContext{
 		tx:   tx,
+		now:  now,
 		conn: &passiveConn{},
 		a:    &passiveApplier{log: sm.log},
 	}
@@ -211,6 +255,7 @@ type runContext struct {
 	a    *passiveApplier
 	conn *passiveConn
 	tx   *buntdb.Tx
+	now  int64 // time in milliseconds, for Date
 }
 
 // cmdFromArgs creates a redcon.Command from javascript values
@@ -469,8 +514,12 @@ func (m *Machine) doEval(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 			// yay. we now have a sha, javascript and a compiled script.
 		}
 
-		// create a run context.
-		m.sm.addRunContext(runid, tx)
+		// create a run context. scripts that write see the cluster time.
+		now, err := txNow(tx)
+		if err != nil {
+			return nil, err
+		}
+		m.sm.addRunContext(runid, tx, now)
 		defer m.sm.removeRunContext(runid)
 
 		var v interface{}
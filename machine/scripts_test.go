@@ -4,6 +4,8 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"testing"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 func subTestScripts(t *testing.T, mc *mockCluster) {
@@ -11,6 +13,7 @@ func subTestScripts(t *testing.T, mc *mockCluster) {
 	runStep(t, mc, "set data", scripts_SET_test)
 	runStep(t, mc, "readonly", scripts_READONLY_test)
 	runStep(t, mc, "sha", scripts_EVALSHA_test)
+	runStep(t, mc, "clock", scripts_CLOCK_test)
 }
 func scripts_SIMPLE_test(mc *mockCluster) error {
 	return mc.DoBatch([][]interface{}{
@@ -52,3 +55,57 @@ func scripts_EVALSHA_test(mc *mockCluster) error {
 		{"EVALSHARO", shaGet, 0}, {"NOSCRIPT No matching script. Please use EVAL."},
 	})
 }
+func scripts_CLOCK_test(mc *mockCluster) error {
+	// a script that writes sees the cluster time, which is the same for
+	// each call.
+	if err := mc.DoBatch([][]interface{}{
+		{"EVAL", `
+			var t = sdb.call("time");
+			var ms = t[0]*1000 + Math.floor(t[1]/1000);
+			var d = Date.now();
+			return [
+				d == ms, new Date().getTime() == d, Date() == new Date(d).toString(),
+				new Date(0).getTime(), new Date(1970, 0).getFullYear(),
+				new Date() instanceof Date, typeof Date.UTC,
+			]`, 0}, {"[true true true 0 1970 true function]"},
+	}); err != nil {
+		return err
+	}
+
+	// the follower sees the same time when it applies the script.
+	conn, err := pubsubDialFollower(mc)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.Send("CHANGES", "SINCE", 0, "MATCH", "clock:*"); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"EVAL", `return sdb.call("set", "clock:1", Date.now())`, 0}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	leader, err := redis.String(mc.Do("GET", "clock:1"))
+	if err != nil {
+		return err
+	}
+	for {
+		vals, err := redis.Values(conn.Receive())
+		if err != nil {
+			return err
+		}
+		normalize(vals)
+		if fmt.Sprint(vals[1]) != "set" {
+			// a snapshot.
+			continue
+		}
+		if fmt.Sprint(vals[2]) != "clock:1" || fmt.Sprint(vals[3]) != leader {
+			return fmt.Errorf("expected 'set clock:1 %v', got '%v'", leader, vals)
+		}
+		return nil
+	}
+}
@@ -3,10 +3,10 @@ package machine
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/tidwall/buntdb"
 	"github.com/tidwall/finn"
@@ -18,12 +18,15 @@ func (m *Machine) doTime(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		return nil, finn.ErrWrongNumberOfArguments
 	}
 	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
-		nano := time.Duration(time.Now().UnixNano())
-		secs := nano / time.Second
-		micro := (nano - secs*time.Second) / time.Microsecond
+		// inside of a script or transaction that writes, this is the
+		// cluster time.
+		now, err := txNow(tx)
+		if err != nil {
+			return err
+		}
 		conn.WriteArray(2)
-		conn.WriteBulkString(strconv.FormatInt(int64(secs), 10))
-		conn.WriteBulkString(strconv.FormatInt(int64(micro), 10))
+		conn.WriteBulkString(strconv.FormatInt(now/1000, 10))
+		conn.WriteBulkString(strconv.FormatInt(now%1000*1000, 10))
 		return nil
 	})
 }
@@ -68,33 +71,39 @@ func (m *Machine) doFence(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 			return nil, fmt.Errorf("length argument to FENCE must be > 0")
 		}
 	}
-	key := sdbMetaPrefix + "fence:" + string(cmd.Args[1])
+	name := string(cmd.Args[1])
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
-		var n uint64
-		val, err := tx.Get(key)
-		if err != nil {
-			if err != buntdb.ErrNotFound {
-				return nil, err
-			}
-		} else {
-			n, err = strconv.ParseUint(val, 10, 64)
-			if err != nil {
-				return nil, err
-			}
-		}
-		n += incr
-		val = strconv.FormatUint(n, 10)
-		_, _, err = tx.Set(key, val, nil)
-		if err != nil {
-			return nil, err
-		}
-		return val, nil
+		return txFence(tx, name, incr)
 	}, func(v interface{}) error {
 		conn.WriteBulkString(v.(string))
 		return nil
 	})
 }
 
+// txFence increments a fencing token and returns the new value.
+func txFence(tx *buntdb.Tx, name string, incr uint64) (string, error) {
+	key := sdbMetaPrefix + "fence:" + name
+	var n uint64
+	val, err := tx.Get(key)
+	if err != nil {
+		if err != buntdb.ErrNotFound {
+			return "", err
+		}
+	} else {
+		n, err = strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return "", err
+		}
+	}
+	n += incr
+	val = strconv.FormatUint(n, 10)
+	_, _, err = tx.Set(key, val, nil)
+	if err != nil {
+		return "", err
+	}
+	return val, nil
+}
+
 func (m *Machine) doFenceGet(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
 	// FENCEGET token
 	if len(cmd.Args) != 2 {
@@ -142,23 +151,32 @@ func (m *Machine) doBackup(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 		}
 		http = true
 	}
-	f, err := os.Open(m.file)
+	// save the database from a consistent read to a temporary file, so that
+	// the size is known before it's written, without holding the copy in
+	// memory.
+	f, err := ioutil.TempFile("", "summitdb-backup-")
 	if err != nil {
 		return nil, err
 	}
-	sz, err := f.Seek(0, 2)
-	if err != nil {
+	if err := m.db.Save(f); err != nil {
 		f.Close()
+		os.Remove(f.Name())
 		return nil, err
 	}
-	if _, err := f.Seek(0, 0); err != nil {
+	sz, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
 		f.Close()
+		os.Remove(f.Name())
 		return nil, err
 	}
 	go func(wr *backupWriter) {
 		var err error
 		defer func() {
 			f.Close()
+			os.Remove(f.Name())
 			conn.Close()
 		}()
 		if http {
@@ -174,7 +192,7 @@ func (m *Machine) doBackup(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 		if err != nil {
 			return
 		}
-		if _, err = io.CopyN(wr, f, sz); err != nil {
+		if _, err = io.Copy(wr, f); err != nil {
 			return
 		}
 		if !http {
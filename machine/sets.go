@@ -0,0 +1,425 @@
+package machine
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// randSeedKey holds the seed for SPOP and SRANDMEMBER.
+const randSeedKey = sdbMetaPrefix + "rand"
+
+// txRand returns a random number generator for the transaction. A writable
+// transaction is seeded from the database and advances the seed. Because the
+// seed is a part of the key space, every node in the cluster will make the
+// same random choices when applying a command. A read-only transaction is
+// only seen by one node and may use any seed.
+func txRand(tx *buntdb.Tx) (*rand.Rand, error) {
+	var seed int64
+	val, err := tx.Get(randSeedKey)
+	if err != nil && err != buntdb.ErrNotFound {
+		return nil, err
+	}
+	if err == nil {
+		seed, _ = strconv.ParseInt(val, 10, 64)
+	}
+	r := rand.New(rand.NewSource(seed))
+	next := strconv.FormatInt(r.Int63(), 10)
+	if _, _, err := tx.Set(randSeedKey, next, nil); err != nil {
+		if err != buntdb.ErrTxNotWritable {
+			return nil, err
+		}
+		return rand.New(rand.NewSource(time.Now().UnixNano())), nil
+	}
+	return r, nil
+}
+
+// txSetMembers returns all the members of a set in sorted order.
+func txSetMembers(tx *buntdb.Tx, key string) ([]string, error) {
+	h, err := txGetHeader(tx, key, "set")
+	if err != nil || h.count == 0 {
+		return nil, err
+	}
+	members := make([]string, 0, h.count)
+	if err := scanMembers(tx, "set", key, func(member, val string) bool {
+		members = append(members, member)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// txSetStore replaces the key with a set of the members.
+func txSetStore(tx *buntdb.Tx, key string, members []string) error {
+	if _, err := deleteKey(tx, key); err != nil {
+		return err
+	}
+	h, err := txGetHeaderForUpdate(tx, key, "set")
+	if err != nil {
+		return err
+	}
+	prefix := memberKeyPrefix("set", key)
+	for _, member := range members {
+		if _, _, err := tx.Set(prefix+member, "", nil); err != nil {
+			return err
+		}
+	}
+	h.count = len(members)
+	return txSetHeader(tx, key, h)
+}
+
+func writeSetMembers(conn redcon.Conn, members []string) {
+	conn.WriteArray(len(members))
+	for _, member := range members {
+		conn.WriteBulkString(member)
+	}
+}
+
+func (m *Machine) doSadd(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SADD key member [member ...]
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := txGetHeaderForUpdate(tx, key, "set")
+		if err != nil {
+			return nil, err
+		}
+		prefix := memberKeyPrefix("set", key)
+		var n int
+		for i := 2; i < len(cmd.Args); i++ {
+			_, replaced, err := tx.Set(prefix+string(cmd.Args[i]), "", nil)
+			if err != nil {
+				return nil, err
+			}
+			if !replaced {
+				n++
+			}
+		}
+		if n > 0 {
+			h.count += n
+			if err := txSetHeader(tx, key, h); err != nil {
+				return nil, err
+			}
+			m.notify(notifySet, "sadd", key)
+		}
+		return n, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+func (m *Machine) doSrem(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SREM key member [member ...]
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := txGetHeader(tx, key, "set")
+		if err != nil {
+			return nil, err
+		}
+		if h.count == 0 {
+			return 0, nil
+		}
+		prefix := memberKeyPrefix("set", key)
+		var n int
+		for i := 2; i < len(cmd.Args); i++ {
+			if _, err := tx.Delete(prefix + string(cmd.Args[i])); err != nil {
+				if err == buntdb.ErrNotFound {
+					continue
+				}
+				return nil, err
+			}
+			n++
+		}
+		if n > 0 {
+			h.count -= n
+			if err := txSetHeader(tx, key, h); err != nil {
+				return nil, err
+			}
+			m.notify(notifySet, "srem", key)
+			if h.count == 0 {
+				m.notify(notifyGeneric, "del", key)
+			}
+		}
+		return n, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+func (m *Machine) doSismember(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SISMEMBER key member
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "set")
+		if err != nil {
+			return err
+		}
+		if h.count == 0 {
+			conn.WriteInt(0)
+			return nil
+		}
+		if _, err := tx.Get(memberKeyPrefix("set", key) + string(cmd.Args[2])); err != nil {
+			if err == buntdb.ErrNotFound {
+				conn.WriteInt(0)
+				return nil
+			}
+			return err
+		}
+		conn.WriteInt(1)
+		return nil
+	})
+}
+
+func (m *Machine) doSmembers(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SMEMBERS key
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		members, err := txSetMembers(tx, key)
+		if err != nil {
+			return err
+		}
+		writeSetMembers(conn, members)
+		return nil
+	})
+}
+
+func (m *Machine) doScard(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SCARD key
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "set")
+		if err != nil {
+			return err
+		}
+		conn.WriteInt(h.count)
+		return nil
+	})
+}
+
+func (m *Machine) doSpop(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SPOP key [count]
+	if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	count := 1
+	if len(cmd.Args) == 3 {
+		n, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+		if err != nil || n < 0 {
+			return nil, errNotAnInt
+		}
+		count = int(n)
+	}
+	key := string(cmd.Args[1])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := txGetHeader(tx, key, "set")
+		if err != nil {
+			return nil, err
+		}
+		members, err := txSetMembers(tx, key)
+		if err != nil {
+			return nil, err
+		}
+		r, err := txRand(tx)
+		if err != nil {
+			return nil, err
+		}
+		prefix := memberKeyPrefix("set", key)
+		var popped []string
+		for len(popped) < count && len(members) > 0 {
+			i := r.Intn(len(members))
+			if _, err := tx.Delete(prefix + members[i]); err != nil {
+				return nil, err
+			}
+			popped = append(popped, members[i])
+			members[i] = members[len(members)-1]
+			members = members[:len(members)-1]
+		}
+		if len(popped) > 0 {
+			h.count -= len(popped)
+			if err := txSetHeader(tx, key, h); err != nil {
+				return nil, err
+			}
+			m.notify(notifySet, "spop", key)
+			if h.count == 0 {
+				m.notify(notifyGeneric, "del", key)
+			}
+		}
+		return popped, nil
+	}, func(v interface{}) error {
+		popped := v.([]string)
+		if len(cmd.Args) == 3 {
+			writeSetMembers(conn, popped)
+		} else if len(popped) == 0 {
+			conn.WriteNull()
+		} else {
+			conn.WriteBulkString(popped[0])
+		}
+		return nil
+	})
+}
+
+func (m *Machine) doSrandmember(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SRANDMEMBER key [count]
+	if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	count := 1
+	if len(cmd.Args) == 3 {
+		n, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+		if err != nil {
+			return nil, errNotAnInt
+		}
+		count = int(n)
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		members, err := txSetMembers(tx, key)
+		if err != nil {
+			return err
+		}
+		r, err := txRand(tx)
+		if err != nil {
+			return err
+		}
+		var results []string
+		if count < 0 {
+			// a negative count allows for the same member more than once
+			for i := 0; i < -count && len(members) > 0; i++ {
+				results = append(results, members[r.Intn(len(members))])
+			}
+		} else {
+			for len(results) < count && len(members) > 0 {
+				i := r.Intn(len(members))
+				results = append(results, members[i])
+				members[i] = members[len(members)-1]
+				members = members[:len(members)-1]
+			}
+		}
+		if len(cmd.Args) == 3 {
+			writeSetMembers(conn, results)
+		} else if len(results) == 0 {
+			conn.WriteNull()
+		} else {
+			conn.WriteBulkString(results[0])
+		}
+		return nil
+	})
+}
+
+// setOp performs a SINTER, SUNION, or SDIFF on the sets at keys.
+func setOp(tx *buntdb.Tx, op string, keys []string) ([]string, error) {
+	var result map[string]bool
+	for i, key := range keys {
+		members, err := txSetMembers(tx, key)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			result = make(map[string]bool)
+			for _, member := range members {
+				result[member] = true
+			}
+			continue
+		}
+		switch op {
+		case "sunion":
+			for _, member := range members {
+				result[member] = true
+			}
+		case "sdiff":
+			for _, member := range members {
+				delete(result, member)
+			}
+		case "sinter":
+			set := make(map[string]bool)
+			for _, member := range members {
+				if result[member] {
+					set[member] = true
+				}
+			}
+			result = set
+		}
+	}
+	members := make([]string, 0, len(result))
+	for member := range result {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+func (m *Machine) doSetOp(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SINTER key [key ...]
+	// SUNION key [key ...]
+	// SDIFF key [key ...]
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	op := qcmdlower(cmd.Args[0])
+	var keys []string
+	for i := 1; i < len(cmd.Args); i++ {
+		keys = append(keys, string(cmd.Args[i]))
+	}
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		members, err := setOp(tx, op, keys)
+		if err != nil {
+			return err
+		}
+		writeSetMembers(conn, members)
+		return nil
+	})
+}
+
+func (m *Machine) doSetOpStore(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SINTERSTORE destination key [key ...]
+	// SUNIONSTORE destination key [key ...]
+	// SDIFFSTORE destination key [key ...]
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	name := qcmdlower(cmd.Args[0])
+	op := name[:len(name)-len("store")]
+	dest := string(cmd.Args[1])
+	var keys []string
+	for i := 2; i < len(cmd.Args); i++ {
+		keys = append(keys, string(cmd.Args[i]))
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		members, err := setOp(tx, op, keys)
+		if err != nil {
+			return nil, err
+		}
+		if err := txSetStore(tx, dest, members); err != nil {
+			return nil, err
+		}
+		if len(members) > 0 {
+			m.notify(notifySet, name, dest)
+		}
+		return len(members), nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
@@ -0,0 +1,132 @@
+package machine
+
+import "testing"
+
+func subTestSets(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "SADD", sets_SADD_test)
+	runStep(t, mc, "SREM", sets_SREM_test)
+	runStep(t, mc, "SPOP", sets_SPOP_test)
+	runStep(t, mc, "SRANDMEMBER", sets_SRANDMEMBER_test)
+	runStep(t, mc, "SINTER", sets_SINTER_test)
+	runStep(t, mc, "SUNION", sets_SUNION_test)
+	runStep(t, mc, "SDIFF", sets_SDIFF_test)
+	runStep(t, mc, "keys", sets_KEYS_test)
+}
+
+func sets_SADD_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SADD", "myset", "Hello"}, {1},
+		{"SADD", "myset", "World"}, {1},
+		{"SADD", "myset", "World", "!"}, {1},
+		{"SMEMBERS", "myset"}, {"[! Hello World]"},
+		{"SISMEMBER", "myset", "Hello"}, {1},
+		{"SISMEMBER", "myset", "Bye"}, {0},
+		{"SISMEMBER", "noset", "Hello"}, {0},
+		{"SCARD", "myset"}, {3},
+		{"SCARD", "noset"}, {0},
+		{"SMEMBERS", "noset"}, {"[]"},
+		{"SADD", "myset"}, {"ERR wrong number of arguments for 'SADD' command"},
+	})
+}
+func sets_SREM_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SADD", "myset", "one", "two", "three"}, {3},
+		{"SREM", "myset", "one", "four"}, {1},
+		{"SMEMBERS", "myset"}, {"[three two]"},
+		{"SREM", "myset", "two", "three"}, {2},
+		{"EXISTS", "myset"}, {0},
+	})
+}
+func sets_SPOP_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SADD", "myset", "one", "two", "three"}, {3},
+		{"SPOP", "myset"}, {func(v interface{}) (resp, expect interface{}) {
+			return mc.DoExpect(0, "SISMEMBER", "myset", v), nil
+		}},
+		{"SCARD", "myset"}, {2},
+		{"SPOP", "myset", 5}, {func(v interface{}) (resp, expect interface{}) {
+			return len(v.([]string)), 2
+		}},
+		{"EXISTS", "myset"}, {0},
+		{"SPOP", "myset"}, {nil},
+		{"SPOP", "myset", 1}, {"[]"},
+		{"SPOP", "myset", -1}, {"ERR value is not an integer or out of range"},
+	})
+}
+func sets_SRANDMEMBER_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SADD", "myset", "one", "two", "three"}, {3},
+		{"SRANDMEMBER", "myset"}, {func(v interface{}) (resp, expect interface{}) {
+			return mc.DoExpect(1, "SISMEMBER", "myset", v), nil
+		}},
+		{"SRANDMEMBER", "myset", 2}, {func(v interface{}) (resp, expect interface{}) {
+			vv := v.([]string)
+			return len(vv) == 2 && vv[0] != vv[1], true
+		}},
+		{"SRANDMEMBER", "myset", 5}, {func(v interface{}) (resp, expect interface{}) {
+			return len(v.([]string)), 3
+		}},
+		{"SRANDMEMBER", "myset", -5}, {func(v interface{}) (resp, expect interface{}) {
+			return len(v.([]string)), 5
+		}},
+		{"SCARD", "myset"}, {3},
+		{"SRANDMEMBER", "noset"}, {nil},
+	})
+}
+func sets_SINTER_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SADD", "key1", "a", "b", "c"}, {3},
+		{"SADD", "key2", "c", "d", "e"}, {3},
+		{"SINTER", "key1", "key2"}, {"[c]"},
+		{"SINTER", "key1", "nokey"}, {"[]"},
+		{"SINTERSTORE", "key", "key1", "key2"}, {1},
+		{"SMEMBERS", "key"}, {"[c]"},
+		{"SINTERSTORE", "key", "key1", "nokey"}, {0},
+		{"EXISTS", "key"}, {0},
+	})
+}
+func sets_SUNION_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SADD", "key1", "a", "b", "c"}, {3},
+		{"SADD", "key2", "c", "d", "e"}, {3},
+		{"SUNION", "key1", "key2"}, {"[a b c d e]"},
+		{"SET", "key", "value"}, {"OK"},
+		{"SUNIONSTORE", "key", "key1", "key2"}, {5},
+		{"SMEMBERS", "key"}, {"[a b c d e]"},
+		{"SUNIONSTORE", "key1", "key1", "key2"}, {5},
+		{"SMEMBERS", "key1"}, {"[a b c d e]"},
+	})
+}
+func sets_SDIFF_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SADD", "key1", "a", "b", "c"}, {3},
+		{"SADD", "key2", "c", "d", "e"}, {3},
+		{"SDIFF", "key1", "key2"}, {"[a b]"},
+		{"SDIFFSTORE", "key", "key1", "key2"}, {2},
+		{"SMEMBERS", "key"}, {"[a b]"},
+		{"SET", "str", "value"}, {"OK"},
+		{"SDIFF", "key1", "str"}, {"WRONGTYPE Operation against a key holding the wrong kind of value"},
+	})
+}
+func sets_KEYS_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SADD", "myset", "one", "two"}, {2},
+		{"TYPE", "myset"}, {"set"},
+		{"KEYS", "*"}, {"[myset]"},
+		{"RENAME", "myset", "newset"}, {"OK"},
+		{"SMEMBERS", "newset"}, {"[one two]"},
+		{"DEL", "newset"}, {1},
+		{"SMEMBERS", "newset"}, {"[]"},
+		{"MULTI"}, {"OK"},
+		{"SADD", "myset", "one", "two"}, {"QUEUED"},
+		{"SPOP", "myset", 1}, {"QUEUED"},
+		{"SCARD", "myset"}, {"QUEUED"},
+		{"EXEC"}, {func(v interface{}) (resp, expect interface{}) {
+			vv := v.([]string)
+			return vv[0] + " " + vv[2], "2 1"
+		}},
+		{"EVAL", `sdb.call("sadd", KEYS[0], "three"); return sdb.call("spop", KEYS[0], 5)`, 1, "myset"}, {func(v interface{}) (resp, expect interface{}) {
+			return len(v.([]string)), 2
+		}},
+	})
+}
@@ -0,0 +1,769 @@
+package machine
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/hashicorp/raft"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/less"
+	"github.com/tidwall/redcon"
+)
+
+// The keyspace may be sharded across a fixed number of raft groups, which
+// are all hosted by every server. Each group has its own Machine and serves
+// some of the key ranges. Group zero is the meta group, and it keeps the
+// routing table. Initially group zero serves the entire keyspace, and a
+// range is split when it has too many keys, with one half moved to the
+// group that serves the fewest ranges.
+//
+// A command for keys that are served by another group is answered with a
+// "MOVED group addr" error, or is forwarded to that group's leader when
+// forwarding is enabled. Commands such as KEYS, ITER and DBSIZE are sent to
+// every group, and the results are merged. A transaction with keys from more
+// than one group is committed in two phases, which is described in txns.go.
+
+// The servers send each other internal commands, such as the commands that
+// move a range or commit a transaction. These are only accepted on a
+// connection that has been authenticated with the shards token by SDBAUTH,
+// which every server of the cluster is configured with.
+
+// DefaultRangeMaxKeys is the number of keys that a range may have before
+// it's split.
+const DefaultRangeMaxKeys = 100000
+
+// rangeMoveBatch is the number of keys that are copied at a time when a
+// range is moved.
+const rangeMoveBatch = 256
+
+// Shards is the set of raft groups that the keyspace is sharded across.
+type Shards struct {
+	mu      sync.RWMutex
+	groups  []*Machine
+	leaders []func() string
+	routes  []keyRoute // the routing table from the meta group
+	maxKeys int
+	token   string // authenticates the servers to each other
+
+	interval   time.Duration // how often the ranges are checked
+	txnTimeout time.Duration // how long a transaction may take
+	fw         *forwarder    // pooled connections to the group leaders
+	moving     sync.Mutex    // held while a range is moved by this server
+	closed     chan struct{}
+	once       sync.Once
+}
+
+// NewShards returns a set of raft groups. Each group must be set with
+// SetGroup before its raft node is opened.
+func NewShards(groups int) *Shards {
+	sh := &Shards{
+		groups:     make([]*Machine, groups),
+		leaders:    make([]func() string, groups),
+		routes:     []keyRoute{{keyRange{"", ""}, 0}},
+		maxKeys:    DefaultRangeMaxKeys,
+		interval:   time.Second * 10,
+		txnTimeout: DefaultTxnTimeout,
+		closed:     make(chan struct{}),
+	}
+	sh.fw = newForwarder(nil, nil)
+	sh.fw.setup = sh.auth
+	return sh
+}
+
+// SetGroup sets the machine for a group.
+func (sh *Shards) SetGroup(group int, m *Machine) error {
+	sh.mu.Lock()
+	sh.groups[group] = m
+	sh.mu.Unlock()
+	m.sh, m.group = sh, group
+	return m.db.View(m.loadRanges)
+}
+
+// SetLeader sets the function that returns the leader of a group.
+func (sh *Shards) SetLeader(group int, leader func() string) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.leaders[group] = leader
+}
+
+// SetToken sets the token that the servers use to send each other internal
+// commands. Every server of the cluster must have the same token.
+func (sh *Shards) SetToken(token string) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.token = token
+}
+
+// SetDialOptions sets the options for dialing the other servers, such as a
+// DialNetDial that uses TLS. It must be called before Start.
+func (sh *Shards) SetDialOptions(opts ...redis.DialOption) {
+	sh.fw.mu.Lock()
+	defer sh.fw.mu.Unlock()
+	sh.fw.opts = opts
+}
+
+// checkToken returns true when the token is the shards token.
+func (sh *Shards) checkToken(token []byte) bool {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.token != "" && subtle.ConstantTimeCompare(token, []byte(sh.token)) == 1
+}
+
+// auth authenticates a new connection to a server with the shards token.
+func (sh *Shards) auth(conn redis.Conn) error {
+	sh.mu.RLock()
+	token := sh.token
+	sh.mu.RUnlock()
+	if token == "" {
+		return errNoToken
+	}
+	_, err := conn.Do("sdbauth", token)
+	return err
+}
+
+// SetRangeMaxKeys sets the number of keys that a range may have before it's
+// split. Zero turns off splitting.
+func (sh *Shards) SetRangeMaxKeys(n int) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.maxKeys = n
+}
+
+// Start starts checking the ranges. Only the server that leads the meta
+// group splits ranges, completes moves that were interrupted, and resolves
+// transactions whose coordinator has failed.
+func (sh *Shards) Start() {
+	go sh.balance()
+}
+
+// Close stops checking the ranges.
+func (sh *Shards) Close() {
+	sh.once.Do(func() { close(sh.closed) })
+}
+
+func (sh *Shards) setRoutes(routes []keyRoute) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.routes = append([]keyRoute(nil), routes...)
+}
+
+func (sh *Shards) routesCopy() []keyRoute {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return append([]keyRoute(nil), sh.routes...)
+}
+
+func (sh *Shards) routeGroup(key string) int {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return routeGroup(sh.routes, key)
+}
+
+// leader returns the address of the leader of a group, or an empty string
+// when it's not known.
+func (sh *Shards) leader(group int) string {
+	sh.mu.RLock()
+	leader := sh.leaders[group]
+	sh.mu.RUnlock()
+	if leader == nil {
+		return ""
+	}
+	return leader()
+}
+
+// groupAddr returns the address to use for a group. That's the leader, or
+// the group on this server when there's no leader.
+func (sh *Shards) groupAddr(group int) string {
+	if leader := sh.leader(group); leader != "" {
+		return leader
+	}
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.groups[group].addr
+}
+
+// do sends a command to the leader of a group.
+func (sh *Shards) do(group int, name string, args ...interface{}) (interface{}, error) {
+	leader := sh.leader(group)
+	if leader == "" {
+		return nil, fmt.Errorf("TRYAGAIN group %d has no leader", group)
+	}
+	conn, err := sh.fw.conn(leader, false)
+	if err != nil {
+		return nil, fmt.Errorf("TRYAGAIN group %d is not reachable", group)
+	}
+	defer conn.Close()
+	return conn.Do(name, args...)
+}
+
+var (
+	errNoToken      = errors.New("ERR the shards token is not set")
+	errInvalidToken = errors.New("ERR invalid shards token")
+)
+
+// internalCommand returns true for a command that only the servers of a
+// sharded keyspace may send.
+func internalCommand(name []byte) bool {
+	switch qcmdlower(name) {
+	case "sdbrangestats", "sdbrangeleave", "sdbrangedump", "sdbrangeload",
+		"sdbrangeown", "sdbrangedrop", "sdbroutemove", "sdbrouteset",
+		"sdbroutedone", "sdbtxbegin", "sdbtxprepare", "sdbtxdecide",
+		"sdbtxcommit", "sdbtxabort", "sdbtxend":
+		return true
+	}
+	return false
+}
+
+// internal returns true when internal commands are allowed on the
+// connection. A command from the log was allowed when it was proposed.
+func (m *Machine) internal(conn redcon.Conn) bool {
+	if m.sh == nil {
+		return false
+	}
+	if conn == nil {
+		return true
+	}
+	ctx, ok := conn.Context().(*connContext)
+	return ok && ctx.internal
+}
+
+func (m *Machine) doAuth(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SDBAUTH token
+	if m.sh == nil || conn == nil {
+		return nil, finn.ErrUnknownCommand
+	}
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	ctx, ok := conn.Context().(*connContext)
+	if !ok {
+		return nil, finn.ErrUnknownCommand
+	}
+	if !m.sh.checkToken(cmd.Args[1]) {
+		return nil, errInvalidToken
+	}
+	ctx.internal = true
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+const (
+	routeLocal = iota // runs on the group that receives the command
+	routeKeys         // runs on the group that serves the keys
+	routeMeta         // runs on the meta group
+	routeAll          // runs on every group
+)
+
+// commandRoute returns how a command is routed, and the keys of a command
+// that is routed by its keys. A command with the wrong number of arguments
+// runs locally so that the error is returned.
+func commandRoute(args [][]byte) (int, [][]byte) {
+	if internalCommand(args[0]) {
+		return routeLocal, nil
+	}
+	switch qcmdlower(args[0]) {
+	default:
+		if len(args) < 2 {
+			return routeLocal, nil
+		}
+		return routeKeys, args[1:2]
+	case "ping", "echo", "select", "time", "multi", "exec", "discard",
+		"unwatch", "subscribe", "psubscribe", "unsubscribe", "punsubscribe",
+		"publish", "changes", "consistency", "config", "backup", "massinsert",
+		"indexes", "ranges", "rangesplit", expiredCommand, "sdbgroup",
+		"sdbauth":
+		return routeLocal, nil
+	case "keys", "iter", "rect", "dbsize", "flushdb", "flushall", "pdel",
+		"setindex", "delindex", "script":
+		return routeAll, nil
+	case "lock", "unlock", "lockrefresh", "lockinfo", "elect", "resign",
+		"leaderof", "observe", "fence", "fenceget":
+		return routeMeta, nil
+	case "del", "exists", "mget", "watch", "plget", "sinter", "sunion",
+		"sdiff", "sinterstore", "sunionstore", "sdiffstore":
+		return routeKeys, args[1:]
+	case "mset", "msetnx", "plset":
+		var keys [][]byte
+		for i := 1; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return routeKeys, keys
+	case "rename", "renamenx":
+		if len(args) < 3 {
+			return routeLocal, nil
+		}
+		return routeKeys, args[1:3]
+	case "bitop":
+		if len(args) < 4 {
+			return routeLocal, nil
+		}
+		return routeKeys, args[2:]
+	case "blpop", "brpop":
+		if len(args) < 3 {
+			return routeLocal, nil
+		}
+		return routeKeys, args[1 : len(args)-1]
+	case "eval", "evalro", "evalsha", "evalsharo":
+		if len(args) < 3 {
+			return routeLocal, nil
+		}
+		n, err := strconv.Atoi(string(args[2]))
+		if err != nil || n < 0 || 3+n > len(args) {
+			return routeLocal, nil
+		}
+		return routeKeys, args[3 : 3+n]
+	case "xgroup":
+		// XGROUP subcommand key ...
+		if len(args) < 3 {
+			return routeLocal, nil
+		}
+		return routeKeys, args[2:3]
+	case "xread", "xreadgroup":
+		for i := 1; i < len(args); i++ {
+			if qcmdlower(args[i]) == "streams" {
+				streams := args[i+1:]
+				return routeKeys, streams[:len(streams)/2]
+			}
+		}
+		return routeLocal, nil
+	case "idempotent":
+		// IDEMPOTENT token seconds command [arg ...]
+		if len(args) < 4 {
+			return routeLocal, nil
+		}
+		return commandRoute(args[3:])
+	case "plwmulti", "plrmulti", "plwpipe":
+		// the commands of an EXEC or a pipeline
+		var keys [][]byte
+		for _, raw := range args[1:] {
+			cmd, err := parseCommand(raw)
+			if err != nil || len(cmd.Args) == 0 {
+				continue
+			}
+			if qcmdlower(cmd.Args[0]) == "watch" {
+				for i := 1; i < len(cmd.Args); i += 2 {
+					keys = append(keys, cmd.Args[i])
+				}
+				continue
+			}
+			if route, ckeys := commandRoute(cmd.Args); route == routeKeys {
+				keys = append(keys, ckeys...)
+			}
+		}
+		return routeKeys, keys
+	}
+}
+
+// route sends a command from a client to the groups that serve it. It
+// returns false when the command runs on this group. The commands of a
+// transaction are queued, and EXEC sends them to their groups.
+func (m *Machine) route(conn redcon.Conn, cmd redcon.Command) (bool, interface{}, error) {
+	route, keys := commandRoute(cmd.Args)
+	if ctx, ok := conn.Context().(*connContext); ok && ctx.multi != nil {
+		if route == routeKeys {
+			if _, err := m.keysGroup(keys); err != nil {
+				ctx.multi.errs = true
+				return true, nil, err
+			}
+		}
+		return false, nil, nil
+	}
+	switch route {
+	case routeMeta:
+		if m.group != 0 {
+			return true, nil, m.redirect(conn, cmd, 0)
+		}
+	case routeAll:
+		return true, nil, m.fanout(conn, cmd)
+	case routeKeys:
+		if qcmdlower(cmd.Args[0]) == "watch" {
+			return true, nil, m.watchGroups(conn, cmd)
+		}
+		group, err := m.keysGroup(keys)
+		if err == errCrossGroup {
+			switch qcmdlower(cmd.Args[0]) {
+			case "eval", "evalro", "evalsha", "evalsharo":
+				return true, nil, m.evalGroups(conn, cmd)
+			}
+		}
+		if err != nil {
+			return true, nil, err
+		}
+		if group != -1 && group != m.group {
+			return true, nil, m.redirect(conn, cmd, group)
+		}
+		for _, key := range keys {
+			if _, ok := m.lockedBy(string(key)); ok {
+				return true, nil, errKeyLocked
+			}
+		}
+	}
+	return false, nil, nil
+}
+
+// keysGroup returns the group that serves all of the keys, or -1 when there
+// are no keys.
+func (m *Machine) keysGroup(keys [][]byte) (int, error) {
+	group := -1
+	for _, key := range keys {
+		g, err := m.keyGroup(string(key))
+		if err != nil {
+			return 0, err
+		}
+		if group != -1 && g != group {
+			return 0, errCrossGroup
+		}
+		group = g
+	}
+	return group, nil
+}
+
+// watchGroups reads the versions of the watched keys from the groups that
+// serve them. Every group has a copy on this server, which may be behind
+// the leader. An older version can only cause EXEC to abort.
+func (m *Machine) watchGroups(conn redcon.Conn, cmd redcon.Command) error {
+	ctx := conn.Context().(*connContext)
+	if ctx.watch == nil {
+		ctx.watch = make(map[string]uint64)
+	}
+	for _, arg := range cmd.Args[1:] {
+		key := string(arg)
+		if _, ok := ctx.watch[key]; ok {
+			continue
+		}
+		group, err := m.keyGroup(key)
+		if err != nil {
+			return err
+		}
+		var version uint64
+		if err := m.sh.groups[group].db.View(func(tx *buntdb.Tx) error {
+			var err error
+			version, err = txKeyVersion(tx, key)
+			return err
+		}); err != nil {
+			return err
+		}
+		ctx.watch[key] = version
+	}
+	conn.WriteString("OK")
+	return nil
+}
+
+// redirect forwards a command to the leader of another group when
+// forwarding is enabled, otherwise the client is told where to go.
+func (m *Machine) redirect(conn redcon.Conn, cmd redcon.Command, group int) error {
+	leader := m.sh.leader(group)
+	if f := m.forwarder(); f != nil && leader != "" {
+		if err := f.forward(conn, cmd, leader); err != raft.ErrNotLeader {
+			return err
+		}
+	}
+	return fmt.Errorf("MOVED %d %s", group, m.sh.groupAddr(group))
+}
+
+// fanout sends a command to every group and writes the merged reply.
+func (m *Machine) fanout(conn redcon.Conn, cmd redcon.Command) error {
+	name := qcmdlower(cmd.Args[0])
+	args := make([]interface{}, 0, len(cmd.Args))
+	for _, arg := range cmd.Args {
+		args = append(args, arg)
+	}
+	var rargs rectSearchArgs
+	if name == "rect" {
+		// the skip is applied to the merged results.
+		var err error
+		if rargs, err = parseRectSearchArgs(cmd.Args); err != nil {
+			return err
+		}
+		args = []interface{}{cmd.Args[0], cmd.Args[1], cmd.Args[2]}
+		if rargs.matchon {
+			args = append(args, "match", rargs.match)
+		}
+		if rargs.limiton {
+			args = append(args, "limit", rargs.skip+rargs.limit)
+		}
+	}
+	replies := make([]interface{}, len(m.sh.groups))
+	for group := range replies {
+		reply, err := m.sh.do(group, "sdbgroup", args...)
+		if err != nil {
+			return err
+		}
+		replies[group] = reply
+	}
+	switch name {
+	default:
+		writeForwarded(conn, replies[0])
+	case "dbsize", "pdel":
+		var n int64
+		for _, reply := range replies {
+			v, _ := reply.(int64)
+			n += v
+		}
+		conn.WriteInt64(n)
+	case "keys", "iter":
+		return m.mergeIter(conn, cmd, replies)
+	case "rect":
+		items, err := mergeItems(replies, 2)
+		if err != nil {
+			return err
+		}
+		sort.Sort(rectItemByKey(items))
+		items = uniqueItems(items)
+		if rargs.skipon {
+			if rargs.skip > len(items) {
+				rargs.skip = len(items)
+			}
+			items = items[rargs.skip:]
+		}
+		if rargs.limiton && len(items) > rargs.limit {
+			items = items[:rargs.limit]
+		}
+		conn.WriteArray(len(items) * 2)
+		for _, item := range items {
+			conn.WriteBulkString(item.key)
+			conn.WriteBulkString(item.val)
+		}
+	}
+	return nil
+}
+
+// mergeItems reads the keys, or the keys and values, from the replies.
+func mergeItems(replies []interface{}, stride int) ([]rectItem, error) {
+	var items []rectItem
+	for _, reply := range replies {
+		vals, err := redis.Strings(reply, nil)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i+stride <= len(vals); i += stride {
+			item := rectItem{key: vals[i]}
+			if stride == 2 {
+				item.val = vals[i+1]
+			}
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// uniqueItems removes repeated keys from sorted items. A key is in two
+// groups for a moment while its range is moved.
+func uniqueItems(items []rectItem) []rectItem {
+	var res []rectItem
+	seen := make(map[string]bool)
+	for _, item := range items {
+		if !seen[item.key] {
+			seen[item.key] = true
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// mergeIter merges the results of KEYS or ITER from every group, in the
+// order of the keys or the index.
+func (m *Machine) mergeIter(conn redcon.Conn, cmd redcon.Command, replies []interface{}) error {
+	rargs, err := parseIterArgs(cmd.Args)
+	if err != nil {
+		return err
+	}
+	stride := 1
+	if rargs.kind == "iter" || rargs.withvalues {
+		stride = 2
+	}
+	items, err := mergeItems(replies, stride)
+	if err != nil {
+		return err
+	}
+	var l less.Less
+	if rargs.kind == "iter" {
+		if err := m.db.View(func(tx *buntdb.Tx) error {
+			lessfn, err := tx.GetLess(rargs.index)
+			if err == nil && lessfn != nil {
+				l = less.Less(lessfn)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if rargs.desc {
+			a, b = b, a
+		}
+		if l != nil {
+			if l.LessThan(a.val, b.val) {
+				return true
+			}
+			if l.LessThan(b.val, a.val) {
+				return false
+			}
+		}
+		return a.key < b.key
+	})
+	items = uniqueItems(items)
+	if rargs.limiton && len(items) > rargs.limit {
+		items = items[:rargs.limit]
+	}
+	conn.WriteArray(len(items) * stride)
+	for _, item := range items {
+		conn.WriteBulkString(item.key)
+		if stride == 2 {
+			conn.WriteBulkString(item.val)
+		}
+	}
+	return nil
+}
+
+// balance checks the ranges until the shards are closed.
+func (sh *Shards) balance() {
+	t := time.NewTicker(sh.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-sh.closed:
+			return
+		case <-t.C:
+		}
+		meta := sh.groups[0]
+		if sh.leader(0) != meta.addr {
+			continue
+		}
+		if err := sh.resolveTxns(); err != nil {
+			meta.log.Warningf("transactions: %v", err)
+		}
+		if err := sh.rebalance(); err != nil {
+			meta.log.Warningf("ranges: %v", err)
+		}
+	}
+}
+
+// rebalance completes a range move that was interrupted, or splits the
+// first range that has too many keys.
+func (sh *Shards) rebalance() error {
+	var mv *rangeMove
+	if err := sh.groups[0].db.View(func(tx *buntdb.Tx) error {
+		var err error
+		mv, err = txRangeMove(tx)
+		return err
+	}); err != nil {
+		return err
+	}
+	if mv != nil {
+		return sh.moveRange(*mv)
+	}
+	sh.mu.RLock()
+	maxKeys := sh.maxKeys
+	sh.mu.RUnlock()
+	if maxKeys <= 0 || len(sh.groups) < 2 {
+		return nil
+	}
+	for _, rt := range sh.routesCopy() {
+		stats, err := redis.Values(sh.do(rt.group, "sdbrangestats", rt.start, rt.end))
+		if err != nil {
+			return err
+		}
+		var count int
+		var middle string
+		if _, err := redis.Scan(stats, &count, &middle); err != nil {
+			return err
+		}
+		if count > maxKeys {
+			sh.groups[0].log.Noticef("ranges: splitting range with %d keys at %q", count, middle)
+			return sh.split(middle, -1)
+		}
+	}
+	return nil
+}
+
+// split splits the range that contains the key, and moves the keys from
+// the key to the end of the range to a group. A negative group is the group
+// that serves the fewest ranges.
+func (sh *Shards) split(key string, to int) error {
+	routes := sh.routesCopy()
+	var rt keyRoute
+	for _, rt = range routes {
+		if rt.contains(key) {
+			break
+		}
+	}
+	if to < 0 {
+		counts := make([]int, len(sh.groups))
+		for _, rt := range routes {
+			counts[rt.group]++
+		}
+		for group := range counts {
+			if group != rt.group && (to < 0 || counts[group] < counts[to]) {
+				to = group
+			}
+		}
+	}
+	r := keyRange{key, rt.end}
+	if to == rt.group {
+		if key == rt.start {
+			return nil
+		}
+		_, err := sh.do(0, "sdbrouteset", r.start, r.end, to)
+		return err
+	}
+	return sh.moveRange(rangeMove{r, rt.group, to})
+}
+
+// moveRange moves a range to another group. It's also used to complete a
+// move that was interrupted.
+func (sh *Shards) moveRange(mv rangeMove) error {
+	sh.moving.Lock()
+	defer sh.moving.Unlock()
+	if _, err := sh.do(0, "sdbroutemove", mv.start, mv.end, mv.from, mv.to); err != nil {
+		return err
+	}
+	if _, err := sh.do(mv.from, "sdbrangeleave", mv.start, mv.end); err != nil {
+		return err
+	}
+	start := mv.start
+	for {
+		vals, err := redis.Values(sh.do(mv.from, "sdbrangedump", start, mv.end, rangeMoveBatch))
+		if err != nil {
+			return err
+		}
+		if len(vals) == 0 {
+			break
+		}
+		if _, err := sh.do(mv.to, "sdbrangeload", vals...); err != nil {
+			return err
+		}
+		if len(vals) < rangeMoveBatch*3 {
+			break
+		}
+		last, err := redis.String(vals[len(vals)-3], nil)
+		if err != nil {
+			return err
+		}
+		// continue from the key that follows the last key.
+		start = last + "\x00"
+	}
+	if _, err := sh.do(mv.to, "sdbrangeown", mv.start, mv.end); err != nil {
+		return err
+	}
+	if _, err := sh.do(0, "sdbrouteset", mv.start, mv.end, mv.to); err != nil {
+		return err
+	}
+	if _, err := sh.do(mv.from, "sdbrangedrop", mv.start, mv.end); err != nil {
+		return err
+	}
+	if _, err := sh.do(0, "sdbroutedone", mv.start, mv.end, mv.from, mv.to); err != nil {
+		return err
+	}
+	sh.groups[0].log.Noticef("ranges: moved [%q, %q) from group %d to group %d",
+		mv.start, mv.end, mv.from, mv.to)
+	return nil
+}
@@ -0,0 +1,234 @@
+package machine
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func subTestShards(t *testing.T, mc *mockCluster) {
+	ms, err := mockOpenShards(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+	runStep(t, mc, "routing", func(mc *mockCluster) error { return shards_ROUTING_test(ms) })
+	runStep(t, mc, "keys", func(mc *mockCluster) error { return shards_KEYS_test(ms) })
+	runStep(t, mc, "forward", func(mc *mockCluster) error { return shards_FORWARD_test(ms) })
+	runStep(t, mc, "resume", func(mc *mockCluster) error { return shards_RESUME_test(ms) })
+	runStep(t, mc, "split", func(mc *mockCluster) error { return shards_SPLIT_test(ms) })
+	runStep(t, mc, "internal", func(mc *mockCluster) error { return shards_INTERNAL_test(mc, ms) })
+}
+
+func shards_ROUTING_test(ms *mockShards) error {
+	if err := ms.DoBatch([][]interface{}{
+		{"RANGES"}, {fmt.Sprintf("[[  0 :%d]]", ms.ss[0].port)},
+		{"MSET", "a", "1", "b", "2", "n", "3", "x", "4"}, {"OK"},
+		{"HSET", "hash", "f", "v"}, {1},
+		{"RANGESPLIT", "m", 1}, {"OK"},
+		{"RANGESPLIT", "w", 2}, {"OK"},
+		{"RANGES"}, {fmt.Sprintf("[[ m 0 :%d] [m w 1 :%d] [w  2 :%d]]",
+			ms.ss[0].port, ms.ss[1].port, ms.ss[2].port)},
+		{"GET", "a"}, {"1"},
+		{"GET", "n"}, {"3"},
+		{"GET", "x"}, {"4"},
+		{"HGET", "hash", "f"}, {"v"},
+		{"MSET", "a", "1", "n", "2"}, {"CROSSGROUP Keys in request belong to different groups"},
+		{"DBSIZE"}, {5},
+	}); err != nil {
+		return err
+	}
+	// the keys were moved out of the first group.
+	if _, err := redis.String(ms.ss[0].Do("GET", "n")); err == nil || err.Error() != fmt.Sprintf("MOVED 1 :%d", ms.ss[1].port) {
+		return fmt.Errorf("expected MOVED, got '%v'", err)
+	}
+	if n, err := redis.Int(ms.ss[1].Do("SDBGROUP", "DBSIZE")); err != nil || n != 1 {
+		return fmt.Errorf("expected '1', got '%v', '%v'", n, err)
+	}
+	if n, err := redis.Int(ms.ss[0].Do("SDBGROUP", "DBSIZE")); err != nil || n != 3 {
+		return fmt.Errorf("expected '3', got '%v', '%v'", n, err)
+	}
+	return ms.DoBatch([][]interface{}{
+		// routed on the key, not the subcommand.
+		{"XGROUP", "CREATE", "x:stream", "g", "$", "MKSTREAM"}, {"OK"},
+		{"XADD", "x:stream", "1-1", "f", "v"}, {"1-1"},
+		{"XREADGROUP", "GROUP", "g", "c", "STREAMS", "x:stream", ">"}, {"[[x:stream [[1-1 [f v]]]]]"},
+		{"XGROUP", "DESTROY", "x:stream", "g"}, {1},
+		{"FLUSHDB"}, {"OK"},
+		{"DBSIZE"}, {0},
+	})
+}
+
+func shards_KEYS_test(ms *mockShards) error {
+	cmds := [][]interface{}{{"FLUSHDB"}, {"OK"}}
+	for _, key := range []string{"a", "c", "e", "m", "p", "t", "w", "y", "z"} {
+		cmds = append(cmds, []interface{}{"SET", key, strings.Repeat("x", int(key[0]-'a')%5)}, []interface{}{"OK"})
+	}
+	cmds = append(cmds, [][]interface{}{
+		{"KEYS", "*"}, {"[a c e m p t w y z]"},
+		{"KEYS", "*", "DESC"}, {"[z y w t p m e c a]"},
+		{"KEYS", "*", "PIVOT", "e", "LIMIT", 4}, {"[m p t w]"},
+		{"KEYS", "*", "PIVOT", "p", "LIMIT", 3, "DESC"}, {"[m e c]"},
+		{"KEYS", "*", "WITHVALUES", "LIMIT", 4}, {"[a  c xx e xxxx m xx]"},
+		{"FLUSHDB"}, {"OK"},
+		{"SET", "a", "3"}, {"OK"},
+		{"SET", "m", "1"}, {"OK"},
+		{"SET", "y", "2"}, {"OK"},
+		{"SET", "c", "2"}, {"OK"},
+		{"SET", "n", "5"}, {"OK"},
+		{"SETINDEX", "nums", "*", "INT"}, {"OK"},
+		{"ITER", "nums"}, {"[m 1 c 2 y 2 a 3 n 5]"},
+		{"ITER", "nums", "DESC", "LIMIT", 2}, {"[n 5 a 3]"},
+		{"ITER", "nums", "RANGE", "2", "3"}, {"[c 2 y 2 a 3]"},
+		{"ITER", "nums", "PIVOT", "1", "MATCH", "?"}, {"[c 2 y 2 a 3 n 5]"},
+		{"DELINDEX", "nums"}, {1},
+	}...)
+	return ms.DoBatch(cmds)
+}
+
+func shards_FORWARD_test(ms *mockShards) error {
+	if err := ms.DoBatch([][]interface{}{
+		{"FLUSHDB"}, {"OK"},
+		{"SET", "n", "forwarded"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	ms.ss[0].m.SetForwarding(ms.ss[0].n.Leader)
+	defer ms.ss[0].m.SetForwarding(nil)
+	if resp, err := redis.String(ms.ss[0].Do("GET", "n")); err != nil || resp != "forwarded" {
+		return fmt.Errorf("expected 'forwarded', got '%v', '%v'", resp, err)
+	}
+	if resp, err := redis.String(ms.ss[0].Do("SET", "x", "forwarded")); err != nil || resp != "OK" {
+		return fmt.Errorf("expected 'OK', got '%v', '%v'", resp, err)
+	}
+	// a command inside of a transaction is queued, and EXEC sends it to
+	// the group.
+	if _, err := ms.ss[0].Do("MULTI"); err != nil {
+		return err
+	}
+	if resp, err := redis.String(ms.ss[0].Do("GET", "n")); err != nil || resp != "QUEUED" {
+		return fmt.Errorf("expected 'QUEUED', got '%v', '%v'", resp, err)
+	}
+	if vals, err := redis.Strings(ms.ss[0].Do("EXEC")); err != nil || len(vals) != 1 || vals[0] != "forwarded" {
+		return fmt.Errorf("expected '[forwarded]', got '%v', '%v'", vals, err)
+	}
+	return ms.DoBatch([][]interface{}{
+		{"GET", "x"}, {"forwarded"},
+	})
+}
+
+func shards_RESUME_test(ms *mockShards) error {
+	if err := ms.DoBatch([][]interface{}{
+		{"FLUSHDB"}, {"OK"},
+		{"SET", "q", "before"}, {"OK"},
+		{"RANGES"}, {fmt.Sprintf("[[ m 0 :%d] [m w 1 :%d] [w  2 :%d]]",
+			ms.ss[0].port, ms.ss[1].port, ms.ss[2].port)},
+	}); err != nil {
+		return err
+	}
+	// start moving [m, w) to the last group and stop after the keys have
+	// been frozen, as if the server had crashed.
+	if resp, err := redis.String(ms.internal(0, "SDBROUTEMOVE", "m", "w", 1, 2)); err != nil || resp != "OK" {
+		return fmt.Errorf("expected 'OK', got '%v', '%v'", resp, err)
+	}
+	if resp, err := redis.String(ms.internal(1, "SDBRANGELEAVE", "m", "w")); err != nil || resp != "OK" {
+		return fmt.Errorf("expected 'OK', got '%v', '%v'", resp, err)
+	}
+	// the balancer completes the move, and the write is retried until then.
+	return ms.DoBatch([][]interface{}{
+		{"SET", "q", "after"}, {"OK"},
+		{"GET", "q"}, {"after"},
+		{"RANGES"}, {fmt.Sprintf("[[ m 0 :%d] [m w 2 :%d] [w  2 :%d]]",
+			ms.ss[0].port, ms.ss[2].port, ms.ss[2].port)},
+	})
+}
+
+func shards_SPLIT_test(ms *mockShards) error {
+	cmds := [][]interface{}{{"FLUSHDB"}, {"OK"}}
+	for i := 0; i < 40; i++ {
+		cmds = append(cmds, []interface{}{"SET", fmt.Sprintf("key:%02d", i), i}, []interface{}{"OK"})
+	}
+	if err := ms.DoBatch(cmds); err != nil {
+		return err
+	}
+	ms.sh.SetRangeMaxKeys(10)
+	defer ms.sh.SetRangeMaxKeys(0)
+	// wait for the ranges to be split until each has ten keys or less.
+	start := time.Now()
+	for {
+		var large bool
+		for _, rt := range ms.sh.routesCopy() {
+			stats, err := redis.Values(ms.internal(rt.group, "SDBRANGESTATS", rt.start, rt.end))
+			if err != nil {
+				return err
+			}
+			if n, _ := redis.Int(stats[0], nil); n > 10 {
+				large = true
+			}
+		}
+		if !large {
+			break
+		}
+		if time.Now().Sub(start) > time.Second*10 {
+			return errTimeout
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if n := len(ms.sh.routesCopy()); n < 6 {
+		return fmt.Errorf("expected at least 6 ranges, got %d", n)
+	}
+	cmds = [][]interface{}{
+		{"DBSIZE"}, {40},
+		{"KEYS", "key:*", "LIMIT", 3, "PIVOT", "key:18"}, {"[key:19 key:20 key:21]"},
+	}
+	for i := 0; i < 40; i++ {
+		cmds = append(cmds, []interface{}{"GET", fmt.Sprintf("key:%02d", i)}, []interface{}{fmt.Sprint(i)})
+	}
+	return ms.DoBatch(cmds)
+}
+
+func shards_INTERNAL_test(mc *mockCluster, ms *mockShards) error {
+	// a server that isn't sharded has no internal commands.
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "mykey", "value"}, {"OK"},
+		{"SDBRANGEDROP", "", ""}, {"ERR unknown command 'SDBRANGEDROP'"},
+		{"SDBAUTH", "secret"}, {"ERR unknown command 'SDBAUTH'"},
+		{"GET", "mykey"}, {"value"},
+	}); err != nil {
+		return err
+	}
+	if err := ms.DoBatch([][]interface{}{
+		{"FLUSHDB"}, {"OK"},
+		{"SET", "a", "1"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	// a client must authenticate with the token of the shards.
+	conn, err := redis.Dial("tcp", fmt.Sprintf(":%d", ms.ss[0].port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, step := range []struct {
+		args   []interface{}
+		expect string
+	}{
+		{[]interface{}{"SDBRANGEDROP", "", ""}, "ERR unknown command 'SDBRANGEDROP'"},
+		{[]interface{}{"SDBROUTESET", "", "", 0}, "ERR unknown command 'SDBROUTESET'"},
+		{[]interface{}{"SDBAUTH", "wrong"}, "ERR invalid shards token"},
+		{[]interface{}{"SDBRANGEDROP", "", ""}, "ERR unknown command 'SDBRANGEDROP'"},
+		{[]interface{}{"SDBAUTH", "secret"}, "OK"},
+		{[]interface{}{"SDBRANGESTATS", "", "m"}, "[1 a]"},
+	} {
+		resp, err := conn.Do(step.args[0].(string), step.args[1:]...)
+		if err := checkExpect(step.expect, resp, err); err != nil {
+			return fmt.Errorf("%v: %v", step.args, err)
+		}
+	}
+	return ms.DoBatch([][]interface{}{
+		{"GET", "a"}, {"1"},
+	})
+}
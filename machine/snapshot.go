@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"os"
 	"strings"
 
 	"github.com/tidwall/buntdb"
@@ -17,7 +16,7 @@ func (m *Machine) Restore(rd io.Reader) error {
 
 	// read the snapshot into a new machine.
 	// the new machine will have the entire keyspace, but will be missing
-	// indexes and scripts.
+	// indexes, including the sorted set index, and scripts.
 	nm := &Machine{}
 	if err := nm.reopenBlankDB(rd, func(keys []string) { m.onExpired(keys) }); err != nil {
 		return err
@@ -25,6 +24,9 @@ func (m *Machine) Restore(rd io.Reader) error {
 
 	// rebuild the indexes
 	if err := nm.db.Update(func(tx *buntdb.Tx) error {
+		if err := dbSetZsetIndex(tx); err != nil {
+			return err
+		}
 		var metas []string
 		if err := tx.AscendGreaterOrEqual("", indexKeyPrefix, func(key, val string) bool {
 			if !strings.HasPrefix(key, indexKeyPrefix) {
@@ -50,47 +52,34 @@ func (m *Machine) Restore(rd io.Reader) error {
 		return err
 	}
 
-	// close and delete the previous file
+	// close the previous database
 	m.db.Close()
-	os.RemoveAll(m.file)
 
-	// set the important fields to the new machine, file, and script machine.
+	// set the important fields to the new machine and script machine.
 	m.db = nm.db
-	m.file = nm.file
-
-	return nil
-}
 
-// Snapshot creates a snapshot
-func (m *Machine) Snapshot(wr io.Writer) error {
-	var pos int64
-	var file string
-	err := func() error {
-		m.mu.RLock()
-		defer m.mu.RUnlock()
-		f, err := os.Open(m.file)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		pos, err = f.Seek(0, 2)
-		if err != nil {
-			return err
-		}
-		file = m.file
-		return nil
-	}()
-	if err != nil {
+	// changes from before the snapshot no longer apply.
+	var index uint64
+	if err := m.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		index, err = txChangeIndex(tx)
 		return err
-	}
-	// write the file data
-	f, err := os.Open(file)
-	if err != nil {
+	}); err != nil {
 		return err
 	}
-	defer f.Close()
-	if _, err := io.CopyN(wr, f, pos); err != nil {
-		return err
+	m.cl.reset(index)
+
+	if m.sh != nil {
+		return m.db.View(m.loadRanges)
 	}
+
 	return nil
 }
+
+// Snapshot creates a snapshot. The database is saved from a consistent read
+// transaction, which holds off writes until it's done.
+func (m *Machine) Snapshot(wr io.Writer) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.db.Save(wr)
+}
@@ -0,0 +1,665 @@
+package machine
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// Each sorted set member is stored as a member key with a value that is the
+// member key prefix followed by the encoded score. The zset index orders all
+// of the values using the binary lesser, which groups the members by their
+// sorted set and then sorts them by score and member.
+
+// zsetIndexName is the index which orders all sorted set members.
+const zsetIndexName = sdbMetaPrefix + "zset"
+
+var errNotAFloat = errors.New("ERR value is not a valid float")
+var errMinMaxNotAFloat = errors.New("ERR min or max is not a float")
+var errMinMaxNotAString = errors.New("ERR min or max not valid string range item")
+
+// dbSetZsetIndex creates the sorted set index. Must be called for every new
+// database, including after a snapshot restore.
+func dbSetZsetIndex(tx *buntdb.Tx) error {
+	return tx.CreateIndex(zsetIndexName, sdbMetaPrefix+"zset:*", buntdb.IndexBinary)
+}
+
+// encodeScore encodes a score into a string which sorts in the same order
+// as the score.
+func encodeScore(score float64) string {
+	if score == 0 {
+		score = 0 // no negative zero
+	}
+	bits := math.Float64bits(score)
+	if bits&(1<<63) == 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	s := strconv.FormatUint(bits, 16)
+	return "0000000000000000"[len(s):] + s
+}
+
+func decodeScore(s string) float64 {
+	bits, _ := strconv.ParseUint(s, 16, 64)
+	if bits&(1<<63) != 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
+
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, +1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+func parseScore(s string) (float64, bool) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, false
+	}
+	return score, true
+}
+
+// zsetValue returns the value of a sorted set member.
+func zsetValue(key string, score float64) string {
+	return memberKeyPrefix("zset", key) + encodeScore(score)
+}
+
+// zsetValueScore returns the score of a sorted set member value.
+func zsetValueScore(val string) float64 {
+	if len(val) < 16 {
+		return 0
+	}
+	return decodeScore(val[len(val)-16:])
+}
+
+// txZsetScore returns the score for a sorted set member.
+func txZsetScore(tx *buntdb.Tx, key, member string) (float64, bool, error) {
+	val, err := tx.Get(memberKeyPrefix("zset", key) + member)
+	if err != nil {
+		if err == buntdb.ErrNotFound {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return zsetValueScore(val), true, nil
+}
+
+// scanZset iterates over the members of a sorted set in score order,
+// starting at the min score.
+func scanZset(tx *buntdb.Tx, key string, min float64, iter func(member string, score float64) bool) error {
+	prefix := memberKeyPrefix("zset", key)
+	return tx.AscendGreaterOrEqual(zsetIndexName, prefix+encodeScore(min), func(mkey, val string) bool {
+		if !strings.HasPrefix(val, prefix) {
+			return false
+		}
+		return iter(mkey[len(prefix):], zsetValueScore(val))
+	})
+}
+
+// scoreRange is a min or max argument for ZRANGEBYSCORE and ZCOUNT.
+type scoreRange struct {
+	score float64
+	ex    bool
+}
+
+func parseScoreRange(s string) (scoreRange, error) {
+	var r scoreRange
+	if strings.HasPrefix(s, "(") {
+		r.ex = true
+		s = s[1:]
+	}
+	var ok bool
+	r.score, ok = parseScore(s)
+	if !ok {
+		return r, errMinMaxNotAFloat
+	}
+	return r, nil
+}
+
+// scanZsetRange iterates over the members of a sorted set that are within
+// the min and max scores.
+func scanZsetRange(tx *buntdb.Tx, key string, min, max scoreRange, iter func(member string, score float64) bool) error {
+	return scanZset(tx, key, min.score, func(member string, score float64) bool {
+		if min.ex && score == min.score {
+			return true
+		}
+		if score > max.score || (max.ex && score == max.score) {
+			return false
+		}
+		return iter(member, score)
+	})
+}
+
+// parseLimit parses an optional LIMIT offset count argument. A negative
+// count returns all remaining members.
+func parseLimit(cmd redcon.Command, i int) (offset, count int, withscores bool, err error) {
+	count = -1
+	for ; i < len(cmd.Args); i++ {
+		switch strings.ToLower(string(cmd.Args[i])) {
+		default:
+			return 0, 0, false, errSyntaxError
+		case "withscores":
+			withscores = true
+		case "limit":
+			if i+2 >= len(cmd.Args) {
+				return 0, 0, false, errSyntaxError
+			}
+			n1, err1 := strconv.ParseInt(string(cmd.Args[i+1]), 10, 64)
+			n2, err2 := strconv.ParseInt(string(cmd.Args[i+2]), 10, 64)
+			if err1 != nil || err2 != nil {
+				return 0, 0, false, errNotAnInt
+			}
+			offset, count = int(n1), int(n2)
+			i += 2
+		}
+	}
+	return offset, count, withscores, nil
+}
+
+func writeZsetMembers(conn redcon.Conn, members []string, scores []float64, withscores bool) {
+	if withscores {
+		conn.WriteArray(len(members) * 2)
+	} else {
+		conn.WriteArray(len(members))
+	}
+	for i, member := range members {
+		conn.WriteBulkString(member)
+		if withscores {
+			conn.WriteBulkString(formatScore(scores[i]))
+		}
+	}
+}
+
+// zsetAdd adds or updates a sorted set member. Returns the new score and
+// whether the member was added or changed.
+func zsetAdd(tx *buntdb.Tx, key string, h *typeHeader, member string, score float64, nx, xx, incr bool) (nscore float64, added, changed, ok bool, err error) {
+	cur, exists, err := txZsetScore(tx, key, member)
+	if err != nil {
+		return 0, false, false, false, err
+	}
+	if (nx && exists) || (xx && !exists) {
+		return cur, false, false, false, nil
+	}
+	if incr && exists {
+		score += cur
+		if math.IsNaN(score) {
+			return 0, false, false, false, errors.New("ERR resulting score is not a number (NaN)")
+		}
+	}
+	if exists && cur == score {
+		return score, false, false, true, nil
+	}
+	if _, _, err := tx.Set(memberKeyPrefix("zset", key)+member, zsetValue(key, score), nil); err != nil {
+		return 0, false, false, false, err
+	}
+	if !exists {
+		h.count++
+		return score, true, false, true, nil
+	}
+	return score, false, true, true, nil
+}
+
+func (m *Machine) doZadd(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// ZADD key [NX|XX] [CH] [INCR] score member [score member ...]
+	if len(cmd.Args) < 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	var nx, xx, ch, incr bool
+	i := 2
+opts:
+	for ; i < len(cmd.Args); i++ {
+		switch strings.ToLower(string(cmd.Args[i])) {
+		default:
+			break opts
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "ch":
+			ch = true
+		case "incr":
+			incr = true
+		}
+	}
+	if nx && xx {
+		return nil, errors.New("ERR XX and NX options at the same time are not compatible")
+	}
+	if len(cmd.Args)-i == 0 || (len(cmd.Args)-i)%2 == 1 {
+		return nil, errSyntaxError
+	}
+	if incr && len(cmd.Args)-i != 2 {
+		return nil, errors.New("ERR INCR option supports a single increment-element pair")
+	}
+	var scores []float64
+	var members []string
+	for ; i < len(cmd.Args); i += 2 {
+		score, ok := parseScore(string(cmd.Args[i]))
+		if !ok {
+			return nil, errNotAFloat
+		}
+		scores = append(scores, score)
+		members = append(members, string(cmd.Args[i+1]))
+	}
+	key := string(cmd.Args[1])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := txGetHeaderForUpdate(tx, key, "zset")
+		if err != nil {
+			return nil, err
+		}
+		var nadded, nchanged int
+		var nscore float64
+		var ok bool
+		for i, member := range members {
+			var added, changed bool
+			nscore, added, changed, ok, err = zsetAdd(tx, key, &h, member, scores[i], nx, xx, incr)
+			if err != nil {
+				return nil, err
+			}
+			if added {
+				nadded++
+			}
+			if changed {
+				nchanged++
+			}
+		}
+		if nadded > 0 {
+			if err := txSetHeader(tx, key, h); err != nil {
+				return nil, err
+			}
+		}
+		if nadded+nchanged > 0 {
+			if incr {
+				m.notify(notifyZset, "zincr", key)
+			} else {
+				m.notify(notifyZset, "zadd", key)
+			}
+		}
+		if incr {
+			if !ok {
+				return nil, nil
+			}
+			return formatScore(nscore), nil
+		}
+		if ch {
+			return nadded + nchanged, nil
+		}
+		return nadded, nil
+	}, func(v interface{}) error {
+		switch v := v.(type) {
+		case nil:
+			conn.WriteNull()
+		case int:
+			conn.WriteInt(v)
+		case string:
+			conn.WriteBulkString(v)
+		}
+		return nil
+	})
+}
+
+func (m *Machine) doZincrby(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// ZINCRBY key increment member
+	if len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	amt, ok := parseScore(string(cmd.Args[2]))
+	if !ok {
+		return nil, errNotAFloat
+	}
+	key := string(cmd.Args[1])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := txGetHeaderForUpdate(tx, key, "zset")
+		if err != nil {
+			return nil, err
+		}
+		score, added, _, _, err := zsetAdd(tx, key, &h, string(cmd.Args[3]), amt, false, false, true)
+		if err != nil {
+			return nil, err
+		}
+		if added {
+			if err := txSetHeader(tx, key, h); err != nil {
+				return nil, err
+			}
+		}
+		m.notify(notifyZset, "zincr", key)
+		return formatScore(score), nil
+	}, func(v interface{}) error {
+		conn.WriteBulkString(v.(string))
+		return nil
+	})
+}
+
+func (m *Machine) doZrem(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// ZREM key member [member ...]
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := txGetHeader(tx, key, "zset")
+		if err != nil {
+			return nil, err
+		}
+		if h.count == 0 {
+			return 0, nil
+		}
+		prefix := memberKeyPrefix("zset", key)
+		var n int
+		for i := 2; i < len(cmd.Args); i++ {
+			if _, err := tx.Delete(prefix + string(cmd.Args[i])); err != nil {
+				if err == buntdb.ErrNotFound {
+					continue
+				}
+				return nil, err
+			}
+			n++
+		}
+		if n > 0 {
+			h.count -= n
+			if err := txSetHeader(tx, key, h); err != nil {
+				return nil, err
+			}
+			m.notify(notifyZset, "zrem", key)
+			if h.count == 0 {
+				m.notify(notifyGeneric, "del", key)
+			}
+		}
+		return n, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+func (m *Machine) doZscore(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// ZSCORE key member
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "zset")
+		if err != nil {
+			return err
+		}
+		if h.count == 0 {
+			conn.WriteNull()
+			return nil
+		}
+		score, ok, err := txZsetScore(tx, key, string(cmd.Args[2]))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			conn.WriteNull()
+			return nil
+		}
+		conn.WriteBulkString(formatScore(score))
+		return nil
+	})
+}
+
+func (m *Machine) doZcard(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// ZCARD key
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "zset")
+		if err != nil {
+			return err
+		}
+		conn.WriteInt(h.count)
+		return nil
+	})
+}
+
+func (m *Machine) doZrank(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// ZRANK key member
+	// ZREVRANK key member
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	rev := strings.ToLower(string(cmd.Args[0])) == "zrevrank"
+	key := string(cmd.Args[1])
+	member := string(cmd.Args[2])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "zset")
+		if err != nil {
+			return err
+		}
+		if h.count == 0 {
+			conn.WriteNull()
+			return nil
+		}
+		_, ok, err := txZsetScore(tx, key, member)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			conn.WriteNull()
+			return nil
+		}
+		var rank int
+		if err := scanZset(tx, key, math.Inf(-1), func(mbr string, score float64) bool {
+			if mbr == member {
+				return false
+			}
+			rank++
+			return true
+		}); err != nil {
+			return err
+		}
+		if rev {
+			rank = h.count - 1 - rank
+		}
+		conn.WriteInt(rank)
+		return nil
+	})
+}
+
+func (m *Machine) doZrange(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// ZRANGE key start stop [WITHSCORES]
+	if len(cmd.Args) != 4 && len(cmd.Args) != 5 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	start, stop, err := parseStartEnd(cmd, 2, 3)
+	if err != nil {
+		return nil, err
+	}
+	var withscores bool
+	if len(cmd.Args) == 5 {
+		if strings.ToLower(string(cmd.Args[4])) != "withscores" {
+			return nil, errSyntaxError
+		}
+		withscores = true
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "zset")
+		if err != nil {
+			return err
+		}
+		start, stop, ok := listRange(start, stop, h.count)
+		if !ok {
+			conn.WriteArray(0)
+			return nil
+		}
+		var members []string
+		var scores []float64
+		var i int
+		if err := scanZset(tx, key, math.Inf(-1), func(member string, score float64) bool {
+			if i > stop {
+				return false
+			}
+			if i >= start {
+				members = append(members, member)
+				scores = append(scores, score)
+			}
+			i++
+			return true
+		}); err != nil {
+			return err
+		}
+		writeZsetMembers(conn, members, scores, withscores)
+		return nil
+	})
+}
+
+func (m *Machine) doZrangebyscore(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+	// ZCOUNT key min max
+	if len(cmd.Args) < 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	count := strings.ToLower(string(cmd.Args[0])) == "zcount"
+	if count && len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	min, err := parseScoreRange(string(cmd.Args[2]))
+	if err != nil {
+		return nil, err
+	}
+	max, err := parseScoreRange(string(cmd.Args[3]))
+	if err != nil {
+		return nil, err
+	}
+	offset, limit, withscores, err := parseLimit(cmd, 4)
+	if err != nil {
+		return nil, err
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "zset")
+		if err != nil {
+			return err
+		}
+		var members []string
+		var scores []float64
+		var n int
+		if h.count > 0 {
+			if err := scanZsetRange(tx, key, min, max, func(member string, score float64) bool {
+				n++
+				if count || n <= offset {
+					return true
+				}
+				if limit >= 0 && len(members) >= limit {
+					return false
+				}
+				members = append(members, member)
+				scores = append(scores, score)
+				return true
+			}); err != nil {
+				return err
+			}
+		}
+		if count {
+			conn.WriteInt(n)
+			return nil
+		}
+		writeZsetMembers(conn, members, scores, withscores)
+		return nil
+	})
+}
+
+// lexRange is a min or max argument for ZRANGEBYLEX.
+type lexRange struct {
+	member string
+	ex     bool
+	inf    int // -1 for '-', +1 for '+'
+}
+
+func parseLexRange(s string) (lexRange, error) {
+	switch {
+	case s == "-":
+		return lexRange{inf: -1}, nil
+	case s == "+":
+		return lexRange{inf: +1}, nil
+	case strings.HasPrefix(s, "["):
+		return lexRange{member: s[1:]}, nil
+	case strings.HasPrefix(s, "("):
+		return lexRange{member: s[1:], ex: true}, nil
+	}
+	return lexRange{}, errMinMaxNotAString
+}
+
+func (r lexRange) greaterThan(member string) bool {
+	if r.inf != 0 {
+		return r.inf > 0
+	}
+	return member < r.member || (r.ex && member == r.member)
+}
+
+func (r lexRange) lessThan(member string) bool {
+	if r.inf != 0 {
+		return r.inf < 0
+	}
+	return member > r.member || (r.ex && member == r.member)
+}
+
+func (m *Machine) doZrangebylex(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// ZRANGEBYLEX key min max [LIMIT offset count]
+	if len(cmd.Args) < 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	min, err := parseLexRange(string(cmd.Args[2]))
+	if err != nil {
+		return nil, err
+	}
+	max, err := parseLexRange(string(cmd.Args[3]))
+	if err != nil {
+		return nil, err
+	}
+	offset, limit, withscores, err := parseLimit(cmd, 4)
+	if err != nil || withscores {
+		return nil, errSyntaxError
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "zset")
+		if err != nil {
+			return err
+		}
+		var members []string
+		var n int
+		if h.count > 0 {
+			// member keys are stored in lexicographical order
+			if err := scanMembers(tx, "zset", key, func(member, val string) bool {
+				if min.greaterThan(member) {
+					return true
+				}
+				if max.lessThan(member) {
+					return false
+				}
+				n++
+				if n <= offset {
+					return true
+				}
+				if limit >= 0 && len(members) >= limit {
+					return false
+				}
+				members = append(members, member)
+				return true
+			}); err != nil {
+				return err
+			}
+		}
+		writeZsetMembers(conn, members, nil, false)
+		return nil
+	})
+}
@@ -0,0 +1,140 @@
+package machine
+
+import "testing"
+
+func subTestSortedSets(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "ZADD", sortedsets_ZADD_test)
+	runStep(t, mc, "ZINCRBY", sortedsets_ZINCRBY_test)
+	runStep(t, mc, "ZREM", sortedsets_ZREM_test)
+	runStep(t, mc, "ZRANK", sortedsets_ZRANK_test)
+	runStep(t, mc, "ZRANGE", sortedsets_ZRANGE_test)
+	runStep(t, mc, "ZRANGEBYSCORE", sortedsets_ZRANGEBYSCORE_test)
+	runStep(t, mc, "ZRANGEBYLEX", sortedsets_ZRANGEBYLEX_test)
+	runStep(t, mc, "ZCOUNT", sortedsets_ZCOUNT_test)
+	runStep(t, mc, "keys", sortedsets_KEYS_test)
+}
+
+func sortedsets_ZADD_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"ZADD", "myzset", 1, "one"}, {1},
+		{"ZADD", "myzset", 1, "uno"}, {1},
+		{"ZADD", "myzset", 2, "two", 3, "three"}, {2},
+		{"ZRANGE", "myzset", 0, -1, "WITHSCORES"}, {"[one 1 uno 1 two 2 three 3]"},
+		{"ZADD", "myzset", "NX", 10, "one", 4, "four"}, {1},
+		{"ZADD", "myzset", "XX", 10, "one", 5, "five"}, {0},
+		{"ZADD", "myzset", "CH", 11, "one", 5, "five", 2, "two"}, {2},
+		{"ZADD", "myzset", "INCR", 1.5, "one"}, {"12.5"},
+		{"ZADD", "myzset", "NX", "INCR", 1.5, "one"}, {nil},
+		{"ZSCORE", "myzset", "one"}, {"12.5"},
+		{"ZSCORE", "myzset", "none"}, {nil},
+		{"ZCARD", "myzset"}, {6},
+		{"ZCARD", "nozset"}, {0},
+		{"ZADD", "myzset", "NX", "XX", 1, "one"}, {"ERR XX and NX options at the same time are not compatible"},
+		{"ZADD", "myzset", "INCR", 1, "one", 2, "two"}, {"ERR INCR option supports a single increment-element pair"},
+		{"ZADD", "myzset", "abc", "one"}, {"ERR value is not a valid float"},
+		{"ZADD", "myzset", 1, "one", 2}, {"ERR syntax error"},
+		{"ZADD", "myzset", "-inf", "low", "+inf", "high"}, {2},
+		{"ZRANGE", "myzset", 0, 0, "WITHSCORES"}, {"[low -inf]"},
+		{"ZRANGE", "myzset", -1, -1, "WITHSCORES"}, {"[high inf]"},
+	})
+}
+func sortedsets_ZINCRBY_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"ZADD", "myzset", 1, "one", 2, "two"}, {2},
+		{"ZINCRBY", "myzset", 2, "one"}, {"3"},
+		{"ZINCRBY", "myzset", -5, "three"}, {"-5"},
+		{"ZRANGE", "myzset", 0, -1, "WITHSCORES"}, {"[three -5 two 2 one 3]"},
+	})
+}
+func sortedsets_ZREM_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"ZADD", "myzset", 1, "one", 2, "two", 3, "three"}, {3},
+		{"ZREM", "myzset", "two", "four"}, {1},
+		{"ZRANGE", "myzset", 0, -1}, {"[one three]"},
+		{"ZREM", "myzset", "one", "three"}, {2},
+		{"EXISTS", "myzset"}, {0},
+		{"ZREM", "myzset", "one"}, {0},
+	})
+}
+func sortedsets_ZRANK_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"ZADD", "myzset", 1, "one", 2, "two", 3, "three"}, {3},
+		{"ZRANK", "myzset", "three"}, {2},
+		{"ZRANK", "myzset", "one"}, {0},
+		{"ZRANK", "myzset", "four"}, {nil},
+		{"ZREVRANK", "myzset", "three"}, {0},
+		{"ZREVRANK", "myzset", "one"}, {2},
+		{"ZRANK", "nozset", "one"}, {nil},
+	})
+}
+func sortedsets_ZRANGE_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"ZADD", "myzset", 3, "three", 1, "one", 2, "two"}, {3},
+		{"ZADD", "other", 0, "zero", 10, "ten"}, {2},
+		{"ZRANGE", "myzset", 0, -1}, {"[one two three]"},
+		{"ZRANGE", "myzset", 2, 3}, {"[three]"},
+		{"ZRANGE", "myzset", -2, -1}, {"[two three]"},
+		{"ZRANGE", "myzset", 5, 10}, {"[]"},
+		{"ZRANGE", "myzset", 0, 1, "WITHSCORES"}, {"[one 1 two 2]"},
+		{"ZRANGE", "myzset", 0, 1, "BADARG"}, {"ERR syntax error"},
+		{"ZRANGE", "nozset", 0, -1}, {"[]"},
+	})
+}
+func sortedsets_ZRANGEBYSCORE_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"ZADD", "myzset", 1, "one", 2, "two", 3, "three", -1.5, "neg"}, {4},
+		{"ZRANGEBYSCORE", "myzset", "-inf", "+inf"}, {"[neg one two three]"},
+		{"ZRANGEBYSCORE", "myzset", 1, 2}, {"[one two]"},
+		{"ZRANGEBYSCORE", "myzset", "(1", 2}, {"[two]"},
+		{"ZRANGEBYSCORE", "myzset", "(1", "(2"}, {"[]"},
+		{"ZRANGEBYSCORE", "myzset", -2, 0, "WITHSCORES"}, {"[neg -1.5]"},
+		{"ZRANGEBYSCORE", "myzset", "-inf", "+inf", "LIMIT", 1, 2}, {"[one two]"},
+		{"ZRANGEBYSCORE", "myzset", "-inf", "+inf", "WITHSCORES", "LIMIT", 3, -1}, {"[three 3]"},
+		{"ZRANGEBYSCORE", "myzset", "a", 2}, {"ERR min or max is not a float"},
+	})
+}
+func sortedsets_ZRANGEBYLEX_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"ZADD", "myzset", 0, "a", 0, "b", 0, "c", 0, "d", 0, "e", 0, "f", 0, "g"}, {7},
+		{"ZRANGEBYLEX", "myzset", "-", "[c"}, {"[a b c]"},
+		{"ZRANGEBYLEX", "myzset", "-", "(c"}, {"[a b]"},
+		{"ZRANGEBYLEX", "myzset", "[aaa", "(g"}, {"[b c d e f]"},
+		{"ZRANGEBYLEX", "myzset", "(e", "+"}, {"[f g]"},
+		{"ZRANGEBYLEX", "myzset", "-", "+", "LIMIT", 2, 2}, {"[c d]"},
+		{"ZRANGEBYLEX", "myzset", "a", "+"}, {"ERR min or max not valid string range item"},
+	})
+}
+func sortedsets_ZCOUNT_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"ZADD", "myzset", 1, "one", 2, "two", 3, "three"}, {3},
+		{"ZCOUNT", "myzset", "-inf", "+inf"}, {3},
+		{"ZCOUNT", "myzset", "(1", 3}, {2},
+		{"ZCOUNT", "nozset", "-inf", "+inf"}, {0},
+	})
+}
+func sortedsets_KEYS_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"ZADD", "myzset", 1, "one", 2, "two"}, {2},
+		{"TYPE", "myzset"}, {"zset"},
+		{"GET", "myzset"}, {"WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"KEYS", "*"}, {"[myzset]"},
+		{"RENAME", "myzset", "newzset"}, {"OK"},
+		{"ZRANGE", "newzset", 0, -1, "WITHSCORES"}, {"[one 1 two 2]"},
+		{"ZRANGE", "myzset", 0, -1}, {"[]"},
+		{"DUMP", "newzset"}, {func(v interface{}) (resp, expect interface{}) {
+			return mc.DoExpect("OK", "RESTORE", "myzset", 0, v), nil
+		}},
+		{"ZADD", "newzset", 3, "three"}, {1},
+		{"ZRANGE", "myzset", 0, -1, "WITHSCORES"}, {"[one 1 two 2]"},
+		{"ZRANGEBYSCORE", "newzset", 2, 3}, {"[two three]"},
+		{"FLUSHDB"}, {"OK"},
+		{"ZRANGE", "newzset", 0, -1}, {"[]"},
+		{"ZADD", "newzset", 1, "one"}, {1},
+		{"ZRANGE", "newzset", 0, -1}, {"[one]"},
+		{"MULTI"}, {"OK"},
+		{"ZADD", "myzset", 1, "one"}, {"QUEUED"},
+		{"ZSCORE", "myzset", "one"}, {"QUEUED"},
+		{"EXEC"}, {"[1 1]"},
+		{"EVAL", `return sdb.call("zrange", KEYS[0], 0, -1)`, 1, "myzset"}, {"[one]"},
+	})
+}
@@ -127,7 +127,7 @@ func (m *Machine) doRect(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		limit := rargs.limit
 		err := tx.Intersects(rargs.index, rargs.value,
 			func(key, val string) bool {
-				if isMercMetaKey(key) {
+				if isMercMetaKey(key) || !m.servesKey(key) {
 					return true
 				}
 				if rargs.limiton && len(results) >= limit {
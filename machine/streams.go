@@ -0,0 +1,1269 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// A stream is a collection with three kinds of members:
+//
+//   e:<id>                  an entry, the value is the RESP encoded fields
+//   g:<group>               a consumer group, the value is the last delivered id
+//   p:<len>:<group>:<id>    a pending entry, the value is "time count consumer"
+//
+// Ids are encoded so that the members are stored in id order. The header
+// keeps the last id that was added to the stream.
+
+var errInvalidStreamID = errors.New("ERR Invalid stream ID specified as stream command argument")
+var errStreamIDTooSmall = errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+
+// streamID is the id of a stream entry.
+type streamID struct {
+	ms, seq uint64
+}
+
+var maxStreamID = streamID{math.MaxUint64, math.MaxUint64}
+
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id streamID) less(other streamID) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+// encode returns the id in a form that sorts in id order.
+func (id streamID) encode() string {
+	return hex16(id.ms) + "-" + hex16(id.seq)
+}
+
+func decodeStreamID(s string) streamID {
+	var id streamID
+	if len(s) == 33 {
+		id.ms, _ = strconv.ParseUint(s[:16], 16, 64)
+		id.seq, _ = strconv.ParseUint(s[17:], 16, 64)
+	}
+	return id
+}
+
+func hex16(n uint64) string {
+	s := strconv.FormatUint(n, 16)
+	return "0000000000000000"[len(s):] + s
+}
+
+// parseStreamID parses an id in the form "ms-seq" or "ms". The seq is used
+// when it is missing from the id.
+func parseStreamID(s string, seq uint64) (streamID, error) {
+	var id streamID
+	var err error
+	if i := strings.IndexByte(s, '-'); i != -1 {
+		id.seq, err = strconv.ParseUint(s[i+1:], 10, 64)
+		if err != nil {
+			return id, errInvalidStreamID
+		}
+		s = s[:i]
+	} else {
+		id.seq = seq
+	}
+	id.ms, err = strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return id, errInvalidStreamID
+	}
+	return id, nil
+}
+
+// parseStreamRange parses the start or end of a range. The special ids "-"
+// and "+" are the smallest and largest ids, and an id that starts with "("
+// is exclusive. Returns false when the range is known to be empty.
+func parseStreamRange(s string, start bool) (streamID, bool, error) {
+	switch s {
+	case "-":
+		return streamID{}, true, nil
+	case "+":
+		return maxStreamID, true, nil
+	}
+	var ex bool
+	if strings.HasPrefix(s, "(") {
+		ex = true
+		s = s[1:]
+	}
+	var seq uint64
+	if !start {
+		seq = math.MaxUint64
+	}
+	id, err := parseStreamID(s, seq)
+	if err != nil || !ex {
+		return id, true, err
+	}
+	if start {
+		if id == maxStreamID {
+			return id, false, nil
+		}
+		if id.seq == math.MaxUint64 {
+			return streamID{id.ms + 1, 0}, true, nil
+		}
+		return streamID{id.ms, id.seq + 1}, true, nil
+	}
+	if id == (streamID{}) {
+		return id, false, nil
+	}
+	if id.seq == 0 {
+		return streamID{id.ms - 1, math.MaxUint64}, true, nil
+	}
+	return streamID{id.ms, id.seq - 1}, true, nil
+}
+
+func streamLastID(h typeHeader) streamID {
+	return streamID{uint64(h.head), uint64(h.tail)}
+}
+
+func streamEntryPrefix(key string) string {
+	return memberKeyPrefix("stream", key) + "e:"
+}
+
+func streamGroupKey(key, group string) string {
+	return memberKeyPrefix("stream", key) + "g:" + group
+}
+
+func streamPendingPrefix(key, group string) string {
+	return memberKeyPrefix("stream", key) + "p:" +
+		strconv.FormatInt(int64(len(group)), 10) + ":" + group + ":"
+}
+
+// pendingEntry is an entry that was delivered to a consumer, but has not
+// been acknowledged.
+type pendingEntry struct {
+	time     int64 // delivery time in milliseconds
+	count    int64 // number of deliveries
+	consumer string
+}
+
+func (p pendingEntry) String() string {
+	return strconv.FormatInt(p.time, 10) + " " + strconv.FormatInt(p.count, 10) + " " + p.consumer
+}
+
+func parsePendingEntry(val string) pendingEntry {
+	var p pendingEntry
+	parts := strings.SplitN(val, " ", 3)
+	if len(parts) == 3 {
+		p.time, _ = strconv.ParseInt(parts[0], 10, 64)
+		p.count, _ = strconv.ParseInt(parts[1], 10, 64)
+		p.consumer = parts[2]
+	}
+	return p
+}
+
+// streamEntry is a stream entry. The fields are nil when the entry has been
+// deleted, which can happen to entries that are pending.
+type streamEntry struct {
+	id     streamID
+	fields [][]byte
+}
+
+// streamResult is the response for one stream key in XREAD and XREADGROUP.
+type streamResult struct {
+	key     string
+	entries []streamEntry
+}
+
+func newStreamEntry(id streamID, val string) streamEntry {
+	cmd, err := parseCommand([]byte(val))
+	if err != nil {
+		return streamEntry{id: id}
+	}
+	return streamEntry{id: id, fields: cmd.Args}
+}
+
+// txStreamEntry returns a single stream entry. The fields are nil when the
+// entry does not exist.
+func txStreamEntry(tx *buntdb.Tx, key string, id streamID) (streamEntry, error) {
+	val, err := tx.Get(streamEntryPrefix(key) + id.encode())
+	if err != nil {
+		if err == buntdb.ErrNotFound {
+			return streamEntry{id: id}, nil
+		}
+		return streamEntry{}, err
+	}
+	return newStreamEntry(id, val), nil
+}
+
+// scanStream returns the entries between start and end, inclusive. A
+// negative count returns all entries.
+func scanStream(tx *buntdb.Tx, key string, start, end streamID, rev bool, count int) ([]streamEntry, error) {
+	var entries []streamEntry
+	if end.less(start) {
+		return nil, nil
+	}
+	prefix := streamEntryPrefix(key)
+	smin, smax := prefix+start.encode(), prefix+end.encode()
+	iter := func(mkey, val string) bool {
+		if count >= 0 && len(entries) >= count {
+			return false
+		}
+		if mkey < smin || mkey > smax || !strings.HasPrefix(mkey, prefix) {
+			return false
+		}
+		entries = append(entries, newStreamEntry(decodeStreamID(mkey[len(prefix):]), val))
+		return true
+	}
+	var err error
+	if rev {
+		err = tx.DescendLessOrEqual("", smax, iter)
+	} else {
+		err = tx.AscendGreaterOrEqual("", smin, iter)
+	}
+	return entries, err
+}
+
+// streamRead returns the entries that come after an id.
+func streamRead(tx *buntdb.Tx, key string, after streamID, count int) ([]streamEntry, error) {
+	if after == maxStreamID {
+		return nil, nil
+	}
+	start := streamID{after.ms, after.seq + 1}
+	if after.seq == math.MaxUint64 {
+		start = streamID{after.ms + 1, 0}
+	}
+	return scanStream(tx, key, start, maxStreamID, false, count)
+}
+
+// streamTrim removes entries from the start of a stream until the stream
+// has no more than maxlen entries and no entries smaller than minid. A
+// negative maxlen is ignored. Returns the number of entries removed.
+func streamTrim(tx *buntdb.Tx, key string, h *typeHeader, maxlen int, minid streamID) (int, error) {
+	var ids []streamID
+	n := h.count
+	prefix := streamEntryPrefix(key)
+	if err := tx.AscendGreaterOrEqual("", prefix, func(mkey, val string) bool {
+		if !strings.HasPrefix(mkey, prefix) {
+			return false
+		}
+		id := decodeStreamID(mkey[len(prefix):])
+		if (maxlen < 0 || n <= maxlen) && !id.less(minid) {
+			return false
+		}
+		ids = append(ids, id)
+		n--
+		return true
+	}); err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		if _, err := tx.Delete(prefix + id.encode()); err != nil {
+			return 0, err
+		}
+	}
+	h.count -= len(ids)
+	return len(ids), nil
+}
+
+// parseTrimArgs parses MAXLEN|MINID [=|~] threshold starting at the
+// argument i. Returns the index of the following argument.
+func parseTrimArgs(cmd redcon.Command, i int) (maxlen int, minid streamID, next int, err error) {
+	strategy := strings.ToLower(string(cmd.Args[i]))
+	i++
+	if i < len(cmd.Args) && (string(cmd.Args[i]) == "=" || string(cmd.Args[i]) == "~") {
+		i++
+	}
+	if i >= len(cmd.Args) {
+		return 0, minid, 0, errSyntaxError
+	}
+	maxlen = -1
+	if strategy == "maxlen" {
+		n, err := strconv.ParseInt(string(cmd.Args[i]), 10, 64)
+		if err != nil || n < 0 {
+			return 0, minid, 0, errNotAnInt
+		}
+		maxlen = int(n)
+	} else {
+		minid, err = parseStreamID(string(cmd.Args[i]), 0)
+		if err != nil {
+			return 0, minid, 0, err
+		}
+	}
+	return maxlen, minid, i + 1, nil
+}
+
+func writeStreamEntries(conn redcon.Conn, entries []streamEntry) {
+	conn.WriteArray(len(entries))
+	for _, entry := range entries {
+		conn.WriteArray(2)
+		conn.WriteBulkString(entry.id.String())
+		if entry.fields == nil {
+			conn.WriteNull()
+			continue
+		}
+		conn.WriteArray(len(entry.fields))
+		for _, field := range entry.fields {
+			conn.WriteBulk(field)
+		}
+	}
+}
+
+func writeStreamResults(conn redcon.Conn, results []streamResult) {
+	if len(results) == 0 {
+		conn.WriteNull()
+		return
+	}
+	conn.WriteArray(len(results))
+	for _, result := range results {
+		conn.WriteArray(2)
+		conn.WriteBulkString(result.key)
+		writeStreamEntries(conn, result.entries)
+	}
+}
+
+func (m *Machine) doXadd(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold] id field value [field value ...]
+	if len(cmd.Args) < 5 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	var nomkstream bool
+	maxlen := -1
+	var minid streamID
+	i := 2
+opts:
+	for i < len(cmd.Args) {
+		switch strings.ToLower(string(cmd.Args[i])) {
+		default:
+			break opts
+		case "nomkstream":
+			nomkstream = true
+			i++
+		case "maxlen", "minid":
+			var err error
+			maxlen, minid, i, err = parseTrimArgs(cmd, i)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if i >= len(cmd.Args) || (len(cmd.Args)-i-1) == 0 || (len(cmd.Args)-i-1)%2 == 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	idarg := string(cmd.Args[i])
+	var auto bool
+	var id streamID
+	switch {
+	case idarg == "*":
+		auto = true
+	case strings.HasSuffix(idarg, "-*"):
+		var err error
+		id, err = parseStreamID(idarg[:len(idarg)-2], 0)
+		if err != nil {
+			return nil, err
+		}
+		auto = true
+	default:
+		var err error
+		id, err = parseStreamID(idarg, 0)
+		if err != nil {
+			return nil, err
+		}
+		if id == (streamID{}) {
+			return nil, errors.New("ERR The ID specified in XADD must be greater than 0-0")
+		}
+	}
+	val := string(buildCommand(cmd.Args[i+1:]).Raw)
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := txGetHeaderForUpdate(tx, key, "stream")
+		if err != nil {
+			return nil, err
+		}
+		if nomkstream && h.count == 0 {
+			if _, err := tx.Get(key); err == buntdb.ErrNotFound {
+				return nil, nil
+			}
+		}
+		last := streamLastID(h)
+		id := id
+		if auto {
+			if idarg == "*" {
+				clock, err := txNow(tx)
+				if err != nil {
+					return nil, err
+				}
+				id.ms = uint64(clock)
+			}
+			if id.ms < last.ms {
+				return nil, errStreamIDTooSmall
+			}
+			if id.ms == last.ms {
+				if last.seq == math.MaxUint64 {
+					return nil, errors.New("ERR The stream has exhausted the last possible ID, unable to add more items")
+				}
+				id.seq = last.seq + 1
+			}
+		} else if !last.less(id) {
+			return nil, errStreamIDTooSmall
+		}
+		if _, _, err := tx.Set(streamEntryPrefix(key)+id.encode(), val, nil); err != nil {
+			return nil, err
+		}
+		h.count++
+		h.head, h.tail = int64(id.ms), int64(id.seq)
+		if _, err := streamTrim(tx, key, &h, maxlen, minid); err != nil {
+			return nil, err
+		}
+		if err := txSetHeader(tx, key, h); err != nil {
+			return nil, err
+		}
+		m.notify(notifyStream, "xadd", key)
+		m.signalKey(key)
+		return id.String(), nil
+	}, func(v interface{}) error {
+		if v == nil {
+			conn.WriteNull()
+		} else {
+			conn.WriteBulkString(v.(string))
+		}
+		return nil
+	})
+}
+
+func (m *Machine) doXrange(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// XRANGE key start end [COUNT count]
+	// XREVRANGE key end start [COUNT count]
+	if len(cmd.Args) != 4 && len(cmd.Args) != 6 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	rev := strings.ToLower(string(cmd.Args[0])) == "xrevrange"
+	sarg, earg := string(cmd.Args[2]), string(cmd.Args[3])
+	if rev {
+		sarg, earg = earg, sarg
+	}
+	start, sok, err := parseStreamRange(sarg, true)
+	if err != nil {
+		return nil, err
+	}
+	end, eok, err := parseStreamRange(earg, false)
+	if err != nil {
+		return nil, err
+	}
+	count := -1
+	if len(cmd.Args) == 6 {
+		if strings.ToLower(string(cmd.Args[4])) != "count" {
+			return nil, errSyntaxError
+		}
+		n, err := strconv.ParseInt(string(cmd.Args[5]), 10, 64)
+		if err != nil {
+			return nil, errNotAnInt
+		}
+		if n < 0 {
+			n = 0
+		}
+		count = int(n)
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "stream")
+		if err != nil {
+			return err
+		}
+		var entries []streamEntry
+		if h.count > 0 && sok && eok {
+			entries, err = scanStream(tx, key, start, end, rev, count)
+			if err != nil {
+				return err
+			}
+		}
+		writeStreamEntries(conn, entries)
+		return nil
+	})
+}
+
+func (m *Machine) doXlen(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// XLEN key
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		h, err := txGetHeader(tx, key, "stream")
+		if err != nil {
+			return err
+		}
+		conn.WriteInt(h.count)
+		return nil
+	})
+}
+
+func (m *Machine) doXtrim(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// XTRIM key MAXLEN|MINID [=|~] threshold
+	if len(cmd.Args) < 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	switch strings.ToLower(string(cmd.Args[2])) {
+	default:
+		return nil, errSyntaxError
+	case "maxlen", "minid":
+	}
+	maxlen, minid, next, err := parseTrimArgs(cmd, 2)
+	if err != nil {
+		return nil, err
+	}
+	if next != len(cmd.Args) {
+		return nil, errSyntaxError
+	}
+	key := string(cmd.Args[1])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := txGetHeader(tx, key, "stream")
+		if err != nil {
+			return nil, err
+		}
+		if h.count == 0 {
+			return 0, nil
+		}
+		n, err := streamTrim(tx, key, &h, maxlen, minid)
+		if err != nil {
+			return nil, err
+		}
+		if err := txSetHeader(tx, key, h); err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			m.notify(notifyStream, "xtrim", key)
+		}
+		return n, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+func (m *Machine) doXdel(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// XDEL key id [id ...]
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	var ids []streamID
+	for i := 2; i < len(cmd.Args); i++ {
+		id, err := parseStreamID(string(cmd.Args[i]), 0)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	key := string(cmd.Args[1])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := txGetHeader(tx, key, "stream")
+		if err != nil {
+			return nil, err
+		}
+		if h.count == 0 {
+			return 0, nil
+		}
+		var n int
+		for _, id := range ids {
+			if _, err := tx.Delete(streamEntryPrefix(key) + id.encode()); err != nil {
+				if err == buntdb.ErrNotFound {
+					continue
+				}
+				return nil, err
+			}
+			n++
+		}
+		if n > 0 {
+			h.count -= n
+			if err := txSetHeader(tx, key, h); err != nil {
+				return nil, err
+			}
+			m.notify(notifyStream, "xdel", key)
+		}
+		return n, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+// txStreamGroup returns the last delivered id for a consumer group.
+func txStreamGroup(tx *buntdb.Tx, key, group string) (streamID, bool, error) {
+	val, err := tx.Get(streamGroupKey(key, group))
+	if err != nil {
+		if err == buntdb.ErrNotFound {
+			return streamID{}, false, nil
+		}
+		return streamID{}, false, err
+	}
+	return decodeStreamID(val), true, nil
+}
+
+// deletePending deletes the pending entries of a consumer group that match
+// the consumer. An empty consumer matches all consumers.
+func deletePending(tx *buntdb.Tx, key, group, consumer string) (int, error) {
+	prefix := streamPendingPrefix(key, group)
+	var mkeys []string
+	if err := tx.AscendGreaterOrEqual("", prefix, func(mkey, val string) bool {
+		if !strings.HasPrefix(mkey, prefix) {
+			return false
+		}
+		if consumer == "" || parsePendingEntry(val).consumer == consumer {
+			mkeys = append(mkeys, mkey)
+		}
+		return true
+	}); err != nil {
+		return 0, err
+	}
+	for _, mkey := range mkeys {
+		if _, err := tx.Delete(mkey); err != nil {
+			return 0, err
+		}
+	}
+	return len(mkeys), nil
+}
+
+func (m *Machine) doXgroup(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// XGROUP CREATE key group id|$ [MKSTREAM]
+	// XGROUP SETID key group id|$
+	// XGROUP DESTROY key group
+	// XGROUP DELCONSUMER key group consumer
+	if len(cmd.Args) < 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	sub := strings.ToLower(string(cmd.Args[1]))
+	key, group := string(cmd.Args[2]), string(cmd.Args[3])
+	var mkstream bool
+	var idarg string
+	var id streamID
+	switch sub {
+	default:
+		return nil, errSyntaxError
+	case "create", "setid":
+		if len(cmd.Args) < 5 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		if len(cmd.Args) == 6 {
+			if sub != "create" || strings.ToLower(string(cmd.Args[5])) != "mkstream" {
+				return nil, errSyntaxError
+			}
+			mkstream = true
+		} else if len(cmd.Args) != 5 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		idarg = string(cmd.Args[4])
+		if idarg != "$" {
+			var err error
+			id, err = parseStreamID(idarg, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case "destroy":
+		if len(cmd.Args) != 4 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+	case "delconsumer":
+		if len(cmd.Args) != 5 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		h, err := txGetHeaderForUpdate(tx, key, "stream")
+		if err != nil {
+			return nil, err
+		}
+		if h.count == 0 {
+			if _, err := tx.Get(key); err == buntdb.ErrNotFound {
+				if !mkstream {
+					return nil, errors.New("ERR The XGROUP subcommand requires the key to exist. " +
+						"Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+				}
+				if _, _, err := tx.Set(key, h.String(), nil); err != nil {
+					return nil, err
+				}
+			}
+		}
+		_, exists, err := txStreamGroup(tx, key, group)
+		if err != nil {
+			return nil, err
+		}
+		if idarg == "$" {
+			id = streamLastID(h)
+		}
+		switch sub {
+		case "create":
+			if exists {
+				return nil, errors.New("BUSYGROUP Consumer Group name already exists")
+			}
+			if _, _, err := tx.Set(streamGroupKey(key, group), id.encode(), nil); err != nil {
+				return nil, err
+			}
+			m.notify(notifyStream, "xgroup-create", key)
+			return "OK", nil
+		case "destroy":
+			if !exists {
+				return 0, nil
+			}
+			if _, err := tx.Delete(streamGroupKey(key, group)); err != nil {
+				return nil, err
+			}
+			if _, err := deletePending(tx, key, group, ""); err != nil {
+				return nil, err
+			}
+			m.notify(notifyStream, "xgroup-destroy", key)
+			return 1, nil
+		}
+		if !exists {
+			return nil, fmt.Errorf("NOGROUP No such consumer group '%s' for key name '%s'", group, key)
+		}
+		if sub == "setid" {
+			if _, _, err := tx.Set(streamGroupKey(key, group), id.encode(), nil); err != nil {
+				return nil, err
+			}
+			m.notify(notifyStream, "xgroup-setid", key)
+			return "OK", nil
+		}
+		m.notify(notifyStream, "xgroup-delconsumer", key)
+		return deletePending(tx, key, group, string(cmd.Args[4]))
+	}, func(v interface{}) error {
+		switch v := v.(type) {
+		case string:
+			conn.WriteString(v)
+		case int:
+			conn.WriteInt(v)
+		}
+		return nil
+	})
+}
+
+// streamReadArgs are the arguments for XREAD and XREADGROUP.
+type streamReadArgs struct {
+	group    string
+	consumer string
+	count    int
+	block    bool
+	timeout  time.Duration
+	noack    bool
+	keys     []string
+	ids      []string
+}
+
+func parseStreamReadArgs(cmd redcon.Command, group bool) (args streamReadArgs, err error) {
+	args.count = -1
+	i := 1
+	if group {
+		if len(cmd.Args) < 4 || strings.ToLower(string(cmd.Args[1])) != "group" {
+			return args, errSyntaxError
+		}
+		args.group, args.consumer = string(cmd.Args[2]), string(cmd.Args[3])
+		i = 4
+	}
+	for ; i < len(cmd.Args); i++ {
+		switch strings.ToLower(string(cmd.Args[i])) {
+		default:
+			return args, errSyntaxError
+		case "count", "block":
+			if i+1 >= len(cmd.Args) {
+				return args, errSyntaxError
+			}
+			n, err := strconv.ParseInt(string(cmd.Args[i+1]), 10, 64)
+			if err != nil || n < 0 {
+				return args, errNotAnInt
+			}
+			if strings.ToLower(string(cmd.Args[i])) == "count" {
+				args.count = int(n)
+			} else {
+				args.block = true
+				args.timeout = time.Duration(n) * time.Millisecond
+			}
+			i++
+		case "noack":
+			if !group {
+				return args, errSyntaxError
+			}
+			args.noack = true
+		case "streams":
+			rest := cmd.Args[i+1:]
+			if len(rest) == 0 || len(rest)%2 == 1 {
+				return args, fmt.Errorf("ERR Unbalanced '%s' list of streams: "+
+					"for each stream key an ID or '$' must be specified.",
+					strings.ToLower(string(cmd.Args[0])))
+			}
+			for j := 0; j < len(rest)/2; j++ {
+				args.keys = append(args.keys, string(rest[j]))
+				args.ids = append(args.ids, string(rest[len(rest)/2+j]))
+			}
+			return args, nil
+		}
+	}
+	return args, errSyntaxError
+}
+
+func (m *Machine) doXread(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+	args, err := parseStreamReadArgs(cmd, false)
+	if err != nil {
+		return nil, err
+	}
+	after := make([]streamID, len(args.keys))
+	last := make([]bool, len(args.keys)) // resolve '$' on the first read
+	for i, idarg := range args.ids {
+		if idarg == "$" {
+			last[i] = true
+			continue
+		}
+		after[i], err = parseStreamID(idarg, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	blocking := args.block && canBlock(conn, tx)
+	try := func() (bool, error) {
+		var results []streamResult
+		_, err := m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+			for i, key := range args.keys {
+				h, err := txGetHeader(tx, key, "stream")
+				if err != nil {
+					return err
+				}
+				if last[i] {
+					after[i] = streamLastID(h)
+					last[i] = false
+				}
+				if h.count == 0 {
+					continue
+				}
+				entries, err := streamRead(tx, key, after[i], args.count)
+				if err != nil {
+					return err
+				}
+				if len(entries) > 0 {
+					results = append(results, streamResult{key, entries})
+				}
+			}
+			if len(results) > 0 || !blocking {
+				writeStreamResults(conn, results)
+			}
+			return nil
+		})
+		return len(results) > 0, err
+	}
+	if !blocking {
+		_, err := try()
+		return nil, err
+	}
+	ok, err := m.blockOn(args.keys, args.timeout, try)
+	if err == nil && !ok {
+		conn.WriteNull()
+	}
+	return nil, err
+}
+
+func (m *Machine) doXreadgroup(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+	args, err := parseStreamReadArgs(cmd, true)
+	if err != nil {
+		return nil, err
+	}
+	after := make([]streamID, len(args.keys))
+	for i, idarg := range args.ids {
+		if idarg == ">" {
+			continue
+		}
+		after[i], err = parseStreamID(idarg, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	wrdo := func(tx *buntdb.Tx) (interface{}, error) {
+		clock, err := txNow(tx)
+		if err != nil {
+			return nil, err
+		}
+		var results []streamResult
+		for i, key := range args.keys {
+			h, err := txGetHeader(tx, key, "stream")
+			if err != nil {
+				return nil, err
+			}
+			lastid, exists, err := txStreamGroup(tx, key, args.group)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				return nil, fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", key, args.group)
+			}
+			pprefix := streamPendingPrefix(key, args.group)
+			var entries []streamEntry
+			if args.ids[i] == ">" {
+				// deliver new entries to the consumer
+				if h.count > 0 {
+					entries, err = streamRead(tx, key, lastid, args.count)
+					if err != nil {
+						return nil, err
+					}
+				}
+				if len(entries) == 0 {
+					continue
+				}
+				for _, entry := range entries {
+					if args.noack {
+						continue
+					}
+					p := pendingEntry{time: clock, count: 1, consumer: args.consumer}
+					if _, _, err := tx.Set(pprefix+entry.id.encode(), p.String(), nil); err != nil {
+						return nil, err
+					}
+				}
+				lastid = entries[len(entries)-1].id
+				if _, _, err := tx.Set(streamGroupKey(key, args.group), lastid.encode(), nil); err != nil {
+					return nil, err
+				}
+			} else {
+				// the history of pending entries for the consumer
+				var ids []streamID
+				if err := tx.AscendGreaterOrEqual("", pprefix+after[i].encode(), func(mkey, val string) bool {
+					if !strings.HasPrefix(mkey, pprefix) {
+						return false
+					}
+					if args.count >= 0 && len(ids) >= args.count {
+						return false
+					}
+					id := decodeStreamID(mkey[len(pprefix):])
+					if id != after[i] && parsePendingEntry(val).consumer == args.consumer {
+						ids = append(ids, id)
+					}
+					return true
+				}); err != nil {
+					return nil, err
+				}
+				for _, id := range ids {
+					entry, err := txStreamEntry(tx, key, id)
+					if err != nil {
+						return nil, err
+					}
+					entries = append(entries, entry)
+				}
+			}
+			results = append(results, streamResult{key, entries})
+		}
+		return results, nil
+	}
+	rddo := func(v interface{}) error {
+		writeStreamResults(conn, v.([]streamResult))
+		return nil
+	}
+	if !args.block || !canBlock(conn, tx) {
+		return m.writeDoApply(a, conn, cmd, tx, wrdo, rddo)
+	}
+	// Each attempt to read goes through the raft log, but only once a read
+	// finds an entry to deliver. A follower always sends the attempt on, so
+	// that the client is redirected to the leader.
+	leader := isLeader(a)
+	ok, err := m.blockOn(args.keys, args.timeout, func() (bool, error) {
+		if leader && !m.streamsUndelivered(args) {
+			return false, nil
+		}
+		var ok bool
+		_, err := m.writeDoApply(a, conn, cmd, tx, wrdo, func(v interface{}) error {
+			if len(v.([]streamResult)) == 0 {
+				return nil
+			}
+			ok = true
+			return rddo(v)
+		})
+		return ok, err
+	})
+	if err == nil && !ok {
+		conn.WriteNull()
+	}
+	return nil, err
+}
+
+// streamsUndelivered returns true when an XREADGROUP has something to
+// reply with: a stream read with '>' that has entries after the last one
+// delivered to the group, or a read of the pending entries, which replies
+// right away even when there are none. A missing group or a key of another
+// type is also true, so that the read returns the error.
+func (m *Machine) streamsUndelivered(args streamReadArgs) bool {
+	undelivered := false
+	m.db.View(func(tx *buntdb.Tx) error {
+		for i, key := range args.keys {
+			if args.ids[i] != ">" {
+				undelivered = true
+				return nil
+			}
+			h, err := txGetHeader(tx, key, "stream")
+			if err != nil {
+				undelivered = true
+				return nil
+			}
+			lastid, exists, err := txStreamGroup(tx, key, args.group)
+			if err != nil || !exists {
+				undelivered = true
+				return nil
+			}
+			if h.count == 0 {
+				continue
+			}
+			entries, err := streamRead(tx, key, lastid, 1)
+			if err != nil || len(entries) > 0 {
+				undelivered = true
+				return nil
+			}
+		}
+		return nil
+	})
+	return undelivered
+}
+
+func (m *Machine) doXack(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// XACK key group id [id ...]
+	if len(cmd.Args) < 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	var ids []streamID
+	for i := 3; i < len(cmd.Args); i++ {
+		id, err := parseStreamID(string(cmd.Args[i]), 0)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	key, group := string(cmd.Args[1]), string(cmd.Args[2])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		if _, err := txGetHeader(tx, key, "stream"); err != nil {
+			return nil, err
+		}
+		var n int
+		for _, id := range ids {
+			if _, err := tx.Delete(streamPendingPrefix(key, group) + id.encode()); err != nil {
+				if err == buntdb.ErrNotFound {
+					continue
+				}
+				return nil, err
+			}
+			n++
+		}
+		return n, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+func (m *Machine) doXpending(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key, group := string(cmd.Args[1]), string(cmd.Args[2])
+	var extended bool
+	var minidle int64
+	var start, end streamID
+	var count int
+	var consumer string
+	if len(cmd.Args) > 3 {
+		extended = true
+		i := 3
+		if strings.ToLower(string(cmd.Args[i])) == "idle" {
+			if i+1 >= len(cmd.Args) {
+				return nil, errSyntaxError
+			}
+			n, err := strconv.ParseInt(string(cmd.Args[i+1]), 10, 64)
+			if err != nil {
+				return nil, errNotAnInt
+			}
+			minidle = n
+			i += 2
+		}
+		if len(cmd.Args)-i != 3 && len(cmd.Args)-i != 4 {
+			return nil, errSyntaxError
+		}
+		var sok, eok bool
+		var err error
+		start, sok, err = parseStreamRange(string(cmd.Args[i]), true)
+		if err != nil {
+			return nil, err
+		}
+		end, eok, err = parseStreamRange(string(cmd.Args[i+1]), false)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseInt(string(cmd.Args[i+2]), 10, 64)
+		if err != nil {
+			return nil, errNotAnInt
+		}
+		count = int(n)
+		if !sok || !eok || count < 0 {
+			count = 0
+		}
+		if len(cmd.Args)-i == 4 {
+			consumer = string(cmd.Args[i+3])
+		}
+	}
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		if _, err := txGetHeader(tx, key, "stream"); err != nil {
+			return err
+		}
+		_, exists, err := txStreamGroup(tx, key, group)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s'", key, group)
+		}
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		prefix := streamPendingPrefix(key, group)
+		var ids []streamID
+		var pending []pendingEntry
+		var consumers []string
+		counts := make(map[string]int)
+		if err := tx.AscendGreaterOrEqual("", prefix+start.encode(), func(mkey, val string) bool {
+			if !strings.HasPrefix(mkey, prefix) {
+				return false
+			}
+			id := decodeStreamID(mkey[len(prefix):])
+			p := parsePendingEntry(val)
+			if !extended {
+				ids = append(ids, id)
+				if counts[p.consumer] == 0 {
+					consumers = append(consumers, p.consumer)
+				}
+				counts[p.consumer]++
+				return true
+			}
+			if len(ids) >= count || end.less(id) {
+				return false
+			}
+			if (consumer == "" || p.consumer == consumer) && now-p.time >= minidle {
+				ids = append(ids, id)
+				pending = append(pending, p)
+			}
+			return true
+		}); err != nil {
+			return err
+		}
+		if !extended {
+			conn.WriteArray(4)
+			conn.WriteInt(len(ids))
+			if len(ids) == 0 {
+				conn.WriteNull()
+				conn.WriteNull()
+				conn.WriteNull()
+				return nil
+			}
+			conn.WriteBulkString(ids[0].String())
+			conn.WriteBulkString(ids[len(ids)-1].String())
+			sort.Strings(consumers)
+			conn.WriteArray(len(consumers))
+			for _, consumer := range consumers {
+				conn.WriteArray(2)
+				conn.WriteBulkString(consumer)
+				conn.WriteBulkString(strconv.FormatInt(int64(counts[consumer]), 10))
+			}
+			return nil
+		}
+		conn.WriteArray(len(ids))
+		for i, id := range ids {
+			idle := now - pending[i].time
+			if idle < 0 {
+				idle = 0
+			}
+			conn.WriteArray(4)
+			conn.WriteBulkString(id.String())
+			conn.WriteBulkString(pending[i].consumer)
+			conn.WriteInt64(idle)
+			conn.WriteInt64(pending[i].count)
+		}
+		return nil
+	})
+}
+
+func (m *Machine) doXclaim(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// XCLAIM key group consumer min-idle-time id [id ...] [JUSTID]
+	if len(cmd.Args) < 6 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key, group, consumer := string(cmd.Args[1]), string(cmd.Args[2]), string(cmd.Args[3])
+	minidle, err := strconv.ParseInt(string(cmd.Args[4]), 10, 64)
+	if err != nil {
+		return nil, errors.New("ERR Invalid min-idle-time argument for XCLAIM")
+	}
+	var justid bool
+	var ids []streamID
+	for i := 5; i < len(cmd.Args); i++ {
+		if strings.ToLower(string(cmd.Args[i])) == "justid" {
+			justid = true
+			continue
+		}
+		id, err := parseStreamID(string(cmd.Args[i]), 0)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		clock, err := txNow(tx)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := txGetHeader(tx, key, "stream"); err != nil {
+			return nil, err
+		}
+		_, exists, err := txStreamGroup(tx, key, group)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s'", key, group)
+		}
+		prefix := streamPendingPrefix(key, group)
+		var entries []streamEntry
+		for _, id := range ids {
+			val, err := tx.Get(prefix + id.encode())
+			if err != nil {
+				if err == buntdb.ErrNotFound {
+					continue
+				}
+				return nil, err
+			}
+			p := parsePendingEntry(val)
+			if clock-p.time < minidle {
+				continue
+			}
+			entry, err := txStreamEntry(tx, key, id)
+			if err != nil {
+				return nil, err
+			}
+			if entry.fields == nil {
+				// the entry no longer exists
+				if _, err := tx.Delete(prefix + id.encode()); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			p.time, p.consumer = clock, consumer
+			if !justid {
+				p.count++
+			}
+			if _, _, err := tx.Set(prefix+id.encode(), p.String(), nil); err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+		return entries, nil
+	}, func(v interface{}) error {
+		entries := v.([]streamEntry)
+		if !justid {
+			writeStreamEntries(conn, entries)
+			return nil
+		}
+		conn.WriteArray(len(entries))
+		for _, entry := range entries {
+			conn.WriteBulkString(entry.id.String())
+		}
+		return nil
+	})
+}
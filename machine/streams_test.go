@@ -0,0 +1,250 @@
+package machine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func subTestStreams(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "XADD", streams_XADD_test)
+	runStep(t, mc, "XRANGE", streams_XRANGE_test)
+	runStep(t, mc, "XTRIM", streams_XTRIM_test)
+	runStep(t, mc, "XDEL", streams_XDEL_test)
+	runStep(t, mc, "XREAD", streams_XREAD_test)
+	runStep(t, mc, "XGROUP", streams_XGROUP_test)
+	runStep(t, mc, "XREADGROUP", streams_XREADGROUP_test)
+	runStep(t, mc, "blocked", streams_BLOCKED_test)
+	runStep(t, mc, "XCLAIM", streams_XCLAIM_test)
+	runStep(t, mc, "keys", streams_KEYS_test)
+}
+
+func streams_XADD_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"XADD", "mystream", "1-1", "name", "Sara"}, {"1-1"},
+		{"XADD", "mystream", "1-2", "name", "Tom", "age", 40}, {"1-2"},
+		{"XADD", "mystream", "1-*", "name", "Ann"}, {"1-3"},
+		{"XADD", "mystream", "1-1", "name", "Bob"}, {"ERR The ID specified in XADD is equal or smaller than the target stream top item"},
+		{"XADD", "mystream", "0-0", "name", "Bob"}, {"ERR The ID specified in XADD must be greater than 0-0"},
+		{"XADD", "mystream", "abc", "name", "Bob"}, {"ERR Invalid stream ID specified as stream command argument"},
+		{"XADD", "mystream", "*", "name"}, {"ERR wrong number of arguments for 'XADD' command"},
+		{"XADD", "mystream", "*", "name", "Bob"}, {func(v interface{}) (resp, expect interface{}) {
+			return strings.HasSuffix(v.(string), "-0") && v.(string) != "1-0", true
+		}},
+		{"XLEN", "mystream"}, {4},
+		{"XLEN", "nostream"}, {0},
+		{"XADD", "nostream", "NOMKSTREAM", "*", "name", "Bob"}, {nil},
+		{"EXISTS", "nostream"}, {0},
+		{"TYPE", "mystream"}, {"stream"},
+	})
+}
+func streams_XRANGE_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"XADD", "mystream", "1-1", "a", "1"}, {"1-1"},
+		{"XADD", "mystream", "1-2", "b", "2"}, {"1-2"},
+		{"XADD", "mystream", "2-1", "c", "3"}, {"2-1"},
+		{"XRANGE", "mystream", "-", "+"}, {"[[1-1 [a 1]] [1-2 [b 2]] [2-1 [c 3]]]"},
+		{"XRANGE", "mystream", "1", "1"}, {"[[1-1 [a 1]] [1-2 [b 2]]]"},
+		{"XRANGE", "mystream", "(1-1", "+"}, {"[[1-2 [b 2]] [2-1 [c 3]]]"},
+		{"XRANGE", "mystream", "-", "+", "COUNT", 1}, {"[[1-1 [a 1]]]"},
+		{"XREVRANGE", "mystream", "+", "-", "COUNT", 2}, {"[[2-1 [c 3]] [1-2 [b 2]]]"},
+		{"XRANGE", "mystream", "3", "+"}, {"[]"},
+		{"XRANGE", "nostream", "-", "+"}, {"[]"},
+	})
+}
+func streams_XTRIM_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"XADD", "mystream", "1-1", "a", "1"}, {"1-1"},
+		{"XADD", "mystream", "1-2", "b", "2"}, {"1-2"},
+		{"XADD", "mystream", "1-3", "c", "3"}, {"1-3"},
+		{"XADD", "mystream", "MAXLEN", 2, "1-4", "d", "4"}, {"1-4"},
+		{"XRANGE", "mystream", "-", "+"}, {"[[1-3 [c 3]] [1-4 [d 4]]]"},
+		{"XTRIM", "mystream", "MAXLEN", "~", 1}, {1},
+		{"XTRIM", "mystream", "MINID", "2"}, {1},
+		{"XLEN", "mystream"}, {0},
+		{"EXISTS", "mystream"}, {1},
+		{"XADD", "mystream", "1-4", "e", "5"}, {"ERR The ID specified in XADD is equal or smaller than the target stream top item"},
+	})
+}
+func streams_XDEL_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"XADD", "mystream", "1-1", "a", "1"}, {"1-1"},
+		{"XADD", "mystream", "1-2", "b", "2"}, {"1-2"},
+		{"XDEL", "mystream", "1-1", "1-5"}, {1},
+		{"XRANGE", "mystream", "-", "+"}, {"[[1-2 [b 2]]]"},
+		{"XLEN", "mystream"}, {1},
+	})
+}
+func streams_XREAD_test(mc *mockCluster) error {
+	err := mc.DoBatch([][]interface{}{
+		{"XADD", "stream1", "1-1", "a", "1"}, {"1-1"},
+		{"XADD", "stream1", "1-2", "b", "2"}, {"1-2"},
+		{"XADD", "stream2", "1-1", "c", "3"}, {"1-1"},
+		{"XREAD", "STREAMS", "stream1", "stream2", "0", "0"}, {"[[stream1 [[1-1 [a 1]] [1-2 [b 2]]]] [stream2 [[1-1 [c 3]]]]]"},
+		{"XREAD", "COUNT", 1, "STREAMS", "stream1", "1-1"}, {"[[stream1 [[1-2 [b 2]]]]]"},
+		{"XREAD", "STREAMS", "stream1", "$"}, {nil},
+		{"XREAD", "BLOCK", 100, "STREAMS", "stream1", "$"}, {nil},
+		{"XREAD", "STREAMS", "stream1"}, {"ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified."},
+	})
+	if err != nil {
+		return err
+	}
+	// add from a different connection while the current one is blocked.
+	port := mc.cs.port
+	errc := make(chan error, 1)
+	go func() {
+		time.Sleep(time.Second / 4)
+		conn, err := redis.Dial("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		_, err = conn.Do("XADD", "stream1", "2-1", "d", "4")
+		errc <- err
+	}()
+	if err := mc.DoExpect("[[stream1 [[2-1 [d 4]]]]]", "XREAD", "BLOCK", 5000, "STREAMS", "stream1", "$"); err != nil {
+		return err
+	}
+	return <-errc
+}
+func streams_XGROUP_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"XGROUP", "CREATE", "mystream", "mygroup", "$"}, {"ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."},
+		{"XGROUP", "CREATE", "mystream", "mygroup", "$", "MKSTREAM"}, {"OK"},
+		{"XLEN", "mystream"}, {0},
+		{"TYPE", "mystream"}, {"stream"},
+		{"XGROUP", "CREATE", "mystream", "mygroup", "0"}, {"BUSYGROUP Consumer Group name already exists"},
+		{"XGROUP", "SETID", "mystream", "mygroup", "0"}, {"OK"},
+		{"XGROUP", "SETID", "mystream", "nogroup", "0"}, {"NOGROUP No such consumer group 'nogroup' for key name 'mystream'"},
+		{"XGROUP", "DESTROY", "mystream", "mygroup"}, {1},
+		{"XGROUP", "DESTROY", "mystream", "mygroup"}, {0},
+	})
+}
+func streams_XREADGROUP_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"XADD", "mystream", "1-1", "a", "1"}, {"1-1"},
+		{"XADD", "mystream", "1-2", "b", "2"}, {"1-2"},
+		{"XGROUP", "CREATE", "mystream", "mygroup", "0"}, {"OK"},
+		{"XREADGROUP", "GROUP", "mygroup", "alice", "COUNT", 1, "STREAMS", "mystream", ">"}, {"[[mystream [[1-1 [a 1]]]]]"},
+		{"XREADGROUP", "GROUP", "mygroup", "bob", "STREAMS", "mystream", ">"}, {"[[mystream [[1-2 [b 2]]]]]"},
+		{"XREADGROUP", "GROUP", "mygroup", "bob", "STREAMS", "mystream", ">"}, {nil},
+		{"XREADGROUP", "GROUP", "mygroup", "bob", "BLOCK", 100, "STREAMS", "mystream", ">"}, {nil},
+		{"XREADGROUP", "GROUP", "mygroup", "alice", "STREAMS", "mystream", "0"}, {"[[mystream [[1-1 [a 1]]]]]"},
+		{"XPENDING", "mystream", "mygroup"}, {"[2 1-1 1-2 [[alice 1] [bob 1]]]"},
+		{"XPENDING", "mystream", "mygroup", "-", "+", 10, "bob"}, {func(v interface{}) (resp, expect interface{}) {
+			return strings.HasPrefix(v.([]string)[0], "[1-2 bob "), true
+		}},
+		{"XACK", "mystream", "mygroup", "1-1", "1-5"}, {1},
+		{"XREADGROUP", "GROUP", "mygroup", "alice", "STREAMS", "mystream", "0"}, {"[[mystream []]]"},
+		{"XPENDING", "mystream", "mygroup"}, {"[1 1-2 1-2 [[bob 1]]]"},
+		{"XADD", "mystream", "1-3", "c", "3"}, {"1-3"},
+		{"XREADGROUP", "GROUP", "mygroup", "carol", "NOACK", "STREAMS", "mystream", ">"}, {"[[mystream [[1-3 [c 3]]]]]"},
+		{"XPENDING", "mystream", "mygroup"}, {"[1 1-2 1-2 [[bob 1]]]"},
+		{"XDEL", "mystream", "1-2"}, {1},
+		{"XREADGROUP", "GROUP", "mygroup", "bob", "STREAMS", "mystream", "0"}, {"[[mystream [[1-2 <nil>]]]]"},
+		{"XREADGROUP", "GROUP", "nogroup", "bob", "STREAMS", "mystream", ">"}, {"NOGROUP No such key 'mystream' or consumer group 'nogroup' in XREADGROUP with GROUP option"},
+	})
+}
+func streams_BLOCKED_test(mc *mockCluster) error {
+	// the group has already been given the entries up to 5-0.
+	if err := mc.DoBatch([][]interface{}{
+		{"XGROUP", "CREATE", "mystream", "mygroup", "5-0", "MKSTREAM"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	lastIndex := func() (int, error) {
+		stats, err := redis.StringMap(mc.cs.Do("RAFTSTATS"))
+		if err != nil {
+			return 0, err
+		}
+		return strconv.Atoi(stats["last_log_index"])
+	}
+	port := mc.cs.port
+	type reply struct {
+		v   interface{}
+		err error
+	}
+	replyc := make(chan reply, 1)
+	go func() {
+		conn, err := redis.Dial("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			replyc <- reply{nil, err}
+			return
+		}
+		defer conn.Close()
+		v, err := conn.Do("XREADGROUP", "GROUP", "mygroup", "alice", "BLOCK", 5000, "STREAMS", "mystream", ">")
+		replyc <- reply{v, err}
+	}()
+	time.Sleep(time.Second / 4)
+	before, err := lastIndex()
+	if err != nil {
+		return err
+	}
+	// an entry on another stream, or one that the group already has, isn't
+	// read through the log.
+	if err := mc.DoBatch([][]interface{}{
+		{"XADD", "otherstream", "1-1", "a", "1"}, {"1-1"},
+		{"XADD", "mystream", "2-1", "b", "2"}, {"2-1"},
+		{time.Second / 4}, {}, // sleep
+		{"XADD", "mystream", "6-1", "c", "3"}, {"6-1"},
+	}); err != nil {
+		return err
+	}
+	r := <-replyc
+	if err := checkExpect("[[mystream [[6-1 [c 3]]]]]", r.v, r.err); err != nil {
+		return err
+	}
+	after, err := lastIndex()
+	if err != nil {
+		return err
+	}
+	// three XADDs and the read that delivered the entry.
+	if after-before != 4 {
+		return fmt.Errorf("expected '4' log entries, got '%v'", after-before)
+	}
+	return nil
+}
+func streams_XCLAIM_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"XADD", "mystream", "1-1", "a", "1"}, {"1-1"},
+		{"XADD", "mystream", "1-2", "b", "2"}, {"1-2"},
+		{"XGROUP", "CREATE", "mystream", "mygroup", "0"}, {"OK"},
+		{"XREADGROUP", "GROUP", "mygroup", "alice", "STREAMS", "mystream", ">"}, {"[[mystream [[1-1 [a 1]] [1-2 [b 2]]]]]"},
+		{"XCLAIM", "mystream", "mygroup", "bob", 60000, "1-1"}, {"[]"},
+		{time.Second / 4}, {}, // sleep
+		{"XCLAIM", "mystream", "mygroup", "bob", 100, "1-1"}, {"[[1-1 [a 1]]]"},
+		{"XCLAIM", "mystream", "mygroup", "bob", 0, "1-2", "JUSTID"}, {"[1-2]"},
+		{"XPENDING", "mystream", "mygroup", "-", "+", 10}, {func(v interface{}) (resp, expect interface{}) {
+			vv := v.([]string)
+			return len(vv) == 2 &&
+				strings.HasPrefix(vv[0], "[1-1 bob ") && strings.HasSuffix(vv[0], " 2]") &&
+				strings.HasPrefix(vv[1], "[1-2 bob ") && strings.HasSuffix(vv[1], " 1]"), true
+		}},
+	})
+}
+func streams_KEYS_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"XADD", "mystream", "1-1", "a", "1"}, {"1-1"},
+		{"XGROUP", "CREATE", "mystream", "mygroup", "0"}, {"OK"},
+		{"XREADGROUP", "GROUP", "mygroup", "alice", "STREAMS", "mystream", ">"}, {"[[mystream [[1-1 [a 1]]]]]"},
+		{"KEYS", "*"}, {"[mystream]"},
+		{"RENAME", "mystream", "newstream"}, {"OK"},
+		{"XRANGE", "newstream", "-", "+"}, {"[[1-1 [a 1]]]"},
+		{"XPENDING", "newstream", "mygroup"}, {"[1 1-1 1-1 [[alice 1]]]"},
+		{"DEL", "newstream"}, {1},
+		{"XGROUP", "CREATE", "newstream", "mygroup", "0", "MKSTREAM"}, {"OK"},
+		{"XPENDING", "newstream", "mygroup"}, {"[0 nil nil nil]"},
+		{"MULTI"}, {"OK"},
+		{"XADD", "mystream", "*", "a", "1"}, {"QUEUED"},
+		{"XLEN", "mystream"}, {"QUEUED"},
+		{"EXEC"}, {func(v interface{}) (resp, expect interface{}) {
+			return v.([]string)[1], "1"
+		}},
+		{"EVAL", `sdb.call("xadd", KEYS[0], "*", "b", "2"); return sdb.call("xlen", KEYS[0])`, 1, "mystream"}, {2},
+	})
+}
@@ -5,7 +5,6 @@ import (
 	"math"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/tidwall/buntdb"
 	"github.com/tidwall/finn"
@@ -23,7 +22,7 @@ func (m *Machine) doGet(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx
 		return nil, finn.ErrWrongNumberOfArguments
 	}
 	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
-		val, err := tx.Get(string(cmd.Args[1]))
+		val, err := txGetString(tx, string(cmd.Args[1]))
 		if err != nil {
 			if err == buntdb.ErrNotFound {
 				conn.WriteNull()
@@ -42,7 +41,7 @@ func (m *Machine) doStrlen(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 		return nil, finn.ErrWrongNumberOfArguments
 	}
 	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
-		val, err := tx.Get(string(cmd.Args[1]))
+		val, err := txGetString(tx, string(cmd.Args[1]))
 		if err != nil && err != buntdb.ErrNotFound {
 			return err
 		}
@@ -62,8 +61,12 @@ func (m *Machine) doSet(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx
 	if len(cmd.Args) == 3 && commandName == "set" {
 		// fasttrack
 		return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
-			_, _, err := tx.Set(string(cmd.Args[1]), string(cmd.Args[2]), nil)
-			return nil, err
+			err := txSetString(tx, string(cmd.Args[1]), string(cmd.Args[2]), nil)
+			if err != nil {
+				return nil, err
+			}
+			m.notify(notifyString, "set", string(cmd.Args[1]))
+			return nil, nil
 		}, func(v interface{}) error {
 			conn.WriteString("OK")
 			return nil
@@ -154,12 +157,21 @@ func (m *Machine) doSet(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx
 		}
 		var opts *buntdb.SetOptions
 		if px {
-			opts = &buntdb.SetOptions{}
-			opts.Expires = true
-			opts.TTL = time.Millisecond * time.Duration(pxi)
+			now, err := txNow(tx)
+			if err != nil {
+				return nil, err
+			}
+			opts = expireOptions(now + int64(pxi))
 		}
-		_, _, err := tx.Set(key, val, opts)
-		return "OK", err
+		err := txSetString(tx, key, val, opts)
+		if err != nil {
+			return nil, err
+		}
+		m.notify(notifyString, "set", key)
+		if px {
+			m.notify(notifyGeneric, "expire", key)
+		}
+		return "OK", nil
 	}, func(v interface{}) error {
 		if v == nil {
 			conn.WriteNull()
@@ -177,10 +189,11 @@ func (m *Machine) doMset(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 	pipeline := qcmdlower(cmd.Args[0]) == "plset"
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
 		for i := 1; i < len(cmd.Args); i += 2 {
-			_, _, err := tx.Set(string(cmd.Args[i]), string(cmd.Args[i+1]), nil)
+			err := txSetString(tx, string(cmd.Args[i]), string(cmd.Args[i+1]), nil)
 			if err != nil {
 				return nil, err
 			}
+			m.notify(notifyString, "set", string(cmd.Args[i]))
 		}
 		return nil, nil
 	}, func(v interface{}) error {
@@ -210,10 +223,11 @@ func (m *Machine) doMsetnx(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 			if err != buntdb.ErrNotFound {
 				return nil, err
 			}
-			_, _, err = tx.Set(key, string(cmd.Args[i+1]), nil)
+			err = txSetString(tx, key, string(cmd.Args[i+1]), nil)
 			if err != nil {
 				return nil, err
 			}
+			m.notify(notifyString, "set", key)
 		}
 		return 1, nil
 	}, func(v interface{}) error {
@@ -231,9 +245,9 @@ func (m *Machine) doMget(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
 		vals := make([]*string, 0, len(cmd.Args)-1)
 		for i := 1; i < len(cmd.Args); i++ {
-			val, err := tx.Get(string(cmd.Args[i]))
+			val, err := txGetString(tx, string(cmd.Args[i]))
 			if err != nil {
-				if err == buntdb.ErrNotFound {
+				if err == buntdb.ErrNotFound || err == errWrongType {
 					vals = append(vals, nil)
 					continue
 				}
@@ -261,15 +275,16 @@ func (m *Machine) doAppend(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 	}
 	key := string(cmd.Args[1])
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
-		val, err := tx.Get(key)
+		val, err := txGetString(tx, key)
 		if err != nil && err != buntdb.ErrNotFound {
 			return nil, err
 		}
 		val += string(cmd.Args[2])
-		_, _, err = tx.Set(key, val, nil)
+		err = txSetString(tx, key, val, nil)
 		if err != nil {
 			return nil, err
 		}
+		m.notify(notifyString, "append", key)
 		return len(val), nil
 	}, func(v interface{}) error {
 		conn.WriteInt(v.(int))
@@ -308,7 +323,7 @@ func (m *Machine) doIncr(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 	}
 	key := string(cmd.Args[1])
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
-		val, err := tx.Get(key)
+		val, err := txGetString(tx, key)
 		if err != nil && err != buntdb.ErrNotFound {
 			return nil, err
 		}
@@ -321,10 +336,11 @@ func (m *Machine) doIncr(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		}
 		n += amt
 		val = strconv.FormatInt(n, 10)
-		_, _, err = tx.Set(key, val, nil)
+		err = txSetString(tx, key, val, nil)
 		if err != nil {
 			return nil, err
 		}
+		m.notify(notifyString, "incrby", key)
 		return n, nil
 	}, func(v interface{}) error {
 		conn.WriteInt64(v.(int64))
@@ -342,7 +358,7 @@ func (m *Machine) doIncrbyfloat(a finn.Applier, conn redcon.Conn, cmd redcon.Com
 	}
 	key := string(cmd.Args[1])
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
-		val, err := tx.Get(key)
+		val, err := txGetString(tx, key)
 		if err != nil && err != buntdb.ErrNotFound {
 			return nil, err
 		}
@@ -358,10 +374,11 @@ func (m *Machine) doIncrbyfloat(a finn.Applier, conn redcon.Conn, cmd redcon.Com
 			return nil, errors.New("ERR increment would produce NaN or Infinity")
 		}
 		val = strconv.FormatFloat(n, 'f', -1, 64)
-		_, _, err = tx.Set(key, val, nil)
+		err = txSetString(tx, key, val, nil)
 		if err != nil {
 			return nil, err
 		}
+		m.notify(notifyString, "incrbyfloat", key)
 		return val, nil
 	}, func(v interface{}) error {
 		conn.WriteBulkString(v.(string))
@@ -376,7 +393,7 @@ func (m *Machine) doGetset(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 	key := string(cmd.Args[1])
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
 		exists := true
-		val, err := tx.Get(key)
+		val, err := txGetString(tx, key)
 		if err != nil {
 			if err == buntdb.ErrNotFound {
 				exists = false
@@ -384,10 +401,11 @@ func (m *Machine) doGetset(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 				return nil, err
 			}
 		}
-		_, _, err = tx.Set(key, string(cmd.Args[2]), nil)
+		err = txSetString(tx, key, string(cmd.Args[2]), nil)
 		if err != nil {
 			return nil, err
 		}
+		m.notify(notifyString, "set", key)
 		if exists {
 			return val, nil
 		}
@@ -452,7 +470,7 @@ func (m *Machine) doGetrange(a finn.Applier, conn redcon.Conn, cmd redcon.Comman
 		return nil, err
 	}
 	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
-		val, err := tx.Get(string(cmd.Args[1]))
+		val, err := txGetString(tx, string(cmd.Args[1]))
 		if err != nil && err != buntdb.ErrNotFound {
 			return err
 		}
@@ -475,7 +493,7 @@ func (m *Machine) doSetrange(a finn.Applier, conn redcon.Conn, cmd redcon.Comman
 	offset := int(n)
 	key := string(cmd.Args[1])
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
-		val, err := tx.Get(key)
+		val, err := txGetString(tx, key)
 		if err != nil && err != buntdb.ErrNotFound {
 			return nil, err
 		}
@@ -488,10 +506,11 @@ func (m *Machine) doSetrange(a finn.Applier, conn redcon.Conn, cmd redcon.Comman
 		copy(bval[offset:], cmd.Args[3])
 
 		val = string(bval)
-		_, _, err = tx.Set(key, val, nil)
+		err = txSetString(tx, key, val, nil)
 		if err != nil {
 			return nil, err
 		}
+		m.notify(notifyString, "setrange", key)
 		return len(val), nil
 	}, func(v interface{}) error {
 		conn.WriteInt(v.(int))
@@ -514,7 +533,7 @@ func (m *Machine) doBitcount(a finn.Applier, conn redcon.Conn, cmd redcon.Comman
 		rng = true
 	}
 	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
-		val, err := tx.Get(string(cmd.Args[1]))
+		val, err := txGetString(tx, string(cmd.Args[1]))
 		if err != nil && err != buntdb.ErrNotFound {
 			return err
 		}
@@ -564,7 +583,7 @@ func (m *Machine) doBitop(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 	}
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
 		if op == opNot {
-			val, err := tx.Get(string(cmd.Args[3]))
+			val, err := txGetString(tx, string(cmd.Args[3]))
 			if err != nil && err != buntdb.ErrNotFound {
 				return nil, err
 			}
@@ -572,17 +591,18 @@ func (m *Machine) doBitop(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 			for i := 0; i < len(val); i++ {
 				nval[i] = ^val[i]
 			}
-			_, _, err = tx.Set(string(cmd.Args[2]), string(nval), nil)
+			err = txSetString(tx, string(cmd.Args[2]), string(nval), nil)
 			if err != nil {
 				return nil, err
 			}
+			m.notify(notifyString, "set", string(cmd.Args[2]))
 			return len(nval), nil
 		}
 
 		var maxlen int
 		vals := make([]string, 0, len(cmd.Args)-3)
 		for i := 3; i < len(cmd.Args); i++ {
-			val, err := tx.Get(string(cmd.Args[i]))
+			val, err := txGetString(tx, string(cmd.Args[i]))
 			if err != nil && err != buntdb.ErrNotFound {
 				return nil, err
 			}
@@ -611,10 +631,11 @@ func (m *Machine) doBitop(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 				}
 			}
 		}
-		_, _, err := tx.Set(string(cmd.Args[2]), string(nval), nil)
+		err := txSetString(tx, string(cmd.Args[2]), string(nval), nil)
 		if err != nil {
 			return nil, err
 		}
+		m.notify(notifyString, "set", string(cmd.Args[2]))
 		return len(nval), nil
 	}, func(v interface{}) error {
 		conn.WriteInt(v.(int))
@@ -631,7 +652,7 @@ func (m *Machine) doGetbit(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 		return nil, errors.New("ERR bit offset is not an integer or out of range")
 	}
 	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
-		val, err := tx.Get(string(cmd.Args[1]))
+		val, err := txGetString(tx, string(cmd.Args[1]))
 		if err != nil && err != buntdb.ErrNotFound {
 			return err
 		}
@@ -659,7 +680,7 @@ func (m *Machine) doSetbit(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 		return nil, errors.New("ERR bit is not an integer or out of range")
 	}
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
-		val, err := tx.Get(string(cmd.Args[1]))
+		val, err := txGetString(tx, string(cmd.Args[1]))
 		if err != nil && err != buntdb.ErrNotFound {
 			return nil, err
 		}
@@ -673,10 +694,11 @@ func (m *Machine) doSetbit(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 		if int(obit) != int(bit) {
 			bval[i] ^= 1 << pos
 		}
-		_, _, err = tx.Set(string(cmd.Args[1]), string(bval), nil)
+		err = txSetString(tx, string(cmd.Args[1]), string(bval), nil)
 		if err != nil {
 			return nil, err
 		}
+		m.notify(notifyString, "setbit", string(cmd.Args[1]))
 		return obit, nil
 	}, func(v interface{}) error {
 		conn.WriteInt(v.(int))
@@ -707,7 +729,7 @@ func (m *Machine) doBitpos(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 		}
 	}
 	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
-		val, err := tx.Get(string(cmd.Args[1]))
+		val, err := txGetString(tx, string(cmd.Args[1]))
 		if err != nil && err != buntdb.ErrNotFound {
 			return err
 		}
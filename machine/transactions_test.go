@@ -7,13 +7,17 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 func subTestTransactions(t *testing.T, mc *mockCluster) {
 	runStep(t, mc, "SET", transactions_SET_test)
 	runStep(t, mc, "GET", transactions_GET_test)
 	runStep(t, mc, "MULTI", transactions_MULTI_test)
+	runStep(t, mc, "WATCH", transactions_WATCH_test)
 	runStep(t, mc, "FENCE", transactions_FENCE_test)
+	runStep(t, mc, "PIPELINE", transactions_PIPELINE_test)
 }
 
 func transactions_MULTI_test(mc *mockCluster) error {
@@ -56,6 +60,83 @@ func transactions_MULTI_test(mc *mockCluster) error {
 	})
 }
 
+func transactions_WATCH_test(mc *mockCluster) error {
+	// another client writes through the leader.
+	other, err := redis.Dial("tcp", fmt.Sprintf(":%d", mc.cs.port))
+	if err != nil {
+		return err
+	}
+	defer other.Close()
+	steps := []struct {
+		other []interface{}
+		batch [][]interface{}
+	}{
+		{nil, [][]interface{}{
+			{"SET", "mykey", "1"}, {"OK"},
+			{"WATCH", "mykey"}, {"OK"},
+		}},
+		{[]interface{}{"SET", "mykey", "2"}, [][]interface{}{
+			{"MULTI"}, {"OK"},
+			{"SET", "mykey", "3"}, {"QUEUED"},
+			{"EXEC"}, {nil},
+			{"GET", "mykey"}, {"2"},
+
+			// the watch is gone after an EXEC.
+			{"MULTI"}, {"OK"},
+			{"SET", "mykey", "3"}, {"QUEUED"},
+			{"EXEC"}, {"[OK]"},
+
+			{"WATCH", "mykey", "otherkey"}, {"OK"},
+			{"MULTI"}, {"OK"},
+			{"WATCH", "mykey"}, {"ERR WATCH inside MULTI is not allowed"},
+			{"INCR", "mykey"}, {"QUEUED"},
+			{"EXEC"}, {"[4]"},
+
+			{"WATCH", "mykey"}, {"OK"},
+			{"UNWATCH"}, {"OK"},
+		}},
+		{[]interface{}{"SET", "mykey", "5"}, [][]interface{}{
+			{"MULTI"}, {"OK"},
+			{"INCR", "mykey"}, {"QUEUED"},
+			{"EXEC"}, {"[6]"},
+
+			// watching a key that doesn't exist.
+			{"WATCH", "newkey"}, {"OK"},
+		}},
+		{[]interface{}{"SET", "newkey", "1"}, [][]interface{}{
+			{"MULTI"}, {"OK"},
+			{"GET", "newkey"}, {"QUEUED"},
+			{"EXEC"}, {nil},
+
+			{"WATCH", "newkey"}, {"OK"},
+		}},
+		{[]interface{}{"DEL", "newkey"}, [][]interface{}{
+			{"MULTI"}, {"OK"},
+			{"SET", "newkey", "2"}, {"QUEUED"},
+			{"EXEC"}, {nil},
+
+			{"WATCH", "mykey"}, {"OK"},
+		}},
+		{[]interface{}{"FLUSHDB"}, [][]interface{}{
+			{"MULTI"}, {"OK"},
+			{"SET", "mykey", "1"}, {"QUEUED"},
+			{"EXEC"}, {nil},
+			{"DBSIZE"}, {0},
+		}},
+	}
+	for _, step := range steps {
+		if step.other != nil {
+			if _, err := other.Do(step.other[0].(string), step.other[1:]...); err != nil {
+				return err
+			}
+		}
+		if err := mc.DoBatch(step.batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func transactions_SET_test(mc *mockCluster) error {
 	s := mc.ss[rand.Int()%len(mc.ss)]
 	for {
@@ -213,3 +294,34 @@ func transactions_FENCE_test(mc *mockCluster) error {
 	})
 	return err
 }
+
+func transactions_PIPELINE_test(mc *mockCluster) error {
+	// find the leader, which batches the pipeline into a single command.
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "mykey", "1"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	// each command has its own reply, and an error doesn't stop the
+	// commands that follow.
+	resps, err := mc.cs.DoPipeline([][]interface{}{
+		{"INCR", "mykey"},
+		{"HSET", "mykey", "a", "1"},
+		{"LPUSH", "mylist", "a", "b"},
+		{"GET", "mykey"},
+		{"LRANGE", "mylist", 0, -1},
+		{"DEL", "mylist"},
+	})
+	if err != nil {
+		return err
+	}
+	resp := fmt.Sprintf("%v", normalize(resps))
+	expect := "[2 WRONGTYPE Operation against a key holding the wrong kind of value 2 2 [b a] 1]"
+	if resp != expect {
+		return fmt.Errorf("expected '%v', got '%v'", expect, resp)
+	}
+	return mc.DoBatch([][]interface{}{
+		{"GET", "mykey"}, {"2"},
+		{"EXISTS", "mylist"}, {0},
+	})
+}
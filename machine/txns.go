@@ -0,0 +1,1039 @@
+package machine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// A MULTI/EXEC or EVAL whose keys are served by more than one group is
+// committed in two phases. The server that receives the transaction is the
+// coordinator:
+//
+//  1. The meta group records the transaction and its groups as pending.
+//  2. Each group prepares its part of the transaction. The commands and an
+//     intent for each of their keys are written, and the watched keys are
+//     checked. Other commands for a key that has an intent are rejected
+//     with TRYAGAIN until the transaction is resolved.
+//  3. The meta group decides whether the transaction commits or aborts.
+//     The transaction is committed once the decision is applied.
+//  4. Each group runs the prepared commands, or drops them, and releases
+//     the intents.
+//  5. The meta group deletes the record of the transaction.
+//
+// Every step is applied through the log of a group. When the coordinator
+// fails, the leader of the meta group resolves the transactions that were
+// recorded longer than the transaction timeout ago. A pending transaction is
+// aborted, and a decided one is completed. A group remembers the
+// transactions that it aborted, so that a late prepare is rejected.
+//
+// A script runs on the coordinator. Its keys are locked and copied from
+// their groups by the prepare, and the keys that the script writes are
+// prepared again as RESTORE and DEL commands.
+
+const (
+	// txnKeyPrefix is the prefix for the transactions that are recorded
+	// by the meta group. The value has the state, the time that the
+	// transaction began, and the groups.
+	txnKeyPrefix = sdbMetaPrefix + "txn:"
+	// txnPrepKeyPrefix is the prefix for the transactions that a group has
+	// prepared. The value has the locked keys and the commands.
+	txnPrepKeyPrefix = sdbMetaPrefix + "txprep:"
+	// txnAbortKeyPrefix is the prefix for the transactions that a group has
+	// aborted. The value is the time of the abort.
+	txnAbortKeyPrefix = sdbMetaPrefix + "txabort:"
+	// intentKeyPrefix is the prefix for the keys that are locked by a
+	// prepared transaction. The value is the transaction id.
+	intentKeyPrefix = sdbMetaPrefix + "intent:"
+)
+
+// DefaultTxnTimeout is how long a transaction that spans groups may take
+// before it's resolved by the leader of the meta group.
+const DefaultTxnTimeout = time.Second * 10
+
+// txnAbortRetain is how long an aborted transaction is remembered, in
+// milliseconds.
+const txnAbortRetain = int64(time.Hour / time.Millisecond)
+
+const (
+	txnPending = "pending"
+	txnCommit  = "commit"
+	txnAbort   = "abort"
+)
+
+var (
+	errKeyLocked   = errors.New("TRYAGAIN key is locked by a transaction")
+	errTxnAborted  = errors.New("TRYAGAIN transaction was aborted")
+	errTxnExists   = errors.New("ERR transaction already exists")
+	errUndeclared  = errors.New("ERR script wrote a key that was not declared")
+	errInvalidTxn  = errors.New("ERR invalid transaction")
+	errInvalidDump = errors.New("ERR invalid dump")
+)
+
+// txnRecord is a transaction that is recorded by the meta group.
+type txnRecord struct {
+	id     string
+	state  string
+	begin  int64 // milliseconds
+	groups []int
+}
+
+func (rec txnRecord) value() string {
+	args := [][]byte{[]byte(rec.state), []byte(strconv.FormatInt(rec.begin, 10))}
+	for _, group := range rec.groups {
+		args = append(args, []byte(strconv.Itoa(group)))
+	}
+	return string(buildCommand(args).Raw)
+}
+
+func parseTxnRecord(id, val string) (txnRecord, error) {
+	cmd, err := parseCommand([]byte(val))
+	if err != nil {
+		return txnRecord{}, err
+	}
+	if len(cmd.Args) < 2 {
+		return txnRecord{}, errInvalidTxn
+	}
+	rec := txnRecord{id: id, state: string(cmd.Args[0])}
+	rec.begin, err = strconv.ParseInt(string(cmd.Args[1]), 10, 64)
+	if err != nil {
+		return txnRecord{}, errInvalidTxn
+	}
+	for _, arg := range cmd.Args[2:] {
+		group, err := strconv.Atoi(string(arg))
+		if err != nil {
+			return txnRecord{}, errInvalidTxn
+		}
+		rec.groups = append(rec.groups, group)
+	}
+	return rec, nil
+}
+
+// txnPrep is the part of a transaction that a group has prepared.
+type txnPrep struct {
+	watch map[string]uint64
+	keys  []string // the locked keys
+	cmds  []redcon.Command
+}
+
+func (p txnPrep) value() string {
+	lock := [][]byte{[]byte("lock")}
+	for _, key := range p.keys {
+		lock = append(lock, []byte(key))
+	}
+	args := [][]byte{buildCommand(lock).Raw}
+	for _, cmd := range p.cmds {
+		args = append(args, cmd.Raw)
+	}
+	return string(buildCommand(args).Raw)
+}
+
+// parseTxnPrep reads the commands of a prepare. A "watch key version ..."
+// command has the watched keys, and a "lock key ..." command has keys to
+// lock without running a command.
+func parseTxnPrep(raws [][]byte) (txnPrep, error) {
+	var p txnPrep
+	seen := make(map[string]bool)
+	lock := func(key []byte) {
+		if !seen[string(key)] {
+			seen[string(key)] = true
+			p.keys = append(p.keys, string(key))
+		}
+	}
+	for _, raw := range raws {
+		cmd, err := parseCommand(raw)
+		if err != nil {
+			return txnPrep{}, err
+		}
+		if len(cmd.Args) == 0 {
+			return txnPrep{}, errInvalidTxn
+		}
+		switch qcmdlower(cmd.Args[0]) {
+		default:
+			if route, keys := commandRoute(cmd.Args); route == routeKeys {
+				for _, key := range keys {
+					lock(key)
+				}
+			}
+			p.cmds = append(p.cmds, cmd)
+		case "watch":
+			if p.watch, err = parseWatch(cmd); err != nil {
+				return txnPrep{}, err
+			}
+			for i := 1; i < len(cmd.Args); i += 2 {
+				lock(cmd.Args[i])
+			}
+		case "lock":
+			for _, key := range cmd.Args[1:] {
+				lock(key)
+			}
+		}
+	}
+	return p, nil
+}
+
+// txnReadPrep returns the prepared part of a transaction, if any.
+func txnReadPrep(tx *buntdb.Tx, id string) (*txnPrep, error) {
+	val, err := tx.Get(txnPrepKeyPrefix + id)
+	if err != nil {
+		if err == buntdb.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	cmd, err := parseCommand([]byte(val))
+	if err != nil {
+		return nil, err
+	}
+	p, err := parseTxnPrep(cmd.Args)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// loadIntents reads the keys that are locked by prepared transactions.
+func (m *Machine) loadIntents(tx *buntdb.Tx) error {
+	intents := make(map[string]string)
+	if err := tx.AscendGreaterOrEqual("", intentKeyPrefix, func(key, val string) bool {
+		if !strings.HasPrefix(key, intentKeyPrefix) {
+			return false
+		}
+		intents[key[len(intentKeyPrefix):]] = val
+		return true
+	}); err != nil {
+		return err
+	}
+	m.rmu.Lock()
+	m.intents = intents
+	m.rmu.Unlock()
+	return nil
+}
+
+// lockedBy returns the transaction that has locked the key.
+func (m *Machine) lockedBy(key string) (string, bool) {
+	m.rmu.RLock()
+	defer m.rmu.RUnlock()
+	id, ok := m.intents[key]
+	return id, ok
+}
+
+// rangeLocked returns true when a key in the range is locked.
+func (m *Machine) rangeLocked(r keyRange) bool {
+	m.rmu.RLock()
+	defer m.rmu.RUnlock()
+	for key := range m.intents {
+		if r.contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// intentChange is a key that is locked by a transaction, or unlocked when
+// the id is empty.
+type intentChange struct {
+	key, id string
+}
+
+// setIntents locks the keys for the transaction. The locks are seen by
+// lockedBy once the buntdb transaction commits.
+func (m *Machine) setIntents(tx *buntdb.Tx, id string, keys []string) error {
+	for _, key := range keys {
+		if _, _, err := tx.Set(intentKeyPrefix+key, id, nil); err != nil {
+			return err
+		}
+	}
+	m.rmu.Lock()
+	for _, key := range keys {
+		m.pintents = append(m.pintents, intentChange{key, id})
+	}
+	m.rmu.Unlock()
+	return nil
+}
+
+// clearIntents unlocks the keys that are locked by the transaction, once the
+// buntdb transaction commits.
+func (m *Machine) clearIntents(tx *buntdb.Tx, id string, keys []string) error {
+	var cleared []string
+	for _, key := range keys {
+		holder, err := tx.Get(intentKeyPrefix + key)
+		if err != nil {
+			if err == buntdb.ErrNotFound {
+				continue
+			}
+			return err
+		}
+		if holder != id {
+			continue
+		}
+		if _, err := tx.Delete(intentKeyPrefix + key); err != nil {
+			return err
+		}
+		cleared = append(cleared, key)
+	}
+	m.rmu.Lock()
+	for _, key := range cleared {
+		m.pintents = append(m.pintents, intentChange{key, ""})
+	}
+	m.rmu.Unlock()
+	return nil
+}
+
+// flushIntents applies the pending changes to the locked keys when commit is
+// true, otherwise the changes are discarded.
+func (m *Machine) flushIntents(commit bool) {
+	m.rmu.Lock()
+	defer m.rmu.Unlock()
+	if commit {
+		for _, c := range m.pintents {
+			if c.id == "" {
+				delete(m.intents, c.key)
+				continue
+			}
+			if m.intents == nil {
+				m.intents = make(map[string]string)
+			}
+			m.intents[c.key] = c.id
+		}
+	}
+	m.pintents = nil
+}
+
+// metaGroup returns an error unless the machine is the meta group of a
+// sharded keyspace.
+func (m *Machine) metaGroup() error {
+	if m.sh == nil {
+		return errNotSharded
+	}
+	if m.group != 0 {
+		return errNotMeta
+	}
+	return nil
+}
+
+func (m *Machine) doTxnBegin(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SDBTXBEGIN id group [group ...]
+	if err := m.metaGroup(); err != nil {
+		return nil, err
+	}
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	rec := txnRecord{id: string(cmd.Args[1]), state: txnPending}
+	for _, arg := range cmd.Args[2:] {
+		group, err := strconv.Atoi(string(arg))
+		if err != nil || group < 0 || group >= len(m.sh.groups) {
+			return nil, errors.New("ERR invalid group")
+		}
+		rec.groups = append(rec.groups, group)
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		if _, err := tx.Get(txnKeyPrefix + rec.id); err != buntdb.ErrNotFound {
+			if err == nil {
+				err = errTxnExists
+			}
+			return nil, err
+		}
+		var err error
+		if rec.begin, err = txNow(tx); err != nil {
+			return nil, err
+		}
+		_, _, err = tx.Set(txnKeyPrefix+rec.id, rec.value(), nil)
+		return nil, err
+	}, func(v interface{}) error {
+		conn.WriteString("OK")
+		return nil
+	})
+}
+
+func (m *Machine) doTxnDecide(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SDBTXDECIDE id COMMIT|ABORT
+	if err := m.metaGroup(); err != nil {
+		return nil, err
+	}
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	id := string(cmd.Args[1])
+	state := qcmdlower(cmd.Args[2])
+	if state != txnCommit && state != txnAbort {
+		return nil, errSyntaxError
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		val, err := tx.Get(txnKeyPrefix + id)
+		if err != nil {
+			if err == buntdb.ErrNotFound {
+				// the transaction was aborted and resolved already.
+				return txnAbort, nil
+			}
+			return nil, err
+		}
+		rec, err := parseTxnRecord(id, val)
+		if err != nil {
+			return nil, err
+		}
+		// only the first decision counts.
+		if rec.state == txnPending {
+			rec.state = state
+			if _, _, err := tx.Set(txnKeyPrefix+id, rec.value(), nil); err != nil {
+				return nil, err
+			}
+		}
+		return rec.state, nil
+	}, func(v interface{}) error {
+		conn.WriteBulkString(v.(string))
+		return nil
+	})
+}
+
+func (m *Machine) doTxnEnd(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SDBTXEND id
+	if err := m.metaGroup(); err != nil {
+		return nil, err
+	}
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	id := string(cmd.Args[1])
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		if _, err := tx.Delete(txnKeyPrefix + id); err != nil && err != buntdb.ErrNotFound {
+			return nil, err
+		}
+		return nil, nil
+	}, func(v interface{}) error {
+		conn.WriteString("OK")
+		return nil
+	})
+}
+
+func (m *Machine) doTxnPrepare(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SDBTXPREPARE id command [command ...]
+	if m.sh == nil {
+		return nil, errNotSharded
+	}
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	id := string(cmd.Args[1])
+	prep, err := parseTxnPrep(cmd.Args[2:])
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range prep.keys {
+		if isMercMetaKey(key) {
+			return nil, errKeyNotAllowed
+		}
+	}
+	// the keys of a "lock" command are copied to the coordinator.
+	var dumps []string
+	for _, raw := range cmd.Args[2:] {
+		if c, err := parseCommand(raw); err == nil && qcmdlower(c.Args[0]) == "lock" {
+			for _, key := range c.Args[1:] {
+				dumps = append(dumps, string(key))
+			}
+		}
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		if _, err := tx.Get(txnAbortKeyPrefix + id); err != buntdb.ErrNotFound {
+			if err == nil {
+				err = errTxnAborted
+			}
+			return nil, err
+		}
+		owned, leaving := m.ranges()
+		for _, key := range prep.keys {
+			if !rangesContain(owned, key) || rangesContain(leaving, key) {
+				return nil, errRangeMoving
+			}
+			if holder, ok := m.lockedBy(key); ok && holder != id {
+				return nil, errKeyLocked
+			}
+		}
+		for key, version := range prep.watch {
+			current, err := txKeyVersion(tx, key)
+			if err != nil {
+				return nil, err
+			}
+			if current != version {
+				// a watched key has changed. nothing is prepared.
+				return nil, nil
+			}
+		}
+		// a transaction may be prepared again with new commands, such as
+		// the writes of a script. the keys stay locked.
+		cur, err := txnReadPrep(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		if cur != nil {
+			keys := append([]string(nil), cur.keys...)
+			for _, key := range prep.keys {
+				if _, ok := m.lockedBy(key); !ok {
+					keys = append(keys, key)
+				}
+			}
+			prep.keys = keys
+		}
+		if _, _, err := tx.Set(txnPrepKeyPrefix+id, prep.value(), nil); err != nil {
+			return nil, err
+		}
+		if err := m.setIntents(tx, id, prep.keys); err != nil {
+			return nil, err
+		}
+		// each key is sent with its time to live in milliseconds and its
+		// serialized value, which is nil when there's no key.
+		vals := make([]interface{}, 0, len(dumps)*3)
+		for _, key := range dumps {
+			val, err := dumpValue(tx, key)
+			if err != nil {
+				if err != buntdb.ErrNotFound {
+					return nil, err
+				}
+				vals = append(vals, []byte(key), int64(0), nil)
+				continue
+			}
+			ttl, err := tx.TTL(key)
+			if err != nil {
+				return nil, err
+			}
+			var pttl int64
+			if ttl >= 0 {
+				pttl = int64(ttl/time.Millisecond) + 1
+			}
+			vals = append(vals, []byte(key), pttl, []byte(val))
+		}
+		return vals, nil
+	}, func(v interface{}) error {
+		vals, ok := v.([]interface{})
+		if !ok {
+			conn.WriteNull()
+			return nil
+		}
+		conn.WriteArray(len(vals))
+		writePassiveResps(conn, vals)
+		return nil
+	})
+}
+
+// txnReplies are the replies to the commands of a transaction.
+type txnReplies struct {
+	count int
+	resps []interface{}
+}
+
+func (m *Machine) doTxnResolve(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SDBTXCOMMIT id
+	// SDBTXABORT id
+	if m.sh == nil {
+		return nil, errNotSharded
+	}
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	id := string(cmd.Args[1])
+	commit := qcmdlower(cmd.Args[0]) == "sdbtxcommit"
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		prep, err := txnReadPrep(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		if prep != nil {
+			if _, err := tx.Delete(txnPrepKeyPrefix + id); err != nil {
+				return nil, err
+			}
+			if err := m.clearIntents(tx, id, prep.keys); err != nil {
+				return nil, err
+			}
+		}
+		if commit {
+			if prep == nil {
+				// the transaction has been committed already.
+				return nil, nil
+			}
+			return &txnReplies{len(prep.cmds), m.runCommands(tx, prep.cmds)}, nil
+		}
+		now, err := txNow(tx)
+		if err != nil {
+			return nil, err
+		}
+		// forget the transactions that were aborted long ago.
+		var old []string
+		if err := tx.AscendGreaterOrEqual("", txnAbortKeyPrefix, func(key, val string) bool {
+			if !strings.HasPrefix(key, txnAbortKeyPrefix) {
+				return false
+			}
+			if at, err := strconv.ParseInt(val, 10, 64); err != nil || now-at > txnAbortRetain {
+				old = append(old, key)
+			}
+			return true
+		}); err != nil {
+			return nil, err
+		}
+		for _, key := range old {
+			if _, err := tx.Delete(key); err != nil {
+				return nil, err
+			}
+		}
+		_, _, err = tx.Set(txnAbortKeyPrefix+id, strconv.FormatInt(now, 10), nil)
+		return nil, err
+	}, func(v interface{}) error {
+		if !commit {
+			conn.WriteString("OK")
+			return nil
+		}
+		r, ok := v.(*txnReplies)
+		if !ok {
+			conn.WriteNull()
+			return nil
+		}
+		conn.WriteArray(r.count)
+		writePassiveResps(conn, r.resps)
+		return nil
+	})
+}
+
+// txn is a transaction that is coordinated by this server.
+type txn struct {
+	sh     *Shards
+	id     string
+	groups []int
+}
+
+// beginTxn records a new transaction for the groups with the meta group.
+func (sh *Shards) beginTxn(groups []int) (*txn, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	t := &txn{sh: sh, id: hex.EncodeToString(b), groups: groups}
+	args := []interface{}{t.id}
+	for _, group := range groups {
+		args = append(args, group)
+	}
+	if _, err := sh.do(0, "sdbtxbegin", args...); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// prepare prepares the part of the transaction for a group. A nil reply
+// means that a watched key has changed.
+func (t *txn) prepare(group int, raws [][]byte) (interface{}, error) {
+	args := []interface{}{t.id}
+	for _, raw := range raws {
+		args = append(args, raw)
+	}
+	return t.sh.do(group, "sdbtxprepare", args...)
+}
+
+// abort aborts the transaction and returns the error. A transaction that
+// can't be aborted now is aborted by the meta group leader later.
+func (t *txn) abort(err error) error {
+	if _, derr := t.sh.do(0, "sdbtxdecide", t.id, txnAbort); derr == nil {
+		t.sh.resolveTxn(t.id, false, t.groups)
+	}
+	return err
+}
+
+// commit commits the transaction, and returns the reply of each group.
+func (t *txn) commit() ([]interface{}, error) {
+	state, err := redis.String(t.sh.do(0, "sdbtxdecide", t.id, txnCommit))
+	if err != nil {
+		return nil, err
+	}
+	if state != txnCommit {
+		return nil, t.abort(errTxnAborted)
+	}
+	replies, err := t.sh.resolveTxn(t.id, true, t.groups)
+	if err != nil {
+		// the transaction will be completed, so it must not be retried.
+		return nil, errors.New("ERR transaction committed without replies: " + err.Error())
+	}
+	return replies, nil
+}
+
+// resolveTxn commits or aborts a transaction on each of its groups, and
+// then deletes its record.
+func (sh *Shards) resolveTxn(id string, commit bool, groups []int) ([]interface{}, error) {
+	name := "sdbtxabort"
+	if commit {
+		name = "sdbtxcommit"
+	}
+	replies := make([]interface{}, len(groups))
+	for i, group := range groups {
+		reply, err := sh.do(group, name, id)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	if _, err := sh.do(0, "sdbtxend", id); err != nil {
+		return nil, err
+	}
+	return replies, nil
+}
+
+// resolveTxns resolves the transactions that were recorded longer than the
+// timeout ago. Their coordinators are assumed to have failed.
+func (sh *Shards) resolveTxns() error {
+	meta := sh.groups[0]
+	var recs []txnRecord
+	if err := meta.db.View(func(tx *buntdb.Tx) error {
+		var perr error
+		err := tx.AscendGreaterOrEqual("", txnKeyPrefix, func(key, val string) bool {
+			if !strings.HasPrefix(key, txnKeyPrefix) {
+				return false
+			}
+			rec, err := parseTxnRecord(key[len(txnKeyPrefix):], val)
+			if err != nil {
+				perr = err
+				return false
+			}
+			recs = append(recs, rec)
+			return true
+		})
+		if err == nil {
+			err = perr
+		}
+		return err
+	}); err != nil {
+		return err
+	}
+	sh.mu.RLock()
+	timeout := int64(sh.txnTimeout / time.Millisecond)
+	sh.mu.RUnlock()
+	now := localClock()
+	for _, rec := range recs {
+		if now-rec.begin < timeout {
+			continue
+		}
+		state := rec.state
+		if state == txnPending {
+			var err error
+			state, err = redis.String(sh.do(0, "sdbtxdecide", rec.id, txnAbort))
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := sh.resolveTxn(rec.id, state == txnCommit, rec.groups); err != nil {
+			return err
+		}
+		meta.log.Noticef("transactions: resolved %s with %s", rec.id, state)
+	}
+	return nil
+}
+
+// commandGroup returns the group that runs a command of a transaction.
+func (m *Machine) commandGroup(cmd redcon.Command) (int, error) {
+	route, keys := commandRoute(cmd.Args)
+	switch route {
+	case routeMeta:
+		return 0, nil
+	case routeKeys:
+		group, err := m.keysGroup(keys)
+		if err != nil || group != -1 {
+			return group, err
+		}
+	}
+	return m.group, nil
+}
+
+// execGroups runs the commands of an EXEC on the groups that serve them.
+// It returns false when every command and watched key is served by this
+// group.
+func (m *Machine) execGroups(conn redcon.Conn, writable bool, watch map[string]uint64, cmds []redcon.Command) (bool, error) {
+	parts := make(map[int][][]byte)
+	watches := make(map[int][][]byte)
+	for key, version := range watch {
+		group, err := m.keyGroup(key)
+		if err != nil {
+			return true, err
+		}
+		if watches[group] == nil {
+			watches[group] = [][]byte{[]byte("watch")}
+		}
+		watches[group] = append(watches[group], []byte(key), []byte(strconv.FormatUint(version, 10)))
+	}
+	cgroups := make([]int, len(cmds))
+	for i, cmd := range cmds {
+		group, err := m.commandGroup(cmd)
+		if err != nil {
+			return true, err
+		}
+		cgroups[i] = group
+		parts[group] = append(parts[group], cmd.Raw)
+	}
+	for group, wargs := range watches {
+		parts[group] = append([][]byte{buildCommand(wargs).Raw}, parts[group]...)
+	}
+	var groups []int
+	for group := range parts {
+		groups = append(groups, group)
+	}
+	sort.Ints(groups)
+	if len(groups) == 1 {
+		if groups[0] == m.group {
+			return false, nil
+		}
+		// a single group runs the transaction on its own.
+		args := []interface{}{"plrmulti"}
+		if writable {
+			args[0] = "plwmulti"
+		}
+		for _, raw := range parts[groups[0]] {
+			args = append(args, raw)
+		}
+		reply, err := m.sh.do(groups[0], "sdbgroup", args...)
+		if err != nil {
+			if _, ok := err.(redis.Error); !ok {
+				return true, err
+			}
+			reply = err
+		}
+		writeForwarded(conn, reply)
+		return true, nil
+	}
+	t, err := m.sh.beginTxn(groups)
+	if err != nil {
+		return true, err
+	}
+	for _, group := range groups {
+		reply, err := t.prepare(group, parts[group])
+		if err != nil {
+			return true, t.abort(err)
+		}
+		if reply == nil {
+			// a watched key has changed.
+			t.abort(nil)
+			conn.WriteNull()
+			return true, nil
+		}
+	}
+	replies, err := t.commit()
+	if err != nil {
+		return true, err
+	}
+	// the replies of each group are in the order of its commands.
+	resps := make(map[int][]interface{})
+	for i, group := range groups {
+		resps[group], _ = replies[i].([]interface{})
+	}
+	conn.WriteArray(len(cmds))
+	for _, group := range cgroups {
+		if len(resps[group]) == 0 {
+			conn.WriteError("ERR invalid response")
+			continue
+		}
+		writeForwarded(conn, resps[group][0])
+		resps[group] = resps[group][1:]
+	}
+	return true, nil
+}
+
+// evalGroups runs a script with keys that are served by more than one
+// group.
+func (m *Machine) evalGroups(conn redcon.Conn, cmd redcon.Command) error {
+	_, keys := commandRoute(cmd.Args)
+	locks := make(map[int][][]byte)
+	declared := make(map[string]int)
+	for _, key := range keys {
+		group, err := m.keyGroup(string(key))
+		if err != nil {
+			return err
+		}
+		if locks[group] == nil {
+			locks[group] = [][]byte{[]byte("lock")}
+		}
+		locks[group] = append(locks[group], key)
+		declared[string(key)] = group
+	}
+	var groups []int
+	for group := range locks {
+		groups = append(groups, group)
+	}
+	sort.Ints(groups)
+	cmd, err := m.inlineScript(cmd)
+	if err != nil {
+		return err
+	}
+	scratch, err := newScratchMachine(m.log)
+	if err != nil {
+		return err
+	}
+	defer scratch.Close()
+	t, err := m.sh.beginTxn(groups)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		reply, err := t.prepare(group, [][]byte{buildCommand(locks[group]).Raw})
+		if err != nil {
+			return t.abort(err)
+		}
+		vals, err := redis.Values(reply, nil)
+		if err != nil {
+			return t.abort(err)
+		}
+		if err := scratch.loadDumps(vals); err != nil {
+			return t.abort(err)
+		}
+	}
+	var resps []interface{}
+	writes := make(map[int][][]byte)
+	if err := scratch.db.Update(func(tx *buntdb.Tx) error {
+		scratch.cl.begin(tx)
+		pconn := &passiveConn{}
+		if _, err := scratch.doEval(&passiveApplier{log: m.log}, pconn, cmd, tx); err != nil {
+			return err
+		}
+		resps = pconn.resps
+		// the keys that the script wrote are written back to their groups.
+		written := make(map[string]bool)
+		scratch.cl.mu.Lock()
+		for _, c := range scratch.cl.pending {
+			if c.key == "" {
+				for key := range declared {
+					written[key] = true
+				}
+			} else {
+				written[c.key] = true
+			}
+		}
+		scratch.cl.mu.Unlock()
+		var wkeys []string
+		for key := range written {
+			if _, ok := declared[key]; !ok {
+				return errUndeclared
+			}
+			wkeys = append(wkeys, key)
+		}
+		sort.Strings(wkeys)
+		for _, key := range wkeys {
+			group := declared[key]
+			val, err := dumpValue(tx, key)
+			if err != nil {
+				if err != buntdb.ErrNotFound {
+					return err
+				}
+				writes[group] = append(writes[group], buildCommand([][]byte{
+					[]byte("del"), []byte(key)}).Raw)
+				continue
+			}
+			ttl, err := tx.TTL(key)
+			if err != nil {
+				return err
+			}
+			var pttl int64
+			if ttl >= 0 {
+				pttl = int64(ttl/time.Millisecond) + 1
+			}
+			writes[group] = append(writes[group], buildCommand([][]byte{
+				[]byte("restore"), []byte(key), []byte(strconv.FormatInt(pttl, 10)),
+				[]byte(val), []byte("replace")}).Raw)
+		}
+		return nil
+	}); err != nil {
+		return t.abort(err)
+	}
+	for _, group := range groups {
+		if len(writes[group]) == 0 {
+			continue
+		}
+		if _, err := t.prepare(group, writes[group]); err != nil {
+			return t.abort(err)
+		}
+	}
+	if _, err := t.commit(); err != nil {
+		return err
+	}
+	writePassiveResps(conn, resps)
+	return nil
+}
+
+// inlineScript replaces the sha of an EVALSHA with the script. SCRIPT LOAD
+// is run on every group, so the script is read from this group.
+func (m *Machine) inlineScript(cmd redcon.Command) (redcon.Command, error) {
+	var name string
+	switch qcmdlower(cmd.Args[0]) {
+	default:
+		return cmd, nil
+	case "evalsha":
+		name = "eval"
+	case "evalsharo":
+		name = "evalro"
+	}
+	var javascript string
+	if err := m.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		javascript, err = tx.Get(scriptKeyPrefix + string(cmd.Args[1]))
+		return err
+	}); err != nil {
+		if err == buntdb.ErrNotFound {
+			return cmd, errNoScript
+		}
+		return cmd, err
+	}
+	args := [][]byte{[]byte(name), []byte(javascript)}
+	return buildCommand(append(args, cmd.Args[2:]...)), nil
+}
+
+// newScratchMachine returns a machine with an in-memory database that isn't
+// part of a raft group. A script that spans groups runs on it.
+func newScratchMachine(log finn.Logger) (*Machine, error) {
+	m := &Machine{log: log}
+	m.blocked = make(map[string]map[chan struct{}]bool)
+	m.ps = newPubsub()
+	m.cl = newChangeLog()
+	var err error
+	if m.db, err = buntdb.Open(":memory:"); err != nil {
+		return nil, err
+	}
+	if err := m.db.Update(dbSetZsetIndex); err != nil {
+		m.Close()
+		return nil, err
+	}
+	if m.sm, err = newScriptMachine(m); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// loadDumps restores the keys that were copied from a group. The values
+// are key, time to live in milliseconds, and serialized-value triples.
+func (m *Machine) loadDumps(vals []interface{}) error {
+	if len(vals)%3 != 0 {
+		return errInvalidDump
+	}
+	return m.db.Update(func(tx *buntdb.Tx) error {
+		for i := 0; i < len(vals); i += 3 {
+			if vals[i+2] == nil {
+				continue
+			}
+			key, err1 := redis.String(vals[i], nil)
+			pttl, err2 := redis.Int64(vals[i+1], nil)
+			val, err3 := redis.String(vals[i+2], nil)
+			if err1 != nil || err2 != nil || err3 != nil {
+				return errInvalidDump
+			}
+			var opts *buntdb.SetOptions
+			if pttl > 0 {
+				opts = expireOptions(localClock() + pttl)
+			}
+			if err := restoreValue(tx, key, val, opts); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
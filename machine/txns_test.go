@@ -0,0 +1,242 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/tidwall/buntdb"
+)
+
+func subTestTxns(t *testing.T, mc *mockCluster) {
+	ms, err := mockOpenShards(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+	if err := ms.DoBatch([][]interface{}{
+		{"RANGESPLIT", "m", 1}, {"OK"},
+		{"RANGESPLIT", "w", 2}, {"OK"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	runStep(t, mc, "exec", func(mc *mockCluster) error { return txns_EXEC_test(ms) })
+	runStep(t, mc, "watch", func(mc *mockCluster) error { return txns_WATCH_test(ms) })
+	runStep(t, mc, "eval", func(mc *mockCluster) error { return txns_EVAL_test(ms) })
+	runStep(t, mc, "locked", func(mc *mockCluster) error { return txns_LOCKED_test(ms) })
+	runStep(t, mc, "recover", func(mc *mockCluster) error { return txns_RECOVER_test(ms) })
+	runStep(t, mc, "rollback", func(mc *mockCluster) error { return txns_ROLLBACK_test(ms) })
+}
+
+func txns_EXEC_test(ms *mockShards) error {
+	return ms.DoBatch([][]interface{}{
+		{"FLUSHDB"}, {"OK"},
+		{"SET", "a", "1"}, {"OK"},
+		{"SET", "x", "10"}, {"OK"},
+		{"MULTI"}, {"OK"},
+		{"SET", "a", "2"}, {"QUEUED"},
+		{"INCR", "n"}, {"QUEUED"},
+		{"INCRBY", "x", 5}, {"QUEUED"},
+		{"LPUSH", "n", "v"}, {"QUEUED"},
+		{"GET", "a"}, {"QUEUED"},
+		{"EXEC"}, {"[OK 1 15 WRONGTYPE Operation against a key holding the wrong kind of value 2]"},
+		{"GET", "a"}, {"2"},
+		{"GET", "n"}, {"1"},
+		{"GET", "x"}, {"15"},
+
+		{"MULTI"}, {"OK"},
+		{"MSET", "a", "1", "n", "2"}, {"CROSSGROUP Keys in request belong to different groups"},
+		{"SET", "a", "3"}, {"QUEUED"},
+		{"EXEC"}, {"EXECABORT Transaction discarded because of previous errors."},
+		{"GET", "a"}, {"2"},
+	})
+}
+
+func txns_WATCH_test(ms *mockShards) error {
+	if err := ms.DoBatch([][]interface{}{
+		{"FLUSHDB"}, {"OK"},
+		{"SET", "a", "1"}, {"OK"},
+		{"SET", "n", "1"}, {"OK"},
+		{"WATCH", "a", "n"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	// another client changes a watched key in the second group.
+	if resp, err := redis.String(ms.ss[1].Do("SET", "n", "2")); err != nil || resp != "OK" {
+		return fmt.Errorf("expected 'OK', got '%v', '%v'", resp, err)
+	}
+	return ms.DoBatch([][]interface{}{
+		{"MULTI"}, {"OK"},
+		{"SET", "a", "2"}, {"QUEUED"},
+		{"SET", "n", "3"}, {"QUEUED"},
+		{"EXEC"}, {nil},
+		{"GET", "a"}, {"1"},
+		{"GET", "n"}, {"2"},
+
+		{"WATCH", "a", "n"}, {"OK"},
+		{"MULTI"}, {"OK"},
+		{"SET", "a", "3"}, {"QUEUED"},
+		{"SET", "n", "4"}, {"QUEUED"},
+		{"EXEC"}, {"[OK OK]"},
+		{"GET", "a"}, {"3"},
+		{"GET", "n"}, {"4"},
+	})
+}
+
+func txns_EVAL_test(ms *mockShards) error {
+	sha, err := redis.String(ms.Do("SCRIPT", "LOAD", `return sdb.call("get", KEYS[0]) + sdb.call("get", KEYS[1])`))
+	if err != nil {
+		return err
+	}
+	return ms.DoBatch([][]interface{}{
+		{"FLUSHDB"}, {"OK"},
+		{"SET", "a", "5"}, {"OK"},
+		{"SET", "x", "7"}, {"OK"},
+		{"EVAL", `var v = sdb.call("get", KEYS[0]); sdb.call("set", KEYS[1], v); return sdb.call("incrby", KEYS[2], v)`,
+			3, "a", "n", "x"}, {12},
+		{"GET", "n"}, {"5"},
+		{"GET", "x"}, {"12"},
+		{"EVAL", `sdb.call("del", KEYS[0]); sdb.call("set", KEYS[1], "moved"); return 1`, 2, "a", "n"}, {1},
+		{"GET", "a"}, {nil},
+		{"GET", "n"}, {"moved"},
+		{"EVAL", `sdb.call("set", "y", "1"); sdb.call("set", KEYS[0], "2")`, 2, "a", "n"}, {"ERR script wrote a key that was not declared"},
+		{"GET", "y"}, {nil},
+		{"GET", "a"}, {nil},
+		{"EVALSHA", sha, 2, "n", "x"}, {"moved12"},
+	})
+}
+
+func txns_LOCKED_test(ms *mockShards) error {
+	if err := ms.DoBatch([][]interface{}{
+		{"FLUSHDB"}, {"OK"},
+		{"SET", "n", "before"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	set := string(buildCommand([][]byte{[]byte("set"), []byte("n"), []byte("after")}).Raw)
+	steps := []struct {
+		group  int
+		args   []interface{}
+		expect interface{}
+	}{
+		{0, []interface{}{"SDBTXBEGIN", "t1", 1}, "OK"},
+		{1, []interface{}{"SDBTXPREPARE", "t1", set}, "[]"},
+		{1, []interface{}{"GET", "n"}, "TRYAGAIN key is locked by a transaction"},
+		{1, []interface{}{"SET", "n", "other"}, "TRYAGAIN key is locked by a transaction"},
+		{1, []interface{}{"SDBTXPREPARE", "t2", set}, "TRYAGAIN key is locked by a transaction"},
+		{0, []interface{}{"SDBTXDECIDE", "t1", "commit"}, "commit"},
+		{0, []interface{}{"SDBTXDECIDE", "t1", "abort"}, "commit"},
+		{1, []interface{}{"SDBTXCOMMIT", "t1"}, "[OK]"},
+		{1, []interface{}{"SDBTXCOMMIT", "t1"}, nil},
+		{0, []interface{}{"SDBTXEND", "t1"}, "OK"},
+		{1, []interface{}{"GET", "n"}, "after"},
+	}
+	for _, step := range steps {
+		resp, err := ms.internal(step.group, step.args[0].(string), step.args[1:]...)
+		if rerr, ok := resp.(error); ok && err == nil {
+			err = rerr
+		}
+		if err := checkExpect(step.expect, resp, err); err != nil {
+			return fmt.Errorf("%v: %v", step.args, err)
+		}
+	}
+	return nil
+}
+
+func txns_RECOVER_test(ms *mockShards) error {
+	if err := ms.DoBatch([][]interface{}{
+		{"FLUSHDB"}, {"OK"},
+		{"SET", "n", "before"}, {"OK"},
+		{"SET", "x", "before"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	set := func(key, val string) string {
+		return string(buildCommand([][]byte{[]byte("set"), []byte(key), []byte(val)}).Raw)
+	}
+	// t3 is decided but not completed, and t4 is prepared but not decided,
+	// as if the coordinator had crashed.
+	for _, step := range []struct {
+		group int
+		args  []interface{}
+	}{
+		{0, []interface{}{"SDBTXBEGIN", "t3", 1, 2}},
+		{1, []interface{}{"SDBTXPREPARE", "t3", set("n", "recovered")}},
+		{2, []interface{}{"SDBTXPREPARE", "t3", set("x", "recovered")}},
+		{0, []interface{}{"SDBTXDECIDE", "t3", "commit"}},
+		{0, []interface{}{"SDBTXBEGIN", "t4", 1}},
+		{1, []interface{}{"SDBTXPREPARE", "t4", set("o", "lost")}},
+	} {
+		resp, err := ms.internal(step.group, step.args[0].(string), step.args[1:]...)
+		if rerr, ok := resp.(error); ok && err == nil {
+			err = rerr
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %v", step.args, err)
+		}
+	}
+	// the leader of the meta group crashes too. the transactions are
+	// resolved once it's back, and the reads are retried until then.
+	if err := ms.restart(0); err != nil {
+		return err
+	}
+	if err := ms.DoBatch([][]interface{}{
+		{"GET", "n"}, {"recovered"},
+		{"GET", "x"}, {"recovered"},
+		{"GET", "o"}, {nil},
+	}); err != nil {
+		return err
+	}
+	// a late prepare of the aborted transaction is rejected.
+	_, err := redis.String(ms.internal(1, "SDBTXPREPARE", "t4", set("o", "lost")))
+	if err == nil || err.Error() != "TRYAGAIN transaction was aborted" {
+		return fmt.Errorf("expected 'TRYAGAIN transaction was aborted', got '%v'", err)
+	}
+	return nil
+}
+
+func txns_ROLLBACK_test(ms *mockShards) error {
+	m := ms.ss[1].m
+	errFailed := errors.New("failed")
+	// apply runs a write that changes the locked keys and then fails when
+	// fail is true.
+	apply := func(fail bool, change func(tx *buntdb.Tx) error) error {
+		cmd := buildCommand([][]byte{[]byte("sdbtxprepare"), []byte("t5")})
+		_, err := m.writeDoApply(&passiveApplier{}, &passiveConn{}, cmd, nil, func(tx *buntdb.Tx) (interface{}, error) {
+			if err := change(tx); err != nil {
+				return nil, err
+			}
+			if fail {
+				return nil, errFailed
+			}
+			return nil, nil
+		}, func(v interface{}) error {
+			return nil
+		})
+		if err != nil && err != errFailed {
+			return err
+		}
+		return nil
+	}
+	lock := func(tx *buntdb.Tx) error { return m.setIntents(tx, "t5", []string{"q"}) }
+	unlock := func(tx *buntdb.Tx) error { return m.clearIntents(tx, "t5", []string{"q"}) }
+	for _, step := range []struct {
+		fail   bool
+		change func(tx *buntdb.Tx) error
+		locked bool
+	}{
+		{true, lock, false},
+		{false, lock, true},
+		{true, unlock, true},
+		{false, unlock, false},
+	} {
+		if err := apply(step.fail, step.change); err != nil {
+			return err
+		}
+		if _, locked := m.lockedBy("q"); locked != step.locked {
+			return fmt.Errorf("expected locked '%v', got '%v'", step.locked, locked)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package machine
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/buntdb"
+)
+
+// A collection, such as a hash, is stored as a header value at the user key
+// and one companion key per member. The members live under the meta prefix
+// which keeps them out of KEYS, DBSIZE, and PDEL, while still allowing them
+// to be carried along with snapshots.
+
+// typeKeyPrefix marks a value as a collection header.
+const typeKeyPrefix = sdbMetaPrefix + "type:"
+
+// dumpKeyPrefix marks a value as a DUMP of a collection.
+const dumpKeyPrefix = sdbMetaPrefix + "dump:"
+
+var errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// memberKinds are all of the collection types that store members.
+var memberKinds = []string{"hash", "list", "set", "stream", "zset"}
+
+// typeHeader is the value of a key that holds a collection.
+type typeHeader struct {
+	kind  string // collection type
+	count int    // number of members
+	head  int64  // list: sequence of the first element, stream: last id time
+	tail  int64  // list: sequence following the last element, stream: last id sequence
+}
+
+func (h typeHeader) String() string {
+	return typeKeyPrefix + h.kind + ":" +
+		strconv.FormatInt(int64(h.count), 10) + ":" +
+		strconv.FormatInt(h.head, 10) + ":" +
+		strconv.FormatInt(h.tail, 10)
+}
+
+func parseTypeHeader(val string) (h typeHeader, ok bool) {
+	if !strings.HasPrefix(val, typeKeyPrefix) {
+		return h, false
+	}
+	parts := strings.Split(val[len(typeKeyPrefix):], ":")
+	if len(parts) != 4 {
+		return h, false
+	}
+	var nums [3]int64
+	for i := 0; i < len(nums); i++ {
+		n, err := strconv.ParseInt(parts[i+1], 10, 64)
+		if err != nil {
+			return h, false
+		}
+		nums[i] = n
+	}
+	h.kind = parts[0]
+	h.count, h.head, h.tail = int(nums[0]), nums[1], nums[2]
+	return h, true
+}
+
+// valueType returns the type name of a value as reported by TYPE.
+func valueType(val string) string {
+	if h, ok := parseTypeHeader(val); ok {
+		return h.kind
+	}
+	return "string"
+}
+
+// memberKeyPrefix returns the prefix of all member keys for a collection.
+// The length of the key is included so that no prefix can be the prefix of
+// a different collection.
+func memberKeyPrefix(kind, key string) string {
+	return sdbMetaPrefix + kind + ":" + strconv.FormatInt(int64(len(key)), 10) + ":" + key + ":"
+}
+
+// isMemberKey returns true when the key is a collection member.
+func isMemberKey(key string) bool {
+	if !isMercMetaKey(key) {
+		return false
+	}
+	for _, kind := range memberKinds {
+		if strings.HasPrefix(key[len(sdbMetaPrefix):], kind+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// txGetString returns the value for a key that must be a string.
+func txGetString(tx *buntdb.Tx, key string) (string, error) {
+	val, err := tx.Get(key)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(val, typeKeyPrefix) {
+		return "", errWrongType
+	}
+	return val, nil
+}
+
+// txSetString sets a string value. When the value replaces a collection then
+// the collection members are removed too.
+func txSetString(tx *buntdb.Tx, key, val string, opts *buntdb.SetOptions) error {
+	prev, replaced, err := tx.Set(key, val, opts)
+	if err != nil {
+		return err
+	}
+	if replaced {
+		if h, ok := parseTypeHeader(prev); ok {
+			return purgeMembers(tx, h.kind, key)
+		}
+	}
+	return nil
+}
+
+// txGetHeader returns the collection header for a key. A missing key
+// returns an empty header of the requested kind.
+func txGetHeader(tx *buntdb.Tx, key, kind string) (typeHeader, error) {
+	val, err := tx.Get(key)
+	if err != nil {
+		if err == buntdb.ErrNotFound {
+			return typeHeader{kind: kind}, nil
+		}
+		return typeHeader{}, err
+	}
+	h, ok := parseTypeHeader(val)
+	if !ok || h.kind != kind {
+		return typeHeader{}, errWrongType
+	}
+	return h, nil
+}
+
+// txGetHeaderForUpdate is like txGetHeader, but it also clears away members
+// that were left behind by an expired collection at the same key.
+func txGetHeaderForUpdate(tx *buntdb.Tx, key, kind string) (typeHeader, error) {
+	h, err := txGetHeader(tx, key, kind)
+	if err != nil {
+		return h, err
+	}
+	if h.count == 0 {
+		if _, err := tx.Get(key); err != buntdb.ErrNotFound {
+			// an empty stream still exists
+			return h, err
+		}
+		if err := purgeMembers(tx, kind, key); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// txSetHeader writes the collection header and keeps the current expiration
+// of the key. An empty collection is deleted, except for a stream.
+func txSetHeader(tx *buntdb.Tx, key string, h typeHeader) error {
+	if h.count <= 0 && h.kind != "stream" {
+		if _, err := tx.Delete(key); err != nil && err != buntdb.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	var opts *buntdb.SetOptions
+	ttl, err := tx.TTL(key)
+	if err != nil && err != buntdb.ErrNotFound {
+		return err
+	}
+	if err == nil && ttl >= 0 {
+		opts = &buntdb.SetOptions{Expires: true, TTL: ttl}
+	}
+	_, _, err = tx.Set(key, h.String(), opts)
+	return err
+}
+
+// scanMembers iterates over the members of a collection in key order. The
+// iterator receives the member suffix and the value.
+func scanMembers(tx *buntdb.Tx, kind, key string, iter func(member, val string) bool) error {
+	prefix := memberKeyPrefix(kind, key)
+	return tx.AscendGreaterOrEqual("", prefix, func(mkey, val string) bool {
+		if !strings.HasPrefix(mkey, prefix) {
+			return false
+		}
+		return iter(mkey[len(prefix):], val)
+	})
+}
+
+// purgeMembers deletes all members of a collection.
+func purgeMembers(tx *buntdb.Tx, kind, key string) error {
+	prefix := memberKeyPrefix(kind, key)
+	var mkeys []string
+	if err := scanMembers(tx, kind, key, func(member, val string) bool {
+		mkeys = append(mkeys, prefix+member)
+		return true
+	}); err != nil {
+		return err
+	}
+	for _, mkey := range mkeys {
+		if _, err := tx.Delete(mkey); err != nil && err != buntdb.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// memberValue returns a member value that is ready to be stored in the
+// collection at key. Sorted set members carry the key of their collection.
+func memberValue(kind, key, val string) string {
+	if kind == "zset" {
+		return zsetValue(key, zsetValueScore(val))
+	}
+	return val
+}
+
+// moveMembers moves all members of a collection to a different key.
+func moveMembers(tx *buntdb.Tx, kind, key, newkey string) error {
+	var members []string
+	if err := scanMembers(tx, kind, key, func(member, val string) bool {
+		members = append(members, member, val)
+		return true
+	}); err != nil {
+		return err
+	}
+	prefix := memberKeyPrefix(kind, key)
+	for i := 0; i < len(members); i += 2 {
+		if _, err := tx.Delete(prefix + members[i]); err != nil {
+			return err
+		}
+	}
+	prefix = memberKeyPrefix(kind, newkey)
+	for i := 0; i < len(members); i += 2 {
+		val := memberValue(kind, newkey, members[i+1])
+		if _, _, err := tx.Set(prefix+members[i], val, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteKey deletes a key of any type. Returns false if the key did not exist.
+func deleteKey(tx *buntdb.Tx, key string) (bool, error) {
+	val, err := tx.Delete(key)
+	if err != nil {
+		if err != buntdb.ErrNotFound {
+			return false, err
+		}
+		// The key may have been a collection that expired. Make sure
+		// that no members are left behind.
+		for _, kind := range memberKinds {
+			if err := purgeMembers(tx, kind, key); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+	if h, ok := parseTypeHeader(val); ok {
+		if err := purgeMembers(tx, h.kind, key); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// dumpValue returns the serialized value of a key. Strings are returned
+// as-is, while collections include the header and all members.
+func dumpValue(tx *buntdb.Tx, key string) (string, error) {
+	val, err := tx.Get(key)
+	if err != nil {
+		return "", err
+	}
+	h, ok := parseTypeHeader(val)
+	if !ok {
+		return val, nil
+	}
+	args := [][]byte{[]byte(val)}
+	if err := scanMembers(tx, h.kind, key, func(member, val string) bool {
+		args = append(args, []byte(member), []byte(val))
+		return true
+	}); err != nil {
+		return "", err
+	}
+	return dumpKeyPrefix + string(buildCommand(args).Raw), nil
+}
+
+// restoreValue writes a value which was serialized by dumpValue.
+func restoreValue(tx *buntdb.Tx, key, val string, opts *buntdb.SetOptions) error {
+	if !strings.HasPrefix(val, dumpKeyPrefix) {
+		if strings.HasPrefix(val, typeKeyPrefix) {
+			return errors.New("ERR DUMP payload version or checksum are wrong")
+		}
+		return txSetString(tx, key, val, opts)
+	}
+	cmd, err := parseCommand([]byte(val[len(dumpKeyPrefix):]))
+	if err != nil || len(cmd.Args)%2 != 1 {
+		return errors.New("ERR DUMP payload version or checksum are wrong")
+	}
+	h, ok := parseTypeHeader(string(cmd.Args[0]))
+	if !ok {
+		return errors.New("ERR DUMP payload version or checksum are wrong")
+	}
+	if _, err := deleteKey(tx, key); err != nil {
+		return err
+	}
+	if err := purgeMembers(tx, h.kind, key); err != nil {
+		return err
+	}
+	prefix := memberKeyPrefix(h.kind, key)
+	for i := 1; i < len(cmd.Args); i += 2 {
+		val := memberValue(h.kind, key, string(cmd.Args[i+1]))
+		if _, _, err := tx.Set(prefix+string(cmd.Args[i]), val, nil); err != nil {
+			return err
+		}
+	}
+	_, _, err = tx.Set(key, h.String(), opts)
+	return err
+}
@@ -38,8 +38,10 @@ func isMercMetaKey(key string) bool {
 	return false
 }
 
-// pipelineCommand creates a single command from a pipeline.
-func pipelineCommand(conn redcon.Conn, cmd redcon.Command) (int, redcon.Command, error) {
+// pipelineCommand creates a single command from a pipeline. GETs become a
+// PLGET, SETs become a PLSET, and other commands become a PLWPIPE when one of
+// them writes, so the pipeline is a single entry in the raft log.
+func (m *Machine) pipelineCommand(conn redcon.Conn, cmd redcon.Command) (int, redcon.Command, error) {
 	if conn == nil {
 		return 0, cmd, nil
 	}
@@ -47,40 +49,34 @@ func pipelineCommand(conn redcon.Conn, cmd redcon.Command) (int, redcon.Command,
 	if len(pcmds) == 0 {
 		return 0, cmd, nil
 	}
-	args := make([][]byte, 0, 64)
 	switch qcmdlower(cmd.Args[0]) {
+	case "plget", "plset", "plwpipe", "plgroup":
+		return 0, redcon.Command{}, finn.ErrUnknownCommand
+	}
+	cmds := append([]redcon.Command{cmd}, pcmds...)
+	args := make([][]byte, 0, 64)
+	switch {
 	default:
 		return 0, cmd, nil
-	case "plget", "plset":
-		return 0, redcon.Command{}, finn.ErrUnknownCommand
-	case "get":
-		if len(cmd.Args) != 2 {
-			return 0, cmd, nil
-		}
+	case pipelineAll(cmds, "get", 2):
 		// convert to an PLGET command which similar to an MGET
-		for _, pcmd := range pcmds {
-			if qcmdlower(pcmd.Args[0]) != "get" || len(pcmd.Args) != 2 {
-				return 0, cmd, nil
-			}
-		}
 		args = append(args, []byte("plget"))
-		for _, pcmd := range append([]redcon.Command{cmd}, pcmds...) {
+		for _, pcmd := range cmds {
 			args = append(args, pcmd.Args[1])
 		}
-	case "set":
-		if len(cmd.Args) != 3 {
-			return 0, cmd, nil
-		}
+	case pipelineAll(cmds, "set", 3):
 		// convert to a PLSET command which is similar to an MSET
-		for _, pcmd := range pcmds {
-			if qcmdlower(pcmd.Args[0]) != "set" || len(pcmd.Args) != 3 {
-				return 0, cmd, nil
-			}
-		}
 		args = append(args, []byte("plset"))
-		for _, pcmd := range append([]redcon.Command{cmd}, pcmds...) {
+		for _, pcmd := range cmds {
 			args = append(args, pcmd.Args[1], pcmd.Args[2])
 		}
+	case m.pipelineWrites(cmds):
+		// convert to a PLWPIPE command which is similar to a PLWMULTI,
+		// but with a reply for each command.
+		args = append(args, []byte("plwpipe"))
+		for _, pcmd := range cmds {
+			args = append(args, pcmd.Raw)
+		}
 	}
 
 	// remove the peeked items off the pipeline
@@ -90,6 +86,38 @@ func pipelineCommand(conn redcon.Conn, cmd redcon.Command) (int, redcon.Command,
 	return len(pcmds) + 1, ncmd, nil
 }
 
+// pipelineAll returns true when every command has the name and the number
+// of arguments.
+func pipelineAll(cmds []redcon.Command, name string, nargs int) bool {
+	for _, cmd := range cmds {
+		if qcmdlower(cmd.Args[0]) != name || len(cmd.Args) != nargs {
+			return false
+		}
+	}
+	return true
+}
+
+// pipelineWrites returns true when every command of a pipeline can run
+// inside of a transaction, and one of the commands writes. A command is
+// queued on a connection that is in a MULTI to tell whether it writes.
+func (m *Machine) pipelineWrites(cmds []redcon.Command) bool {
+	var writes bool
+	for _, cmd := range cmds {
+		switch qcmdlower(cmd.Args[0]) {
+		case "blpop", "brpop", "xread", "xreadgroup", "observe":
+			// these only block outside of a transaction.
+			return false
+		}
+		conn := &probeConn{ctx: &connContext{multi: &multiContext{}}}
+		_, err := m.doTransactableCommand(&validateApplier{}, conn, cmd, nil)
+		if err != nil || len(conn.ctx.multi.cmds) != 1 {
+			return false
+		}
+		writes = writes || conn.ctx.multi.writable
+	}
+	return writes
+}
+
 func buildCommand(args [][]byte) redcon.Command {
 	// build a pipeline command
 	buf := make([]byte, 0, 128)
@@ -311,3 +339,12 @@ func (conn *passiveConn) WriteNull() {
 func (conn *passiveConn) WriteRaw(data []byte) {
 	panic("WriteRaw is not allowed in a script context")
 }
+
+// probeConn is a custom redcon.Conn type that is inside of a MULTI. It's
+// used to tell whether a command of a pipeline writes.
+type probeConn struct {
+	passiveConn
+	ctx *connContext
+}
+
+func (conn *probeConn) Context() interface{} { return conn.ctx }
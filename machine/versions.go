@@ -0,0 +1,194 @@
+package machine
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// Every key has a version, which is the change index of the last write that
+// modified the key, that is the index of the write in the log. The versions
+// are stored along with the keys, so they're the same on every node and are
+// included in snapshots. A key that has no version, such as a key that
+// doesn't exist, uses the change index of the last write that deleted a key.
+// That way the version of a key always changes when the key is created or
+// deleted.
+
+// versionKeyPrefix is the prefix for the version of a key.
+const versionKeyPrefix = sdbMetaPrefix + "version:"
+
+// versionDeletedKey holds the change index of the last write that deleted a
+// key.
+const versionDeletedKey = sdbMetaPrefix + "version-deleted"
+
+// txKeyVersion returns the version of a key.
+func txKeyVersion(tx *buntdb.Tx, key string) (uint64, error) {
+	val, err := tx.Get(versionKeyPrefix + key)
+	if err == buntdb.ErrNotFound {
+		val, err = tx.Get(versionDeletedKey)
+	}
+	if err != nil {
+		if err == buntdb.ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseUint(val, 10, 64)
+}
+
+func txSetVersion(tx *buntdb.Tx, vkey string, index uint64) error {
+	_, _, err := tx.Set(vkey, strconv.FormatUint(index, 10), nil)
+	return err
+}
+
+// txPurgeVersions removes the versions of all keys, such as after a FLUSHDB.
+func txPurgeVersions(tx *buntdb.Tx) error {
+	var vkeys []string
+	if err := tx.AscendGreaterOrEqual("", versionKeyPrefix, func(key, _ string) bool {
+		if !strings.HasPrefix(key, versionKeyPrefix) {
+			return false
+		}
+		vkeys = append(vkeys, key)
+		return true
+	}); err != nil {
+		return err
+	}
+	for _, vkey := range vkeys {
+		if _, err := tx.Delete(vkey); err != nil && err != buntdb.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyVersion returns the version of a key. Inside of a write, a key that
+// has already been changed by the write has the version of the write.
+func (m *Machine) keyVersion(tx *buntdb.Tx, key string) (uint64, error) {
+	if m.cl.changed(tx, key) {
+		return m.nextVersion()
+	}
+	return txKeyVersion(tx, key)
+}
+
+// checkVersion returns true when the key is at the version. A version of
+// zero means that the key must not exist.
+func (m *Machine) checkVersion(tx *buntdb.Tx, key string, version uint64) (bool, error) {
+	_, err := tx.Get(key)
+	if err != nil && err != buntdb.ErrNotFound {
+		return false, err
+	}
+	if exists := err == nil; version == 0 || !exists {
+		return version == 0 && !exists, nil
+	}
+	current, err := m.keyVersion(tx, key)
+	if err != nil {
+		return false, err
+	}
+	return current == version, nil
+}
+
+// nextVersion returns the version of the keys that are changed by the
+// current write, which is the index of its entry in the log.
+func (m *Machine) nextVersion() (uint64, error) {
+	m.cl.mu.Lock()
+	defer m.cl.mu.Unlock()
+	return m.cl.applying, nil
+}
+
+// parseVersion parses a version argument.
+func parseVersion(arg []byte) (uint64, error) {
+	version, err := strconv.ParseUint(string(arg), 10, 64)
+	if err != nil {
+		return 0, errors.New("ERR version is not an integer or out of range")
+	}
+	return version, nil
+}
+
+func (m *Machine) doGetv(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// GETV key
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		val, err := txGetString(tx, key)
+		if err != nil {
+			if err == buntdb.ErrNotFound {
+				conn.WriteNull()
+				return nil
+			}
+			return err
+		}
+		version, err := m.keyVersion(tx, key)
+		if err != nil {
+			return err
+		}
+		conn.WriteArray(2)
+		conn.WriteBulkString(val)
+		conn.WriteInt64(int64(version))
+		return nil
+	})
+}
+
+func (m *Machine) doSetcas(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SETCAS key value version
+	if len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key, val := string(cmd.Args[1]), string(cmd.Args[2])
+	version, err := parseVersion(cmd.Args[3])
+	if err != nil {
+		return nil, err
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		ok, err := m.checkVersion(tx, key, version)
+		if err != nil || !ok {
+			return nil, err
+		}
+		if err := txSetString(tx, key, val, nil); err != nil {
+			return nil, err
+		}
+		m.notify(notifyString, "set", key)
+		return m.nextVersion()
+	}, func(v interface{}) error {
+		if v == nil {
+			conn.WriteNull()
+		} else {
+			conn.WriteInt64(int64(v.(uint64)))
+		}
+		return nil
+	})
+}
+
+func (m *Machine) doDelcas(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// DELCAS key version
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	version, err := parseVersion(cmd.Args[2])
+	if err != nil {
+		return nil, err
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		if version == 0 {
+			return 0, nil
+		}
+		ok, err := m.checkVersion(tx, key, version)
+		if err != nil || !ok {
+			return 0, err
+		}
+		if _, err := deleteKey(tx, key); err != nil {
+			return nil, err
+		}
+		m.notify(notifyGeneric, "del", key)
+		return 1, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
@@ -0,0 +1,141 @@
+package machine
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func subTestVersions(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "GETV", versions_GETV_test)
+	runStep(t, mc, "SETCAS", versions_SETCAS_test)
+	runStep(t, mc, "DELCAS", versions_DELCAS_test)
+	runStep(t, mc, "JSETCAS", versions_JSETCAS_test)
+}
+
+func versions_GETV_test(mc *mockCluster) error {
+	if err := mc.DoBatch([][]interface{}{
+		{"GETV", "mykey"}, {nil},
+		{"GETV"}, {"ERR wrong number of arguments for 'GETV' command"},
+		{"HSET", "myhash", "a", "1"}, {1},
+		{"GETV", "myhash"}, {"WRONGTYPE Operation against a key holding the wrong kind of value"},
+		{"SET", "mykey", "1"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	vals, err := redis.Values(mc.Do("GETV", "mykey"))
+	if err != nil {
+		return err
+	}
+	v1 := vals[1].(int64)
+	// every write changes the version, even to the same value.
+	return mc.DoBatch([][]interface{}{
+		{"SET", "mykey", "1"}, {"OK"},
+		{"GETV", "mykey"}, {func(v interface{}) (resp, expect interface{}) {
+			vals := v.([]string)
+			return vals[0] == "1" && vals[1] > fmt.Sprint(v1), true
+		}},
+	})
+}
+
+func versions_SETCAS_test(mc *mockCluster) error {
+	v1, err := redis.Int64(mc.Do("SETCAS", "mykey", "1", 0))
+	if err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"GETV", "mykey"}, {fmt.Sprintf("[1 %d]", v1)},
+		{"SETCAS", "mykey", "2", 0}, {nil},
+		{"SETCAS", "mykey", "2", v1 + 1}, {nil},
+		{"SETCAS", "mykey", "2", "a"}, {"ERR version is not an integer or out of range"},
+		{"SETCAS", "mykey", "2"}, {"ERR wrong number of arguments for 'SETCAS' command"},
+		{"GET", "mykey"}, {"1"},
+	}); err != nil {
+		return err
+	}
+	v2, err := versionsAfter(mc, v1, "SETCAS", "mykey", "2", v1)
+	if err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"GETV", "mykey"}, {fmt.Sprintf("[2 %d]", v2)},
+
+		// the version in a transaction is the version at the end.
+		{"MULTI"}, {"OK"},
+		{"SETCAS", "mykey", "3", v2}, {"QUEUED"},
+		{"SET", "otherkey", "1"}, {"QUEUED"},
+		{"GETV", "mykey"}, {"QUEUED"},
+	}); err != nil {
+		return err
+	}
+	vals, err := redis.Values(mc.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	v3, _ := vals[0].(int64)
+	if resp := fmt.Sprint(normalize(vals)); v3 <= v2 || resp != fmt.Sprintf("[%d OK [3 %d]]", v3, v3) {
+		return fmt.Errorf("expected '[%d OK [3 %[1]d]]', got '%v'", v3, resp)
+	}
+	return mc.DoBatch([][]interface{}{
+		{"GETV", "otherkey"}, {fmt.Sprintf("[1 %d]", v3)},
+	})
+}
+
+// versionsAfter runs a write that returns the new version, and checks that
+// it follows the version.
+func versionsAfter(mc *mockCluster, version int64, commandName string, args ...interface{}) (int64, error) {
+	v, err := redis.Int64(mc.Do(commandName, args...))
+	if err != nil {
+		return 0, err
+	}
+	if v <= version {
+		return 0, fmt.Errorf("expected a version after '%d', got '%d'", version, v)
+	}
+	return v, nil
+}
+
+func versions_DELCAS_test(mc *mockCluster) error {
+	v1, err := redis.Int64(mc.Do("SETCAS", "mykey", "1", 0))
+	if err != nil {
+		return err
+	}
+	return mc.DoBatch([][]interface{}{
+		{"DELCAS", "mykey", 0}, {0},
+		{"DELCAS", "mykey", v1 - 1}, {0},
+		{"DELCAS", "mykey", v1}, {1},
+		{"GETV", "mykey"}, {nil},
+		{"DELCAS", "mykey", v1}, {0},
+	})
+}
+
+func versions_JSETCAS_test(mc *mockCluster) error {
+	v1, err := redis.Int64(mc.Do("JSETCAS", "mydoc", "name", "Tom", 0))
+	if err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"JSETCAS", "mydoc", "age", "10", 0}, {nil},
+	}); err != nil {
+		return err
+	}
+	v2, err := versionsAfter(mc, v1, "JSETCAS", "mydoc", "age", "10", v1)
+	if err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"JSETCAS", "mydoc", "age", "11", v1}, {nil},
+	}); err != nil {
+		return err
+	}
+	v3, err := versionsAfter(mc, v2, "JSETCAS", "mydoc", "age", "11", v2, "STR")
+	if err != nil {
+		return err
+	}
+	return mc.DoBatch([][]interface{}{
+		{"JSETCAS", "mydoc", "age", "11", v3, "BAD"}, {"ERR syntax error"},
+		{"JSETCAS", "mydoc", "age", "11"}, {"ERR wrong number of arguments for 'JSETCAS' command"},
+		{"JGET", "mydoc", "name"}, {"Tom"},
+		{"JGET", "mydoc", "age"}, {"11"},
+	})
+}